@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// envPrefix starts the environment variables of config keys, so unrelated
+// variables like HOME or PATH aren't read as config
+const envPrefix = "CONNECTIVITY_TESTER"
+
+// bindEnv makes environment variables override the config file, so
+// credentials can be passed to containers without a file: the variable of a
+// key is envPrefix and the key in upper case with dots replaced by
+// underscores, e.g. CONNECTIVITY_TESTER_SOAX_API_KEY for soax.api_key.
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestBindEnv(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	config := `
+soax:
+  api_key: file-key
+  session_length: 300
+database:
+  password: file-password
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	bindEnv(v)
+
+	t.Setenv("CONNECTIVITY_TESTER_SOAX_API_KEY", "env-key")
+	t.Setenv("CONNECTIVITY_TESTER_PROXYRACK_USERNAME", "env-user")
+	t.Setenv("CONNECTIVITY_TESTER_DATABASE_PASSWORD", "")
+	// Variables without the prefix aren't config
+	t.Setenv("SOAX_SESSION_LENGTH", "600")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		// The environment overrides the file
+		{"soax.api_key", "env-key"},
+		// Keys missing from the file are read from the environment
+		{"proxyrack.username", "env-user"},
+		// Empty variables are ignored
+		{"database.password", "file-password"},
+		{"soax.session_length", "300"},
+	}
+	for _, tt := range tests {
+		if got := v.GetString(tt.key); got != tt.want {
+			t.Errorf("GetString(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"connectivity-tester/pkg/fetch"
+)
+
+func TestRunFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Agent", r.Header.Get("User-Agent"))
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	// The URL host doesn't resolve, the address override reaches the server
+	url := strings.Replace(srv.URL, "127.0.0.1", "server.invalid", 1)
+	var out bytes.Buffer
+	err := runFetch(&out, url, fetch.Options{
+		Transport: "",
+		Address:   srv.Listener.Addr().String(),
+		Method:    http.MethodPost,
+		Headers:   []string{"User-Agent: fetch-test"},
+	})
+	if err != nil {
+		t.Fatalf("runFetch() error = %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{
+		"HTTP/1.1 418 I'm a teapot\n",
+		"X-Agent: fetch-test\n",
+		"X-Method: POST\n",
+		"\n\nhello",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("runFetch() output = %q, want it to contain %q", got, want)
+		}
+	}
+}
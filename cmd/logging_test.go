@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+
+	// Packages log through the default logger
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	logger.Info("first", "clientID", 1)
+	slog.Debug("second", "error", "connect: connection refused")
+
+	scanner := bufio.NewScanner(&buf)
+	var lines int
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("log line %q is not valid JSON: %v", scanner.Text(), err)
+		}
+		if _, ok := entry["msg"]; !ok {
+			t.Errorf("log line %q has no msg field", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("got %d JSON log lines, want 2", lines)
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "text", "warn")
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("unexpected output for warn level: %q", buf.String())
+	}
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("newLogger() with format xml: expected error")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "json", "verbose"); err == nil {
+		t.Error("newLogger() with level verbose: expected error")
+	}
+}
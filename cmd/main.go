@@ -7,12 +7,21 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"connectivity-tester/pkg/alert"
+	"connectivity-tester/pkg/api"
 	"connectivity-tester/pkg/config"
+	"connectivity-tester/pkg/connectivity"
 	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/export"
 	"connectivity-tester/pkg/ipinfo"
 	"connectivity-tester/pkg/measurement"
 	"connectivity-tester/pkg/models"
@@ -30,15 +39,31 @@ var rootCmd = &cobra.Command{
 	Use:   "connectivity-tester",
 	Short: "A tool for testing server connectivity",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		// Set up logging based on the debug flag
-		var logLevel slog.Level
+		// Set up logging. --log-level supersedes --debug, and both
+		// supersede the log section of the config file
+		logLevel := viper.GetString("log.level")
+		if logLevel == "" {
+			logLevel = "info"
+		}
 		if debugFlag {
-			logLevel = slog.LevelDebug
-		} else {
-			logLevel = slog.LevelInfo
+			logLevel = "debug"
+		}
+		if cmd.Flags().Changed("log-level") {
+			logLevel, _ = cmd.Flags().GetString("log-level")
+		}
+
+		logFormat := viper.GetString("log.format")
+		if logFormat == "" || cmd.Flags().Changed("log-format") {
+			logFormat, _ = cmd.Flags().GetString("log-format")
 		}
 
-		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+		var err error
+		logger, err = newLogger(os.Stderr, logFormat, logLevel)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// Packages log through the default logger, so they use the same handler
 		slog.SetDefault(logger)
 	},
 }
@@ -62,8 +87,17 @@ var addServersCmd = &cobra.Command{
 		}
 
 		preresolve, _ := cmd.Flags().GetBool("preresolve")
+		dedupeBy, _ := cmd.Flags().GetString("dedupe-by")
+		allowPrivate, _ := cmd.Flags().GetBool("allow-private")
 
-		err = server.AddServersFromFile(db, args[0], name, preresolve)
+		err = server.AddServersFromFile(db, args[0], server.ImportOptions{
+			Name:       name,
+			Preresolve: preresolve,
+			DedupeBy:   dedupeBy,
+
+			AllowPrivate:      allowPrivate,
+			LookupConcurrency: viper.GetInt("ipinfo.concurrency"),
+		})
 		if err != nil {
 			logger.Error("Error adding servers", "error", err)
 			os.Exit(1)
@@ -72,6 +106,49 @@ var addServersCmd = &cobra.Command{
 	},
 }
 
+var syncServersCmd = &cobra.Command{
+	Use:   "sync-servers",
+	Short: "Sync a server group with a remote catalog of access links",
+	Long: `Fetch a JSON array of access links from a catalog URL, import them into a
+server group and remove the servers of the group that are no longer in the catalog.
+Examples:
+  sync-servers --catalog-url https://catalog.example.com/servers.json --server-name catalog`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		catalogURL, _ := cmd.Flags().GetString("catalog-url")
+		name, _ := cmd.Flags().GetString("server-name")
+		preresolve, _ := cmd.Flags().GetBool("preresolve")
+		dedupeBy, _ := cmd.Flags().GetString("dedupe-by")
+		allowPrivate, _ := cmd.Flags().GetBool("allow-private")
+
+		if catalogURL == "" || name == "" {
+			logger.Error("Required flags missing", "catalog-url", catalogURL, "server-name", name)
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		result, err := server.SyncServersFromCatalog(db, catalogURL, server.ImportOptions{
+			Name:       name,
+			Preresolve: preresolve,
+			DedupeBy:   dedupeBy,
+
+			AllowPrivate:      allowPrivate,
+			LookupConcurrency: viper.GetInt("ipinfo.concurrency"),
+		})
+		if err != nil {
+			logger.Error("Error syncing servers", "error", err, "upserted", result.Upserted, "removed", result.Removed)
+			os.Exit(1)
+		}
+		logger.Info("Servers synced successfully", "upserted", result.Upserted, "removed", result.Removed)
+	},
+}
+
 var testServersCmd = &cobra.Command{
 	Use:   "test-servers",
 	Short: "Test servers in the database",
@@ -106,42 +183,77 @@ Examples:
   measure --proxy soax --country ir --network mobile --clients 10
   # Test with specific ISP and server group:
   measure --proxy soax --country ir --isp MNT%20Irancell --network mobile --clients 5 --server-name shadowmere
+  # Test random ISPs in several countries in one run:
+  measure --proxy soax --country ir,ru,cn --network mobile --clients 5
+  # Test access keys from a file without importing them:
+  measure --proxy soax --country ir --network mobile --clients 5 --servers-file links.txt
 
   Flags:
-  --proxy: Optional. Proxy service (soax or proxyrack); Defaul is proxyrack
-  --country: Required. Country code (e.g., us, uk, ir)
-  --isp: Optional. ISP name. If not provided, tests will be pick random ISPs from target country and network type
+  --proxy: Optional. Proxy service (soax, proxyrack or none to measure from this machine); Default is none
+  --country: Required. Country codes (e.g., us, uk, ir), comma separated or repeated to measure several countries in one run
+  --isp: Optional. ISP name, only with a single country. If not provided, tests will be pick random ISPs from target country and network type
+  --city: Optional. City to get clients in, only with a single country and providers that support city targeting
   --network: Optional. Network type (residential or mobile). Default is residential
   --clients: Required. Maximum number of clients to test with
   --server-id: Optional. Specific server ID to test. Only server id or server name can be provided at a time.
   --server-name: Optional. Specific server group name to test. Only server id or server name can be provided at a time.
+  --priority: Optional. Order in which servers are measured. 'stalest' measures the least recently tested servers first
+  --ip-version: Optional. IP version (v4 or v6) the local client measures from with --proxy none
+  --server-ip-version: Optional. Measure only servers with IPv4 (v4) or IPv6 (v6) addresses
+  --servers-file: Optional. File of access keys to measure without importing them as servers
+  --allow-private: Optional. Measure the servers of the servers file with private, loopback, link-local or multicast IPs, which are skipped otherwise
+  --tag: Optional. Measure the servers with a fragment tag, key=value, repeated to require several tags
+  --results-db: Optional. Write measurements to the results_database instead of the database servers are read from
+  --alert-webhook: Optional. URL a JSON alert is posted to when a server expected to be reachable fails a probe. The run exits non-zero after such failures either way
+  --servers-per-client: Optional. Measure a random sample of this many servers on each client. Defaults to measurement.servers_per_client
+  --no-lock: Optional. Run even if another run for the same provider and network is measuring one of the countries
 
-  Please note either server ID or server group name can be provided`,
+  Please note only one of server ID, server group name, servers file or tags can be provided`,
 
 	Run: func(cmd *cobra.Command, args []string) {
 		// Get flags
 		proxyName, _ := cmd.Flags().GetString("proxy")
-		country, _ := cmd.Flags().GetString("country")
+		countries, _ := cmd.Flags().GetStringSlice("country")
 		isp, _ := cmd.Flags().GetString("isp")
+		city, _ := cmd.Flags().GetString("city")
 		network, _ := cmd.Flags().GetString("network")
 		clients, _ := cmd.Flags().GetInt("clients")
 		serverID, _ := cmd.Flags().GetInt64Slice("server-id")
 		serverName, _ := cmd.Flags().GetStringSlice("server-name")
+		priority, _ := cmd.Flags().GetString("priority")
+		serversFile, _ := cmd.Flags().GetString("servers-file")
+		allowPrivate, _ := cmd.Flags().GetBool("allow-private")
+		tagFlags, _ := cmd.Flags().GetStringSlice("tag")
+		noLock, _ := cmd.Flags().GetBool("no-lock")
+		useResultsDB, _ := cmd.Flags().GetBool("results-db")
+		ipVersion, _ := cmd.Flags().GetString("ip-version")
+		serversPerClient, _ := cmd.Flags().GetInt("servers-per-client")
+		serverIPVersion, _ := cmd.Flags().GetString("server-ip-version")
+		alertWebhook, _ := cmd.Flags().GetString("alert-webhook")
+		if !cmd.Flags().Changed("servers-per-client") {
+			serversPerClient = viper.GetInt("measurement.servers_per_client")
+		}
 
-		// Validate required flags
-		if proxyName == "" || country == "" || network == "" || clients == 0 {
+		// The provider is built from these, the other settings are
+		// validated with it once it's created
+		if proxyName == "" || network == "" {
 			logger.Error("Required flags missing",
 				"proxy", proxyName,
-				"country", country,
-				"network", network,
-				"clients", clients)
+				"network", network)
 			os.Exit(1)
 		}
 
-		// make sure only server ID or server name is provided
-		if len(serverID) > 0 && len(serverName) > 0 {
-			logger.Error("Only one of server ID or server name can be provided")
-			os.Exit(1)
+		var tags map[string]string
+		for _, tag := range tagFlags {
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok || key == "" {
+				logger.Error("Invalid tag, must be key=value", "tag", tag)
+				os.Exit(1)
+			}
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[key] = value
 		}
 
 		// Validate network type
@@ -150,10 +262,6 @@ Examples:
 		case "residential":
 			clientType = models.ResidentialType
 		case "mobile":
-			if proxyName == "proxyrack" {
-				logger.Error("ProxyRack does not support mobile clients")
-				os.Exit(1)
-			}
 			clientType = models.MobileType
 		default:
 			logger.Error("Invalid network type. Must be 'residential' or 'mobile'")
@@ -161,57 +269,28 @@ Examples:
 		}
 
 		// Create provider config based on proxy type
-		var providerConfig proxy.Config
-		switch proxyName {
-		case "soax":
-			providerConfig = proxy.Config{
-				System:        proxy.SystemSOAX,
-				APIKey:        viper.GetString("soax.api_key"),
-				SessionLength: viper.GetInt("soax.session_length"),
-				Endpoint:      viper.GetString("soax.endpoint"),
-				MaxWorkers:    viper.GetInt("soax.max_workers"),
-			}
-			if network == "residential" {
-				providerConfig.PackageID = viper.GetString("soax.residential_package_id")
-				providerConfig.PackageKey = viper.GetString("soax.residential_package_key")
-			} else {
-				providerConfig.PackageID = viper.GetString("soax.mobile_package_id")
-				providerConfig.PackageKey = viper.GetString("soax.mobile_package_key")
-			}
-		case "proxyrack":
-			providerConfig = proxy.Config{
-				System:        proxy.SystemProxyRack,
-				Username:      viper.GetString("proxyrack.username"),
-				APIKey:        viper.GetString("proxyrack.api_key"),
-				SessionLength: viper.GetInt("proxyrack.session_length"),
-				Endpoint:      viper.GetString("proxyrack.endpoint"),
-				MaxWorkers:    viper.GetInt("proxyrack.max_workers"),
-			}
-		case "none":
-			providerConfig = proxy.Config{
-				System:        proxy.SystemNone,
-				SessionLength: 86400,
-				MaxWorkers:    100,
-			}
-		default:
-			logger.Error("Invalid proxy name. Must be 'soax' or 'proxyrack'")
+		providerConfig, ok := providerConfigFor(proxyName, clientType, ipVersion)
+		if !ok {
+			logger.Error("Invalid proxy name. Must be 'soax', 'proxyrack' or 'none'")
 			os.Exit(1)
 		}
-
-		// Get max retries from config
-		maxRetries := viper.GetInt(fmt.Sprintf("%s.max_retries", proxyName))
-		if maxRetries == 0 {
-			maxRetries = 3 // Default if not specified
-		}
+		maxRetries := proxyMaxRetries(proxyName)
 
 		settings := measurement.Settings{
 			MaxClients:  clients,
 			MaxRetries:  maxRetries,
 			ServerIDs:   serverID,
 			ServerNames: serverName,
-			Country:     country,
+			Tags:        tags,
+			Countries:   countries,
 			ISP:         isp,
+			City:        city,
 			ClientType:  clientType,
+			Priority:    database.ServerOrder(priority),
+			NoLock:      noLock,
+
+			ServersPerClient: serversPerClient,
+			ServerIPVersion:  serverIPVersion,
 		}
 
 		// Initialize database
@@ -243,18 +322,851 @@ Examples:
 			os.Exit(1)
 		}
 
+		// Check the flags before the links of the servers file are read and
+		// resolved, with a stand-in for the servers it selects
+		check := settings
+		if serversFile != "" {
+			check.Servers = []models.Server{{}}
+		}
+		if err := check.Validate(provider); err != nil {
+			logger.Error("Invalid measurement settings", "error", err)
+			os.Exit(1)
+		}
+
+		// Parse servers to measure without importing them
+		if serversFile != "" {
+			settings.Servers, err = server.ReadServersFile(serversFile, server.ImportOptions{Preresolve: true, AllowPrivate: allowPrivate})
+			if err != nil {
+				logger.Error("Error reading servers file", "error", err)
+				os.Exit(1)
+			}
+			if len(settings.Servers) == 0 {
+				logger.Error("No servers found in servers file", "file", serversFile)
+				os.Exit(1)
+			}
+		}
+
 		measurementService := measurement.NewMeasurementService(db, logger, viper.GetViper(), provider)
+		defer measurementService.Shutdown()
+		measurementService.SetAlerts(alert.NewDispatcher(alertWebhook, logger))
+
+		if useResultsDB {
+			resultsDB, err := initResultsDB()
+			if err != nil {
+				logger.Error("Error initializing results database", "error", err)
+				os.Exit(1)
+			}
+			defer resultsDB.Close()
+			measurementService.SetResultsStore(resultsDB)
+		}
 
 		// maxClients, maxRetries, Server ID, Server Group name, ISP name, country code, client type
 
 		// Use existing measurement logic for all other cases
-		err = measurementService.RunMeasurements(context.Background(), provider, settings)
+		result, err := measurementService.RunMeasurements(context.Background(), provider, settings)
 		if err != nil {
 			logger.Error("Error running measurements", "error", err)
 			os.Exit(1)
 		}
 
-		logger.Info("Measurements completed successfully")
+		logger.Info("Measurements completed successfully",
+			"runID", result.RunID,
+			"baselineSuccesses", result.BaselineSuccesses,
+			"prefixSuccesses", result.PrefixSuccesses,
+			"clientAcquisitions", result.ClientAcquisitions,
+			"clientValidations", result.ClientValidations,
+			"sessionSeconds", result.SessionSeconds,
+			"countryMismatches", result.CountryMismatches)
+		if result.ExpectedFailures > 0 {
+			logger.Error("Servers expected to be reachable failed probes", "failures", result.ExpectedFailures)
+			os.Exit(1)
+		}
+	},
+}
+
+var importMeasurementsCmd = &cobra.Command{
+	Use:   "import-measurements [file]",
+	Short: "Import measurements spilled during a database outage",
+	Long: `Insert the measurements a run spilled to a file because the database was
+unavailable, see measurement.spill_file. The file defaults to the configured
+spill file and is removed once all of its measurements are imported. If the
+import fails, the measurements not imported yet are kept in the file.
+Examples:
+  # Import the configured spill file
+  import-measurements
+  # Import a spill file into the results database
+  import-measurements spill.jsonl --results-db`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("measurement.spill_file")
+		if len(args) == 1 {
+			path = args[0]
+		}
+		if path == "" {
+			logger.Error("No spill file given and measurement.spill_file isn't set")
+			os.Exit(1)
+		}
+
+		useResultsDB, _ := cmd.Flags().GetBool("results-db")
+		var (
+			db  *database.DB
+			err error
+		)
+		if useResultsDB {
+			db, err = initResultsDB()
+		} else {
+			db, err = initDB()
+		}
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		imported, err := measurement.ImportSpillFile(context.Background(), db, path)
+		if err != nil {
+			logger.Error("Error importing measurements", "file", path, "imported", imported, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Imported spilled measurements", "file", path, "count", imported)
+	},
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Re-run the probe of a stored measurement",
+	Long: `Re-run the probe of a stored measurement to reproduce a failure. The probe
+tests the same server, protocol and prefix from a new client of the proxy the
+measurement was taken through, with the ISP, country, city and network of the
+original client, and the original and new results are printed side by side.
+The replay is stored as a measurement of a new run.
+Examples:
+  # Replay measurement 1234
+  replay --measurement-id 1234`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		measurementID, _ := cmd.Flags().GetInt64("measurement-id")
+		if measurementID == 0 {
+			logger.Error("Required flag missing", "flag", "measurement-id")
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		ctx := context.Background()
+		original, err := db.GetMeasurement(ctx, measurementID)
+		if err != nil {
+			logger.Error("Error loading measurement", "error", err)
+			os.Exit(1)
+		}
+		if original.Client == nil {
+			logger.Error("Measurement has no client", "measurementID", measurementID)
+			os.Exit(1)
+		}
+
+		// The provider is the one the original client was acquired from
+		proxyName := original.Client.Proxy
+		providerConfig, ok := providerConfigFor(proxyName, models.ClientType(original.Client.ClientType), original.Client.IPVersion)
+		if !ok {
+			logger.Error("Measurement was taken through an unknown proxy", "proxy", proxyName)
+			os.Exit(1)
+		}
+		provider, err := proxy.NewProvider(providerConfig, logger)
+		if err != nil {
+			logger.Error("Failed to create proxy provider", "error", err)
+			os.Exit(1)
+		}
+
+		measurementService := measurement.NewMeasurementService(db, logger, viper.GetViper(), provider)
+		defer measurementService.Shutdown()
+
+		result, err := measurementService.Replay(ctx, provider, measurementID, proxyMaxRetries(proxyName))
+		if err != nil {
+			logger.Error("Error replaying measurement", "error", err)
+			os.Exit(1)
+		}
+		if result.ASNMismatch {
+			logger.Warn("The replay client exits from a different AS than the original client")
+		}
+
+		old, replay := result.Original, result.Replay
+		fmt.Printf("\toriginal\treplay\n")
+		fmt.Printf("measurement\t%d\t%d\n", old.ID, replay.ID)
+		fmt.Printf("time\t%s\t%s\n", old.Time.Format(time.RFC3339), replay.Time.Format(time.RFC3339))
+		fmt.Printf("client\t%s\t%s\n", old.Client.IP, replay.Client.IP)
+		fmt.Printf("asn\t%s\t%s\n", old.Client.ASNumber, replay.Client.ASNumber)
+		fmt.Printf("exit_asn\t%s\t%s\n", old.ExitASN, replay.ExitASN)
+		fmt.Printf("result\t%s\t%s\n", old.ErrorOp, replay.ErrorOp)
+		fmt.Printf("error\t%s\t%s\n", old.ErrorMsg, replay.ErrorMsg)
+		fmt.Printf("duration_ms\t%d\t%d\n", old.Duration, replay.Duration)
+		fmt.Printf("ttfb_ms\t%d\t%d\n", old.TTFBMs, replay.TTFBMs)
+		fmt.Printf("dialed_ip\t%s\t%s\n", old.DialedIP, replay.DialedIP)
+		fmt.Printf("exit_ip_changed\t%t\t%t\n", old.ExitIPChanged, replay.ExitIPChanged)
+		fmt.Printf("original report: %s\n", old.FullReport)
+		fmt.Printf("replay report: %s\n", replay.FullReport)
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the measurements of a run",
+	Long: `Export the measurements of a run for sharing and analysis.
+Examples:
+  # Write the measurements of a run as OONI newline delimited JSON
+  export --format ooni --run-id 5c1e... --output run.jsonl`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		runID, _ := cmd.Flags().GetString("run-id")
+		output, _ := cmd.Flags().GetString("output")
+
+		if format != export.FormatOONI {
+			logger.Error("Invalid export format. Must be 'ooni'", "format", format)
+			os.Exit(1)
+		}
+		if runID == "" {
+			logger.Error("Required flag missing", "flag", "run-id")
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		measurements, err := db.GetMeasurementsByRun(context.Background(), runID)
+		if err != nil {
+			logger.Error("Error getting measurements", "error", err)
+			os.Exit(1)
+		}
+
+		w := os.Stdout
+		if output != "" {
+			w, err = os.Create(output)
+			if err != nil {
+				logger.Error("Error creating output file", "error", err)
+				os.Exit(1)
+			}
+			defer w.Close()
+		}
+
+		if err := export.WriteOONI(w, measurements); err != nil {
+			logger.Error("Error exporting measurements", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Measurements exported successfully", "runID", runID, "measurements", len(measurements))
+	},
+}
+
+var exportCompareCmd = &cobra.Command{
+	Use:   "compare",
+	Short: "Compare the measurements of two runs",
+	Long: `Compare the measurements of two runs by server, protocol, client country and ASN.
+The change in success rate and median latency from run A to run B is written as
+JSON, along with the keys measured in only one of the runs. Retries and tests
+through a prefix are left out.
+Examples:
+  export compare --run-a 5c1e... --run-b 9f2d... --output compare.json`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runA, _ := cmd.Flags().GetString("run-a")
+		runB, _ := cmd.Flags().GetString("run-b")
+		output, _ := cmd.Flags().GetString("output")
+
+		if runA == "" || runB == "" {
+			logger.Error("Required flag missing", "flag", "run-a and run-b")
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		measurementsA, err := db.GetMeasurementsByRun(context.Background(), runA)
+		if err != nil {
+			logger.Error("Error getting measurements", "error", err)
+			os.Exit(1)
+		}
+		measurementsB, err := db.GetMeasurementsByRun(context.Background(), runB)
+		if err != nil {
+			logger.Error("Error getting measurements", "error", err)
+			os.Exit(1)
+		}
+
+		comparison, err := export.Compare(measurementsA, measurementsB)
+		if err != nil {
+			logger.Error("Error comparing runs", "error", err)
+			os.Exit(1)
+		}
+
+		w := os.Stdout
+		if output != "" {
+			w, err = os.Create(output)
+			if err != nil {
+				logger.Error("Error creating output file", "error", err)
+				os.Exit(1)
+			}
+			defer w.Close()
+		}
+
+		if err := export.WriteComparison(w, comparison); err != nil {
+			logger.Error("Error writing comparison", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Runs compared successfully",
+			"runA", runA,
+			"runB", runB,
+			"deltas", len(comparison.Deltas),
+			"onlyA", len(comparison.OnlyA),
+			"onlyB", len(comparison.OnlyB))
+	},
+}
+
+var exportPrefixMatrixCmd = &cobra.Command{
+	Use:   "prefix-matrix",
+	Short: "Export the prefix that worked per server and client ASN",
+	Long: `Export the winning prefix of each server, client country and ASN in a run.
+The winner is the prefix with the most successful measurements, ties going to the
+higher success rate. Cells where no prefix succeeded are left out.
+Examples:
+  export prefix-matrix --run-id 5c1e... --output prefixes.json`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runID, _ := cmd.Flags().GetString("run-id")
+		output, _ := cmd.Flags().GetString("output")
+
+		if runID == "" {
+			logger.Error("Required flag missing", "flag", "run-id")
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		cells, err := db.GetPrefixMatrix(context.Background(), runID)
+		if err != nil {
+			logger.Error("Error getting prefix matrix", "error", err)
+			os.Exit(1)
+		}
+
+		w := os.Stdout
+		if output != "" {
+			w, err = os.Create(output)
+			if err != nil {
+				logger.Error("Error creating output file", "error", err)
+				os.Exit(1)
+			}
+			defer w.Close()
+		}
+
+		if err := export.WritePrefixMatrix(w, cells); err != nil {
+			logger.Error("Error writing prefix matrix", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Prefix matrix exported successfully", "runID", runID, "cells", len(cells))
+	},
+}
+
+var exportServersCmd = &cobra.Command{
+	Use:   "servers",
+	Short: "Export servers as access links",
+	Long: `Export the imported servers as access links with their fragments, one per line,
+in the format add-servers reads. Servers imported from a link whose domain
+resolved to several IPs share the link, it's written once.
+Examples:
+  export servers --format links --group my-servers --working-only --output servers.txt`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		groups, _ := cmd.Flags().GetStringSlice("group")
+		workingOnly, _ := cmd.Flags().GetBool("working-only")
+		output, _ := cmd.Flags().GetString("output")
+
+		if format != server.FormatLinks {
+			logger.Error("Invalid export format. Must be 'links'", "format", format)
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		servers, err := db.GetServersForExport(context.Background(), groups, workingOnly)
+		if err != nil {
+			logger.Error("Error getting servers", "error", err)
+			os.Exit(1)
+		}
+
+		w := os.Stdout
+		if output != "" {
+			w, err = os.Create(output)
+			if err != nil {
+				logger.Error("Error creating output file", "error", err)
+				os.Exit(1)
+			}
+			defer w.Close()
+		}
+
+		if err := server.WriteLinks(w, servers); err != nil {
+			logger.Error("Error writing servers", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Servers exported successfully", "servers", len(servers))
+	},
+}
+
+var coverageCmd = &cobra.Command{
+	Use:   "coverage",
+	Short: "Show the ISP, server and protocol combinations a run missed",
+	Long: `Show the combinations of client ISP, server and protocol of a run that were
+measured by fewer than --clients-per-isp clients or only failed, to schedule a
+targeted re-run. The ISPs and protocols are those of the run, the servers those
+of --server-id or, without it, those measured in the run.
+Examples:
+  coverage --run-id 5c1e... --clients-per-isp 3
+  coverage --run-id 5c1e... --server-id 1,2,3 --format json`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runID, _ := cmd.Flags().GetString("run-id")
+		serverIDs, _ := cmd.Flags().GetInt64Slice("server-id")
+		clientsPerISP, _ := cmd.Flags().GetInt("clients-per-isp")
+		format, _ := cmd.Flags().GetString("format")
+
+		if runID == "" {
+			logger.Error("Required flag missing", "flag", "run-id")
+			os.Exit(1)
+		}
+		if clientsPerISP < 1 {
+			logger.Error("Clients per ISP must be at least 1", "clientsPerISP", clientsPerISP)
+			os.Exit(1)
+		}
+		if format != export.FormatTable && format != export.FormatJSON {
+			logger.Error("Invalid format. Must be 'table' or 'json'", "format", format)
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		gaps, err := db.GetCoverageGaps(context.Background(), runID, serverIDs, clientsPerISP)
+		if err != nil {
+			logger.Error("Error getting coverage gaps", "error", err)
+			os.Exit(1)
+		}
+
+		if err := export.WriteCoverageGaps(os.Stdout, gaps, format); err != nil {
+			logger.Error("Error writing coverage gaps", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Coverage checked", "runID", runID, "gaps", len(gaps))
+	},
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve runs, servers and measurements over a read only HTTP API",
+	Long: `Serve runs, servers and measurements as JSON over HTTP.
+Endpoints:
+  GET /runs
+  GET /runs/{id}/measurements
+  GET /servers
+  GET /servers/{id}/measurements
+
+List endpoints are paginated with the limit (default 100, at most 1000) and offset query parameters.
+Examples:
+  serve --addr 127.0.0.1:8080`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("addr")
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		// Stop gracefully on interrupt
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := api.ListenAndServe(ctx, addr, api.NewHandler(db, logger), logger); err != nil {
+			logger.Error("Error serving API", "error", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var providersCmd = &cobra.Command{
+	Use:   "providers",
+	Short: "List the proxy providers and the features they support",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, system := range []proxy.System{proxy.SystemSOAX, proxy.SystemProxyRack, proxy.SystemNone} {
+			c, err := proxy.CapabilitiesOf(system)
+			if err != nil {
+				logger.Error("Error getting provider capabilities", "provider", system, "error", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s: client types %v, ISP targeting %t, city targeting %t, UDP %t, session length %d-%ds\n",
+				system, c.ClientTypes, c.ISPTargeting, c.CityTargeting, c.UDP, c.MinSessionLength, c.MaxSessionLength)
+		}
+	},
+}
+
+// soaxConfig returns the SOAX provider config, with the package of clientType
+func soaxConfig(clientType models.ClientType) proxy.Config {
+	config := proxy.Config{
+		System:        proxy.SystemSOAX,
+		APIKey:        viper.GetString("soax.api_key"),
+		SessionLength: viper.GetInt("soax.session_length"),
+		Endpoint:      viper.GetString("soax.endpoint"),
+		CheckerIP:     viper.GetString("soax.checker_ip"),
+		SoaxOptions:   viper.GetStringSlice("soax.options"),
+		MaxWorkers:    viper.GetInt("soax.max_workers"),
+		ProxyScheme:   viper.GetString("soax.proxy_scheme"),
+
+		AllowCountryMismatch:  viper.GetBool("measurement.allow_country_mismatch"),
+		DeterministicSessions: viper.GetBool("measurement.deterministic_sessions"),
+		AuditDir:              viper.GetString("provider.audit_dir"),
+	}
+	if clientType == models.ResidentialType {
+		config.PackageID = viper.GetString("soax.residential_package_id")
+		config.PackageKey = viper.GetString("soax.residential_package_key")
+	} else {
+		config.PackageID = viper.GetString("soax.mobile_package_id")
+		config.PackageKey = viper.GetString("soax.mobile_package_key")
+	}
+	return config
+}
+
+// providerConfigFor returns the config of the proxy provider named
+// proxyName for clientType clients, false if there is no such provider.
+// ipVersion only applies to the local provider.
+func providerConfigFor(proxyName string, clientType models.ClientType, ipVersion string) (proxy.Config, bool) {
+	switch proxyName {
+	case "soax":
+		return soaxConfig(clientType), true
+	case "proxyrack":
+		return proxy.Config{
+			System:        proxy.SystemProxyRack,
+			Username:      viper.GetString("proxyrack.username"),
+			APIKey:        viper.GetString("proxyrack.api_key"),
+			SessionLength: viper.GetInt("proxyrack.session_length"),
+			Endpoint:      viper.GetString("proxyrack.endpoint"),
+			CheckerIP:     viper.GetString("proxyrack.checker_ip"),
+			MaxWorkers:    viper.GetInt("proxyrack.max_workers"),
+			AutoReplace:   viper.GetString("proxyrack.auto_replace"),
+			ProxyScheme:   viper.GetString("proxyrack.proxy_scheme"),
+
+			AllowCountryMismatch:  viper.GetBool("measurement.allow_country_mismatch"),
+			DeterministicSessions: viper.GetBool("measurement.deterministic_sessions"),
+			AuditDir:              viper.GetString("provider.audit_dir"),
+		}, true
+	case "none":
+		return proxy.Config{
+			System:        proxy.SystemNone,
+			SessionLength: 86400,
+			MaxWorkers:    100,
+			IPVersion:     ipVersion,
+		}, true
+	}
+	return proxy.Config{}, false
+}
+
+// proxyMaxRetries returns the client acquisition retries of a proxy
+// provider from the config
+func proxyMaxRetries(proxyName string) int {
+	maxRetries := viper.GetInt(fmt.Sprintf("%s.max_retries", proxyName))
+	if maxRetries == 0 {
+		maxRetries = 3 // Default if not specified
+	}
+	return maxRetries
+}
+
+// newSoaxProvider creates the SOAX provider for the network flag of cmd,
+// exiting on invalid flags or config
+func newSoaxProvider(cmd *cobra.Command) *proxy.SoaxProvider {
+	network, _ := cmd.Flags().GetString("network")
+	var clientType models.ClientType
+	switch network {
+	case "residential":
+		clientType = models.ResidentialType
+	case "mobile":
+		clientType = models.MobileType
+	default:
+		logger.Error("Invalid network type. Must be 'residential' or 'mobile'")
+		os.Exit(1)
+	}
+
+	provider, err := proxy.NewProvider(soaxConfig(clientType), logger)
+	if err != nil {
+		logger.Error("Error creating SOAX provider", "error", err)
+		os.Exit(1)
+	}
+	return provider.(*proxy.SoaxProvider)
+}
+
+var listRegionsCmd = &cobra.Command{
+	Use:   "list-regions",
+	Short: "List the regions SOAX has clients in for a country",
+	Long: `List the regions SOAX has clients in for a country, sorted.
+Examples:
+  # List the regions of residential clients in Iran
+  list-regions --country ir
+  # List the regions of mobile clients
+  list-regions --country ir --network mobile`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		country, _ := cmd.Flags().GetString("country")
+		if country == "" {
+			logger.Error("Required flag missing", "flag", "country")
+			os.Exit(1)
+		}
+
+		regions, err := newSoaxProvider(cmd).GetRegionList(country)
+		if err != nil {
+			logger.Error("Error listing regions", "country", country, "error", err)
+			os.Exit(1)
+		}
+		for _, region := range regions {
+			fmt.Println(region)
+		}
+	},
+}
+
+var listCitiesCmd = &cobra.Command{
+	Use:   "list-cities",
+	Short: "List the cities SOAX has clients in for a country",
+	Long: `List the cities SOAX has clients in for a country, sorted. The names can be
+passed to measure --city.
+Examples:
+  # List the cities of residential clients in Iran
+  list-cities --country ir
+  # List the cities of an ISP's mobile clients
+  list-cities --country ir --network mobile --isp "MTN Irancell"`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		country, _ := cmd.Flags().GetString("country")
+		isp, _ := cmd.Flags().GetString("isp")
+		if country == "" {
+			logger.Error("Required flag missing", "flag", "country")
+			os.Exit(1)
+		}
+
+		cities, err := newSoaxProvider(cmd).GetCityList(country, isp)
+		if err != nil {
+			logger.Error("Error listing cities", "country", country, "isp", isp, "error", err)
+			os.Exit(1)
+		}
+		for _, city := range cities {
+			fmt.Println(city)
+		}
+	},
+}
+
+var serversCmd = &cobra.Command{
+	Use:   "servers",
+	Short: "Maintain the stored servers",
+}
+
+var serversDedupeCmd = &cobra.Command{
+	Use:   "dedupe",
+	Short: "Merge duplicate servers",
+	Long: `Find stored servers of a group that are the same endpoint, with the same
+scheme, domain, port and user info but different IPs or access links, and
+merge each cluster into its most recently tested server. The measurements of the
+duplicates are reassigned to that server before the duplicates are deleted.
+Examples:
+  # List the duplicate clusters without changing anything
+  servers dedupe --dry-run
+  # Merge them
+  servers dedupe`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		clusters, err := server.DedupeServers(db, dryRun)
+		if err != nil {
+			logger.Error("Error deduplicating servers", "error", err)
+			os.Exit(1)
+		}
+
+		for _, c := range clusters {
+			var duplicates []string
+			for _, d := range c.Duplicates {
+				duplicates = append(duplicates, fmt.Sprintf("%d (%s)", d.ID, d.IP))
+			}
+			fmt.Printf("%s://%s:%s\tkeep %d (%s)\tmerge %s\n",
+				c.Canonical.Scheme, c.Canonical.DomainName, c.Canonical.Port,
+				c.Canonical.ID, c.Canonical.IP, strings.Join(duplicates, ", "))
+		}
+		if dryRun {
+			logger.Info("Dry run, no servers merged", "clusters", len(clusters))
+		}
+	},
+}
+
+var serversExpectCmd = &cobra.Command{
+	Use:   "expect",
+	Short: "Set the expected outcome of servers",
+	Long: `Set the expected outcome of servers. A probe of a server expected to be
+reachable that fails raises an alert in measure, which posts it to
+--alert-webhook and exits non-zero. Servers can also be imported with an
+expected=reachable fragment tag.
+Examples:
+  # Expect servers to be reachable
+  servers expect --server-id 12,13 --outcome reachable
+  # Clear the expected outcome
+  servers expect --server-id 12 --outcome none`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ids, _ := cmd.Flags().GetInt64Slice("server-id")
+		outcome, _ := cmd.Flags().GetString("outcome")
+		if len(ids) == 0 {
+			logger.Error("Required flag missing", "flag", "server-id")
+			os.Exit(1)
+		}
+		switch outcome {
+		case models.ExpectReachable:
+		case "none":
+			outcome = ""
+		default:
+			logger.Error("Invalid outcome. Must be 'reachable' or 'none'", "outcome", outcome)
+			os.Exit(1)
+		}
+
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		updated, err := db.SetServersExpected(context.Background(), ids, outcome)
+		if err != nil {
+			logger.Error("Error setting expected outcome", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Expected outcome set", "servers", updated)
+	},
+}
+
+var serversRepairLinksCmd = &cobra.Command{
+	Use:   "repair-links",
+	Short: "Point access links at the IP of their server",
+	Long: `Find stored servers whose access link host is neither their IP nor their
+domain, and replace the link host with the server IP. The port, user info,
+path and params of the links are kept.
+Examples:
+  # List the inconsistent servers without changing anything
+  servers repair-links --dry-run
+  # Repair them
+  servers repair-links`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		repairs, err := server.RepairLinks(db, dryRun)
+		if err != nil {
+			logger.Error("Error repairing access links", "error", err)
+			os.Exit(1)
+		}
+
+		for _, r := range repairs {
+			fmt.Printf("%d\t%s\t%s -> %s\n", r.Server.ID, r.Server.IP,
+				connectivity.RedactTransport(r.Server.FullAccessLink), connectivity.RedactTransport(r.Link))
+		}
+	},
+}
+
+var refreshGeoCmd = &cobra.Command{
+	Use:   "refresh-geo",
+	Short: "Look up the location and AS info of existing servers again",
+	Long: `Look up the location and AS info of existing servers again using ipinfo.io API.
+Examples:
+  # Refresh all servers
+  refresh-geo
+  # Refresh servers of a group that weren't refreshed in the last 30 days
+  refresh-geo --server-name mygroup --older-than 720h`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		serverName, _ := cmd.Flags().GetStringSlice("server-name")
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+
+		err = server.RefreshServersGeo(db, serverName, olderThan, viper.GetInt("ipinfo.concurrency"))
+		if err != nil {
+			logger.Error("Error refreshing server geo info", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Server geo info refreshed successfully")
+	},
+}
+
+var activeClientsCmd = &cobra.Command{
+	Use:   "active-clients",
+	Short: "List the proxy clients whose session hasn't expired",
+	Long: `List the proxy clients whose session hasn't expired. A measure run resumes
+monitoring the active clients of its provider left by a previous process.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := initDB()
+		if err != nil {
+			logger.Error("Error initializing database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		clients, err := db.GetActiveClients(context.Background())
+		if err != nil {
+			logger.Error("Error getting active clients", "error", err)
+			os.Exit(1)
+		}
+
+		for _, c := range clients {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\texpires %s\n",
+				c.ID, c.Proxy, c.IP, c.CountryCode, c.ISP, c.ExpirationTime.Format(time.RFC3339))
+		}
 	},
 }
 
@@ -362,38 +1274,231 @@ var jsonToURLCmd = &cobra.Command{
 	},
 }
 
+var normalizeLinkCmd = &cobra.Command{
+	Use:   "normalize-link [link]",
+	Short: "Validate an access link and print its canonical form",
+	Long: `Parse and resolve an access link like add-servers does, check that a dialer
+can be built from it and print its canonical form, scheme, params and resolved IPs.
+The database is not used and no connection is made to the server.
+Examples:
+  normalize-link 'ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpzZWNyZXQ@ss.example.com:8388#My%20Server'`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		link, err := server.NormalizeLink(args[0])
+		if err != nil {
+			logger.Error("Invalid access link", "error", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("link: %s\n", link.Link)
+		fmt.Printf("scheme: %s\n", link.Scheme)
+		if link.DomainName != "" {
+			fmt.Printf("domain: %s\n", link.DomainName)
+		}
+		fmt.Printf("port: %s\n", link.Port)
+		if link.Fragment != "" {
+			fmt.Printf("name: %s\n", link.Fragment)
+		}
+		keys := make([]string, 0, len(link.Params))
+		for key := range link.Params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("param: %s=%s\n", key, link.Params[key])
+		}
+		for i, ip := range link.IPs {
+			fmt.Printf("resolved: %s %s\n", ip, link.ResolvedLinks[i])
+		}
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply pending database schema migrations",
+	Long: `Apply pending database schema migrations.
+Migrations also run automatically whenever a command initializes the database.
+Examples:
+  # Apply pending migrations
+  migrate
+  # Show applied and pending migrations
+  migrate --status`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.NewDB()
+		if err != nil {
+			logger.Error("Error connecting to database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		status, _ := cmd.Flags().GetBool("status")
+		if status {
+			ms, err := db.MigrationStatus(context.Background())
+			if err != nil {
+				logger.Error("Error getting migration status", "error", err)
+				os.Exit(1)
+			}
+			for _, m := range ms {
+				state := "pending"
+				if m.IsApplied() {
+					state = fmt.Sprintf("applied (group %d)", m.GroupID)
+				}
+				fmt.Printf("%s_%s: %s\n", m.Name, m.Comment, state)
+			}
+			return
+		}
+
+		group, err := db.Migrate(context.Background())
+		if err != nil {
+			logger.Error("Error applying migrations", "error", err)
+			os.Exit(1)
+		}
+		if group.IsZero() {
+			logger.Info("Database schema is up to date")
+			return
+		}
+		logger.Info("Migrations applied successfully", "group", group.String())
+	},
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().BoolVarP(&debugFlag, "debug", "d", false, "Enable debug logging")
+	rootCmd.PersistentFlags().String("log-level", "info", "Log level: debug, info, warn or error (supersedes --debug)")
+	rootCmd.PersistentFlags().String("log-format", "text", "Log format: text or json")
 	testServersCmd.Flags().Bool("tcp", false, "Retest servers with TCP errors (excluding 'connect' errors)")
 	testServersCmd.Flags().Bool("udp", false, "Retest servers with UDP errors")
 
 	rootCmd.AddCommand(addServersCmd)
+	rootCmd.AddCommand(syncServersCmd)
 	rootCmd.AddCommand(testServersCmd)
 	rootCmd.AddCommand(measureCmd)
+	rootCmd.AddCommand(importMeasurementsCmd)
 	rootCmd.AddCommand(updateClientsCmd)
+	rootCmd.AddCommand(activeClientsCmd)
 	rootCmd.AddCommand(jsonToURLCmd)
+	rootCmd.AddCommand(normalizeLinkCmd)
+	rootCmd.AddCommand(fetchCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(refreshGeoCmd)
+	rootCmd.AddCommand(serversCmd)
+	serversCmd.AddCommand(serversDedupeCmd)
+	serversCmd.AddCommand(serversRepairLinksCmd)
+	serversCmd.AddCommand(serversExpectCmd)
+	rootCmd.AddCommand(providersCmd)
+	rootCmd.AddCommand(listRegionsCmd)
+	rootCmd.AddCommand(listCitiesCmd)
+	rootCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(coverageCmd)
+	exportCmd.AddCommand(exportCompareCmd)
+	exportCmd.AddCommand(exportPrefixMatrixCmd)
+	exportCmd.AddCommand(exportServersCmd)
+	rootCmd.AddCommand(serveCmd)
 
 	// Add new flags to measureCmd
 	measureCmd.Flags().String("proxy", "none", "Proxy service (soax, proxyrack, or none)")
-	measureCmd.Flags().String("country", "us", "Country code (e.g., us, uk)")
+	measureCmd.Flags().StringSlice("country", []string{"us"}, "Country codes, comma separated or repeated (e.g., us,uk)")
 	measureCmd.Flags().String("isp", "", "ISP name (optional)")
+	measureCmd.Flags().String("city", "", "City to target clients in, only with a single country (optional)")
 	measureCmd.Flags().String("network", "residential", "Network type (residential or mobile)")
 	measureCmd.Flags().Int("clients", 1, "Maximum number of clients to test with")
 	measureCmd.Flags().Int64Slice("server-id", []int64{}, "Specific server ID to test (optional)")
 	measureCmd.Flags().StringSlice("server-name", []string{}, "Specific server group names to test (optional)")
+	measureCmd.Flags().String("ip-version", "", "IP version (v4 or v6) to measure from with --proxy none on dual stack machines (optional)")
+	measureCmd.Flags().String("servers-file", "", "Measure the access keys in a file without importing them as servers (optional)")
+	measureCmd.Flags().Bool("allow-private", false, "Measure servers of the servers file with private, loopback, link-local or multicast IPs, which are skipped otherwise")
+	measureCmd.Flags().String("priority", "", "Order in which servers are measured: 'stalest' tests least recently tested servers first (optional)")
+	measureCmd.Flags().StringSlice("tag", []string{}, "Measure the servers with this fragment tag, key=value, repeat to require several (optional)")
+	measureCmd.Flags().String("server-ip-version", "", "Measure only servers with IPv4 (v4) or IPv6 (v6) addresses (optional)")
+	measureCmd.Flags().Int("servers-per-client", 0, "Measure a random sample of this many servers on each client, 0 measures all (optional)")
+	measureCmd.Flags().Bool("results-db", false, "Write measurements to the database configured in results_database (optional)")
+	importMeasurementsCmd.Flags().Bool("results-db", false, "Import into the database configured in results_database (optional)")
+	measureCmd.Flags().String("alert-webhook", "", "URL to post an alert to when a server expected to be reachable fails a probe (optional)")
+	measureCmd.Flags().Bool("no-lock", false, "Run even if another run for the same provider and network is measuring one of the countries")
 
 	// Remove the Args requirement since we're using flags
 	measureCmd.Args = cobra.NoArgs
 
+	// Add fetch command flags
+	fetchCmd.Flags().String("transport", "", "Transport config to fetch through, e.g. an access link or proxy URL (optional, direct by default)")
+	fetchCmd.Flags().String("method", "GET", "HTTP method")
+	fetchCmd.Flags().StringArray("header", []string{}, "Raw HTTP header line to add, e.g. 'User-Agent: curl/8.0', repeatable")
+	fetchCmd.Flags().Int("timeout", 5, "Timeout in seconds")
+	fetchCmd.Flags().String("address", "", "Address to connect to instead of the URL host, host or host:port (optional)")
+
 	// Add update-clients command
 	updateClientsCmd.Flags().Bool("city", false, "Update missing city information")
 	updateClientsCmd.Flags().Bool("country", false, "Update missing country information")
 	updateClientsCmd.Flags().Bool("all", false, "Update all missing information")
 
+	// Add filter flags to refreshGeoCmd
+	refreshGeoCmd.Flags().StringSlice("server-name", []string{}, "Server group names to refresh (optional)")
+	refreshGeoCmd.Flags().Duration("older-than", 0, "Only refresh servers not refreshed within this duration, e.g. 720h (optional)")
+
+	// Add flags to the SOAX listing commands
+	listRegionsCmd.Flags().String("country", "", "Country code, e.g. ir")
+	listRegionsCmd.Flags().String("network", "residential", "Network type (residential or mobile)")
+	listCitiesCmd.Flags().String("country", "", "Country code, e.g. ir")
+	listCitiesCmd.Flags().String("network", "residential", "Network type (residential or mobile)")
+	listCitiesCmd.Flags().String("isp", "", "Only list the cities of this ISP (optional)")
+
+	// Add flags to serversExpectCmd
+	serversExpectCmd.Flags().Int64Slice("server-id", []int64{}, "IDs of the servers, comma separated or repeated")
+	serversExpectCmd.Flags().String("outcome", models.ExpectReachable, "Expected outcome: 'reachable' or 'none' to clear it")
+
+	// Add dry run flags to the servers subcommands
+	serversDedupeCmd.Flags().Bool("dry-run", false, "Only list the duplicate clusters")
+	serversRepairLinksCmd.Flags().Bool("dry-run", false, "Only list the servers whose links would be repaired")
+
+	// Add flags to replayCmd
+	replayCmd.Flags().Int64("measurement-id", 0, "ID of the measurement to replay")
+
+	// Add flags to exportCmd
+	exportCmd.Flags().String("format", export.FormatOONI, "Export format: ooni")
+	exportCmd.Flags().String("run-id", "", "Run ID of the measurements to export, logged at the end of measure")
+	exportCmd.Flags().String("output", "", "File to write to instead of stdout (optional)")
+
+	// Add flags to exportCompareCmd
+	exportCompareCmd.Flags().String("run-a", "", "Run ID of the baseline run")
+	exportCompareCmd.Flags().String("run-b", "", "Run ID of the run compared to the baseline")
+	exportCompareCmd.Flags().String("output", "", "File to write to instead of stdout (optional)")
+
+	// Add flags to coverageCmd
+	coverageCmd.Flags().String("run-id", "", "Run ID to check the coverage of")
+	coverageCmd.Flags().Int64Slice("server-id", []int64{}, "Servers the run should have measured, defaults to those it measured (optional)")
+	coverageCmd.Flags().Int("clients-per-isp", 1, "Number of clients of each ISP that should have measured each server")
+	coverageCmd.Flags().String("format", export.FormatTable, "Output format: table or json")
+
+	// Add flags to exportServersCmd
+	exportServersCmd.Flags().String("format", server.FormatLinks, "Export format: links")
+	exportServersCmd.Flags().StringSlice("group", []string{}, "Only export the servers of these groups, the names given on import (optional)")
+	exportServersCmd.Flags().Bool("working-only", false, "Only export the servers measurements would use")
+	exportServersCmd.Flags().String("output", "", "File to write to instead of stdout (optional)")
+
+	// Add flags to exportPrefixMatrixCmd
+	exportPrefixMatrixCmd.Flags().String("run-id", "", "Run ID to export the prefix matrix of")
+	exportPrefixMatrixCmd.Flags().String("output", "", "File to write to instead of stdout (optional)")
+
+	// Add listen address flag to serveCmd
+	serveCmd.Flags().String("addr", "127.0.0.1:8080", "Address to listen on")
+
+	// Add status flag to migrateCmd
+	migrateCmd.Flags().Bool("status", false, "Show applied and pending migrations instead of applying them")
+
 	// Add preresolve flag to addServersCmd
 	addServersCmd.Flags().Bool("preresolve", true, "Pre-resolve domain names to IP addresses (default: true)")
+	addServersCmd.Flags().String("dedupe-by", "", "Collapse servers that are the same endpoint: 'domain' keeps one server per domain, port and user info (optional)")
+	addServersCmd.Flags().Bool("allow-private", false, "Import servers with private, loopback, link-local or multicast IPs, which are skipped otherwise")
+
+	// Add catalog flags to syncServersCmd
+	syncServersCmd.Flags().String("catalog-url", "", "URL of a JSON array of access links")
+	syncServersCmd.Flags().String("server-name", "", "Server group kept in sync with the catalog")
+	syncServersCmd.Flags().Bool("preresolve", true, "Pre-resolve domain names to IP addresses (default: true)")
+	syncServersCmd.Flags().String("dedupe-by", "", "Collapse servers that are the same endpoint: 'domain' keeps one server per domain, port and user info (optional)")
+	syncServersCmd.Flags().Bool("allow-private", false, "Import servers with private, loopback, link-local or multicast IPs, which are skipped otherwise")
 }
 
 func initConfig() {
@@ -402,6 +1507,7 @@ func initConfig() {
 	viper.AddConfigPath("../")
 	viper.AddConfigPath("$HOME/.connectivity-tester")
 	viper.AddConfigPath("/etc/connectivity-tester/")
+	bindEnv(viper.GetViper())
 
 	if err := viper.ReadInConfig(); err != nil {
 		fmt.Printf("Error reading config file: %v\n", err)
@@ -424,6 +1530,22 @@ func initDB() (*database.DB, error) {
 	return db, nil
 }
 
+// initResultsDB connects to the results database and brings its schema up
+// to date like initDB
+func initResultsDB() (*database.DB, error) {
+	db, err := database.NewResultsDB()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to results database: %v", err)
+	}
+
+	if err := db.InitSchema(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing results database schema: %v", err)
+	}
+
+	return db, nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
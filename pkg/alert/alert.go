@@ -0,0 +1,134 @@
+// Package alert notifies about servers that fail probes they are expected
+// to pass, see models.ExpectReachable.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+// webhookTimeout bounds each webhook request
+const webhookTimeout = 10 * time.Second
+
+// Alert is the JSON payload posted to the webhook when a server expected to
+// be reachable fails a probe. It leaves out the access link, which holds
+// the server credentials.
+type Alert struct {
+	Time          time.Time `json:"time"`
+	RunID         string    `json:"run_id"`
+	ServerID      int64     `json:"server_id"`
+	ServerIP      string    `json:"server_ip"`
+	Expected      string    `json:"expected"`
+	Protocol      string    `json:"protocol"`
+	PrefixUsed    string    `json:"prefix_used,omitempty"`
+	ErrorOp       string    `json:"error_op"`
+	ErrorMsg      string    `json:"error_msg,omitempty"`
+	ClientIP      string    `json:"client_ip"`
+	ClientISP     string    `json:"client_isp,omitempty"`
+	ClientCountry string    `json:"client_country,omitempty"`
+	Proxy         string    `json:"proxy"`
+}
+
+// Dispatcher raises an alert for each failed probe of a server expected to
+// be reachable, posting it to a webhook if one is configured. It's safe for
+// concurrent use.
+type Dispatcher struct {
+	webhookURL string
+	client     *http.Client
+	logger     *slog.Logger
+	// failures counts the alerts raised
+	failures atomic.Int64
+}
+
+// NewDispatcher creates a dispatcher posting alerts to webhookURL, alerts
+// are only counted and logged if it's empty
+func NewDispatcher(webhookURL string, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: webhookTimeout},
+		logger:     logger,
+	}
+}
+
+// failed reports whether a measurement is a probe that ran and didn't
+// succeed. Skipped tests are not failures.
+func failed(m models.Measurement) bool {
+	return m.ErrorOp != "success" && m.ErrorOp != "skipped"
+}
+
+// Check raises an alert if server is expected to be reachable and the probe
+// measured from client failed. It reports whether an alert was raised.
+func (d *Dispatcher) Check(server models.Server, client models.Client, m models.Measurement) bool {
+	if server.Expected != models.ExpectReachable || !failed(m) {
+		return false
+	}
+	d.failures.Add(1)
+
+	alert := Alert{
+		Time:          m.Time,
+		RunID:         m.RunID,
+		ServerID:      server.ID,
+		ServerIP:      server.IP,
+		Expected:      server.Expected,
+		Protocol:      m.Protocol,
+		PrefixUsed:    m.PrefixUsed,
+		ErrorOp:       m.ErrorOp,
+		ErrorMsg:      m.ErrorMsg,
+		ClientIP:      client.IP,
+		ClientISP:     client.ISP,
+		ClientCountry: client.CountryCode,
+		Proxy:         client.Proxy,
+	}
+	d.logger.Warn("Server expected to be reachable failed a probe",
+		"serverID", server.ID,
+		"serverIP", server.IP,
+		"protocol", m.Protocol,
+		"errorOp", m.ErrorOp,
+		"error", m.ErrorMsg)
+
+	if d.webhookURL != "" {
+		if err := d.post(alert); err != nil {
+			d.logger.Error("Failed to post alert", "serverID", server.ID, "error", err)
+		}
+	}
+	return true
+}
+
+// Failures returns the number of alerts raised
+func (d *Dispatcher) Failures() int64 {
+	return d.failures.Load()
+}
+
+// post sends alert to the webhook as JSON
+func (d *Dispatcher) post(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package alert
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestDispatcherCheck(t *testing.T) {
+	var mu sync.Mutex
+	var alerts []Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("failed to decode alert: %v", err)
+		}
+		mu.Lock()
+		alerts = append(alerts, a)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	d := NewDispatcher(srv.URL, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	expected := models.Server{ID: 1, IP: "198.51.100.1", Expected: models.ExpectReachable}
+	unexpected := models.Server{ID: 2, IP: "198.51.100.2"}
+	client := models.Client{IP: "192.0.2.1", ISP: "MCI", CountryCode: "IR", Proxy: "soax"}
+
+	tests := []struct {
+		name   string
+		server models.Server
+		errOp  string
+		want   bool
+	}{
+		{"expected failure", expected, "connect", true},
+		{"expected success", expected, "success", false},
+		{"expected skipped", expected, "skipped", false},
+		{"unexpected failure", unexpected, "connect", false},
+	}
+	for _, tt := range tests {
+		m := models.Measurement{RunID: "run", Protocol: "tcp", ErrorOp: tt.errOp}
+		if got := d.Check(tt.server, client, m); got != tt.want {
+			t.Errorf("%s: Check() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := d.Failures(); got != 1 {
+		t.Errorf("Failures() = %d, want 1", got)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("webhook got %d alerts, want 1", len(alerts))
+	}
+	if a := alerts[0]; a.ServerID != 1 || a.ErrorOp != "connect" || a.ClientISP != "MCI" || a.RunID != "run" {
+		t.Errorf("alert = %+v", a)
+	}
+}
@@ -0,0 +1,289 @@
+// Package api serves read only JSON endpoints over the stored runs, servers
+// and measurements, so results can be queried without database access.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+
+	// shutdownTimeout bounds how long in flight requests may take to finish
+	shutdownTimeout = 10 * time.Second
+)
+
+// Store is the query interface the API reads from, it's implemented by database.DB
+type Store interface {
+	ListRuns(ctx context.Context, limit, offset int) ([]database.RunSummary, error)
+	ListServers(ctx context.Context, limit, offset int) ([]models.Server, error)
+	ListMeasurements(ctx context.Context, filter database.MeasurementFilter, limit, offset int) ([]models.Measurement, error)
+}
+
+// page is the envelope of every list response. Offset of the next page is
+// offset plus the number of items; a page shorter than limit is the last one.
+type page struct {
+	Items  interface{} `json:"items"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+type runView struct {
+	RunID        string    `json:"run_id"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Measurements int       `json:"measurements"`
+}
+
+// serverView leaves out the access link and user info, they hold credentials
+type serverView struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	IP           string    `json:"ip"`
+	Port         string    `json:"port"`
+	Scheme       string    `json:"scheme"`
+	DomainName   string    `json:"domain_name"`
+	ASNumber     string    `json:"as_number"`
+	ASOrg        string    `json:"as_org"`
+	City         string    `json:"city"`
+	Region       string    `json:"region"`
+	Country      string    `json:"country"`
+	LastTestTime time.Time `json:"last_test_time"`
+	TCPErrorMsg  string    `json:"tcp_error_msg"`
+	TCPErrorOp   string    `json:"tcp_error_op"`
+	UDPErrorMsg  string    `json:"udp_error_msg"`
+	UDPErrorOp   string    `json:"udp_error_op"`
+	FailureCount int       `json:"failure_count"`
+}
+
+type measurementView struct {
+	ID            int64     `json:"id"`
+	RunID         string    `json:"run_id"`
+	SessionID     string    `json:"session_id"`
+	ClientID      int64     `json:"client_id"`
+	ServerID      int64     `json:"server_id"`
+	Time          time.Time `json:"time"`
+	Protocol      string    `json:"protocol"`
+	RetryNumber   int       `json:"retry_number"`
+	PrefixUsed    string    `json:"prefix_used"`
+	ErrorMsg      string    `json:"error_msg"`
+	ErrorOp       string    `json:"error_op"`
+	ErrorCategory string    `json:"error_category"`
+	DurationMs    int64     `json:"duration_ms"`
+}
+
+func newServerView(s models.Server) serverView {
+	return serverView{
+		ID:           s.ID,
+		Name:         s.Name,
+		IP:           s.IP,
+		Port:         s.Port,
+		Scheme:       s.Scheme,
+		DomainName:   s.DomainName,
+		ASNumber:     s.ASNumber,
+		ASOrg:        s.ASOrg,
+		City:         s.City,
+		Region:       s.Region,
+		Country:      s.Country,
+		LastTestTime: s.LastTestTime,
+		TCPErrorMsg:  s.TCPErrorMsg,
+		TCPErrorOp:   s.TCPErrorOp,
+		UDPErrorMsg:  s.UDPErrorMsg,
+		UDPErrorOp:   s.UDPErrorOp,
+		FailureCount: s.FailureCount,
+	}
+}
+
+func newMeasurementView(m models.Measurement) measurementView {
+	return measurementView{
+		ID:            m.ID,
+		RunID:         m.RunID,
+		SessionID:     m.SessionID,
+		ClientID:      m.ClientID,
+		ServerID:      m.ServerID,
+		Time:          m.Time,
+		Protocol:      m.Protocol,
+		RetryNumber:   m.RetryNumber,
+		PrefixUsed:    m.PrefixUsed,
+		ErrorMsg:      m.ErrorMsg,
+		ErrorOp:       m.ErrorOp,
+		ErrorCategory: m.ErrorCategory,
+		DurationMs:    m.Duration,
+	}
+}
+
+// Handler routes the API endpoints
+type Handler struct {
+	store  Store
+	logger *slog.Logger
+}
+
+// NewHandler creates the API handler
+func NewHandler(store Store, logger *slog.Logger) *Handler {
+	return &Handler{store: store, logger: logger}
+}
+
+// ServeHTTP serves:
+//
+//	GET /runs
+//	GET /runs/{id}/measurements
+//	GET /servers
+//	GET /servers/{id}/measurements
+//
+// List endpoints take limit and offset query parameters.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		h.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "runs":
+		h.listRuns(w, r, limit, offset)
+	case len(parts) == 3 && parts[0] == "runs" && parts[2] == "measurements":
+		h.listMeasurements(w, r, database.MeasurementFilter{RunID: parts[1]}, limit, offset)
+	case len(parts) == 1 && parts[0] == "servers":
+		h.listServers(w, r, limit, offset)
+	case len(parts) == 3 && parts[0] == "servers" && parts[2] == "measurements":
+		serverID, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || serverID <= 0 {
+			h.writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid server ID %q", parts[1]))
+			return
+		}
+		h.listMeasurements(w, r, database.MeasurementFilter{ServerID: serverID}, limit, offset)
+	default:
+		h.writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) listRuns(w http.ResponseWriter, r *http.Request, limit, offset int) {
+	runs, err := h.store.ListRuns(r.Context(), limit, offset)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+
+	items := make([]runView, len(runs))
+	for i, run := range runs {
+		items[i] = runView(run)
+	}
+	h.writeJSON(w, http.StatusOK, page{Items: items, Limit: limit, Offset: offset})
+}
+
+func (h *Handler) listServers(w http.ResponseWriter, r *http.Request, limit, offset int) {
+	servers, err := h.store.ListServers(r.Context(), limit, offset)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+
+	items := make([]serverView, len(servers))
+	for i, server := range servers {
+		items[i] = newServerView(server)
+	}
+	h.writeJSON(w, http.StatusOK, page{Items: items, Limit: limit, Offset: offset})
+}
+
+func (h *Handler) listMeasurements(w http.ResponseWriter, r *http.Request, filter database.MeasurementFilter, limit, offset int) {
+	measurements, err := h.store.ListMeasurements(r.Context(), filter, limit, offset)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+
+	items := make([]measurementView, len(measurements))
+	for i, m := range measurements {
+		items[i] = newMeasurementView(m)
+	}
+	h.writeJSON(w, http.StatusOK, page{Items: items, Limit: limit, Offset: offset})
+}
+
+// parsePage reads the limit and offset query parameters
+func parsePage(r *http.Request) (limit, offset int, err error) {
+	limit = defaultLimit
+	query := r.URL.Query()
+
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+func (h *Handler) internalError(w http.ResponseWriter, err error) {
+	h.logger.Error("API query failed", "error", err)
+	h.writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, status int, msg string) {
+	h.writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Error("Failed to write API response", "error", err)
+	}
+}
+
+// ListenAndServe serves handler on addr until ctx is done, then waits for
+// in flight requests to finish before returning
+func ListenAndServe(ctx context.Context, addr string, handler http.Handler, logger *slog.Logger) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Info("API server listening", "addr", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("API server failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down API server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("API server shutdown failed: %v", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("API server failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+// stubStore records the queries it receives and returns canned results
+type stubStore struct {
+	err error
+
+	gotFilter        database.MeasurementFilter
+	gotLimit, gotOff int
+}
+
+func (s *stubStore) ListRuns(ctx context.Context, limit, offset int) ([]database.RunSummary, error) {
+	s.gotLimit, s.gotOff = limit, offset
+	return []database.RunSummary{{
+		RunID:        "run-1",
+		Start:        time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		End:          time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC),
+		Measurements: 12,
+	}}, s.err
+}
+
+func (s *stubStore) ListServers(ctx context.Context, limit, offset int) ([]models.Server, error) {
+	s.gotLimit, s.gotOff = limit, offset
+	return []models.Server{{
+		ID:             3,
+		IP:             "192.0.2.1",
+		Port:           "8388",
+		UserInfo:       "secret-user-info",
+		FullAccessLink: "ss://secret-user-info@192.0.2.1:8388",
+		Scheme:         "ss",
+	}}, s.err
+}
+
+func (s *stubStore) ListMeasurements(ctx context.Context, filter database.MeasurementFilter, limit, offset int) ([]models.Measurement, error) {
+	s.gotFilter, s.gotLimit, s.gotOff = filter, limit, offset
+	return []models.Measurement{{ID: 9, RunID: filter.RunID, ServerID: filter.ServerID, Protocol: "tcp", Duration: 120}}, s.err
+}
+
+func serve(t *testing.T, store Store, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	h := NewHandler(store, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func decodePage(t *testing.T, rec *httptest.ResponseRecorder) (items []map[string]interface{}, limit, offset int) {
+	t.Helper()
+	var body struct {
+		Items  []map[string]interface{} `json:"items"`
+		Limit  int                      `json:"limit"`
+		Offset int                      `json:"offset"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rec.Body.String(), err)
+	}
+	return body.Items, body.Limit, body.Offset
+}
+
+func TestListRuns(t *testing.T) {
+	store := &stubStore{}
+	rec := serve(t, store, http.MethodGet, "/runs?limit=20&offset=40")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	items, limit, offset := decodePage(t, rec)
+	if limit != 20 || offset != 40 || store.gotLimit != 20 || store.gotOff != 40 {
+		t.Errorf("page = %d/%d, store got %d/%d, want 20/40", limit, offset, store.gotLimit, store.gotOff)
+	}
+	if len(items) != 1 || items[0]["run_id"] != "run-1" || items[0]["measurements"] != float64(12) {
+		t.Errorf("items = %v", items)
+	}
+}
+
+func TestListMeasurements(t *testing.T) {
+	tests := []struct {
+		target string
+		want   database.MeasurementFilter
+	}{
+		{"/runs/run-1/measurements", database.MeasurementFilter{RunID: "run-1"}},
+		{"/servers/3/measurements", database.MeasurementFilter{ServerID: 3}},
+	}
+
+	for _, tt := range tests {
+		store := &stubStore{}
+		rec := serve(t, store, http.MethodGet, tt.target)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200: %s", tt.target, rec.Code, rec.Body)
+		}
+		if store.gotFilter != tt.want {
+			t.Errorf("%s: filter = %+v, want %+v", tt.target, store.gotFilter, tt.want)
+		}
+		if store.gotLimit != defaultLimit || store.gotOff != 0 {
+			t.Errorf("%s: page = %d/%d, want the default", tt.target, store.gotLimit, store.gotOff)
+		}
+		items, _, _ := decodePage(t, rec)
+		if len(items) != 1 || items[0]["duration_ms"] != float64(120) {
+			t.Errorf("%s: items = %v", tt.target, items)
+		}
+	}
+}
+
+func TestListServersHidesCredentials(t *testing.T) {
+	rec := serve(t, &stubStore{}, http.MethodGet, "/servers")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "secret-user-info") {
+		t.Errorf("response exposes server credentials: %s", rec.Body)
+	}
+	items, _, _ := decodePage(t, rec)
+	if len(items) != 1 || items[0]["ip"] != "192.0.2.1" {
+		t.Errorf("items = %v", items)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		store  *stubStore
+		method string
+		target string
+		want   int
+	}{
+		{"unknown path", &stubStore{}, http.MethodGet, "/clients", http.StatusNotFound},
+		{"invalid server ID", &stubStore{}, http.MethodGet, "/servers/abc/measurements", http.StatusBadRequest},
+		{"limit too large", &stubStore{}, http.MethodGet, "/runs?limit=5000", http.StatusBadRequest},
+		{"negative offset", &stubStore{}, http.MethodGet, "/runs?offset=-1", http.StatusBadRequest},
+		{"write method", &stubStore{}, http.MethodPost, "/runs", http.StatusMethodNotAllowed},
+		{"store error", &stubStore{err: fmt.Errorf("connection refused")}, http.MethodGet, "/servers", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, tt.store, tt.method, tt.target)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == "" {
+				t.Errorf("expected a JSON error, got %q", rec.Body.String())
+			}
+			if strings.Contains(rec.Body.String(), "connection refused") {
+				t.Errorf("internal error details leaked: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestListenAndServeShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServe(ctx, "127.0.0.1:0", http.NotFoundHandler(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ListenAndServe() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() didn't return after the context was done")
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 )
 
 // SSConfig represents the shadowsocks configuration structure
@@ -51,7 +53,33 @@ func ParseSSConfig(jsonConfig string) (string, error) {
 	return config.BuildURL()
 }
 
-// FetchSSConfig fetches and parses SS configuration from a URL
+// dynamicKeySchemes are the schemes of access keys whose server key is
+// fetched over HTTPS: Outline's ssconf:// dynamic access keys and the
+// custom ssconfig://
+var dynamicKeySchemes = []string{"ssconf", "ssconfig"}
+
+// httpClient fetches dynamic access keys, it's replaced in tests
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// IsDynamicKey reports whether accessKey is a dynamic access key, see
+// FetchSSConfig
+func IsDynamicKey(accessKey string) bool {
+	scheme, _, found := strings.Cut(accessKey, "://")
+	return found && slices.Contains(dynamicKeySchemes, strings.ToLower(scheme))
+}
+
+// dynamicKeyResponse is the JSON an Outline dynamic access key serves: the
+// server key as an SSConfig, or an error message for the client to show
+type dynamicKeyResponse struct {
+	SSConfig
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// FetchSSConfig fetches the server key of a dynamic access key, an ssconf://
+// or ssconfig:// URL, from the same URL over HTTPS. The response is either
+// an ss:// link or the Outline dynamic key JSON, which is built into one.
 func FetchSSConfig(configURL string) (string, error) {
 	// Parse the input URL
 	u, err := url.Parse(configURL)
@@ -60,15 +88,16 @@ func FetchSSConfig(configURL string) (string, error) {
 	}
 
 	// Validate URL scheme
-	if u.Scheme != "ssconfig" {
-		return "", fmt.Errorf("invalid URL scheme: must be ssconfig://")
+	if !slices.Contains(dynamicKeySchemes, u.Scheme) {
+		return "", fmt.Errorf("invalid URL scheme: must be ssconf:// or ssconfig://")
 	}
 
-	// Override scheme to https
+	// Override scheme to https, the fragment only names the key
 	u.Scheme = "https"
+	u.Fragment = ""
 
 	// Fetch the content
-	resp, err := http.Get(u.String())
+	resp, err := httpClient.Get(u.String())
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch config: %w", err)
 	}
@@ -78,6 +107,9 @@ func FetchSSConfig(configURL string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to read response body: %w", err)
 	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch config: %s", resp.Status)
+	}
 
 	content := strings.TrimSpace(string(body))
 
@@ -86,6 +118,16 @@ func FetchSSConfig(configURL string) (string, error) {
 		return content, nil
 	}
 
-	// Try parsing as JSON
-	return ParseSSConfig(content)
+	// Try parsing as the JSON of a dynamic key
+	var key dynamicKeyResponse
+	if err := json.Unmarshal([]byte(content), &key); err != nil {
+		return "", fmt.Errorf("failed to parse JSON config: %w", err)
+	}
+	if key.Error != nil {
+		return "", fmt.Errorf("dynamic key returned an error: %s", key.Error.Message)
+	}
+	if key.Server == "" || key.ServerPort == 0 || key.Method == "" {
+		return "", fmt.Errorf("dynamic key config is missing the server, port or method")
+	}
+	return key.BuildURL()
 }
@@ -1,6 +1,10 @@
 package config
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +59,82 @@ func TestParseSSConfig(t *testing.T) {
 		t.Errorf("ParseSSConfig() = %v, want %v", got, expected)
 	}
 }
+
+func TestFetchSSConfigDynamicKey(t *testing.T) {
+	responses := map[string]string{
+		"/outline.json": `{
+			"server": "admin.c1.havij.co",
+			"server_port": 443,
+			"method": "chacha20-ietf-poly1305",
+			"password": "WhRZ2CeMR5RCgsw1",
+			"prefix": "POST%20x2a8a1eO"
+		}`,
+		"/link.txt":   "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpXaFJaMkNlTVI1UkNnc3cx@192.0.2.1:443\n",
+		"/error.json": `{"error": {"message": "This key has expired"}}`,
+	}
+	var paths []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	origClient := httpClient
+	t.Cleanup(func() { httpClient = origClient })
+	httpClient = srv.Client()
+	host := srv.Listener.Addr().String()
+
+	tests := []struct {
+		name    string
+		key     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "outline dynamic key JSON",
+			key:  "ssconf://" + host + "/outline.json#My%20Server",
+			want: "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpXaFJaMkNlTVI1UkNnc3cx@admin.c1.havij.co:443?prefix=POST%2520x2a8a1eO",
+		},
+		{
+			name: "ss link",
+			key:  "ssconfig://" + host + "/link.txt",
+			want: "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpXaFJaMkNlTVI1UkNnc3cx@192.0.2.1:443",
+		},
+		{name: "error message", key: "ssconf://" + host + "/error.json", wantErr: "This key has expired"},
+		{name: "not found", key: "ssconf://" + host + "/missing", wantErr: "404"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !IsDynamicKey(tt.key) {
+				t.Errorf("IsDynamicKey(%q) = false", tt.key)
+			}
+			got, err := FetchSSConfig(tt.key)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("FetchSSConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchSSConfig() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("FetchSSConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The fragment only names the key, it isn't requested
+	if paths[0] != "/outline.json" {
+		t.Errorf("requested %q, want /outline.json", paths[0])
+	}
+	if IsDynamicKey("ss://Y2hh@192.0.2.1:443") {
+		t.Error("IsDynamicKey() of an ss:// key = true")
+	}
+}
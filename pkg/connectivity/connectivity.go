@@ -7,24 +7,78 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http/httptrace"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/dns"
 	"github.com/Jigsaw-Code/outline-sdk/transport"
-	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
 	"github.com/Jigsaw-Code/outline-sdk/x/connectivity"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
+// DirectScheme is the access link scheme of plain host:port targets that are
+// reached without any tunnel protocol, e.g. direct://1.2.3.4:443
+const DirectScheme = "direct"
+
 type ConnectivityReport struct {
-	Test           testReport  `json:"test"`
-	DNSQueries     []dnsReport `json:"dns_queries,omitempty"`
-	TCPConnections []tcpReport `json:"tcp_connections,omitempty"`
-	UDPConnections []udpReport `json:"udp_connections,omitempty"`
+	Test testReport `json:"test"`
+	// Domains has the result of each test domain, in the order they were tested
+	Domains        []domainReport `json:"domains,omitempty"`
+	DNSQueries     []dnsReport    `json:"dns_queries,omitempty"`
+	TCPConnections []tcpReport    `json:"tcp_connections,omitempty"`
+	UDPConnections []udpReport    `json:"udp_connections,omitempty"`
+	// HTTPRequests has the requests of http tests, in the order they were made
+	HTTPRequests []httpReport `json:"http_requests,omitempty"`
+	// ResolverComparison has the answers of the connectivity.compare_resolvers
+	// for the domain of the server
+	ResolverComparison []resolverComparison `json:"resolver_comparison,omitempty"`
+	// TLS has the certificates presented to tcp and http tests with
+	// connectivity.inspect_tls set
+	TLS *tlsReport `json:"tls,omitempty"`
+}
+
+// DialedIP returns the IP of the server the test of transportConfig
+// connected to. Through a proxy the connections of the report only reach the
+// first hop, so it's the IP of the server hop, the last one, which is empty
+// if the hop has a domain that the proxy resolves. Without a proxy it's the
+// IP of the last successful connection of the test's protocol, or of the
+// last attempted one if none succeeded, and empty if no connection was made.
+func (r ConnectivityReport) DialedIP(transportConfig string) string {
+	if hops := strings.Split(transportConfig, "|"); len(hops) > 1 {
+		if host := serverHop(transportConfig).Hostname(); net.ParseIP(host) != nil {
+			return host
+		}
+		return ""
+	}
+
+	var ips, errs []string
+	if r.Test.Proto == "udp" {
+		for _, c := range r.UDPConnections {
+			ips, errs = append(ips, c.IP), append(errs, c.Error)
+		}
+	} else {
+		for _, c := range r.TCPConnections {
+			ips, errs = append(ips, c.IP), append(errs, c.Error)
+		}
+	}
+
+	for i := len(ips) - 1; i >= 0; i-- {
+		if errs[i] == "" {
+			return ips[i]
+		}
+	}
+	if len(ips) > 0 {
+		return ips[len(ips)-1]
+	}
+	return ""
 }
 
 type testReport struct {
@@ -36,14 +90,34 @@ type testReport struct {
 	Time       time.Time  `json:"time"`
 	DurationMs int64      `json:"duration_ms"`
 	Error      *errorJSON `json:"error"`
+	// TTFBMs is the time from the connection to the first hop being
+	// established to the first response byte, 0 if nothing was received
+	TTFBMs int64 `json:"ttfb_ms,omitempty"`
+	// Handshake is the application layer stage of TCP tests through a tunnel
+	Handshake *handshakeReport `json:"handshake,omitempty"`
+}
+
+// domainReport is the result of resolving one of the test domains over the
+// transport. Comparing the domains of a test tells a transport failure, where
+// all of them fail, from blocking of selected domains.
+type domainReport struct {
+	Domain     string     `json:"domain"`
+	Time       time.Time  `json:"time"`
+	DurationMs int64      `json:"duration_ms"`
+	Error      *errorJSON `json:"error"`
 }
 
 type dnsReport struct {
-	QueryName  string    `json:"query_name"`
+	QueryName string `json:"query_name"`
+	// QueryType is the record type of test queries, see QueryType. It's
+	// empty for the lookups of the transport hostnames.
+	QueryType  string    `json:"query_type,omitempty"`
 	Time       time.Time `json:"time"`
 	DurationMs int64     `json:"duration_ms"`
 	AnswerIPs  []string  `json:"answer_ips"`
-	Error      string    `json:"error"`
+	// Answers are the records of other types than A and AAAA
+	Answers []string `json:"answers,omitempty"`
+	Error   string   `json:"error"`
 }
 
 type tcpReport struct {
@@ -126,12 +200,40 @@ func init() {
 	}
 }
 
+// connectTimes records when the connections of a test started. Dials can run
+// concurrently, e.g. happy eyeballs dials to IPv4 and IPv6 addresses, so the
+// times are guarded by a mutex.
+type connectTimes struct {
+	mu     sync.Mutex
+	starts map[string]time.Time
+}
+
+func newConnectTimes() *connectTimes {
+	return &connectTimes{starts: make(map[string]time.Time)}
+}
+
+func (c *connectTimes) set(network, addr string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.starts[network+"|"+addr] = t
+}
+
+// get returns when the connection to addr started, zero if it wasn't seen
+func (c *connectTimes) get(network, addr string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.starts[network+"|"+addr]
+}
+
+// newTCPTraceDialer returns a TCP dialer reporting its lookups and connections
+// to the callbacks, each dial bounded by connectTimeout if it's positive
 func newTCPTraceDialer(
 	onDNS func(ctx context.Context, domain string) func(di httptrace.DNSDoneInfo),
 	onDial func(ctx context.Context, network, addr string, connErr error),
 	onDialStart func(ctx context.Context, network, addr string),
+	connectTimeout time.Duration,
 ) transport.StreamDialer {
-	dialer := &transport.TCPDialer{}
+	dialer := withConnectTimeout(&transport.TCPDialer{}, connectTimeout)
 	var onDNSDone func(di httptrace.DNSDoneInfo)
 	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
 		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
@@ -155,12 +257,14 @@ func newTCPTraceDialer(
 	})
 }
 
+// newUDPTraceDialer is the UDP counterpart of newTCPTraceDialer
 func newUDPTraceDialer(
 	onDNS func(ctx context.Context, domain string) func(di httptrace.DNSDoneInfo),
 	onDial func(ctx context.Context, network, addr string, connErr error),
 	onDialStart func(ctx context.Context, network, addr string),
+	connectTimeout time.Duration,
 ) transport.PacketDialer {
-	dialer := &transport.UDPDialer{}
+	dialer := withPacketConnectTimeout(&transport.UDPDialer{}, connectTimeout)
 	var onDNSDone func(di httptrace.DNSDoneInfo)
 	return transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
 		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
@@ -184,19 +288,150 @@ func newUDPTraceDialer(
 	})
 }
 
-// TestConnectivity performs the connectivity test with the given parameters
-func TestConnectivity(transportConfig, proto, resolver, domain string) (ConnectivityReport, error) {
+// serverHop returns the last hop of a transport config, the server the
+// other hops lead to. It's empty if the hop can't be parsed.
+func serverHop(transportConfig string) *url.URL {
+	hops := strings.Split(transportConfig, "|")
+	u, err := url.Parse(strings.TrimSpace(hops[len(hops)-1]))
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
+
+// splitDirectTarget separates a trailing direct://host:port target from the
+// transport config used to reach it
+func splitDirectTarget(transportConfig string) (transport string, address string, ok bool) {
+	parts := strings.Split(transportConfig, "|")
+	u, err := url.Parse(strings.TrimSpace(parts[len(parts)-1]))
+	if err != nil || u.Scheme != DirectScheme {
+		return transportConfig, "", false
+	}
+	return strings.Join(parts[:len(parts)-1], "|"), u.Host, true
+}
+
+// ValidateTransport checks that a stream dialer can be built from the
+// transport config without connecting anywhere
+func ValidateTransport(transportConfig string) error {
+	endToEndTransport, _, _ := splitDirectTarget(transportConfig)
+	if _, err := NewConfigToDialer().NewStreamDialer(endToEndTransport); err != nil {
+		return fmt.Errorf("invalid transport: %w", err)
+	}
+	return nil
+}
+
+// newConnectResolver returns a resolver that only opens a stream to address.
+// It lets plain TCP targets go through the same test and error reporting as
+// the resolver based tests, where a failed dial is reported as a connect error.
+func newConnectResolver(sd transport.StreamDialer, address string) dns.Resolver {
+	return dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		conn, err := sd.DialStream(ctx, address)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", dns.ErrDial, err)
+		}
+		conn.Close()
+		return nil, nil
+	})
+}
+
+// Domains returns the test domains of the connectivity.domains setting, or
+// the single connectivity.domain if no list is configured
+func Domains() []string {
+	if domains := viper.GetStringSlice("connectivity.domains"); len(domains) > 0 {
+		return domains
+	}
+	if domain := viper.GetString("connectivity.domain"); domain != "" {
+		return []string{domain}
+	}
+	return nil
+}
+
+// Resolver returns the resolver of proto tests: connectivity.tcp_resolver or
+// connectivity.udp_resolver if set, connectivity.resolver otherwise. Networks
+// that block UDP:53 to some resolvers may still allow TCP to them.
+func Resolver(proto string) string {
+	if resolver := viper.GetString("connectivity." + proto + "_resolver"); resolver != "" {
+		return resolver
+	}
+	return viper.GetString("connectivity.resolver")
+}
+
+// SchemeDomains returns the test domains of servers with the access link
+// scheme, configured in connectivity.schemes.<scheme>.domains or .domain, and
+// falls back to Domains. Servers proxying to different targets can so be
+// probed against their own control domains in one run.
+func SchemeDomains(scheme string) []string {
+	if scheme != "" {
+		key := "connectivity.schemes." + scheme
+		if domains := viper.GetStringSlice(key + ".domains"); len(domains) > 0 {
+			return domains
+		}
+		if domain := viper.GetString(key + ".domain"); domain != "" {
+			return []string{domain}
+		}
+	}
+	return Domains()
+}
+
+// SchemeResolver returns the resolver of proto tests of servers with the
+// access link scheme: connectivity.schemes.<scheme>.resolver if set, Resolver
+// otherwise
+func SchemeResolver(scheme, proto string) string {
+	if scheme != "" {
+		if resolver := viper.GetString("connectivity.schemes." + scheme + ".resolver"); resolver != "" {
+			return resolver
+		}
+	}
+	return Resolver(proto)
+}
+
+// TestConnectivity performs the connectivity test with the given parameters.
+// If the transport ends in a direct://host:port target, TCP tests only check
+// that a connection to the target can be opened, and UDP tests send the DNS
+// query to the target itself since UDP has no handshake to observe. Other TCP
+// tests report the transport connection and the exchange over it separately.
+//
+// The http proto fetches each domain with a GET request through the
+// transport instead, see probeHTTP. The resolver is not used then.
+//
+// Each domain is resolved in turn and gets its own entry in the report. The
+// test succeeds if any domain was resolved, since the transport works then;
+// if all of them failed, the test error is the error of the first domain.
+// The queries ask for records of type connectivity.query_type and are
+// reported with their answers in DNSQueries. Each dial is bounded by
+// connectivity.connect_timeout_ms, see ConnectTimeout. With
+// connectivity.inspect_tls set, tcp and http tests also capture the TLS
+// certificate chain of their target in TLS, see inspectTLS.
+func TestConnectivity(transportConfig, proto, resolver string, domains []string) (ConnectivityReport, error) {
 	var report ConnectivityReport
 
-	endToEndTransport := transportConfig
+	if len(domains) == 0 {
+		return ConnectivityReport{}, errors.New("no test domain")
+	}
+
+	endToEndTransport, directAddress, isDirect := splitDirectTarget(transportConfig)
+	queryTypeName, queryType, err := QueryType()
+	if err != nil {
+		return ConnectivityReport{}, err
+	}
 
 	resolverAddress := net.JoinHostPort(resolver, "53")
-	var connectStart = make(map[string]time.Time)
+	if isDirect {
+		resolverAddress = directAddress
+	}
+	connectTimeout := ConnectTimeout()
+	connectStart := newConnectTimes()
 	var mu sync.Mutex
 	dnsReports := make([]dnsReport, 0)
 	tcpReports := make([]tcpReport, 0)
 	udpReports := make([]udpReport, 0)
-	configToDialer := configurl.NewDefaultConfigToDialer()
+	configToDialer := NewConfigToDialer()
+	ttfb := &firstByteTrace{}
+	recordQuery := func(report dnsReport) {
+		mu.Lock()
+		dnsReports = append(dnsReports, report)
+		mu.Unlock()
+	}
 
 	onDNS := func(ctx context.Context, domain string) func(di httptrace.DNSDoneInfo) {
 		dnsStart := time.Now()
@@ -228,27 +463,28 @@ func TestConnectivity(transportConfig, proto, resolver, domain string) (Connecti
 			if err != nil {
 				return
 			}
+			start := connectStart.get(network, addr)
 			report := tcpReport{
 				Hostname: hostname,
 				IP:       ip,
 				Port:     port,
-				Time:     connectStart[network+"|"+addr].UTC().Truncate(time.Second),
-				Duration: time.Since(connectStart[network+"|"+addr]).Milliseconds(),
+				Time:     start.UTC().Truncate(time.Second),
+				Duration: time.Since(start).Milliseconds(),
 			}
 			if connErr != nil {
 				report.Error = connErr.Error()
+			} else {
+				ttfb.connected()
 			}
 			mu.Lock()
 			tcpReports = append(tcpReports, report)
 			mu.Unlock()
 		}
 		onDialStart := func(ctx context.Context, network, addr string) {
-			mu.Lock()
-			connectStart[network+"|"+addr] = time.Now()
-			mu.Unlock()
+			connectStart.set(network, addr, time.Now())
 		}
 
-		return newTCPTraceDialer(onDNS, onDial, onDialStart).DialStream(ctx, addr)
+		return newTCPTraceDialer(onDNS, onDial, onDialStart, connectTimeout).DialStream(ctx, addr)
 	})
 
 	configToDialer.BasePacketDialer = transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
@@ -257,76 +493,158 @@ func TestConnectivity(transportConfig, proto, resolver, domain string) (Connecti
 			return nil, err
 		}
 		onDialStart := func(ctx context.Context, network, addr string) {
-			mu.Lock()
-			connectStart[network+"|"+addr] = time.Now()
-			mu.Unlock()
+			connectStart.set(network, addr, time.Now())
 		}
 		onDial := func(ctx context.Context, network, addr string, connErr error) {
 			ip, port, err := net.SplitHostPort(addr)
 			if err != nil {
 				return
 			}
+			start := connectStart.get(network, addr)
 			report := udpReport{
 				Hostname: hostname,
 				IP:       ip,
 				Port:     port,
-				Time:     connectStart[network+"|"+addr].UTC().Truncate(time.Second),
-				Duration: time.Since(connectStart[network+"|"+addr]).Milliseconds(),
+				Time:     start.UTC().Truncate(time.Second),
+				Duration: time.Since(start).Milliseconds(),
 			}
 			if connErr != nil {
 				report.Error = connErr.Error()
+			} else {
+				ttfb.connected()
 			}
 			mu.Lock()
 			udpReports = append(udpReports, report)
 			mu.Unlock()
 		}
 
-		return newUDPTraceDialer(onDNS, onDial, onDialStart).DialPacket(ctx, addr)
+		return newUDPTraceDialer(onDNS, onDial, onDialStart, connectTimeout).DialPacket(ctx, addr)
 	})
 
 	var dnsResolver dns.Resolver
+	var handshake *handshakeTrace
+	var httpDialer transport.StreamDialer
 	switch proto {
 	case "tcp":
 		streamDialer, err := configToDialer.NewStreamDialer(endToEndTransport)
 		if err != nil {
 			return ConnectivityReport{}, err
 		}
-		dnsResolver = dns.NewTCPResolver(streamDialer, resolverAddress)
+		streamDialer = ttfb.streamDialer(streamDialer)
+		if isDirect {
+			dnsResolver = newConnectResolver(streamDialer, directAddress)
+		} else {
+			streamDialer, handshake = traceHandshake(streamDialer)
+			dnsResolver = typedResolver(dns.NewTCPResolver(streamDialer, resolverAddress), queryTypeName, queryType, recordQuery)
+		}
 	case "udp":
 		packetDialer, err := configToDialer.NewPacketDialer(endToEndTransport)
 		if err != nil {
 			return ConnectivityReport{}, err
 		}
-		dnsResolver = dns.NewUDPResolver(packetDialer, resolverAddress)
+		dnsResolver = typedResolver(dns.NewUDPResolver(ttfb.packetDialer(packetDialer), resolverAddress), queryTypeName, queryType, recordQuery)
+	case "http":
+		streamDialer, err := configToDialer.NewStreamDialer(endToEndTransport)
+		if err != nil {
+			return ConnectivityReport{}, err
+		}
+		httpDialer = ttfb.streamDialer(streamDialer)
 	default:
 		return ConnectivityReport{}, errors.New("invalid protocol")
 	}
 
+	// The domains of http tests are cleared once fetched, pick the TLS target first
+	tlsSNI, tlsAddress := tlsTarget(directAddress, domains)
+
 	startTime := time.Now()
-	result, err := connectivity.TestConnectivityWithResolver(context.Background(), dnsResolver, domain)
-	if err != nil {
-		return ConnectivityReport{}, err
+	var testError *errorJSON
+	var resolved bool
+	var httpReports []httpReport
+	if httpDialer != nil {
+		// HTTP tests fetch the domains instead of resolving them
+		httpReports, testError = probeHTTP(httpDialer, directAddress, domains)
+		domains = nil
+	}
+	domainReports := make([]domainReport, 0, len(domains))
+	for _, domain := range domains {
+		domainStart := time.Now()
+		result, err := connectivity.TestConnectivityWithResolver(context.Background(), dnsResolver, domain)
+		if err != nil {
+			return ConnectivityReport{}, err
+		}
+		domainReport := domainReport{
+			Domain:     domain,
+			Time:       domainStart.UTC().Truncate(time.Second),
+			DurationMs: time.Since(domainStart).Milliseconds(),
+			Error:      makeErrorRecord(result),
+		}
+		domainReports = append(domainReports, domainReport)
+
+		if result == nil {
+			resolved = true
+		} else if testError == nil {
+			testError = domainReport.Error
+		}
+	}
+	if resolved {
+		testError = nil
 	}
 	testDuration := time.Since(startTime)
 
+	var tlsInspection *tlsReport
+	if proto != "udp" && InspectTLS() {
+		// A dialer of its own keeps the inspection out of the connections
+		// of the test
+		inspectDialer, err := NewConfigToDialer().NewStreamDialer(endToEndTransport)
+		if err != nil {
+			return ConnectivityReport{}, err
+		}
+		tlsInspection = inspectTLS(withConnectTimeout(inspectDialer, connectTimeout), tlsAddress, tlsSNI)
+	}
+
+	var comparisons []resolverComparison
+	if resolvers := CompareResolvers(); len(resolvers) > 0 {
+		// Direct targets have no resolver to query through the transport
+		lookups, err := comparisonLookups(resolvers, endToEndTransport, proto, resolverAddress, !isDirect && resolver != "")
+		if err != nil {
+			return ConnectivityReport{}, err
+		}
+		if domain := serverDomain(endToEndTransport); domain != "" {
+			comparison := compareResolvers(context.Background(), domain, lookups)
+			if comparison.Divergent {
+				slog.Warn("Resolvers returned divergent answers", "domain", domain, "answers", comparison.Answers)
+			}
+			comparisons = append(comparisons, comparison)
+		}
+	}
+
 	report = ConnectivityReport{
 		Test: testReport{
 			Resolver:   resolverAddress,
 			Proto:      proto,
 			Time:       startTime.UTC().Truncate(time.Second),
 			DurationMs: testDuration.Milliseconds(),
-			Error:      makeErrorRecord(result),
+			TTFBMs:     ttfb.Ms(),
+			Error:      testError,
 		},
+		Domains:        domainReports,
 		DNSQueries:     dnsReports,
 		TCPConnections: tcpReports,
 		UDPConnections: udpReports,
+		HTTPRequests:   httpReports,
+
+		ResolverComparison: comparisons,
+		TLS:                tlsInspection,
+	}
+	if handshake != nil {
+		report.Test.Handshake = handshake.Report()
 	}
 
 	reportJSON, err := json.Marshal(report)
 	if err != nil {
 		return ConnectivityReport{}, err
 	}
-	fmt.Printf("report: %v\n", string(reportJSON))
+	slog.Debug("Connectivity report", "report", string(reportJSON))
 
 	return report, nil
 }
@@ -0,0 +1,78 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/spf13/viper"
+)
+
+// ConnectTimeout returns connectivity.connect_timeout_ms, the deadline of each
+// dial of a test. It's 0 if not configured, dials are then only bound by the
+// deadline of the whole test.
+func ConnectTimeout() time.Duration {
+	if ms := viper.GetInt("connectivity.connect_timeout_ms"); ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 0
+}
+
+// connectTimeoutError is the error of a dial that didn't connect within the
+// connect timeout. It's a timeout, so failed tests record ETIMEDOUT.
+type connectTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *connectTimeoutError) Error() string {
+	return fmt.Sprintf("connect timeout after %v", e.timeout)
+}
+
+func (e *connectTimeoutError) Timeout() bool { return true }
+
+// connectError returns the error of a dial with dialCtx, the context of the
+// dial bounded by the connect timeout. Dials cut short by the deadline of
+// the test itself keep their error.
+func connectError(ctx, dialCtx context.Context, timeout time.Duration, addr string, err error) error {
+	if errors.Is(dialCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("dial %s: %w", addr, &connectTimeoutError{timeout: timeout})
+	}
+	return err
+}
+
+// withConnectTimeout bounds each dial of sd by timeout. A timeout that is not
+// positive leaves sd unchanged.
+func withConnectTimeout(sd transport.StreamDialer, timeout time.Duration) transport.StreamDialer {
+	if timeout <= 0 {
+		return sd
+	}
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := sd.DialStream(dialCtx, addr)
+		if err != nil {
+			return nil, connectError(ctx, dialCtx, timeout, addr, err)
+		}
+		return conn, nil
+	})
+}
+
+// withPacketConnectTimeout bounds each dial of pd by timeout, see
+// withConnectTimeout
+func withPacketConnectTimeout(pd transport.PacketDialer, timeout time.Duration) transport.PacketDialer {
+	if timeout <= 0 {
+		return pd
+	}
+	return transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := pd.DialPacket(dialCtx, addr)
+		if err != nil {
+			return nil, connectError(ctx, dialCtx, timeout, addr, err)
+		}
+		return conn, nil
+	})
+}
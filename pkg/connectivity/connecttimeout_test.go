@@ -0,0 +1,65 @@
+package connectivity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/x/connectivity"
+	"github.com/spf13/viper"
+)
+
+func TestConnectTimeout(t *testing.T) {
+	t.Cleanup(func() { viper.Set("connectivity.connect_timeout_ms", nil) })
+
+	if timeout := ConnectTimeout(); timeout != 0 {
+		t.Errorf("ConnectTimeout() without configuration = %v, want 0", timeout)
+	}
+	viper.Set("connectivity.connect_timeout_ms", 1500)
+	if timeout := ConnectTimeout(); timeout != 1500*time.Millisecond {
+		t.Errorf("ConnectTimeout() = %v, want 1.5s", timeout)
+	}
+}
+
+func TestWithConnectTimeout(t *testing.T) {
+	// stalled never connects, it waits until its dial is canceled
+	stalled := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	resolver := dns.NewTCPResolver(withConnectTimeout(stalled, 50*time.Millisecond), "192.0.2.1:53")
+
+	start := time.Now()
+	result, err := connectivity.TestConnectivityWithResolver(context.Background(), resolver, "example.com")
+	if err != nil {
+		t.Fatalf("TestConnectivityWithResolver() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled connect failed after %v, want the 50ms connect timeout", elapsed)
+	}
+
+	record := makeErrorRecord(result)
+	if record == nil {
+		t.Fatal("stalled connect succeeded")
+	}
+	if record.Op != "connect" || record.PosixError != "ETIMEDOUT" || record.Msg != "connect timeout after 50ms" {
+		t.Errorf("got error %+v, want a connect timeout", record)
+	}
+}
+
+func TestWithConnectTimeoutTestDeadline(t *testing.T) {
+	stalled := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	// The deadline of the test expires before the connect timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := withConnectTimeout(stalled, time.Minute).DialStream(ctx, "192.0.2.1:53")
+	if err != context.DeadlineExceeded {
+		t.Errorf("DialStream() error = %v, want the test deadline", err)
+	}
+}
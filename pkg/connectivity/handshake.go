@@ -0,0 +1,104 @@
+package connectivity
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// handshakeReport separates the transport connection of a stream test from
+// the application layer exchange over it. A connection that is established
+// but gets no response, e.g. because it's reset once the tunnel handshake is
+// seen, points to blocking above the transport.
+type handshakeReport struct {
+	// Connected is true if the transport connection was established
+	Connected bool  `json:"connected"`
+	ConnectMs int64 `json:"connect_ms"`
+	// Completed is true if a response was read over the connection
+	Completed  bool   `json:"completed"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handshakeTrace records the handshake stage of the first stream dialed
+// through a traced dialer
+type handshakeTrace struct {
+	mu          sync.Mutex
+	report      *handshakeReport
+	connectedAt time.Time
+}
+
+// traceHandshake wraps sd to record when its first connection is established
+// and when the first response, or error, is read from it
+func traceHandshake(sd transport.StreamDialer) (transport.StreamDialer, *handshakeTrace) {
+	trace := &handshakeTrace{}
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		start := time.Now()
+		conn, err := sd.DialStream(ctx, addr)
+
+		trace.mu.Lock()
+		defer trace.mu.Unlock()
+		// Only the first connection is traced
+		if trace.report != nil {
+			return conn, err
+		}
+		trace.report = &handshakeReport{ConnectMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			trace.report.Error = findBaseError(err).Error()
+			return nil, err
+		}
+		trace.report.Connected = true
+		trace.connectedAt = time.Now()
+		return &handshakeConn{StreamConn: conn, trace: trace}, nil
+	}), trace
+}
+
+// done records the outcome of the first read or failed write on the connection
+func (t *handshakeTrace) done(n int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.report.DurationMs = time.Since(t.connectedAt).Milliseconds()
+	if n > 0 {
+		t.report.Completed = true
+		return
+	}
+	if err != nil {
+		t.report.Error = findBaseError(err).Error()
+	}
+}
+
+// Report returns the handshake stage, or nil if no connection was dialed
+func (t *handshakeTrace) Report() *handshakeReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.report == nil {
+		return nil
+	}
+	report := *t.report
+	return &report
+}
+
+// handshakeConn reports the first response or error to its trace
+type handshakeConn struct {
+	transport.StreamConn
+	trace *handshakeTrace
+	once  sync.Once
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	n, err := c.StreamConn.Read(b)
+	if n > 0 || err != nil {
+		c.once.Do(func() { c.trace.done(n, err) })
+	}
+	return n, err
+}
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	n, err := c.StreamConn.Write(b)
+	if err != nil {
+		c.once.Do(func() { c.trace.done(0, err) })
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/x/connectivity"
+)
+
+// fakeConn is a connected stream that accepts writes and answers reads
+// with response, or with readErr if response is empty
+type fakeConn struct {
+	response []byte
+	readErr  error
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	if len(c.response) == 0 {
+		return 0, c.readErr
+	}
+	n := copy(b, c.response)
+	c.response = c.response[n:]
+	return n, nil
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *fakeConn) Close() error                { return nil }
+func (c *fakeConn) CloseRead() error            { return nil }
+func (c *fakeConn) CloseWrite() error           { return nil }
+func (c *fakeConn) LocalAddr() net.Addr         { return &net.TCPAddr{} }
+func (c *fakeConn) RemoteAddr() net.Addr        { return &net.TCPAddr{} }
+
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func fakeDialer(conn transport.StreamConn, err error) transport.StreamDialer {
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		return conn, err
+	})
+}
+
+func TestTraceHandshake(t *testing.T) {
+	t.Run("connect succeeds but handshake is reset", func(t *testing.T) {
+		reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+		dialer, trace := traceHandshake(fakeDialer(&fakeConn{readErr: reset}, nil))
+
+		resolver := dns.NewTCPResolver(dialer, "192.0.2.53:53")
+		result, err := connectivity.TestConnectivityWithResolver(context.Background(), resolver, "example.com")
+		if err != nil {
+			t.Fatalf("TestConnectivityWithResolver() error = %v", err)
+		}
+		if result == nil {
+			t.Fatalf("TestConnectivityWithResolver() succeeded, want a reset error")
+		}
+
+		report := trace.Report()
+		if report == nil {
+			t.Fatalf("Report() = nil, want the handshake stage")
+		}
+		if !report.Connected {
+			t.Errorf("Connected = false, want the connect stage to succeed")
+		}
+		if report.Completed {
+			t.Errorf("Completed = true, want the handshake stage to fail")
+		}
+		if !strings.Contains(report.Error, "connection reset") {
+			t.Errorf("Error = %q, want a connection reset", report.Error)
+		}
+	})
+
+	t.Run("connect fails", func(t *testing.T) {
+		dialer, trace := traceHandshake(fakeDialer(nil, errors.New("connect: connection refused")))
+		if _, err := dialer.DialStream(context.Background(), "192.0.2.53:53"); err == nil {
+			t.Fatalf("DialStream() expected an error")
+		}
+
+		report := trace.Report()
+		if report.Connected || report.Completed {
+			t.Errorf("Report() = %+v, want neither stage to succeed", report)
+		}
+		if report.Error == "" {
+			t.Errorf("Error is empty, want the connect error")
+		}
+	})
+
+	t.Run("handshake completes", func(t *testing.T) {
+		dialer, trace := traceHandshake(fakeDialer(&fakeConn{response: []byte("ok")}, nil))
+		conn, err := dialer.DialStream(context.Background(), "192.0.2.53:53")
+		if err != nil {
+			t.Fatalf("DialStream() error = %v", err)
+		}
+		conn.Write([]byte("hello"))
+		conn.Read(make([]byte, 2))
+
+		report := trace.Report()
+		if !report.Connected || !report.Completed || report.Error != "" {
+			t.Errorf("Report() = %+v, want both stages to succeed", report)
+		}
+	})
+
+	t.Run("no connection", func(t *testing.T) {
+		_, trace := traceHandshake(fakeDialer(nil, nil))
+		if report := trace.Report(); report != nil {
+			t.Errorf("Report() = %+v, want nil", report)
+		}
+	})
+}
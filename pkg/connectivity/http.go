@@ -0,0 +1,108 @@
+package connectivity
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/spf13/viper"
+)
+
+// httpProbeTimeout bounds each request of an http test
+const httpProbeTimeout = 10 * time.Second
+
+// httpProbeBodyLimit is how much of a response body is read, the body is
+// only read to time the whole response
+const httpProbeBodyLimit = 1 << 20
+
+// httpReport is the result of a request of an http test
+type httpReport struct {
+	URL        string    `json:"url"`
+	Time       time.Time `json:"time"`
+	DurationMs int64     `json:"duration_ms"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// HTTPURL returns the control URL of http tests in connectivity.http_url,
+// empty if http tests fetch the test domains
+func HTTPURL() string {
+	return viper.GetString("connectivity.http_url")
+}
+
+// probeURL returns the URL fetched for an http test target, a URL or a
+// domain whose root page is fetched
+func probeURL(target string) string {
+	if strings.Contains(target, "://") {
+		return target
+	}
+	return "http://" + target + "/"
+}
+
+// probeHTTP fetches each target with a GET request through sd. If address is
+// not empty the requests connect to it instead of the URL host, as with a
+// direct://host:port target. The test succeeds if any target responded, with
+// any status, since the transport works then; otherwise its error is the
+// error of the first target.
+func probeHTTP(sd transport.StreamDialer, address string, targets []string) ([]httpReport, *errorJSON) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if address != "" {
+					addr = address
+				}
+				return sd.DialStream(ctx, addr)
+			},
+			// Each test opens its own connections
+			DisableKeepAlives: true,
+		},
+		Timeout: httpProbeTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	reports := make([]httpReport, 0, len(targets))
+	var testError *errorJSON
+	var responded bool
+	for _, target := range targets {
+		report := httpReport{URL: probeURL(target)}
+		start := time.Now()
+		report.Time = start.UTC().Truncate(time.Second)
+
+		err := func() error {
+			resp, err := client.Get(report.URL)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			report.StatusCode = resp.StatusCode
+			if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, httpProbeBodyLimit)); err != nil {
+				return fmt.Errorf("failed to read response body: %w", err)
+			}
+			return nil
+		}()
+		report.DurationMs = time.Since(start).Milliseconds()
+
+		if err != nil {
+			report.Error = err.Error()
+			if testError == nil {
+				testError = &errorJSON{Op: "http", Msg: err.Error()}
+			}
+		} else {
+			responded = true
+		}
+		reports = append(reports, report)
+	}
+
+	if responded {
+		return reports, nil
+	}
+	return reports, testError
+}
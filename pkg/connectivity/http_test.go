@@ -0,0 +1,56 @@
+package connectivity
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnectivityHTTP(t *testing.T) {
+	var hosts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// The direct target is connected to, the URL host is only sent
+	report, err := TestConnectivity("direct://"+srv.Listener.Addr().String(), "http", "", []string{"example.com", "http://control.example/204"})
+	if err != nil {
+		t.Fatalf("TestConnectivity() error = %v", err)
+	}
+	if !report.IsSuccess() || report.Test.Proto != "http" {
+		t.Errorf("TestConnectivity() test = %+v, want a successful http test", report.Test)
+	}
+	if len(report.HTTPRequests) != 2 {
+		t.Fatalf("got %d http requests, want 2", len(report.HTTPRequests))
+	}
+	for i, want := range []string{"http://example.com/", "http://control.example/204"} {
+		r := report.HTTPRequests[i]
+		if r.URL != want || r.StatusCode != http.StatusNoContent || r.Error != "" {
+			t.Errorf("http request %d = %+v, want %s with status 204", i, r, want)
+		}
+	}
+	if len(hosts) != 2 || hosts[0] != "example.com" || hosts[1] != "control.example" {
+		t.Errorf("server got requests for hosts %v", hosts)
+	}
+	if len(report.Domains) != 0 || len(report.DNSQueries) != 0 {
+		t.Errorf("http test resolved domains: %+v", report.Domains)
+	}
+
+	// An unreachable target fails the test
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	report, err = TestConnectivity("direct://"+addr, "http", "", []string{"example.com"})
+	if err != nil {
+		t.Fatalf("TestConnectivity() error = %v", err)
+	}
+	if report.IsSuccess() || report.Test.Error.Op != "http" || report.HTTPRequests[0].Error == "" {
+		t.Errorf("TestConnectivity() of an unreachable target = %+v, want an http error", report)
+	}
+}
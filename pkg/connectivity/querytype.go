@@ -0,0 +1,94 @@
+package connectivity
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultQueryType is the record type of test queries when
+// connectivity.query_type is not set
+const defaultQueryType = "A"
+
+// queryTypes are the record types test queries can ask for. dnsmessage has
+// no constants for SVCB and HTTPS, their answers are recorded as hex.
+var queryTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"TXT":   dnsmessage.TypeTXT,
+	"SVCB":  dnsmessage.Type(64),
+	"HTTPS": dnsmessage.Type(65),
+}
+
+// QueryType returns the record type of connectivity.query_type and its
+// name, A if it's not set
+func QueryType() (string, dnsmessage.Type, error) {
+	name := strings.ToUpper(viper.GetString("connectivity.query_type"))
+	if name == "" {
+		name = defaultQueryType
+	}
+	qtype, ok := queryTypes[name]
+	if !ok {
+		return "", 0, fmt.Errorf("unsupported DNS query type %q", name)
+	}
+	return name, qtype, nil
+}
+
+// typedResolver asks r for records of type qtype, named name, whatever type
+// the question has, and reports each query with its answers
+func typedResolver(r dns.Resolver, name string, qtype dnsmessage.Type, record func(dnsReport)) dns.Resolver {
+	return dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		q.Type = qtype
+		start := time.Now()
+		msg, err := r.Query(ctx, q)
+
+		report := dnsReport{
+			QueryName:  strings.TrimSuffix(q.Name.String(), "."),
+			QueryType:  name,
+			Time:       start.UTC().Truncate(time.Second),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			report.Error = err.Error()
+		} else if msg != nil {
+			report.AnswerIPs, report.Answers = answersOf(msg)
+		}
+		record(report)
+
+		return msg, err
+	})
+}
+
+// answersOf returns the addresses of the A and AAAA answers of msg and the
+// other answers as text
+func answersOf(msg *dnsmessage.Message) (ips, answers []string) {
+	for _, a := range msg.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.CNAMEResource:
+			answers = append(answers, body.CNAME.String())
+		case *dnsmessage.NSResource:
+			answers = append(answers, body.NS.String())
+		case *dnsmessage.MXResource:
+			answers = append(answers, fmt.Sprintf("%d %s", body.Pref, body.MX))
+		case *dnsmessage.TXTResource:
+			answers = append(answers, strings.Join(body.TXT, ""))
+		case *dnsmessage.UnknownResource:
+			answers = append(answers, hex.EncodeToString(body.Data))
+		}
+	}
+	return ips, answers
+}
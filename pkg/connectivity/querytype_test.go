@@ -0,0 +1,78 @@
+package connectivity
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestQueryType(t *testing.T) {
+	t.Cleanup(func() { viper.Set("connectivity.query_type", nil) })
+
+	for _, tt := range []struct {
+		config   string
+		wantName string
+		wantType dnsmessage.Type
+	}{
+		{"", "A", dnsmessage.TypeA},
+		{"aaaa", "AAAA", dnsmessage.TypeAAAA},
+		{"HTTPS", "HTTPS", dnsmessage.Type(65)},
+	} {
+		viper.Set("connectivity.query_type", tt.config)
+		name, qtype, err := QueryType()
+		if err != nil || name != tt.wantName || qtype != tt.wantType {
+			t.Errorf("QueryType() with %q = (%s, %v, %v), want (%s, %v)", tt.config, name, qtype, err, tt.wantName, tt.wantType)
+		}
+	}
+
+	viper.Set("connectivity.query_type", "ANY")
+	if _, _, err := QueryType(); err == nil {
+		t.Error("QueryType() with an unsupported type succeeded, want error")
+	}
+}
+
+func TestTypedResolver(t *testing.T) {
+	var asked []dnsmessage.Type
+	upstream := dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		asked = append(asked, q.Type)
+		return &dnsmessage.Message{
+			Questions: []dnsmessage.Question{q},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}},
+			}},
+		}, nil
+	})
+
+	var reports []dnsReport
+	r := typedResolver(upstream, "AAAA", dnsmessage.TypeAAAA, func(report dnsReport) {
+		reports = append(reports, report)
+	})
+
+	// The test asks for A records, the resolver turns it into an AAAA query
+	q, err := dns.NewQuestion("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatalf("NewQuestion() error = %v", err)
+	}
+	if _, err := r.Query(context.Background(), *q); err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(asked, []dnsmessage.Type{dnsmessage.TypeAAAA}) {
+		t.Errorf("queried types %v, want one AAAA query", asked)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("recorded %d queries, want 1", len(reports))
+	}
+	got := reports[0]
+	if got.QueryName != "example.com" || got.QueryType != "AAAA" || got.Error != "" {
+		t.Errorf("recorded query %+v, want an AAAA query of example.com", got)
+	}
+	if !reflect.DeepEqual(got.AnswerIPs, []string{"2001:db8::1"}) {
+		t.Errorf("recorded answers %v, want 2001:db8::1", got.AnswerIPs)
+	}
+}
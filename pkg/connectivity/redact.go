@@ -0,0 +1,51 @@
+package connectivity
+
+import (
+	"net/url"
+	"strings"
+)
+
+// redacted replaces the secrets of a redacted transport
+const redacted = "REDACTED"
+
+// RedactTransport masks the credentials in each hop of a transport config,
+// such as an access link or a proxy URL, so it can be logged. A hop with a
+// user name and password keeps the user name, which holds the proxy session
+// parameters, and loses the password; a hop with only user info, like a
+// Shadowsocks key, loses all of it. Bare host:port hops are kept, and hops that
+// can't be parsed are replaced by their scheme.
+func RedactTransport(transportConfig string) string {
+	hops := strings.Split(transportConfig, "|")
+	for i, hop := range hops {
+		hops[i] = redactHop(strings.TrimSpace(hop))
+	}
+	return strings.Join(hops, "|")
+}
+
+func redactHop(hop string) string {
+	if hop == "" {
+		return hop
+	}
+
+	// A bare host:port, such as the server of a multi-hop config, has no
+	// credentials and doesn't parse as a URL
+	if !strings.Contains(hop, "://") && !strings.Contains(hop, "@") {
+		return hop
+	}
+
+	u, err := url.Parse(hop)
+	if err != nil {
+		scheme, _, _ := strings.Cut(hop, ":")
+		return scheme + "://" + redacted
+	}
+	if u.User == nil {
+		return hop
+	}
+
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	} else {
+		u.User = url.User(redacted)
+	}
+	return u.String()
+}
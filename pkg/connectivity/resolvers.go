@@ -0,0 +1,173 @@
+package connectivity
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolvers of connectivity.compare_resolvers that aren't resolver IPs
+const (
+	// systemResolver is the resolver of the machine running the test
+	systemResolver = "system"
+	// transportResolver is the test resolver queried through the transport
+	transportResolver = "transport"
+)
+
+// compareTimeout bounds each query of a resolver comparison
+const compareTimeout = 5 * time.Second
+
+// resolverAnswer is the answer of one resolver in a resolver comparison
+type resolverAnswer struct {
+	Resolver  string   `json:"resolver"`
+	AnswerIPs []string `json:"answer_ips"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// resolverComparison has the answers of several resolvers for a server
+// domain. Divergent is set if two resolvers that answered returned IPs
+// without any in common, a sign of DNS poisoning by one of them.
+type resolverComparison struct {
+	Domain    string           `json:"domain"`
+	Answers   []resolverAnswer `json:"answers"`
+	Divergent bool             `json:"divergent"`
+}
+
+// lookupFunc resolves the IPv4 addresses of a domain
+type lookupFunc func(ctx context.Context, domain string) ([]string, error)
+
+// namedLookup is a resolver of a comparison
+type namedLookup struct {
+	name   string
+	lookup lookupFunc
+}
+
+// CompareResolvers returns the resolvers of connectivity.compare_resolvers,
+// the server domains of tests are resolved with each of them if it's set
+func CompareResolvers() []string {
+	return viper.GetStringSlice("connectivity.compare_resolvers")
+}
+
+// compareResolvers resolves domain with each resolver and flags divergent
+// answers. Resolvers that failed don't take part in the divergence check.
+func compareResolvers(ctx context.Context, domain string, lookups []namedLookup) resolverComparison {
+	comparison := resolverComparison{Domain: domain, Answers: make([]resolverAnswer, 0, len(lookups))}
+	for _, l := range lookups {
+		answer := resolverAnswer{Resolver: l.name}
+		queryCtx, cancel := context.WithTimeout(ctx, compareTimeout)
+		ips, err := l.lookup(queryCtx, domain)
+		cancel()
+		if err != nil {
+			answer.Error = err.Error()
+		} else {
+			answer.AnswerIPs = ips
+			slices.Sort(answer.AnswerIPs)
+		}
+		comparison.Answers = append(comparison.Answers, answer)
+	}
+
+	for i, a := range comparison.Answers {
+		for _, b := range comparison.Answers[i+1:] {
+			if len(a.AnswerIPs) == 0 || len(b.AnswerIPs) == 0 {
+				continue
+			}
+			if !slices.ContainsFunc(a.AnswerIPs, func(ip string) bool { return slices.Contains(b.AnswerIPs, ip) }) {
+				comparison.Divergent = true
+			}
+		}
+	}
+	return comparison
+}
+
+// serverDomain returns the domain of the server, the last hop of a
+// transport config, or "" if the server is an IP. The domains of the hops
+// before it, such as a proxy, are resolved by those hops.
+func serverDomain(transportConfig string) string {
+	host := serverHop(transportConfig).Hostname()
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// systemLookup resolves with the resolver of the machine running the test
+func systemLookup(ctx context.Context, domain string) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", domain)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]string, len(ips))
+	for i, ip := range ips {
+		answers[i] = ip.String()
+	}
+	return answers, nil
+}
+
+// resolverLookup resolves the A records of a domain with resolver
+func resolverLookup(resolver dns.Resolver) lookupFunc {
+	return func(ctx context.Context, domain string) ([]string, error) {
+		q, err := dns.NewQuestion(domain, dnsmessage.TypeA)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := resolver.Query(ctx, *q)
+		if err != nil {
+			return nil, err
+		}
+		var answers []string
+		for _, rr := range msg.Answers {
+			if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+				answers = append(answers, net.IP(a.A[:]).String())
+			}
+		}
+		return answers, nil
+	}
+}
+
+// comparisonLookups returns the lookups of the resolvers of a comparison.
+// The transport resolver queries resolverAddress over proto through the
+// transport, it's left out unless withTransport is set.
+func comparisonLookups(resolvers []string, endToEndTransport, proto, resolverAddress string, withTransport bool) ([]namedLookup, error) {
+	var lookups []namedLookup
+	for _, resolver := range resolvers {
+		switch resolver {
+		case systemResolver:
+			lookups = append(lookups, namedLookup{resolver, systemLookup})
+		case transportResolver:
+			if !withTransport {
+				continue
+			}
+			// The comparison doesn't go through the traced dialers of the test
+			var r dns.Resolver
+			if proto == "udp" {
+				pd, err := NewConfigToDialer().NewPacketDialer(endToEndTransport)
+				if err != nil {
+					return nil, err
+				}
+				r = dns.NewUDPResolver(pd, resolverAddress)
+			} else {
+				sd, err := NewConfigToDialer().NewStreamDialer(endToEndTransport)
+				if err != nil {
+					return nil, err
+				}
+				r = dns.NewTCPResolver(sd, resolverAddress)
+			}
+			lookups = append(lookups, namedLookup{resolver + " " + resolverAddress, resolverLookup(r)})
+		default:
+			if net.ParseIP(resolver) == nil {
+				return nil, fmt.Errorf("invalid resolver %q to compare, must be an IP, %s or %s", resolver, systemResolver, transportResolver)
+			}
+			address := net.JoinHostPort(resolver, "53")
+			r := dns.NewUDPResolver(&transport.UDPDialer{}, address)
+			lookups = append(lookups, namedLookup{address, resolverLookup(r)})
+		}
+	}
+	return lookups, nil
+}
@@ -0,0 +1,112 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubLookup answers every domain with ips
+func stubLookup(ips ...string) lookupFunc {
+	return func(ctx context.Context, domain string) ([]string, error) {
+		return ips, nil
+	}
+}
+
+func TestCompareResolvers(t *testing.T) {
+	failing := func(ctx context.Context, domain string) ([]string, error) {
+		return nil, errors.New("i/o timeout")
+	}
+
+	tests := []struct {
+		name          string
+		lookups       []namedLookup
+		wantDivergent bool
+	}{
+		{
+			name: "overlapping answers",
+			lookups: []namedLookup{
+				{"system", stubLookup("203.0.113.1")},
+				{"8.8.8.8:53", stubLookup("203.0.113.2", "203.0.113.1")},
+			},
+		},
+		{
+			name: "poisoned answer",
+			lookups: []namedLookup{
+				{"system", stubLookup("10.10.34.35")},
+				{"8.8.8.8:53", stubLookup("203.0.113.1")},
+				{"transport 1.1.1.1:53", stubLookup("203.0.113.1")},
+			},
+			wantDivergent: true,
+		},
+		{
+			name: "failed resolver",
+			lookups: []namedLookup{
+				{"system", failing},
+				{"8.8.8.8:53", stubLookup("203.0.113.1")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comparison := compareResolvers(context.Background(), "server.example", tt.lookups)
+			if comparison.Divergent != tt.wantDivergent {
+				t.Errorf("Divergent = %t, want %t: %+v", comparison.Divergent, tt.wantDivergent, comparison.Answers)
+			}
+			if len(comparison.Answers) != len(tt.lookups) {
+				t.Fatalf("got %d answers, want one per resolver", len(comparison.Answers))
+			}
+			for i, answer := range comparison.Answers {
+				if answer.Resolver != tt.lookups[i].name {
+					t.Errorf("answer %d resolver = %q, want %q", i, answer.Resolver, tt.lookups[i].name)
+				}
+			}
+		})
+	}
+
+	comparison := compareResolvers(context.Background(), "server.example", tests[2].lookups)
+	if answer := comparison.Answers[0]; answer.Error == "" || answer.AnswerIPs != nil {
+		t.Errorf("failed resolver answer = %+v, want the error only", answer)
+	}
+}
+
+func TestResolverLookup(t *testing.T) {
+	resolver := dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return &dnsmessage.Message{Answers: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA}, Body: &dnsmessage.AResource{A: [4]byte{203, 0, 113, 7}}},
+			{Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME}, Body: &dnsmessage.CNAMEResource{CNAME: q.Name}},
+		}}, nil
+	})
+	ips, err := resolverLookup(resolver)(context.Background(), "server.example")
+	if err != nil {
+		t.Fatalf("lookup error = %v", err)
+	}
+	if want := []string{"203.0.113.7"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("lookup = %v, want %v", ips, want)
+	}
+}
+
+func TestServerDomain(t *testing.T) {
+	tests := []struct {
+		transport string
+		want      string
+	}{
+		{transport: "socks5://proxy.example:1080|split:3|ss://key@server.example:443", want: "server.example"},
+		// The proxy resolves its own domain, it's not the server's
+		{transport: "socks5://proxy.example:1080|ss://key@192.0.2.1:443", want: ""},
+		{transport: "ss://key@server.example:8388", want: "server.example"},
+	}
+	for _, tt := range tests {
+		if got := serverDomain(tt.transport); got != tt.want {
+			t.Errorf("serverDomain(%q) = %q, want %q", tt.transport, got, tt.want)
+		}
+	}
+
+	if _, err := comparisonLookups([]string{"system", "resolver.example"}, "", "tcp", "1.1.1.1:53", true); err == nil {
+		t.Error("comparisonLookups() with a resolver name succeeded, want error")
+	}
+}
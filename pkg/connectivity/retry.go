@@ -0,0 +1,97 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// defaultRetryBackoff is the wait before the first retry of a transient
+// failure when connectivity.retry_backoff_ms is not configured
+const defaultRetryBackoff = 500 * time.Millisecond
+
+// TestFunc runs a connectivity test, see TestConnectivity
+type TestFunc func(transportConfig, proto, resolver string, domains []string) (ConnectivityReport, error)
+
+// Retry bounds the retries of connectivity tests that failed to run because
+// of a transient error
+type Retry struct {
+	// Attempts is the number of times a test is run at most, 1 or less
+	// runs it once
+	Attempts int
+	// Backoff is the wait before the first retry, it doubles for each
+	// further retry
+	Backoff time.Duration
+	// Test runs the tests, TestConnectivity if nil
+	Test TestFunc
+}
+
+// RetryFromConfig returns the retries of connectivity.retry_attempts and
+// connectivity.retry_backoff_ms in config, tests run once if they're not
+// configured
+func RetryFromConfig(config *viper.Viper) Retry {
+	retry := Retry{
+		Attempts: config.GetInt("connectivity.retry_attempts"),
+		Backoff:  defaultRetryBackoff,
+	}
+	if ms := config.GetInt("connectivity.retry_backoff_ms"); ms > 0 {
+		retry.Backoff = time.Duration(ms) * time.Millisecond
+	}
+	return retry
+}
+
+// IsTransient reports whether err is a failure that may not happen again,
+// such as a temporary DNS error, a timeout or a reset connection. Errors of
+// the test setup, e.g. an invalid protocol or transport config, are not
+// transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// TestConnectivityWithRetry runs the test of retry, retrying it while it
+// fails with a transient error, see IsTransient. Test results, including
+// failed connectivity, are returned as they are, only errors running the
+// test are retried. The wait between attempts ends early if ctx is done.
+func TestConnectivityWithRetry(ctx context.Context, retry Retry, transportConfig, proto, resolver string, domains []string) (ConnectivityReport, error) {
+	test := retry.Test
+	if test == nil {
+		test = TestConnectivity
+	}
+
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		report, err := test(transportConfig, proto, resolver, domains)
+		if err == nil || attempt >= retry.Attempts || !IsTransient(err) {
+			return report, err
+		}
+
+		slog.Debug("Retrying connectivity test after a transient error",
+			"proto", proto,
+			"attempt", attempt,
+			"backoff", backoff,
+			"error", err)
+		select {
+		case <-ctx.Done():
+			return ConnectivityReport{}, fmt.Errorf("%w, retry canceled: %v", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
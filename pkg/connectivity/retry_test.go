@@ -0,0 +1,91 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// scriptedTest fails with the scripted errors in turn and succeeds after them
+type scriptedTest struct {
+	errs  []error
+	calls int
+}
+
+func (s *scriptedTest) run(transportConfig, proto, resolver string, domains []string) (ConnectivityReport, error) {
+	s.calls++
+	if s.calls <= len(s.errs) {
+		return ConnectivityReport{}, s.errs[s.calls-1]
+	}
+	return ConnectivityReport{Test: testReport{Proto: proto}}, nil
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"temporary DNS error", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"DNS timeout", fmt.Errorf("resolve: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true}), true},
+		{"unknown host", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"invalid protocol", errors.New("invalid protocol"), false},
+		{"canceled", context.Canceled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryConnectivity(t *testing.T) {
+	transient := &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+
+	t.Run("transient then success", func(t *testing.T) {
+		test := &scriptedTest{errs: []error{transient, transient}}
+		report, err := TestConnectivityWithRetry(context.Background(),
+			Retry{Attempts: 3, Backoff: time.Millisecond, Test: test.run}, "", "tcp", "1.1.1.1", []string{"example.com"})
+		if err != nil {
+			t.Fatalf("TestConnectivityWithRetry() error = %v", err)
+		}
+		if test.calls != 3 || report.Test.Proto != "tcp" {
+			t.Errorf("ran %d tests with report %+v, want the third attempt's report", test.calls, report.Test)
+		}
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		test := &scriptedTest{errs: []error{transient, transient}}
+		_, err := TestConnectivityWithRetry(context.Background(),
+			Retry{Attempts: 2, Backoff: time.Millisecond, Test: test.run}, "", "tcp", "1.1.1.1", []string{"example.com"})
+		if !errors.Is(err, transient) || test.calls != 2 {
+			t.Errorf("ran %d tests with error %v, want 2 with the transient error", test.calls, err)
+		}
+	})
+
+	t.Run("deterministic failure", func(t *testing.T) {
+		test := &scriptedTest{errs: []error{errors.New("invalid protocol")}}
+		_, err := TestConnectivityWithRetry(context.Background(),
+			Retry{Attempts: 3, Backoff: time.Millisecond, Test: test.run}, "", "icmp", "1.1.1.1", []string{"example.com"})
+		if err == nil || test.calls != 1 {
+			t.Errorf("ran %d tests with error %v, want a single failed test", test.calls, err)
+		}
+	})
+
+	t.Run("canceled backoff", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		test := &scriptedTest{errs: []error{transient}}
+		_, err := TestConnectivityWithRetry(ctx,
+			Retry{Attempts: 3, Backoff: time.Hour, Test: test.run}, "", "tcp", "1.1.1.1", []string{"example.com"})
+		if !errors.Is(err, transient) || test.calls != 1 {
+			t.Errorf("ran %d tests with error %v, want the backoff to end with the context", test.calls, err)
+		}
+	})
+}
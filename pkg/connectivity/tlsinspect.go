@@ -0,0 +1,134 @@
+package connectivity
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/spf13/viper"
+)
+
+// tlsInspectTimeout bounds the connection and handshake of a TLS inspection
+const tlsInspectTimeout = 10 * time.Second
+
+// tlsReport is the TLS handshake made through the transport of a test to
+// capture the certificate chain presented for the SNI. A chain that doesn't
+// belong to the SNI, e.g. issued by an unexpected CA, points to interception
+// on the path.
+type tlsReport struct {
+	Address    string    `json:"address"`
+	SNI        string    `json:"sni"`
+	Time       time.Time `json:"time"`
+	DurationMs int64     `json:"duration_ms"`
+	Version    string    `json:"version,omitempty"`
+	// Certificates is the chain as presented by the peer, leaf first. It's
+	// recorded without being verified.
+	Certificates []certificateReport `json:"certificates,omitempty"`
+	Error        string              `json:"error,omitempty"`
+}
+
+// certificateReport has the details of a presented certificate
+type certificateReport struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+	// SANs are the DNS names and IPs the certificate is valid for
+	SANs         []string  `json:"sans,omitempty"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	SerialNumber string    `json:"serial_number"`
+	// SHA256 is the fingerprint of the DER encoded certificate
+	SHA256 string `json:"sha256"`
+}
+
+// InspectTLS reports whether tcp and http tests capture the TLS certificate
+// chain of their target, see connectivity.inspect_tls
+func InspectTLS() bool {
+	return viper.GetBool("connectivity.inspect_tls")
+}
+
+// tlsTarget returns the SNI and the address of the TLS inspection of a test.
+// The SNI is connectivity.tls_sni, or the host of the first test domain. The
+// inspection connects to the direct target if there is one, otherwise to
+// port 443 of the SNI.
+func tlsTarget(directAddress string, domains []string) (sni, address string) {
+	sni = viper.GetString("connectivity.tls_sni")
+	if sni == "" && len(domains) > 0 {
+		sni = domains[0]
+		// http tests may fetch URLs
+		if strings.Contains(sni, "://") {
+			if u, err := url.Parse(sni); err == nil {
+				sni = u.Hostname()
+			}
+		}
+	}
+	address = directAddress
+	if address == "" && sni != "" {
+		address = net.JoinHostPort(sni, "443")
+	}
+	return sni, address
+}
+
+// inspectTLS connects to address through sd and records the certificates
+// presented in a TLS handshake for sni. Failures are recorded in the report,
+// they don't fail the test.
+func inspectTLS(sd transport.StreamDialer, address, sni string) *tlsReport {
+	start := time.Now()
+	report := &tlsReport{
+		Address: address,
+		SNI:     sni,
+		Time:    start.UTC().Truncate(time.Second),
+	}
+	defer func() { report.DurationMs = time.Since(start).Milliseconds() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsInspectTimeout)
+	defer cancel()
+	conn, err := sd.DialStream(ctx, address)
+	if err != nil {
+		report.Error = findBaseError(err).Error()
+		return report
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: sni,
+		// The chain is captured to spot interception, so it's accepted
+		// whoever issued it
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	state := tlsConn.ConnectionState()
+	report.Version = tls.VersionName(state.Version)
+	for _, cert := range state.PeerCertificates {
+		report.Certificates = append(report.Certificates, makeCertificateReport(cert))
+	}
+	return report
+}
+
+// makeCertificateReport returns the details of cert
+func makeCertificateReport(cert *x509.Certificate) certificateReport {
+	sum := sha256.Sum256(cert.Raw)
+	report := certificateReport{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		NotBefore:    cert.NotBefore.UTC(),
+		NotAfter:     cert.NotAfter.UTC(),
+		SerialNumber: cert.SerialNumber.String(),
+		SHA256:       hex.EncodeToString(sum[:]),
+	}
+	report.SANs = append(report.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		report.SANs = append(report.SANs, ip.String())
+	}
+	return report
+}
@@ -0,0 +1,85 @@
+package connectivity
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestInspectTLS(t *testing.T) {
+	var serverNames []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames = append(serverNames, hello.ServerName)
+			return nil, nil
+		},
+	}
+	// The connect only tcp tests close their connections before a handshake
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Cleanup(func() {
+		viper.Set("connectivity.inspect_tls", nil)
+		viper.Set("connectivity.tls_sni", nil)
+	})
+	viper.Set("connectivity.tls_sni", "example.com")
+
+	// The inspection is off by default
+	target := "direct://" + srv.Listener.Addr().String()
+	report, err := TestConnectivity(target, "tcp", "", []string{"example.org"})
+	if err != nil {
+		t.Fatalf("TestConnectivity() error = %v", err)
+	}
+	if report.TLS != nil || len(serverNames) != 0 {
+		t.Fatalf("TestConnectivity() inspected TLS without connectivity.inspect_tls: %+v", report.TLS)
+	}
+
+	viper.Set("connectivity.inspect_tls", true)
+	report, err = TestConnectivity(target, "tcp", "", []string{"example.org"})
+	if err != nil {
+		t.Fatalf("TestConnectivity() error = %v", err)
+	}
+	if !report.IsSuccess() {
+		t.Errorf("TestConnectivity() test = %+v, want a successful tcp test", report.Test)
+	}
+	tlsReport := report.TLS
+	if tlsReport == nil {
+		t.Fatal("TestConnectivity() report has no TLS inspection")
+	}
+	if tlsReport.Error != "" || tlsReport.SNI != "example.com" || tlsReport.Address != srv.Listener.Addr().String() {
+		t.Errorf("TLS inspection = %+v, want a handshake with the direct target for example.com", tlsReport)
+	}
+	if len(serverNames) != 1 || serverNames[0] != "example.com" {
+		t.Errorf("server got handshakes for %q, want example.com", serverNames)
+	}
+	// The self-signed test certificate isn't verified
+	if len(tlsReport.Certificates) != 1 {
+		t.Fatalf("got %d certificates, want the test certificate", len(tlsReport.Certificates))
+	}
+	cert := tlsReport.Certificates[0]
+	want := srv.Certificate()
+	if cert.Subject != want.Subject.String() || cert.Subject != "O=Acme Co" || cert.Issuer != want.Issuer.String() {
+		t.Errorf("certificate subject %q, issuer %q, want those of the test certificate", cert.Subject, cert.Issuer)
+	}
+	if !slices.Contains(cert.SANs, "example.com") || !slices.Contains(cert.SANs, "127.0.0.1") {
+		t.Errorf("certificate SANs = %v, want the names and IPs of the test certificate", cert.SANs)
+	}
+	if !cert.NotAfter.Equal(want.NotAfter) || cert.SHA256 == "" {
+		t.Errorf("certificate = %+v, want the validity and fingerprint of the test certificate", cert)
+	}
+}
+
+func TestTLSTarget(t *testing.T) {
+	sni, address := tlsTarget("", []string{"http://control.example/204"})
+	if sni != "control.example" || address != "control.example:443" {
+		t.Errorf("tlsTarget() = %q, %q, want the host of the URL on port 443", sni, address)
+	}
+}
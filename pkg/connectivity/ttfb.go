@@ -0,0 +1,109 @@
+package connectivity
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// firstByteTrace measures the time to first byte of a test: from the
+// connection to the first hop being established, as seen by the trace
+// dialers, to the first byte read over the end-to-end connection. Only the
+// first connection that gets a response is measured.
+type firstByteTrace struct {
+	mu sync.Mutex
+	// connectedAt is when the last connection to the first hop was established
+	connectedAt time.Time
+	ttfb        time.Duration
+	measured    bool
+}
+
+// connected records that a connection to the first hop was established
+func (t *firstByteTrace) connected() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connectedAt = time.Now()
+}
+
+// lastConnected returns when the last connection to the first hop was
+// established, zero if none was
+func (t *firstByteTrace) lastConnected() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connectedAt
+}
+
+// received records the first byte of a connection established at connectedAt
+func (t *firstByteTrace) received(connectedAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.measured || connectedAt.IsZero() {
+		return
+	}
+	t.ttfb = time.Since(connectedAt)
+	t.measured = true
+}
+
+// Ms returns the time to first byte in milliseconds, 0 if nothing was received
+func (t *firstByteTrace) Ms() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ttfb.Milliseconds()
+}
+
+// streamDialer wraps sd to report the first byte read on its connections
+func (t *firstByteTrace) streamDialer(sd transport.StreamDialer) transport.StreamDialer {
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		conn, err := sd.DialStream(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &firstByteStreamConn{StreamConn: conn, trace: t, connectedAt: t.lastConnected()}, nil
+	})
+}
+
+// packetDialer wraps pd to report the first byte read on its connections
+func (t *firstByteTrace) packetDialer(pd transport.PacketDialer) transport.PacketDialer {
+	return transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := pd.DialPacket(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &firstByteConn{Conn: conn, trace: t, connectedAt: t.lastConnected()}, nil
+	})
+}
+
+// firstByteStreamConn reports its first read byte to its trace
+type firstByteStreamConn struct {
+	transport.StreamConn
+	trace       *firstByteTrace
+	connectedAt time.Time
+	once        sync.Once
+}
+
+func (c *firstByteStreamConn) Read(b []byte) (int, error) {
+	n, err := c.StreamConn.Read(b)
+	if n > 0 {
+		c.once.Do(func() { c.trace.received(c.connectedAt) })
+	}
+	return n, err
+}
+
+// firstByteConn reports its first read byte to its trace
+type firstByteConn struct {
+	net.Conn
+	trace       *firstByteTrace
+	connectedAt time.Time
+	once        sync.Once
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() { c.trace.received(c.connectedAt) })
+	}
+	return n, err
+}
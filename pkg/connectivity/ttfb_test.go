@@ -0,0 +1,38 @@
+package connectivity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectivityTTFB(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The headers are sent after delay, the body after another delay
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	report, err := TestConnectivity("direct://"+srv.Listener.Addr().String(), "http", "", []string{"http://control.example/"})
+	if err != nil {
+		t.Fatalf("TestConnectivity() error = %v", err)
+	}
+	if !report.IsSuccess() {
+		t.Fatalf("TestConnectivity() test = %+v, want success", report.Test)
+	}
+
+	ttfb, duration := report.Test.TTFBMs, report.Test.DurationMs
+	if ttfb < delay.Milliseconds() {
+		t.Errorf("TTFBMs = %d, want at least the %v before the first byte", ttfb, delay)
+	}
+	// The body read after the first byte only counts in the total duration
+	if duration-ttfb < delay.Milliseconds()/2 {
+		t.Errorf("TTFBMs = %d, DurationMs = %d, want the body delay only in the duration", ttfb, duration)
+	}
+}
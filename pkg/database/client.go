@@ -9,19 +9,10 @@ import (
 	"connectivity-tester/pkg/models"
 )
 
-// InitSoaxSchema creates the SOAX clients table if it doesn't exist
+// InitClientSchema creates the clients table if it doesn't exist.
+// All tables are managed by migrations, see InitSchema.
 func (db *DB) InitClientSchema(ctx context.Context) error {
-	// Create the table if it doesn't exist
-	_, err := db.NewCreateTable().
-		Model((*models.Client)(nil)).
-		IfNotExists().
-		Exec(ctx)
-
-	if err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
-	}
-
-	return nil
+	return db.InitSchema(ctx)
 }
 
 // InsertClients inserts or updates proxy clients in the database
@@ -66,6 +57,56 @@ func (db *DB) GetActiveClientByIP(ctx context.Context, ip string) (*models.Clien
 	return &client, nil
 }
 
+// GetActiveClients returns the clients whose session hasn't expired yet
+func (db *DB) GetActiveClients(ctx context.Context) ([]models.Client, error) {
+	var clients []models.Client
+	err := db.NewSelect().
+		Model(&clients).
+		Where("expiration_time > ?", time.Now()).
+		Order("id ASC").
+		Scan(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying active clients: %v", err)
+	}
+
+	return clients, nil
+}
+
+// ClientTarget is what a client was requested for, clients of the same
+// target are interchangeable
+type ClientTarget struct {
+	Proxy      string
+	ClientType string
+	Country    string
+	ISP        string
+	// City is the requested city, empty if any city
+	City string
+}
+
+// GetActiveClientsFor returns the clients of target that stay valid past
+// validUntil and weren't located in another country, longest lived first
+func (db *DB) GetActiveClientsFor(ctx context.Context, target ClientTarget, validUntil time.Time) ([]models.Client, error) {
+	var clients []models.Client
+	err := db.NewSelect().
+		Model(&clients).
+		Where("proxy = ?", target.Proxy).
+		Where("client_type = ?", target.ClientType).
+		Where("LOWER(country_code) = LOWER(?)", target.Country).
+		Where("isp = ?", target.ISP).
+		Where("COALESCE(target_city, '') = ?", target.City).
+		Where("country_mismatch = ?", false).
+		Where("expiration_time > ?", validUntil).
+		Order("expiration_time DESC", "id ASC").
+		Scan(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying active clients of %s: %v", target.ISP, err)
+	}
+
+	return clients, nil
+}
+
 // UpdateClientExpiration updates the expiration time of a client using bun ORM
 func (db *DB) UpdateClientExpiration(ctx context.Context, clientID int64, expirationTime time.Time) error {
 	_, err := db.NewUpdate().
@@ -81,6 +122,14 @@ func (db *DB) UpdateClientExpiration(ctx context.Context, clientID int64, expira
 	return nil
 }
 
+// InsertIPChange records a change of a client's exit IP
+func (db *DB) InsertIPChange(ctx context.Context, change *models.IPChange) error {
+	if _, err := db.NewInsert().Model(change).Exec(ctx); err != nil {
+		return fmt.Errorf("failed to insert IP change: %w", err)
+	}
+	return nil
+}
+
 // GetClientsWithMissingInfo returns all clients that have missing information
 func (db *DB) GetClientsWithMissingInfo(ctx context.Context) ([]models.Client, error) {
 	var clients []models.Client
@@ -111,3 +160,27 @@ func (db *DB) UpdateClientInfo(ctx context.Context, client *models.Client) error
 
 	return nil
 }
+
+// MirrorClients copies clients of another database with their IDs, so
+// measurements referencing them can be stored here as well. Clients that
+// were already copied are updated, and the ID sequence is moved past the
+// copies so clients inserted here don't take their IDs.
+func (db *DB) MirrorClients(ctx context.Context, clients []models.Client) error {
+	if len(clients) == 0 {
+		return nil
+	}
+
+	_, err := db.NewInsert().
+		Model(&clients).
+		On("CONFLICT (id) DO UPDATE").
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error mirroring clients: %v", err)
+	}
+
+	if err := db.advanceIDSequence(ctx, "clients"); err != nil {
+		return fmt.Errorf("error mirroring clients: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestGetActiveClients(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	now := time.Now()
+	var clients []models.Client
+	for _, exp := range []time.Duration{time.Hour, -time.Minute, 10 * time.Minute, -time.Hour} {
+		clients = append(clients, models.Client{
+			IP: "198.51.100.1", ClientType: "residential", Time: now, ExpirationTime: now.Add(exp),
+			IPVersion: "v4", CountryCode: "us", CountryName: "United States", LastSeen: now, ISP: "isp", Proxy: "soax",
+			Region: "region", DetectedISP: "detected isp",
+		})
+	}
+	saved, err := db.InsertClients(ctx, clients)
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	got, err := db.GetActiveClients(ctx)
+	if err != nil {
+		t.Fatalf("GetActiveClients() error = %v", err)
+	}
+	if len(got) != 2 || got[0].ID != saved[0].ID || got[1].ID != saved[2].ID {
+		t.Errorf("GetActiveClients() = %+v, want clients %d and %d", got, saved[0].ID, saved[2].ID)
+	}
+	for _, c := range got {
+		if c.Region != "region" || c.DetectedISP != "detected isp" {
+			t.Errorf("client %d Region = %q, DetectedISP = %q", c.ID, c.Region, c.DetectedISP)
+		}
+	}
+}
+
+func TestGetActiveClientsFor(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	now := time.Now()
+	client := func(isp, country string, exp time.Duration, mismatch bool) models.Client {
+		return models.Client{
+			IP: "198.51.100.1", ClientType: "mobile", Time: now, ExpirationTime: now.Add(exp),
+			IPVersion: "v4", CountryCode: country, CountryName: "Iran", LastSeen: now, ISP: isp, Proxy: "soax",
+			CountryMismatch: mismatch,
+		}
+	}
+	saved, err := db.InsertClients(ctx, []models.Client{
+		client("MCI", "IR", 10*time.Minute, false),
+		client("MCI", "ir", time.Hour, false),
+		client("MCI", "ir", 30*time.Second, false),
+		client("MCI", "ir", time.Hour, true),
+		client("MTN", "ir", time.Hour, false),
+	})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	target := ClientTarget{Proxy: "soax", ClientType: "mobile", Country: "ir", ISP: "MCI"}
+	got, err := db.GetActiveClientsFor(ctx, target, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("GetActiveClientsFor() error = %v", err)
+	}
+	// The client expiring within a minute, the mismatched one and the
+	// other ISP's are left out
+	if len(got) != 2 || got[0].ID != saved[1].ID || got[1].ID != saved[0].ID {
+		t.Errorf("GetActiveClientsFor() = %+v, want clients %d and %d", got, saved[1].ID, saved[0].ID)
+	}
+}
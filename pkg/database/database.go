@@ -3,50 +3,176 @@ package database
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-
-	"connectivity-tester/pkg/models"
+	"io"
+	"net"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/viper"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
 	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/dialect/sqlitedialect"
 	"github.com/uptrace/bun/driver/pgdriver"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Supported values of database.driver
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
 )
 
 type DB struct {
 	*bun.DB
+	// DedupeReports stores each distinct measurement report once in the
+	// reports table, referenced by its hash, see InsertMeasurement
+	DedupeReports bool
+	// writes limits the rate of measurement inserts if set, see
+	// SetMaxWritesPerSecond
+	writes *writeLimiter
 }
 
+// NewDB connects to the database selected by database.driver. Postgres, the
+// default, is configured by the database host, port, user, password, dbname
+// and sslmode settings; SQLite opens the file in database.dsn.
 func NewDB() (*DB, error) {
+	return newDB("database")
+}
+
+// NewResultsDB connects to the results database, a separate database that
+// measurements can be written to, e.g. a shared analysis database. It's
+// configured by the results_database block, with the same settings as
+// database.
+func NewResultsDB() (*DB, error) {
+	if !viper.IsSet("results_database") {
+		return nil, fmt.Errorf("results_database is not configured")
+	}
+	return newDB("results_database")
+}
+
+// newDB connects to the database configured under key
+func newDB(key string) (*DB, error) {
+	var db *DB
+	switch driver := viper.GetString(key + ".driver"); driver {
+	case "", DriverPostgres:
+		db = newPostgresDB(key)
+	case DriverSQLite:
+		var err error
+		if db, err = OpenSQLite(viper.GetString(key + ".dsn")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %s driver %q", key, driver)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping %s: %v", key, err)
+	}
+	db.DedupeReports = viper.GetBool(key + ".dedupe_reports")
+	db.SetMaxWritesPerSecond(viper.GetInt(key + ".max_writes_per_second"))
+
+	return db, nil
+}
+
+func newPostgresDB(key string) *DB {
 	dsn := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
-		viper.GetString("database.user"),
-		viper.GetString("database.password"),
-		viper.GetString("database.host"),
-		viper.GetInt("database.port"),
-		viper.GetString("database.dbname"),
-		viper.GetString("database.sslmode"),
+		viper.GetString(key+".user"),
+		viper.GetString(key+".password"),
+		viper.GetString(key+".host"),
+		viper.GetInt(key+".port"),
+		viper.GetString(key+".dbname"),
+		viper.GetString(key+".sslmode"),
 	)
 
 	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
 
-	db := bun.NewDB(sqldb, pgdialect.New())
+	return &DB{DB: bun.NewDB(sqldb, pgdialect.New())}
+}
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %v", err)
+// OpenSQLite opens the SQLite database in dsn, a file name or ":memory:", with
+// foreign keys enforced. SQLite allows a single writer, so all queries share
+// one connection; this also keeps an in memory database alive between queries.
+func OpenSQLite(dsn string) (*DB, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("database.dsn is required for the sqlite driver")
 	}
+	if !strings.Contains(dsn, "foreign_keys") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_pragma=foreign_keys(1)"
+	}
+
+	sqldb, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+	sqldb.SetMaxOpenConns(1)
+	sqldb.SetConnMaxLifetime(0)
+	sqldb.SetConnMaxIdleTime(0)
 
-	return &DB{db}, nil
+	return &DB{DB: bun.NewDB(sqldb, sqlitedialect.New())}, nil
 }
 
-// InitSchema creates the necessary tables if they don't exist
-func (db *DB) InitSchema(ctx context.Context) error {
-	_, err := db.NewCreateTable().
-		Model((*models.Server)(nil)).
-		IfNotExists().
-		Exec(ctx)
+// IsSQLite reports whether db uses the SQLite dialect
+func (db *DB) IsSQLite() bool {
+	return db.Dialect().Name() == dialect.SQLite
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
+// IsUnavailable reports whether err is a failure to reach the database, such
+// as a refused or lost connection, a server shutting down or a busy SQLite
+// file, that may not happen once the database recovers. Errors of the
+// statement itself, e.g. constraint violations, are not.
+func IsUnavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var pgErr pgdriver.Error
+	if errors.As(err, &pgErr) {
+		code := pgErr.Field('C')
+		// Connection exceptions, insufficient resources and operator
+		// intervention such as a shutdown
+		return strings.HasPrefix(code, "08") || strings.HasPrefix(code, "53") || strings.HasPrefix(code, "57P")
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code() & 0xff
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// advanceIDSequence moves the ID sequence of table past the largest ID in
+// it, after rows were inserted with their own IDs. SQLite takes the next ID
+// from the table itself.
+func (db *DB) advanceIDSequence(ctx context.Context, table string) error {
+	if db.IsSQLite() {
+		return nil
+	}
+	_, err := db.ExecContext(ctx,
+		"SELECT setval(pg_get_serial_sequence(?, 'id'), (SELECT MAX(id) FROM ?))",
+		table, bun.Ident(table))
+	return err
+}
+
+// InitSchema creates the necessary tables if they don't exist and brings
+// existing tables up to date by applying any pending migrations
+func (db *DB) InitSchema(ctx context.Context) error {
+	if _, err := db.Migrate(ctx); err != nil {
+		return fmt.Errorf("failed to migrate schema: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// newTestDB connects to the Postgres database in TEST_DATABASE_DSN using a
+// fresh schema that is dropped when the test ends. When the variable is not
+// set, tests run against an in memory SQLite database instead.
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		db, err := OpenSQLite(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+
+	admin := bun.NewDB(sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn))), pgdialect.New())
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		admin.Close()
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	sqldb := sql.OpenDB(pgdriver.NewConnector(
+		pgdriver.WithDSN(dsn),
+		pgdriver.WithConnParams(map[string]interface{}{"search_path": schema}),
+	))
+	db := &DB{DB: bun.NewDB(sqldb, pgdialect.New())}
+
+	t.Cleanup(func() {
+		db.Close()
+		admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close()
+	})
+
+	return db
+}
+
+func TestOpenSQLite(t *testing.T) {
+	db, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	if !db.IsSQLite() {
+		t.Fatal("IsSQLite() = false, want true")
+	}
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss",
+		TransportJSON: json.RawMessage(`{"scheme":"ss"}`)}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+	// Upserting again goes through ON CONFLICT and keeps the same row
+	again := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss", ASOrg: "org"}
+	if err := db.UpsertServer(ctx, &again); err != nil {
+		t.Fatalf("second UpsertServer() error = %v", err)
+	}
+
+	// SQLite keeps the microseconds of a time, truncating the rest
+	now := time.Now().Truncate(time.Microsecond)
+	clients, err := db.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.1", ClientType: "residential", Time: now, ExpirationTime: now.Add(time.Hour),
+		IPVersion: "v4", CountryCode: "us", CountryName: "United States", LastSeen: now, ISP: "isp", Proxy: "none",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+	if clients[0].ID == 0 {
+		t.Error("InsertClients() did not return the client ID")
+	}
+
+	m := models.Measurement{
+		ClientID:   clients[0].ID,
+		ServerID:   server.ID,
+		Time:       now,
+		Protocol:   "tcp",
+		SessionID:  "session",
+		ErrorOp:    "success",
+		FullReport: json.RawMessage(`{"ok":true}`),
+	}
+	if err := db.InsertMeasurement(ctx, &m); err != nil {
+		t.Fatalf("InsertMeasurement() error = %v", err)
+	}
+
+	got, err := db.GetMeasurementsBySession(ctx, "session", 0)
+	if err != nil {
+		t.Fatalf("GetMeasurementsBySession() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("GetMeasurementsBySession() returned %d measurements, want 1", len(got))
+	}
+	if got[0].ServerID != server.ID || got[0].ErrorOp != "success" || !got[0].Time.Equal(now) {
+		t.Errorf("GetMeasurementsBySession() = %+v, want the inserted measurement", got[0])
+	}
+	if string(got[0].FullReport) != `{"ok":true}` {
+		t.Errorf("FullReport = %s, want {\"ok\":true}", got[0].FullReport)
+	}
+
+	servers, err := db.GetAllServers(ctx)
+	if err != nil {
+		t.Fatalf("GetAllServers() error = %v", err)
+	}
+	if len(servers) != 1 || servers[0].ASOrg != "org" || string(servers[0].TransportJSON) != `{"scheme":"ss"}` {
+		t.Errorf("GetAllServers() = %+v, want the upserted server with its transport JSON kept", servers)
+	}
+
+	// Removing the server cascades to its measurements
+	if err := db.RemoveServer(ctx, &servers[0]); err != nil {
+		t.Fatalf("RemoveServer() error = %v", err)
+	}
+	if count, err := db.NewSelect().Model((*models.Measurement)(nil)).Count(ctx); err != nil || count != 0 {
+		t.Errorf("measurements left after RemoveServer() = %d (err = %v), want 0", count, err)
+	}
+}
+
+func TestMigrationsCreateModelColumns(t *testing.T) {
+	db := newTestDB(t)
+	if !db.IsSQLite() {
+		t.Skip("columns are looked up in SQLite")
+	}
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	// The initial schema is frozen, the later migrations add the columns
+	// the models gained since
+	for _, model := range []interface{}{(*models.Server)(nil), (*models.Client)(nil), (*models.Measurement)(nil)} {
+		table := db.Table(reflect.TypeOf(model))
+		var columns []string
+		if err := db.NewSelect().
+			TableExpr("pragma_table_info(?)", table.Name).
+			Column("name").
+			Scan(ctx, &columns); err != nil {
+			t.Fatalf("columns of %s: %v", table.Name, err)
+		}
+		created := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			created[column] = true
+		}
+		for _, field := range table.Fields {
+			if !created[field.Name] {
+				t.Errorf("migrations don't create column %s.%s", table.Name, field.Name)
+			}
+		}
+	}
+}
+
+func TestIsUnavailable(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE unavailable_test (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO unavailable_test (id) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	_, conflict := db.ExecContext(ctx, "INSERT INTO unavailable_test (id) VALUES (1)")
+	if conflict == nil {
+		t.Fatal("inserting a duplicate key succeeded")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "reset", err: fmt.Errorf("write: %w", syscall.ECONNRESET), want: true},
+		{name: "closed", err: io.EOF, want: true},
+		{name: "constraint", err: conflict, want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		if got := IsUnavailable(tt.err); got != tt.want {
+			t.Errorf("IsUnavailable(%s: %v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+)
+
+// ErrLocked is returned by TryLock when another process holds the lock
+var ErrLocked = errors.New("lock is held by another process")
+
+// lockID maps a lock key to a Postgres advisory lock ID
+func lockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// TryLock takes the advisory lock of key without waiting for it, returning
+// ErrLocked if it's held. The lock is held on a dedicated connection until
+// unlock is called or the process exits. SQLite has no advisory locks, there
+// TryLock only logs a warning and returns a no-op unlock.
+func (db *DB) TryLock(ctx context.Context, key string) (unlock func() error, err error) {
+	if db.IsSQLite() {
+		slog.Warn("Run locks are not supported on SQLite, overlapping runs are not detected", "key", key)
+		return func() error { return nil }, nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting connection for lock: %v", err)
+	}
+
+	id := lockID(key)
+	var locked bool
+	if err := conn.NewRaw("SELECT pg_try_advisory_lock(?)", id).Scan(ctx, &locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error taking lock %s: %v", key, err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, ErrLocked
+	}
+
+	return func() error {
+		defer conn.Close()
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(?)", id); err != nil {
+			return fmt.Errorf("error releasing lock %s: %v", key, err)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTryLock(t *testing.T) {
+	db := newTestDB(t)
+	if db.IsSQLite() {
+		t.Skip("advisory locks need Postgres, set TEST_DATABASE_DSN")
+	}
+	ctx := context.Background()
+
+	unlock, err := db.TryLock(ctx, "measure/soax/ir/mobile")
+	if err != nil {
+		t.Fatalf("TryLock() error = %v", err)
+	}
+
+	// A held lock can't be taken again, other keys can
+	if _, err := db.TryLock(ctx, "measure/soax/ir/mobile"); !errors.Is(err, ErrLocked) {
+		t.Errorf("TryLock() of a held lock error = %v, want ErrLocked", err)
+	}
+	other, err := db.TryLock(ctx, "measure/soax/ru/mobile")
+	if err != nil {
+		t.Fatalf("TryLock() of another key error = %v", err)
+	}
+	other()
+
+	if err := unlock(); err != nil {
+		t.Fatalf("unlock() error = %v", err)
+	}
+	relock, err := db.TryLock(ctx, "measure/soax/ir/mobile")
+	if err != nil {
+		t.Fatalf("TryLock() after unlock error = %v", err)
+	}
+	relock()
+}
@@ -2,51 +2,427 @@ package database
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"time"
 
 	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
 )
 
-// InitMeasurementSchema creates the measurements table with foreign keys
+// InitMeasurementSchema creates the measurements table with foreign keys.
+// All tables are managed by migrations, see InitSchema.
 func (db *DB) InitMeasurementSchema(ctx context.Context) error {
-	_, err := db.NewCreateTable().
-		Model((*models.Measurement)(nil)).
-		IfNotExists().
-		ForeignKey(`("client_id") REFERENCES clients ("id") ON DELETE CASCADE`).
-		ForeignKey(`("server_id") REFERENCES servers ("id") ON DELETE CASCADE`).
-		Exec(ctx)
+	return db.InitSchema(ctx)
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to create measurements table: %v", err)
+// InsertMeasurement stores a measurement. With DedupeReports set its report
+// is stored in the reports table under its hash, unless a report with the
+// same hash is stored already, and the measurement references it. Inserts
+// beyond the limit of SetMaxWritesPerSecond wait for their turn. Errors wrap
+// the driver's, so IsUnavailable can tell an unreachable database.
+func (db *DB) InsertMeasurement(ctx context.Context, measurement *models.Measurement) error {
+	if err := db.writes.wait(ctx); err != nil {
+		return fmt.Errorf("error inserting measurement: %w", err)
 	}
 
-	return nil
-}
+	if !db.DedupeReports || len(measurement.FullReport) == 0 {
+		_, err := db.NewInsert().
+			Model(measurement).
+			Exec(ctx)
 
-func (db *DB) InsertMeasurement(ctx context.Context, measurement *models.Measurement) error {
-	_, err := db.NewInsert().
-		Model(measurement).
-		Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("error inserting measurement: %w", err)
+		}
+		return nil
+	}
+
+	sum := sha256.Sum256(measurement.FullReport)
+	report := &models.Report{Hash: hex.EncodeToString(sum[:]), Report: measurement.FullReport}
 
+	// The measurement is inserted without its report, which is kept in memory
+	stored := *measurement
+	stored.FullReport = nil
+	stored.ReportHash = report.Hash
+
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().
+			Model(report).
+			On("CONFLICT (hash) DO NOTHING").
+			Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewInsert().
+			Model(&stored).
+			Exec(ctx)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error inserting measurement: %v", err)
+		return fmt.Errorf("error inserting measurement: %w", err)
 	}
 
+	measurement.ID = stored.ID
+	measurement.ReportHash = stored.ReportHash
 	return nil
 }
 
+// restoreReports sets the full report of measurements whose report was
+// deduplicated from the joined Report relation
+func restoreReports(measurements []models.Measurement) {
+	for i := range measurements {
+		if m := &measurements[i]; m.Report != nil && len(m.FullReport) == 0 {
+			m.FullReport = m.Report.Report
+		}
+	}
+}
+
 // Add this helper method to the MeasurementService
 func (db *DB) GetMeasurementsBySession(ctx context.Context, sessionID string, retryNumber int) ([]models.Measurement, error) {
 	var measurements []models.Measurement
 	err := db.NewSelect().
 		Model(&measurements).
-		Where("session_id = ?", sessionID).
-		Where("retry_number = ?", retryNumber).
+		Relation("Report").
+		Where("m.session_id = ?", sessionID).
+		Where("m.retry_number = ?", retryNumber).
 		Scan(ctx)
 
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving measurements: %v", err)
 	}
+	restoreReports(measurements)
 
 	return measurements, nil
 }
+
+// GetMeasurementsByRun returns the measurements of a run with their client
+// and server, in the order they were taken
+func (db *DB) GetMeasurementsByRun(ctx context.Context, runID string) ([]models.Measurement, error) {
+	var measurements []models.Measurement
+	err := db.NewSelect().
+		Model(&measurements).
+		Relation("Client").
+		Relation("Server").
+		Relation("Report").
+		Where("m.run_id = ?", runID).
+		Order("m.time ASC", "m.id ASC").
+		Scan(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving measurements of run %s: %v", runID, err)
+	}
+	restoreReports(measurements)
+
+	return measurements, nil
+}
+
+// GetMeasurement returns a measurement with its client and server
+func (db *DB) GetMeasurement(ctx context.Context, id int64) (*models.Measurement, error) {
+	measurement := new(models.Measurement)
+	err := db.NewSelect().
+		Model(measurement).
+		Relation("Client").
+		Relation("Server").
+		Relation("Report").
+		Where("m.id = ?", id).
+		Scan(ctx)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("measurement %d not found", id)
+		}
+		return nil, fmt.Errorf("error retrieving measurement %d: %v", id, err)
+	}
+	if measurement.Report != nil && len(measurement.FullReport) == 0 {
+		measurement.FullReport = measurement.Report.Report
+	}
+
+	return measurement, nil
+}
+
+// RunSummary describes a measurement run
+type RunSummary struct {
+	RunID        string    `bun:"run_id"`
+	Start        time.Time `bun:"start"`
+	End          time.Time `bun:"end"`
+	Measurements int       `bun:"measurements"`
+}
+
+// ListRuns returns a page of runs, the most recent first. Measurements taken
+// before runs were recorded have no run and are not included.
+func (db *DB) ListRuns(ctx context.Context, limit, offset int) ([]RunSummary, error) {
+	var runs []RunSummary
+	err := db.NewSelect().
+		TableExpr("measurement AS m").
+		ColumnExpr("m.run_id").
+		ColumnExpr("MIN(m.time) AS start").
+		ColumnExpr("MAX(m.time) AS \"end\"").
+		ColumnExpr("COUNT(*) AS measurements").
+		Where("m.run_id IS NOT NULL AND m.run_id != ''").
+		GroupExpr("m.run_id").
+		OrderExpr("start DESC").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx, &runs)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing runs: %v", err)
+	}
+
+	return runs, nil
+}
+
+// MeasurementFilter selects the measurements of ListMeasurements, zero
+// fields don't filter
+type MeasurementFilter struct {
+	RunID    string
+	ServerID int64
+}
+
+// ListMeasurements returns a page of measurements in the order they were taken
+func (db *DB) ListMeasurements(ctx context.Context, filter MeasurementFilter, limit, offset int) ([]models.Measurement, error) {
+	var measurements []models.Measurement
+	q := db.NewSelect().Model(&measurements).Relation("Report")
+
+	if filter.RunID != "" {
+		q = q.Where("m.run_id = ?", filter.RunID)
+	}
+	if filter.ServerID != 0 {
+		q = q.Where("m.server_id = ?", filter.ServerID)
+	}
+
+	err := q.
+		Order("m.time ASC", "m.id ASC").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing measurements: %v", err)
+	}
+	restoreReports(measurements)
+
+	return measurements, nil
+}
+
+// ServerSuccessSummary is the success rate of a server for a protocol from
+// the clients of one country and ASN
+type ServerSuccessSummary struct {
+	Protocol     string  `bun:"protocol"`
+	CountryCode  string  `bun:"country_code"`
+	ASNumber     string  `bun:"as_number"`
+	ASOrg        string  `bun:"as_org"`
+	Measurements int     `bun:"measurements"`
+	Successes    int     `bun:"successes"`
+	SuccessRate  float64 `bun:"success_rate"` // Successes / Measurements, from 0 to 1
+}
+
+// GetServerSuccessSummary returns the success rates of a server per protocol,
+// client country and ASN. Only the initial attempt of each measurement
+// session counts, retries with prefixes would inflate the failures. Skipped
+// tests don't count either.
+func (db *DB) GetServerSuccessSummary(ctx context.Context, serverID int64) ([]ServerSuccessSummary, error) {
+	var summary []ServerSuccessSummary
+	err := db.NewSelect().
+		TableExpr("measurement AS m").
+		Join("JOIN clients AS sc ON sc.id = m.client_id").
+		ColumnExpr("m.protocol").
+		ColumnExpr("sc.country_code").
+		ColumnExpr("COALESCE(sc.as_number, '') AS as_number").
+		ColumnExpr("COALESCE(MAX(sc.as_org), '') AS as_org").
+		ColumnExpr("COUNT(*) AS measurements").
+		ColumnExpr("SUM(CASE WHEN m.error_op = 'success' THEN 1 ELSE 0 END) AS successes").
+		ColumnExpr("SUM(CASE WHEN m.error_op = 'success' THEN 1.0 ELSE 0.0 END) / COUNT(*) AS success_rate").
+		Where("m.server_id = ?", serverID).
+		Where("m.retry_number = 0").
+		Where("COALESCE(m.error_op, '') != 'skipped'").
+		GroupExpr("m.protocol, sc.country_code, COALESCE(sc.as_number, '')").
+		OrderExpr("m.protocol, sc.country_code, as_number").
+		Scan(ctx, &summary)
+
+	if err != nil {
+		return nil, fmt.Errorf("error summarizing measurements of server %d: %v", serverID, err)
+	}
+
+	return summary, nil
+}
+
+// PrefixMatrixCell is the prefix that worked best for a server from the
+// clients of one country and ASN in a run
+type PrefixMatrixCell struct {
+	ServerID    int64  `bun:"server_id" json:"server_id"`
+	ServerIP    string `bun:"server_ip" json:"server_ip"`
+	CountryCode string `bun:"country_code" json:"country"`
+	ASNumber    string `bun:"as_number" json:"asn"`
+	ASOrg       string `bun:"as_org" json:"as_org"`
+	Prefix      string `bun:"prefix" json:"prefix"`
+	// Attempts and Successes count the measurements with the prefix
+	Attempts    int     `bun:"attempts" json:"attempts"`
+	Successes   int     `bun:"successes" json:"successes"`
+	SuccessRate float64 `bun:"success_rate" json:"success_rate"`
+	// WorkingPrefixes counts the prefixes that succeeded at least once
+	WorkingPrefixes int `bun:"working_prefixes" json:"working_prefixes"`
+}
+
+// GetPrefixMatrix returns the winning prefix of each server, client country
+// and ASN of a run: the prefix with the most successful measurements, ties
+// going to the higher success rate and then to the first prefix in order.
+// Cells where no prefix succeeded are left out.
+func (db *DB) GetPrefixMatrix(ctx context.Context, runID string) ([]PrefixMatrixCell, error) {
+	perPrefix := db.NewSelect().
+		TableExpr("measurement AS m").
+		Join("JOIN clients AS sc ON sc.id = m.client_id").
+		Join("JOIN servers AS ss ON ss.id = m.server_id").
+		ColumnExpr("m.server_id").
+		ColumnExpr("MAX(ss.ip) AS server_ip").
+		ColumnExpr("COALESCE(sc.country_code, '') AS country_code").
+		ColumnExpr("COALESCE(sc.as_number, '') AS as_number").
+		ColumnExpr("COALESCE(MAX(sc.as_org), '') AS as_org").
+		ColumnExpr("m.prefix_used AS prefix").
+		ColumnExpr("COUNT(*) AS attempts").
+		ColumnExpr("SUM(CASE WHEN m.error_op = 'success' THEN 1 ELSE 0 END) AS successes").
+		ColumnExpr("SUM(CASE WHEN m.error_op = 'success' THEN 1.0 ELSE 0.0 END) / COUNT(*) AS success_rate").
+		Where("m.run_id = ?", runID).
+		Where("COALESCE(m.prefix_used, '') != ''").
+		GroupExpr("m.server_id, COALESCE(sc.country_code, ''), COALESCE(sc.as_number, ''), m.prefix_used")
+
+	ranked := db.NewSelect().
+		TableExpr("(?) AS p", perPrefix).
+		ColumnExpr("p.*").
+		ColumnExpr("ROW_NUMBER() OVER (PARTITION BY p.server_id, p.country_code, p.as_number ORDER BY p.successes DESC, p.success_rate DESC, p.prefix) AS rn").
+		ColumnExpr("SUM(CASE WHEN p.successes > 0 THEN 1 ELSE 0 END) OVER (PARTITION BY p.server_id, p.country_code, p.as_number) AS working_prefixes")
+
+	var cells []PrefixMatrixCell
+	err := db.NewSelect().
+		TableExpr("(?) AS r", ranked).
+		ColumnExpr("r.server_id, r.server_ip, r.country_code, r.as_number, r.as_org").
+		ColumnExpr("r.prefix, r.attempts, r.successes, r.success_rate, r.working_prefixes").
+		Where("r.rn = 1").
+		Where("r.successes > 0").
+		OrderExpr("r.server_id, r.country_code, r.as_number").
+		Scan(ctx, &cells)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting prefix matrix of run %s: %v", runID, err)
+	}
+
+	return cells, nil
+}
+
+// CoverageGap is an ISP, server and protocol of a run that was measured by
+// too few clients or never succeeded
+type CoverageGap struct {
+	ISP      string `bun:"isp" json:"isp"`
+	ServerID int64  `bun:"server_id" json:"server_id"`
+	ServerIP string `bun:"server_ip" json:"server_ip"`
+	Protocol string `bun:"protocol" json:"protocol"`
+	// Clients counts the clients of the ISP that measured the server,
+	// skipped tests left out
+	Clients   int `bun:"clients" json:"clients"`
+	Successes int `bun:"successes" json:"successes"`
+}
+
+// GetCoverageGaps diffs the intended measurements of a run against the
+// recorded ones. The intended matrix is every ISP of the run's clients,
+// every protocol measured in the run, and the servers of serverIDs, or the
+// servers measured in the run if it's empty. A combination is a gap if fewer
+// than clientsPerISP clients measured it or none of its measurements,
+// retries included, succeeded.
+func (db *DB) GetCoverageGaps(ctx context.Context, runID string, serverIDs []int64, clientsPerISP int) ([]CoverageGap, error) {
+	isps := db.NewSelect().
+		TableExpr("measurement AS m").
+		Join("JOIN clients AS sc ON sc.id = m.client_id").
+		ColumnExpr("DISTINCT COALESCE(sc.isp, '') AS isp").
+		Where("m.run_id = ?", runID)
+
+	protocols := db.NewSelect().
+		TableExpr("measurement AS m").
+		ColumnExpr("DISTINCT m.protocol").
+		Where("m.run_id = ?", runID)
+
+	servers := db.NewSelect().
+		TableExpr("servers AS ss").
+		ColumnExpr("ss.id AS server_id").
+		ColumnExpr("ss.ip AS server_ip")
+	if len(serverIDs) > 0 {
+		servers = servers.Where("ss.id IN (?)", bun.In(serverIDs))
+	} else {
+		servers = servers.Where("ss.id IN (SELECT m.server_id FROM measurement AS m WHERE m.run_id = ?)", runID)
+	}
+
+	measured := db.NewSelect().
+		TableExpr("measurement AS m").
+		Join("JOIN clients AS sc ON sc.id = m.client_id").
+		ColumnExpr("COALESCE(sc.isp, '') AS isp").
+		ColumnExpr("m.server_id").
+		ColumnExpr("m.protocol").
+		ColumnExpr("COUNT(DISTINCT m.client_id) AS clients").
+		ColumnExpr("SUM(CASE WHEN m.error_op = 'success' THEN 1 ELSE 0 END) AS successes").
+		Where("m.run_id = ?", runID).
+		Where("COALESCE(m.error_op, '') != 'skipped'").
+		GroupExpr("COALESCE(sc.isp, ''), m.server_id, m.protocol")
+
+	var gaps []CoverageGap
+	err := db.NewSelect().
+		TableExpr("(?) AS i", isps).
+		Join("CROSS JOIN (?) AS s", servers).
+		Join("CROSS JOIN (?) AS p", protocols).
+		Join("LEFT JOIN (?) AS c ON c.isp = i.isp AND c.server_id = s.server_id AND c.protocol = p.protocol", measured).
+		ColumnExpr("i.isp, s.server_id, s.server_ip, p.protocol").
+		ColumnExpr("COALESCE(c.clients, 0) AS clients").
+		ColumnExpr("COALESCE(c.successes, 0) AS successes").
+		Where("(COALESCE(c.clients, 0) < ? OR COALESCE(c.successes, 0) = 0)", clientsPerISP).
+		OrderExpr("i.isp, s.server_id, p.protocol").
+		Scan(ctx, &gaps)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting coverage gaps of run %s: %v", runID, err)
+	}
+
+	return gaps, nil
+}
+
+// ServerProxySuccessRate is the success rate of a server from the clients of
+// a proxy provider over its most recent measurements
+type ServerProxySuccessRate struct {
+	ServerID     int64   `bun:"server_id"`
+	Measurements int     `bun:"measurements"`
+	Successes    int     `bun:"successes"`
+	SuccessRate  float64 `bun:"success_rate"` // Successes / Measurements, from 0 to 1
+}
+
+// GetServerProxySuccessRates returns the success rate of each server over its
+// last window measurements from clients of proxy. Like
+// GetServerSuccessSummary only the initial attempts count. Servers without
+// measurements from the provider are left out.
+func (db *DB) GetServerProxySuccessRates(ctx context.Context, proxy string, window int) ([]ServerProxySuccessRate, error) {
+	recent := db.NewSelect().
+		TableExpr("measurement AS m").
+		Join("JOIN clients AS sc ON sc.id = m.client_id").
+		ColumnExpr("m.server_id").
+		ColumnExpr("m.error_op").
+		ColumnExpr("ROW_NUMBER() OVER (PARTITION BY m.server_id ORDER BY m.time DESC, m.id DESC) AS rn").
+		Where("sc.proxy = ?", proxy).
+		Where("m.retry_number = 0").
+		Where("COALESCE(m.error_op, '') != 'skipped'")
+
+	var rates []ServerProxySuccessRate
+	err := db.NewSelect().
+		TableExpr("(?) AS recent", recent).
+		ColumnExpr("recent.server_id").
+		ColumnExpr("COUNT(*) AS measurements").
+		ColumnExpr("SUM(CASE WHEN recent.error_op = 'success' THEN 1 ELSE 0 END) AS successes").
+		ColumnExpr("SUM(CASE WHEN recent.error_op = 'success' THEN 1.0 ELSE 0.0 END) / COUNT(*) AS success_rate").
+		Where("recent.rn <= ?", window).
+		GroupExpr("recent.server_id").
+		OrderExpr("recent.server_id").
+		Scan(ctx, &rates)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting success rates of servers from %s clients: %v", proxy, err)
+	}
+
+	return rates, nil
+}
@@ -0,0 +1,405 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestListRunsAndMeasurements(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+	now := time.Now()
+	clients, err := db.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.1", ClientType: "residential", Time: now, ExpirationTime: now.Add(time.Hour),
+		IPVersion: "v4", CountryCode: "us", CountryName: "United States", LastSeen: now, ISP: "isp", Proxy: "none",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	for i, runID := range []string{"old", "old", "new", ""} {
+		m := models.Measurement{
+			ClientID: clients[0].ID,
+			ServerID: server.ID,
+			Time:     now.Add(time.Duration(i) * time.Minute),
+			Protocol: "tcp",
+			RunID:    runID,
+		}
+		if err := db.InsertMeasurement(ctx, &m); err != nil {
+			t.Fatalf("InsertMeasurement() error = %v", err)
+		}
+	}
+
+	runs, err := db.ListRuns(ctx, 10, 0)
+	if err != nil {
+		t.Fatalf("ListRuns() error = %v", err)
+	}
+	if len(runs) != 2 || runs[0].RunID != "new" || runs[1].RunID != "old" || runs[1].Measurements != 2 {
+		t.Errorf("ListRuns() = %+v, want new then old with 2 measurements", runs)
+	}
+
+	measurements, err := db.ListMeasurements(ctx, MeasurementFilter{RunID: "old"}, 1, 1)
+	if err != nil {
+		t.Fatalf("ListMeasurements() error = %v", err)
+	}
+	if len(measurements) != 1 || measurements[0].RunID != "old" {
+		t.Errorf("ListMeasurements() = %+v, want the second measurement of run old", measurements)
+	}
+
+	measurements, err = db.ListMeasurements(ctx, MeasurementFilter{ServerID: server.ID}, 10, 0)
+	if err != nil {
+		t.Fatalf("ListMeasurements() error = %v", err)
+	}
+	if len(measurements) != 4 {
+		t.Errorf("ListMeasurements() for server = %d measurements, want 4", len(measurements))
+	}
+
+	m, err := db.GetMeasurement(ctx, measurements[2].ID)
+	if err != nil {
+		t.Fatalf("GetMeasurement() error = %v", err)
+	}
+	if m.RunID != "new" || m.Client == nil || m.Client.ISP != "isp" || m.Server == nil || m.Server.IP != "192.0.2.1" {
+		t.Errorf("GetMeasurement() = %+v, want the measurement of run new with its client and server", m)
+	}
+	if _, err := db.GetMeasurement(ctx, 999); err == nil {
+		t.Error("GetMeasurement() of a missing measurement succeeded, want error")
+	}
+}
+
+func TestGetServerSuccessSummary(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+	now := time.Now()
+	newClient := func(ip, asn, org string) models.Client {
+		return models.Client{
+			IP: ip, ClientType: "mobile", Time: now, ExpirationTime: now.Add(time.Hour), IPVersion: "v4",
+			CountryCode: "ir", CountryName: "Iran", ASNumber: asn, ASOrg: org, LastSeen: now, ISP: org, Proxy: "soax",
+		}
+	}
+	clients, err := db.InsertClients(ctx, []models.Client{
+		newClient("198.51.100.1", "44244", "Iran Cell"),
+		newClient("198.51.100.2", "197207", "MCI"),
+	})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	// 9 of 10 succeed from Iran Cell, 1 of 10 from MCI
+	for i := 0; i < 10; i++ {
+		for _, c := range []struct {
+			client  models.Client
+			success bool
+		}{
+			{clients[0], i < 9},
+			{clients[1], i < 1},
+		} {
+			m := models.Measurement{ClientID: c.client.ID, ServerID: server.ID, Time: now, Protocol: "tcp", ErrorOp: "receive"}
+			if c.success {
+				m.ErrorOp = "success"
+			}
+			if err := db.InsertMeasurement(ctx, &m); err != nil {
+				t.Fatalf("InsertMeasurement() error = %v", err)
+			}
+		}
+	}
+	// Retries don't count
+	retry := models.Measurement{ClientID: clients[1].ID, ServerID: server.ID, Time: now, Protocol: "tcp", RetryNumber: 1, ErrorOp: "success"}
+	if err := db.InsertMeasurement(ctx, &retry); err != nil {
+		t.Fatalf("InsertMeasurement() error = %v", err)
+	}
+
+	summary, err := db.GetServerSuccessSummary(ctx, server.ID)
+	if err != nil {
+		t.Fatalf("GetServerSuccessSummary() error = %v", err)
+	}
+
+	want := map[string]float64{"44244": 0.9, "197207": 0.1}
+	if len(summary) != len(want) {
+		t.Fatalf("GetServerSuccessSummary() = %+v, want one row per ASN", summary)
+	}
+	for _, s := range summary {
+		if s.Protocol != "tcp" || s.CountryCode != "ir" || s.Measurements != 10 {
+			t.Errorf("unexpected summary row %+v", s)
+		}
+		if diff := s.SuccessRate - want[s.ASNumber]; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("success rate of AS%s = %v, want %v", s.ASNumber, s.SuccessRate, want[s.ASNumber])
+		}
+	}
+}
+
+func TestGetPrefixMatrix(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+	now := time.Now()
+	newClient := func(ip, asn, org string) models.Client {
+		return models.Client{
+			IP: ip, ClientType: "mobile", Time: now, ExpirationTime: now.Add(time.Hour), IPVersion: "v4",
+			CountryCode: "ir", CountryName: "Iran", ASNumber: asn, ASOrg: org, LastSeen: now, ISP: org, Proxy: "soax",
+		}
+	}
+	clients, err := db.InsertClients(ctx, []models.Client{
+		newClient("198.51.100.1", "44244", "Iran Cell"),
+		newClient("198.51.100.2", "197207", "MCI"),
+	})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	insert := func(runID string, client models.Client, prefix string, success bool) {
+		t.Helper()
+		m := models.Measurement{
+			RunID: runID, ClientID: client.ID, ServerID: server.ID, Time: now,
+			Protocol: "tcp", PrefixUsed: prefix, ErrorOp: "receive",
+		}
+		if success {
+			m.ErrorOp = "success"
+		}
+		if err := db.InsertMeasurement(ctx, &m); err != nil {
+			t.Fatalf("InsertMeasurement() error = %v", err)
+		}
+	}
+	// Iran Cell: HTTP%2F1.1 works twice, POST once
+	insert("run-1", clients[0], "HTTP%2F1.1", true)
+	insert("run-1", clients[0], "HTTP%2F1.1", true)
+	insert("run-1", clients[0], "POST", true)
+	insert("run-1", clients[0], "POST", false)
+	// MCI: POST and HTTP%2F1.1 tie on successes, POST has the better rate
+	insert("run-1", clients[1], "HTTP%2F1.1", true)
+	insert("run-1", clients[1], "HTTP%2F1.1", false)
+	insert("run-1", clients[1], "POST", true)
+	// Unprefixed measurements and other runs don't count
+	insert("run-1", clients[1], "", true)
+	insert("run-1", clients[1], "", true)
+	insert("run-2", clients[1], "HTTP%2F1.1", true)
+	insert("run-2", clients[1], "HTTP%2F1.1", true)
+
+	cells, err := db.GetPrefixMatrix(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("GetPrefixMatrix() error = %v", err)
+	}
+
+	want := map[string]PrefixMatrixCell{
+		"44244":  {Prefix: "HTTP%2F1.1", Attempts: 2, Successes: 2, WorkingPrefixes: 2},
+		"197207": {Prefix: "POST", Attempts: 1, Successes: 1, WorkingPrefixes: 2},
+	}
+	if len(cells) != len(want) {
+		t.Fatalf("GetPrefixMatrix() = %+v, want one cell per ASN", cells)
+	}
+	for _, c := range cells {
+		w := want[c.ASNumber]
+		if c.ServerID != server.ID || c.ServerIP != server.IP || c.CountryCode != "ir" {
+			t.Errorf("unexpected cell %+v", c)
+		}
+		if c.Prefix != w.Prefix || c.Attempts != w.Attempts || c.Successes != w.Successes || c.WorkingPrefixes != w.WorkingPrefixes {
+			t.Errorf("cell of AS%s = %+v, want prefix %s with %d/%d successes and %d working prefixes",
+				c.ASNumber, c, w.Prefix, w.Successes, w.Attempts, w.WorkingPrefixes)
+		}
+	}
+
+	empty, err := db.GetPrefixMatrix(ctx, "missing")
+	if err != nil {
+		t.Fatalf("GetPrefixMatrix() error = %v", err)
+	}
+	if len(empty) != 0 {
+		t.Errorf("GetPrefixMatrix() of unknown run = %+v, want none", empty)
+	}
+}
+
+func TestGetCoverageGaps(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	var servers []models.Server
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		server := models.Server{IP: ip, Port: "443", FullAccessLink: "ss://" + ip + ":443", Scheme: "ss"}
+		if err := db.UpsertServer(ctx, &server); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+		servers = append(servers, server)
+	}
+	a, b, c := servers[0], servers[1], servers[2]
+	now := time.Now()
+	newClient := func(ip, isp string) models.Client {
+		return models.Client{
+			IP: ip, ClientType: "mobile", Time: now, ExpirationTime: now.Add(time.Hour), IPVersion: "v4",
+			CountryCode: "ir", CountryName: "Iran", LastSeen: now, ISP: isp, Proxy: "soax",
+		}
+	}
+	clients, err := db.InsertClients(ctx, []models.Client{
+		newClient("198.51.100.1", "MCI"),
+		newClient("198.51.100.2", "MCI"),
+		newClient("198.51.100.3", "Irancell"),
+	})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+	mci1, mci2, irancell := clients[0], clients[1], clients[2]
+
+	insert := func(runID string, client models.Client, server models.Server, protocol string, retry int, errorOp string) {
+		t.Helper()
+		m := models.Measurement{
+			RunID: runID, ClientID: client.ID, ServerID: server.ID, Time: now,
+			Protocol: protocol, RetryNumber: retry, ErrorOp: errorOp,
+		}
+		if err := db.InsertMeasurement(ctx, &m); err != nil {
+			t.Fatalf("InsertMeasurement() error = %v", err)
+		}
+	}
+	insert("run-1", mci1, a, "tcp", 0, "success")
+	insert("run-1", mci1, a, "udp", 0, "receive")
+	insert("run-1", mci1, b, "tcp", 0, "connect")
+	insert("run-1", mci2, a, "tcp", 0, "success")
+	insert("run-1", mci2, a, "udp", 0, "receive")
+	insert("run-1", irancell, a, "tcp", 0, "receive")
+	// A successful retry covers the server
+	insert("run-1", irancell, a, "tcp", 1, "success")
+	insert("run-1", irancell, a, "udp", 0, "success")
+	// Skipped tests and other runs don't cover anything
+	insert("run-1", irancell, b, "tcp", 0, "skipped")
+	insert("run-2", irancell, b, "tcp", 0, "success")
+
+	type gap struct {
+		isp      string
+		serverID int64
+		protocol string
+	}
+	gapsOf := func(serverIDs []int64, clientsPerISP int) []gap {
+		t.Helper()
+		got, err := db.GetCoverageGaps(ctx, "run-1", serverIDs, clientsPerISP)
+		if err != nil {
+			t.Fatalf("GetCoverageGaps() error = %v", err)
+		}
+		var gaps []gap
+		for _, g := range got {
+			gaps = append(gaps, gap{g.ISP, g.ServerID, g.Protocol})
+		}
+		return gaps
+	}
+
+	want := []gap{
+		{"Irancell", b.ID, "tcp"}, {"Irancell", b.ID, "udp"},
+		{"MCI", a.ID, "udp"}, {"MCI", b.ID, "tcp"}, {"MCI", b.ID, "udp"},
+	}
+	if got := gapsOf(nil, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetCoverageGaps() = %v, want %v", got, want)
+	}
+
+	// Irancell has a single client
+	want = []gap{
+		{"Irancell", a.ID, "tcp"}, {"Irancell", a.ID, "udp"},
+		{"MCI", a.ID, "udp"},
+	}
+	if got := gapsOf([]int64{a.ID}, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetCoverageGaps() of server A with 2 clients per ISP = %v, want %v", got, want)
+	}
+
+	// An intended server that was never measured is a gap everywhere
+	want = []gap{
+		{"Irancell", c.ID, "tcp"}, {"Irancell", c.ID, "udp"},
+		{"MCI", a.ID, "udp"}, {"MCI", c.ID, "tcp"}, {"MCI", c.ID, "udp"},
+	}
+	if got := gapsOf([]int64{a.ID, c.ID}, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetCoverageGaps() of servers A and C = %v, want %v", got, want)
+	}
+}
+
+func TestInsertMeasurementDedupeReports(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+	db.DedupeReports = true
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+	now := time.Now()
+	clients, err := db.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.1", ClientType: "residential", Time: now, ExpirationTime: now.Add(time.Hour),
+		IPVersion: "v4", CountryCode: "us", CountryName: "United States", LastSeen: now, ISP: "isp", Proxy: "none",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	report := json.RawMessage(`{"test":{"error":{"op":"resolve","msg":"no such host"}}}`)
+	for retry := 0; retry < 2; retry++ {
+		m := models.Measurement{
+			ClientID:    clients[0].ID,
+			ServerID:    server.ID,
+			Time:        now,
+			Protocol:    "tcp",
+			RunID:       "run",
+			RetryNumber: retry,
+			FullReport:  report,
+		}
+		if err := db.InsertMeasurement(ctx, &m); err != nil {
+			t.Fatalf("InsertMeasurement() error = %v", err)
+		}
+	}
+
+	// One blob is stored, referenced by both measurements
+	var reports []models.Report
+	if err := db.NewSelect().Model(&reports).Scan(ctx); err != nil {
+		t.Fatalf("failed to select reports: %v", err)
+	}
+	if len(reports) != 1 || string(reports[0].Report) != string(report) {
+		t.Fatalf("stored reports = %+v, want the report once", reports)
+	}
+	inline, err := db.NewSelect().
+		Model((*models.Measurement)(nil)).
+		Where("report_hash = ?", reports[0].Hash).
+		Where("full_report IS NULL").
+		Count(ctx)
+	if err != nil || inline != 2 {
+		t.Errorf("measurements referencing the report = %d, %v, want 2", inline, err)
+	}
+
+	// Reads join the report back
+	measurements, err := db.GetMeasurementsByRun(ctx, "run")
+	if err != nil {
+		t.Fatalf("GetMeasurementsByRun() error = %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("GetMeasurementsByRun() returned %d measurements, want 2", len(measurements))
+	}
+	for _, m := range measurements {
+		if string(m.FullReport) != string(report) {
+			t.Errorf("measurement %d FullReport = %s, want %s", m.ID, m.FullReport, report)
+		}
+	}
+}
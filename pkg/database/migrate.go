@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"connectivity-tester/pkg/database/migrations"
+
+	"github.com/uptrace/bun/migrate"
+)
+
+func (db *DB) newMigrator() *migrate.Migrator {
+	return migrate.NewMigrator(db.DB, migrations.Migrations)
+}
+
+// Migrate applies all pending schema migrations and returns the group of
+// migrations that was applied. The group is empty if the schema is up to date.
+func (db *DB) Migrate(ctx context.Context) (*migrate.MigrationGroup, error) {
+	migrator := db.newMigrator()
+
+	if err := migrator.Init(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create migration tables: %v", err)
+	}
+
+	if err := migrator.Lock(ctx); err != nil {
+		return nil, fmt.Errorf("failed to lock migrations: %v", err)
+	}
+	defer migrator.Unlock(ctx)
+
+	group, err := migrator.Migrate(ctx)
+	if err != nil {
+		return group, fmt.Errorf("failed to apply migrations: %v", err)
+	}
+
+	if !group.IsZero() {
+		slog.Default().Info("Applied database migrations", "group", group.String())
+	}
+
+	return group, nil
+}
+
+// MigrationStatus returns all known migrations along with whether, and in
+// which group, they have been applied
+func (db *DB) MigrationStatus(ctx context.Context) (migrate.MigrationSlice, error) {
+	migrator := db.newMigrator()
+
+	if err := migrator.Init(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create migration tables: %v", err)
+	}
+
+	ms, err := migrator.MigrationsWithStatus(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration status: %v", err)
+	}
+
+	return ms, nil
+}
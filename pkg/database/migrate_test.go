@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"connectivity-tester/pkg/database/migrations"
+)
+
+func TestMigrate(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	want := len(migrations.Migrations.Sorted())
+
+	group, err := db.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if group.ID != 1 || len(group.Migrations) != want {
+		t.Errorf("Migrate() applied %s, want group #1 with %d migrations", group, want)
+	}
+
+	var versions int
+	if err := db.NewSelect().Table("bun_migrations").ColumnExpr("count(*)").Scan(ctx, &versions); err != nil {
+		t.Fatalf("failed to count applied migrations: %v", err)
+	}
+	if versions != want {
+		t.Errorf("bun_migrations has %d rows, want %d", versions, want)
+	}
+
+	// Running again on an up to date schema must be a no-op
+	group, err = db.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("second Migrate() error = %v", err)
+	}
+	if !group.IsZero() {
+		t.Errorf("second Migrate() applied %s, want nothing", group)
+	}
+
+	ms, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatalf("MigrationStatus() error = %v", err)
+	}
+	for _, m := range ms {
+		if !m.IsApplied() {
+			t.Errorf("migration %s_%s is not applied", m.Name, m.Comment)
+		}
+	}
+
+	// The tables managed by migrations must exist
+	for _, table := range []string{"servers", "clients", "measurement"} {
+		if _, err := db.NewSelect().Table(table).Count(ctx); err != nil {
+			t.Errorf("table %s was not created (err = %v)", table, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// The initial schema matches the tables created by the Init*Schema functions
+// before migrations were introduced, so it is a no-op on existing databases.
+// The tables are frozen here as they were then, columns added to the models
+// since are added by the later migrations.
+
+type initialServer struct {
+	bun.BaseModel `bun:"table:servers"`
+
+	ID             int64  `bun:",pk,autoincrement"`
+	IP             string `bun:",unique:servers_ip_full_access_link_key,notnull"`
+	Port           string `bun:",notnull"`
+	UserInfo       string `bun:",notnull"`
+	FullAccessLink string `bun:",unique:servers_ip_full_access_link_key,notnull"`
+	Name           string
+	Fragment       string
+	Scheme         string `bun:",notnull"`
+	DomainName     string `bun:",notnull"`
+	IPType         string
+	ASNumber       string
+	ASOrg          string
+	City           string
+	Region         string
+	Country        string
+	LastTestTime   time.Time `bun:",notnull"`
+	TCPErrorMsg    string
+	TCPErrorOp     string
+	UDPErrorMsg    string
+	UDPErrorOp     string
+	CreatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+type initialClient struct {
+	bun.BaseModel `bun:"table:clients"`
+
+	ID             int64     `bun:",pk,autoincrement"`
+	IP             string    `bun:",notnull"`
+	ClientType     string    `bun:",notnull"`
+	SessionID      int       `bun:",notnull"`
+	SessionLength  int       `bun:",notnull"`
+	Time           time.Time `bun:",notnull"`
+	ExpirationTime time.Time `bun:",notnull"`
+	IPVersion      string    `bun:",notnull"`
+	Carrier        string
+	City           string
+	CountryCode    string `bun:",notnull"`
+	CountryName    string `bun:",notnull"`
+	ASNumber       string
+	ASOrg          string
+	LastSeen       time.Time `bun:",notnull"`
+	UpdateCount    int       `bun:",notnull,default:0"`
+	ISP            string    `bun:",notnull"`
+	Proxy          string    `bun:",notnull"`
+}
+
+type initialMeasurement struct {
+	bun.BaseModel `bun:"table:measurement"`
+
+	ID              int64     `bun:",pk,autoincrement"`
+	ClientID        int64     `bun:",notnull"`
+	ServerID        int64     `bun:",notnull"`
+	Time            time.Time `bun:",notnull"`
+	Protocol        string    `bun:",notnull"`
+	SessionID       string
+	RetryNumber     int
+	PrefixUsed      string
+	ErrorMsg        string
+	ErrorMsgVerbose string
+	ErrorOp         string
+	Duration        int64
+	FullReport      json.RawMessage `bun:",type:jsonb"`
+}
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().
+			Model((*initialServer)(nil)).
+			IfNotExists().
+			Exec(ctx); err != nil {
+			return fmt.Errorf("failed to create servers table: %v", err)
+		}
+
+		if _, err := db.NewCreateTable().
+			Model((*initialClient)(nil)).
+			IfNotExists().
+			Exec(ctx); err != nil {
+			return fmt.Errorf("failed to create clients table: %v", err)
+		}
+
+		if _, err := db.NewCreateTable().
+			Model((*initialMeasurement)(nil)).
+			IfNotExists().
+			ForeignKey(`("client_id") REFERENCES clients ("id") ON DELETE CASCADE`).
+			ForeignKey(`("server_id") REFERENCES servers ("id") ON DELETE CASCADE`).
+			Exec(ctx); err != nil {
+			return fmt.Errorf("failed to create measurements table: %v", err)
+		}
+
+		return nil
+	}, func(ctx context.Context, db *bun.DB) error {
+		for _, model := range []interface{}{
+			(*initialMeasurement)(nil),
+			(*initialClient)(nil),
+			(*initialServer)(nil),
+		} {
+			if _, err := db.NewDropTable().Model(model).IfExists().Exec(ctx); err != nil {
+				return fmt.Errorf("failed to drop table: %v", err)
+			}
+		}
+		return nil
+	})
+}
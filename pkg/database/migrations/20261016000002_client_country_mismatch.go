@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"context"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return addColumns(ctx, db, (*models.Client)(nil),
+			"country_mismatch BOOLEAN NOT NULL DEFAULT FALSE")
+	}, func(ctx context.Context, db *bun.DB) error {
+		return dropColumns(ctx, db, (*models.Client)(nil),
+			"country_mismatch")
+	})
+}
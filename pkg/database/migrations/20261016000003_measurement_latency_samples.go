@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"context"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return addColumns(ctx, db, (*models.Measurement)(nil),
+			"samples BIGINT",
+			"successful_samples BIGINT",
+			"duration_min BIGINT",
+			"duration_median BIGINT",
+			"duration_p95 BIGINT",
+			"duration_max BIGINT")
+	}, func(ctx context.Context, db *bun.DB) error {
+		return dropColumns(ctx, db, (*models.Measurement)(nil),
+			"samples", "successful_samples", "duration_min", "duration_median", "duration_p95", "duration_max")
+	})
+}
@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"context"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return addColumns(ctx, db, (*models.Server)(nil),
+			"geo_updated_at TIMESTAMPTZ")
+	}, func(ctx context.Context, db *bun.DB) error {
+		return dropColumns(ctx, db, (*models.Server)(nil),
+			"geo_updated_at")
+	})
+}
@@ -0,0 +1,20 @@
+package migrations
+
+import (
+	"context"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return addColumns(ctx, db, (*models.Server)(nil),
+			"failure_count BIGINT NOT NULL DEFAULT 0",
+			"last_failure TIMESTAMPTZ")
+	}, func(ctx context.Context, db *bun.DB) error {
+		return dropColumns(ctx, db, (*models.Server)(nil),
+			"failure_count", "last_failure")
+	})
+}
@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if err := addColumns(ctx, db, (*models.Measurement)(nil),
+			"run_id VARCHAR"); err != nil {
+			return err
+		}
+
+		// Exports and reports select the measurements of a run
+		_, err := db.NewCreateIndex().
+			Model((*models.Measurement)(nil)).
+			Index("measurements_run_id_idx").
+			Column("run_id").
+			IfNotExists().
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create run_id index: %v", err)
+		}
+		return nil
+	}, func(ctx context.Context, db *bun.DB) error {
+		return dropColumns(ctx, db, (*models.Measurement)(nil),
+			"run_id")
+	})
+}
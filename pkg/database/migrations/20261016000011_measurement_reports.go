@@ -0,0 +1,45 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+// reportsTable is the reports table as the migration creates it, frozen so
+// changes of models.Report take their own migration
+type reportsTable struct {
+	bun.BaseModel `bun:"table:reports"`
+
+	Hash      string          `bun:",pk"`
+	Report    json.RawMessage `bun:",type:jsonb,notnull"`
+	CreatedAt time.Time       `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		// Deduplicated reports are stored once and referenced by hash
+		if _, err := db.NewCreateTable().
+			Model((*reportsTable)(nil)).
+			IfNotExists().
+			Exec(ctx); err != nil {
+			return fmt.Errorf("failed to create reports table: %v", err)
+		}
+		return addColumns(ctx, db, (*models.Measurement)(nil),
+			"report_hash VARCHAR")
+	}, func(ctx context.Context, db *bun.DB) error {
+		if err := dropColumns(ctx, db, (*models.Measurement)(nil),
+			"report_hash"); err != nil {
+			return err
+		}
+		if _, err := db.NewDropTable().Model((*reportsTable)(nil)).IfExists().Exec(ctx); err != nil {
+			return fmt.Errorf("failed to drop reports table: %v", err)
+		}
+		return nil
+	})
+}
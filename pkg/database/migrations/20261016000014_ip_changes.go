@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// ipChangesTable is the ip_changes table as the migration creates it, frozen
+// so changes of models.IPChange take their own migration
+type ipChangesTable struct {
+	bun.BaseModel `bun:"table:ip_changes"`
+
+	ID          int64     `bun:",pk,autoincrement"`
+	ClientID    int64     `bun:",notnull"`
+	Time        time.Time `bun:",notnull"`
+	OldIP       string    `bun:",notnull"`
+	NewIP       string    `bun:",notnull"`
+	CountryCode string
+	ASNumber    string
+	SameCountry bool `bun:",notnull,default:false"`
+	SameASN     bool `bun:",notnull,default:false"`
+}
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		// Exit IP changes of monitored clients
+		if _, err := db.NewCreateTable().
+			Model((*ipChangesTable)(nil)).
+			IfNotExists().
+			Exec(ctx); err != nil {
+			return fmt.Errorf("failed to create ip_changes table: %v", err)
+		}
+		return nil
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewDropTable().Model((*ipChangesTable)(nil)).IfExists().Exec(ctx); err != nil {
+			return fmt.Errorf("failed to drop ip_changes table: %v", err)
+		}
+		return nil
+	})
+}
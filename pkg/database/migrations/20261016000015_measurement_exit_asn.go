@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"context"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return addColumns(ctx, db, (*models.Measurement)(nil),
+			"exit_asn VARCHAR",
+			"exit_as_org VARCHAR")
+	}, func(ctx context.Context, db *bun.DB) error {
+		return dropColumns(ctx, db, (*models.Measurement)(nil),
+			"exit_asn",
+			"exit_as_org")
+	})
+}
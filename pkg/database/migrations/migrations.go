@@ -0,0 +1,73 @@
+// Package migrations contains the versioned schema migrations of the
+// connectivity-tester database. Each migration lives in its own file named
+// <version>_<description>.go and is applied in version order; applied
+// versions are recorded in the bun_migrations table.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+	"github.com/uptrace/bun/migrate"
+)
+
+// Migrations is the registry of all schema migrations
+var Migrations = migrate.NewMigrations()
+
+// addColumns adds columns, given as "name TYPE [constraints]" definitions, to
+// the table of model. Existing columns are left untouched so the migration
+// also applies to tables that were created from the models before
+// migrations were introduced.
+func addColumns(ctx context.Context, db *bun.DB, model interface{}, columns ...string) error {
+	for _, column := range columns {
+		q := db.NewAddColumn().
+			Model(model).
+			ColumnExpr(column)
+
+		// SQLite has no ADD COLUMN IF NOT EXISTS, look the column up instead
+		if db.Dialect().Name() == dialect.SQLite {
+			exists, err := sqliteColumnExists(ctx, db, model, strings.Fields(column)[0])
+			if err != nil {
+				return fmt.Errorf("failed to look up column %q: %v", column, err)
+			}
+			if exists {
+				continue
+			}
+		} else {
+			q = q.IfNotExists()
+		}
+
+		if _, err := q.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to add column %q: %v", column, err)
+		}
+	}
+	return nil
+}
+
+// sqliteColumnExists reports whether the table of model has the named column
+func sqliteColumnExists(ctx context.Context, db *bun.DB, model interface{}, column string) (bool, error) {
+	table := db.Table(reflect.TypeOf(model))
+	count, err := db.NewSelect().
+		TableExpr("pragma_table_info(?)", table.Name).
+		Where("name = ?", column).
+		Count(ctx)
+	return count > 0, err
+}
+
+// dropColumns removes the named columns from the table of model
+func dropColumns(ctx context.Context, db *bun.DB, model interface{}, columns ...string) error {
+	for _, column := range columns {
+		_, err := db.NewDropColumn().
+			Model(model).
+			Column(column).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to drop column %q: %v", column, err)
+		}
+	}
+	return nil
+}
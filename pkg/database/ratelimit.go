@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// writeLimiter spaces writes evenly so bursts, e.g. of many concurrent
+// measurements finishing at once, reach the database at a steady rate. A nil
+// limiter doesn't limit.
+type writeLimiter struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// next is the earliest time of the next write
+	next time.Time
+}
+
+// newWriteLimiter allows perSecond writes per second, nil if perSecond isn't
+// positive
+func newWriteLimiter(perSecond int) *writeLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &writeLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until the caller may write or ctx is done. The slot of a
+// caller whose ctx is done is given back if no later caller took one.
+func (l *writeLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	slot := l.next
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		if l.next.Equal(slot.Add(l.interval)) {
+			l.next = slot
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// SetMaxWritesPerSecond limits the measurements inserted per second, 0
+// removes the limit. Inserts wait for their turn while their context allows.
+func (db *DB) SetMaxWritesPerSecond(perSecond int) {
+	db.writes = newWriteLimiter(perSecond)
+}
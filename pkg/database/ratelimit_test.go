@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestInsertMeasurementRateLimit(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+	now := time.Now()
+	clients, err := db.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.1", ClientType: "residential", Time: now, ExpirationTime: now.Add(time.Hour),
+		IPVersion: "v4", LastSeen: now, ISP: "isp", Proxy: "none",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	// 6 concurrent inserts at 20 per second take at least 5 intervals of 50ms
+	db.SetMaxWritesPerSecond(20)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := models.Measurement{ClientID: clients[0].ID, ServerID: server.ID, Time: now, Protocol: "tcp"}
+			if err := db.InsertMeasurement(ctx, &m); err != nil {
+				t.Errorf("InsertMeasurement() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+		t.Errorf("6 inserts took %v, want them spread over at least 250ms", elapsed)
+	}
+}
+
+func TestWriteLimiterCancel(t *testing.T) {
+	l := newWriteLimiter(2)
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+
+	// The next slot is 500ms away, a done context doesn't wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() error = %v, want the context deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("canceled wait() took %v", elapsed)
+	}
+
+	// The canceled slot was given back, the next caller gets it
+	start = time.Now()
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("wait() after a canceled wait took %v, want the canceled slot", elapsed)
+	}
+}
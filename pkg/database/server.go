@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"connectivity-tester/pkg/models"
 
@@ -26,11 +27,15 @@ func (db *DB) UpsertServer(ctx context.Context, server *models.Server) error {
 		Set("tcp_error_msg = EXCLUDED.tcp_error_msg").
 		Set("tcp_error_op = EXCLUDED.tcp_error_op").
 		Set("ip_type = EXCLUDED.ip_type").
+		Set("transport_json = COALESCE(EXCLUDED.transport_json, s.transport_json)").
+		Set("tags = COALESCE(EXCLUDED.tags, s.tags)").
+		Set("expected = COALESCE(EXCLUDED.expected, s.expected)").
 		Set("as_number = EXCLUDED.as_number").
 		Set("as_org = EXCLUDED.as_org").
 		Set("city = EXCLUDED.city").
 		Set("region = EXCLUDED.region").
 		Set("country = EXCLUDED.country").
+		Set("geo_updated_at = EXCLUDED.geo_updated_at").
 		Set("updated_at = CURRENT_TIMESTAMP").
 		Exec(ctx)
 
@@ -41,10 +46,35 @@ func (db *DB) UpsertServer(ctx context.Context, server *models.Server) error {
 	return nil
 }
 
+// InsertEphemeralServers stores servers that are measured without being
+// imported so measurements can reference them. New servers are marked
+// ephemeral and left out of server selection; servers that were already
+// imported are reused as they are. The servers are updated with their rows.
+func (db *DB) InsertEphemeralServers(ctx context.Context, servers []models.Server) ([]models.Server, error) {
+	saved := make([]models.Server, len(servers))
+	for i, server := range servers {
+		server.Ephemeral = true
+		_, err := db.NewInsert().
+			Model(&server).
+			On("CONFLICT (ip, full_access_link) DO UPDATE").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error inserting ephemeral server %s: %v", server.IP, err)
+		}
+		saved[i] = server
+	}
+
+	return saved, nil
+}
+
+// GetAllServers returns all imported servers, ephemeral servers are excluded
 func (db *DB) GetAllServers(ctx context.Context) ([]models.Server, error) {
 	var servers []models.Server
 	err := db.NewSelect().
 		Model(&servers).
+		Where("NOT ephemeral").
 		Scan(ctx)
 
 	if err != nil {
@@ -54,9 +84,78 @@ func (db *DB) GetAllServers(ctx context.Context) ([]models.Server, error) {
 	return servers, nil
 }
 
+// ListServers returns a page of imported servers ordered by ID
+func (db *DB) ListServers(ctx context.Context, limit, offset int) ([]models.Server, error) {
+	var servers []models.Server
+	err := db.NewSelect().
+		Model(&servers).
+		Where("NOT ephemeral").
+		Order("id ASC").
+		Limit(limit).
+		Offset(offset).
+		Scan(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing servers: %v", err)
+	}
+
+	return servers, nil
+}
+
+// GetServersForGeoRefresh returns the imported servers whose geo and AS info
+// should be looked up again. Only servers in the named groups are returned if
+// names is not empty, and only servers not refreshed since olderThan if it's
+// not zero.
+func (db *DB) GetServersForGeoRefresh(ctx context.Context, names []string, olderThan time.Time) ([]models.Server, error) {
+	var servers []models.Server
+	q := db.NewSelect().
+		Model(&servers).
+		Where("NOT ephemeral")
+
+	if len(names) > 0 {
+		q = q.Where("name IN (?)", bun.In(names))
+	}
+	if !olderThan.IsZero() {
+		q = q.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("geo_updated_at IS NULL").
+				WhereOr("geo_updated_at < ?", olderThan)
+		})
+	}
+
+	err := q.Order("id ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting servers for geo refresh: %v", err)
+	}
+
+	return servers, nil
+}
+
+// GetServersForExport returns the imported servers ordered by ID. Only
+// servers in the named groups are returned if names is not empty, and only
+// those GetWorkingServers would return if workingOnly is set.
+func (db *DB) GetServersForExport(ctx context.Context, names []string, workingOnly bool) ([]models.Server, error) {
+	var servers []models.Server
+	q := db.NewSelect().
+		Model(&servers).
+		Where("NOT ephemeral")
+
+	if len(names) > 0 {
+		q = q.Where("name IN (?)", bun.In(names))
+	}
+	if workingOnly {
+		q = q.Apply(workingServers)
+	}
+
+	if err := q.Order("id ASC").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error getting servers for export: %v", err)
+	}
+
+	return servers, nil
+}
+
 func (db *DB) GetServersForRetest(ctx context.Context, retestTCP, retestUDP bool) ([]models.Server, error) {
 	var servers []models.Server
-	q := db.NewSelect().Model(&servers)
+	q := db.NewSelect().Model(&servers).Where("NOT ephemeral")
 
 	if retestTCP && retestUDP {
 		q = q.Where("(tcp_error_op IS NOT NULL AND tcp_error_op != '' AND tcp_error_op != 'connect') OR udp_error_msg IS NOT NULL")
@@ -80,9 +179,13 @@ func (db *DB) UpdateServerTestResults(ctx context.Context, server *models.Server
 	updateMutex.Lock()
 	defer updateMutex.Unlock()
 
+	// A completed test run ends any streak of failed runs and makes an
+	// inactive server active again
+	server.FailureCount = 0
+	server.Status = ""
 	_, err := db.NewUpdate().
 		Model(server).
-		Column("last_test_time", "tcp_error_msg", "tcp_error_op", "udp_error_msg", "udp_error_op").
+		Column("last_test_time", "tcp_error_msg", "tcp_error_op", "udp_error_msg", "udp_error_op", "failure_count", "status").
 		Where("ip = ? AND port = ? AND user_info = ?", server.IP, server.Port, server.UserInfo).
 		Exec(ctx)
 
@@ -93,6 +196,28 @@ func (db *DB) UpdateServerTestResults(ctx context.Context, server *models.Server
 	return nil
 }
 
+// RecordServerFailure counts a failed test run of the server and returns the
+// number of consecutive failed runs
+func (db *DB) RecordServerFailure(ctx context.Context, server *models.Server) (int, error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	server.LastFailure = time.Now()
+	_, err := db.NewUpdate().
+		Model(server).
+		Set("failure_count = failure_count + 1").
+		Set("last_failure = ?", server.LastFailure).
+		Where("ip = ? AND port = ? AND user_info = ?", server.IP, server.Port, server.UserInfo).
+		Returning("failure_count").
+		Exec(ctx)
+
+	if err != nil {
+		return 0, fmt.Errorf("error recording server failure: %v", err)
+	}
+
+	return server.FailureCount, nil
+}
+
 func (db *DB) RemoveServer(ctx context.Context, server *models.Server) error {
 	removeMutex.Lock()
 	defer removeMutex.Unlock()
@@ -109,12 +234,159 @@ func (db *DB) RemoveServer(ctx context.Context, server *models.Server) error {
 	return nil
 }
 
-// GetWorkingServers returns servers with no errors and allowed ports
-func (db *DB) GetWorkingServers(ctx context.Context, allowedPorts []string) ([]models.Server, error) {
+// RemoveGroupServer removes the server with the ID if it's in the group name.
+// Unlike RemoveServer it leaves other servers of the same endpoint alone,
+// such as a server just upserted with a new access link or one of another
+// group.
+func (db *DB) RemoveGroupServer(ctx context.Context, id int64, name string) error {
+	removeMutex.Lock()
+	defer removeMutex.Unlock()
+
+	_, err := db.NewDelete().
+		Model((*models.Server)(nil)).
+		Where("id = ? AND name = ?", id, name).
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error removing server: %v", err)
+	}
+
+	return nil
+}
+
+// MarkServerInactive keeps a server that failed its tests but leaves it out of
+// the working servers
+func (db *DB) MarkServerInactive(ctx context.Context, server *models.Server) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	server.Status = models.ServerStatusInactive
+	_, err := db.NewUpdate().
+		Model(server).
+		Set("status = ?", server.Status).
+		Set("updated_at = CURRENT_TIMESTAMP").
+		Where("ip = ? AND port = ? AND user_info = ?", server.IP, server.Port, server.UserInfo).
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error marking server inactive: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateServerGeo stores the geo and AS info of the server with the ID,
+// leaving its other columns alone
+func (db *DB) UpdateServerGeo(ctx context.Context, server *models.Server) error {
+	_, err := db.NewUpdate().
+		Model(server).
+		Column("as_number", "as_org", "city", "region", "country", "geo_updated_at").
+		Where("id = ?", server.ID).
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating geo info of server %d: %v", server.ID, err)
+	}
+
+	return nil
+}
+
+// UpdateServerAccessLink replaces the access link of a server
+func (db *DB) UpdateServerAccessLink(ctx context.Context, id int64, link string) error {
+	_, err := db.NewUpdate().
+		Model((*models.Server)(nil)).
+		Set("full_access_link = ?", link).
+		Set("updated_at = CURRENT_TIMESTAMP").
+		Where("id = ?", id).
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating access link of server %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// SetServersExpected sets the expected outcome of the servers with the IDs,
+// empty clears it. It returns the number of servers updated.
+func (db *DB) SetServersExpected(ctx context.Context, ids []int64, expected string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res, err := db.NewUpdate().
+		Model((*models.Server)(nil)).
+		Set("expected = ?", sql.NullString{String: expected, Valid: expected != ""}).
+		Set("updated_at = CURRENT_TIMESTAMP").
+		Where("id IN (?)", bun.In(ids)).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error setting expected outcome of servers: %v", err)
+	}
+
+	updated, _ := res.RowsAffected()
+	return updated, nil
+}
+
+// MergeServers reassigns the measurements of the duplicate servers to the
+// canonical server and deletes the duplicates, in one transaction. It returns
+// the number of measurements reassigned.
+func (db *DB) MergeServers(ctx context.Context, canonicalID int64, duplicateIDs []int64) (int64, error) {
+	if len(duplicateIDs) == 0 {
+		return 0, nil
+	}
+
+	var moved int64
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().
+			Model((*models.Measurement)(nil)).
+			Set("server_id = ?", canonicalID).
+			Where("server_id IN (?)", bun.In(duplicateIDs)).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("error reassigning measurements: %v", err)
+		}
+		moved, _ = res.RowsAffected()
+
+		if _, err := tx.NewDelete().
+			Model((*models.Server)(nil)).
+			Where("id IN (?)", bun.In(duplicateIDs)).
+			Exec(ctx); err != nil {
+			return fmt.Errorf("error deleting duplicate servers: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error merging servers into %d: %v", canonicalID, err)
+	}
+	return moved, nil
+}
+
+// ServerOrder controls the order in which server queries return rows
+type ServerOrder string
+
+const (
+	// ServerOrderDefault leaves the order up to the database
+	ServerOrderDefault ServerOrder = ""
+	// ServerOrderStalest returns the least recently tested servers first
+	ServerOrderStalest ServerOrder = "stalest"
+)
+
+// workingServers limits a server query to the servers that are measured:
+// imported, not marked inactive and without an error on one of the protocols
+func workingServers(q *bun.SelectQuery) *bun.SelectQuery {
+	return q.
+		Where("((tcp_error_msg IS NULL OR tcp_error_msg = '') OR (udp_error_msg IS NULL OR udp_error_msg = ''))").
+		Where("NOT ephemeral").
+		Where("(status IS NULL OR status != ?)", models.ServerStatusInactive)
+}
+
+// GetWorkingServers returns active servers with no errors and allowed ports
+func (db *DB) GetWorkingServers(ctx context.Context, allowedPorts []string, order ServerOrder) ([]models.Server, error) {
 	var servers []models.Server
 	query := db.NewSelect().
 		Model(&servers).
-		Where("((tcp_error_msg IS NULL OR tcp_error_msg = '') OR (udp_error_msg IS NULL OR udp_error_msg = ''))")
+		Apply(workingServers)
 
 	// Only add port restriction if allowedPorts is not nil
 	if allowedPorts != nil {
@@ -122,6 +394,14 @@ func (db *DB) GetWorkingServers(ctx context.Context, allowedPorts []string) ([]m
 	}
 	// add a mechasnism to get all servers except ones on rejected port list
 
+	switch order {
+	case ServerOrderStalest:
+		query = query.Order("last_test_time ASC", "id ASC")
+	case ServerOrderDefault:
+	default:
+		return nil, fmt.Errorf("unsupported server order: %s", order)
+	}
+
 	err := query.Scan(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error getting working servers: %v", err)
@@ -131,11 +411,110 @@ func (db *DB) GetWorkingServers(ctx context.Context, allowedPorts []string) ([]m
 	logger := slog.Default()
 	logger.Debug("GetWorkingServers query",
 		"allowedPorts", allowedPorts,
+		"order", order,
 		"serverCount", len(servers))
 
 	return servers, nil
 }
 
+// ServerLite holds the server columns a measurement needs. Loading it
+// instead of models.Server leaves out the transport JSON and geo info, which
+// keeps large server sets small in memory.
+type ServerLite struct {
+	bun.BaseModel `bun:"table:servers,alias:s"`
+
+	ID             int64
+	IP             string
+	Port           string
+	FullAccessLink string
+	Scheme         string
+	IPType         string
+	TCPErrorMsg    string
+	TCPErrorOp     string
+	UDPErrorMsg    string
+	UDPErrorOp     string
+	Expected       string
+	// LastTestTime orders the servers of a stalest first run
+	LastTestTime time.Time
+}
+
+// Server returns the server with only the loaded columns set
+func (s ServerLite) Server() models.Server {
+	return models.Server{
+		ID:             s.ID,
+		IP:             s.IP,
+		Port:           s.Port,
+		FullAccessLink: s.FullAccessLink,
+		Scheme:         s.Scheme,
+		IPType:         s.IPType,
+		TCPErrorMsg:    s.TCPErrorMsg,
+		TCPErrorOp:     s.TCPErrorOp,
+		UDPErrorMsg:    s.UDPErrorMsg,
+		UDPErrorOp:     s.UDPErrorOp,
+		Expected:       s.Expected,
+		LastTestTime:   s.LastTestTime,
+	}
+}
+
+// GetWorkingServersLite is GetWorkingServers loading only the columns of ServerLite
+func (db *DB) GetWorkingServersLite(ctx context.Context, allowedPorts []string, order ServerOrder) ([]ServerLite, error) {
+	return db.GetWorkingServersByIPType(ctx, "", allowedPorts, order)
+}
+
+// GetWorkingServersByIPType is GetWorkingServersLite limited to the servers
+// whose IPType is ipType, v4 or v6. An empty ipType selects servers of any IP
+// type.
+func (db *DB) GetWorkingServersByIPType(ctx context.Context, ipType string, allowedPorts []string, order ServerOrder) ([]ServerLite, error) {
+	var servers []ServerLite
+	query := db.NewSelect().
+		Model(&servers).
+		Apply(workingServers)
+
+	if allowedPorts != nil {
+		query = query.Where("port IN (?)", bun.In(allowedPorts))
+	}
+	if ipType != "" {
+		query = query.Where("ip_type = ?", ipType)
+	}
+
+	switch order {
+	case ServerOrderStalest:
+		query = query.Order("last_test_time ASC", "id ASC")
+	case ServerOrderDefault:
+	default:
+		return nil, fmt.Errorf("unsupported server order: %s", order)
+	}
+
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error getting working servers: %v", err)
+	}
+
+	return servers, nil
+}
+
+// UpdateServerErrors stores the TCP and UDP errors of a server, leaving its
+// other columns as they are
+func (db *DB) UpdateServerErrors(ctx context.Context, server *models.Server) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	_, err := db.NewUpdate().
+		Model(server).
+		Set("tcp_error_msg = ?", server.TCPErrorMsg).
+		Set("tcp_error_op = ?", server.TCPErrorOp).
+		Set("udp_error_msg = ?", server.UDPErrorMsg).
+		Set("udp_error_op = ?", server.UDPErrorOp).
+		Set("updated_at = CURRENT_TIMESTAMP").
+		WherePK().
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error updating server errors: %v", err)
+	}
+
+	return nil
+}
+
 func (db *DB) GetServersByIDs(ctx context.Context, ids []int64) ([]models.Server, error) {
 	var servers []models.Server
 
@@ -253,3 +632,59 @@ func (db *DB) GetServersByNames(ctx context.Context, names []string) ([]models.S
 
 	return servers, nil
 }
+
+// GetServersByTag returns the imported servers that have all the tags parsed
+// from their fragments, see server.ParseTags
+func (db *DB) GetServersByTag(ctx context.Context, tags map[string]string) ([]models.Server, error) {
+	var servers []models.Server
+	if len(tags) == 0 {
+		return servers, nil
+	}
+
+	query := db.NewSelect().
+		Model(&servers).
+		Where("NOT ephemeral").
+		Order("id ASC")
+	for key, value := range tags {
+		if db.IsSQLite() {
+			// json_each takes any key, a JSON path can't hold every one
+			query = query.Where("EXISTS (SELECT 1 FROM json_each(tags) AS t WHERE t.key = ? AND t.value = ?)", key, value)
+		} else {
+			query = query.Where("tags ->> ? = ?", key, value)
+		}
+	}
+
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error getting servers by tags %v: %v", tags, err)
+	}
+
+	slog.Debug("Retrieved servers by tags",
+		"tags", tags,
+		"foundCount", len(servers))
+
+	return servers, nil
+}
+
+// MirrorServers copies servers of another database with their IDs, see
+// MirrorClients
+func (db *DB) MirrorServers(ctx context.Context, servers []models.Server) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	// A server stored here under another ID with the same IP and access
+	// link fails the copy, measurements would reference the wrong row
+	_, err := db.NewInsert().
+		Model(&servers).
+		On("CONFLICT (id) DO UPDATE").
+		Exec(ctx)
+
+	if err != nil {
+		return fmt.Errorf("error mirroring servers: %v", err)
+	}
+
+	if err := db.advanceIDSequence(ctx, "servers"); err != nil {
+		return fmt.Errorf("error mirroring servers: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,637 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestGetServersForGeoRefresh(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	now := time.Now()
+	servers := []models.Server{
+		{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss", Name: "a"},
+		{IP: "192.0.2.2", Port: "443", FullAccessLink: "ss://192.0.2.2:443", Scheme: "ss", Name: "a", GeoUpdatedAt: now.Add(-48 * time.Hour)},
+		{IP: "192.0.2.3", Port: "443", FullAccessLink: "ss://192.0.2.3:443", Scheme: "ss", Name: "a", GeoUpdatedAt: now},
+		{IP: "192.0.2.4", Port: "443", FullAccessLink: "ss://192.0.2.4:443", Scheme: "ss", Name: "b"},
+	}
+	for i := range servers {
+		if err := db.UpsertServer(ctx, &servers[i]); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+	if _, err := db.InsertEphemeralServers(ctx, []models.Server{
+		{IP: "192.0.2.5", Port: "443", FullAccessLink: "ss://192.0.2.5:443", Scheme: "ss", Name: "a"},
+	}); err != nil {
+		t.Fatalf("InsertEphemeralServers() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		names     []string
+		olderThan time.Time
+		want      []string
+	}{
+		{name: "all servers", want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}},
+		{name: "by group", names: []string{"b"}, want: []string{"192.0.2.4"}},
+		{name: "stale only", olderThan: now.Add(-24 * time.Hour), want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.4"}},
+		{name: "stale in group", names: []string{"a"}, olderThan: now.Add(-24 * time.Hour), want: []string{"192.0.2.1", "192.0.2.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.GetServersForGeoRefresh(ctx, tt.names, tt.olderThan)
+			if err != nil {
+				t.Fatalf("GetServersForGeoRefresh() error = %v", err)
+			}
+			var ips []string
+			for _, s := range got {
+				ips = append(ips, s.IP)
+			}
+			if len(ips) != len(tt.want) {
+				t.Fatalf("GetServersForGeoRefresh() = %v, want %v", ips, tt.want)
+			}
+			for i := range ips {
+				if ips[i] != tt.want[i] {
+					t.Errorf("GetServersForGeoRefresh() = %v, want %v", ips, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateServerGeo(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss", Name: "a", TCPErrorMsg: "reset"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+
+	// A stale copy must not overwrite the columns other than the geo info
+	refreshed := server
+	refreshed.TCPErrorMsg = ""
+	refreshed.Name = "b"
+	refreshed.ASNumber = "64496"
+	refreshed.ASOrg = "Example"
+	refreshed.City = "Berlin"
+	refreshed.Region = "Berlin"
+	refreshed.Country = "DE"
+	refreshed.GeoUpdatedAt = time.Now()
+	if err := db.UpdateServerGeo(ctx, &refreshed); err != nil {
+		t.Fatalf("UpdateServerGeo() error = %v", err)
+	}
+
+	got, err := db.GetServersByIDs(ctx, []int64{server.ID})
+	if err != nil {
+		t.Fatalf("GetServersByIDs() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("GetServersByIDs() = %d servers, want 1", len(got))
+	}
+	if got[0].ASNumber != "64496" || got[0].ASOrg != "Example" || got[0].City != "Berlin" ||
+		got[0].Region != "Berlin" || got[0].Country != "DE" || got[0].GeoUpdatedAt.IsZero() {
+		t.Errorf("UpdateServerGeo() stored %+v, want the geo info of %+v", got[0], refreshed)
+	}
+	if got[0].TCPErrorMsg != "reset" || got[0].Name != "a" {
+		t.Errorf("UpdateServerGeo() changed tcp_error_msg %q and name %q, want %q and %q", got[0].TCPErrorMsg, got[0].Name, "reset", "a")
+	}
+}
+
+func TestGetServersForExport(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	servers := []models.Server{
+		{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss", Name: "a"},
+		{IP: "192.0.2.2", Port: "443", FullAccessLink: "ss://192.0.2.2:443", Scheme: "ss", Name: "a", TCPErrorMsg: "reset", UDPErrorMsg: "timeout"},
+		{IP: "192.0.2.3", Port: "443", FullAccessLink: "ss://192.0.2.3:443", Scheme: "ss", Name: "a", Status: models.ServerStatusInactive},
+		{IP: "192.0.2.4", Port: "443", FullAccessLink: "ss://192.0.2.4:443", Scheme: "ss", Name: "b", TCPErrorMsg: "reset"},
+	}
+	for i := range servers {
+		if err := db.UpsertServer(ctx, &servers[i]); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+	if _, err := db.InsertEphemeralServers(ctx, []models.Server{
+		{IP: "192.0.2.5", Port: "443", FullAccessLink: "ss://192.0.2.5:443", Scheme: "ss", Name: "a"},
+	}); err != nil {
+		t.Fatalf("InsertEphemeralServers() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		names       []string
+		workingOnly bool
+		want        []string
+	}{
+		{name: "all servers", want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}},
+		{name: "by group", names: []string{"a"}, want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{name: "working only", workingOnly: true, want: []string{"192.0.2.1", "192.0.2.4"}},
+		{name: "working in group", names: []string{"a"}, workingOnly: true, want: []string{"192.0.2.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.GetServersForExport(ctx, tt.names, tt.workingOnly)
+			if err != nil {
+				t.Fatalf("GetServersForExport() error = %v", err)
+			}
+			var ips []string
+			for _, s := range got {
+				ips = append(ips, s.IP)
+			}
+			if !reflect.DeepEqual(ips, tt.want) {
+				t.Errorf("GetServersForExport() = %v, want %v", ips, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveGroupServer(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	// Three servers of the same endpoint, two of them in group a
+	servers := []models.Server{
+		{IP: "192.0.2.1", Port: "443", UserInfo: "key", FullAccessLink: "ss://key@192.0.2.1:443", Scheme: "ss", Name: "a"},
+		{IP: "192.0.2.1", Port: "443", UserInfo: "key", FullAccessLink: "ss://key@192.0.2.1:443/?outline=1", Scheme: "ss", Name: "a"},
+		{IP: "192.0.2.1", Port: "443", UserInfo: "key", FullAccessLink: "ss://key@192.0.2.1:443/?prefix=x", Scheme: "ss", Name: "b"},
+	}
+	for i := range servers {
+		if err := db.UpsertServer(ctx, &servers[i]); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+
+	// The server of group b isn't removed as a server of group a
+	if err := db.RemoveGroupServer(ctx, servers[2].ID, "a"); err != nil {
+		t.Fatalf("RemoveGroupServer() error = %v", err)
+	}
+	if err := db.RemoveGroupServer(ctx, servers[0].ID, "a"); err != nil {
+		t.Fatalf("RemoveGroupServer() error = %v", err)
+	}
+
+	remaining, err := db.GetAllServers(ctx)
+	if err != nil {
+		t.Fatalf("GetAllServers() error = %v", err)
+	}
+	var links []string
+	for _, server := range remaining {
+		links = append(links, server.Name+" "+server.FullAccessLink)
+	}
+	slices.Sort(links)
+	want := []string{"a ss://key@192.0.2.1:443/?outline=1", "b ss://key@192.0.2.1:443/?prefix=x"}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("servers after RemoveGroupServer() = %v, want %v", links, want)
+	}
+}
+
+func TestInsertEphemeralServers(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	imported := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss", Name: "imported"}
+	if err := db.UpsertServer(ctx, &imported); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+
+	saved, err := db.InsertEphemeralServers(ctx, []models.Server{
+		{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"},
+		{IP: "192.0.2.2", Port: "443", FullAccessLink: "ss://192.0.2.2:443", Scheme: "ss"},
+	})
+	if err != nil {
+		t.Fatalf("InsertEphemeralServers() error = %v", err)
+	}
+
+	if saved[0].ID != imported.ID || saved[0].Ephemeral || saved[0].Name != "imported" {
+		t.Errorf("already imported server = %+v, want the imported row", saved[0])
+	}
+	if saved[1].ID == 0 || !saved[1].Ephemeral {
+		t.Errorf("new server = %+v, want a stored ephemeral server", saved[1])
+	}
+
+	all, err := db.GetAllServers(ctx)
+	if err != nil {
+		t.Fatalf("GetAllServers() error = %v", err)
+	}
+	working, err := db.GetWorkingServers(ctx, nil, ServerOrderDefault)
+	if err != nil {
+		t.Fatalf("GetWorkingServers() error = %v", err)
+	}
+	for name, servers := range map[string][]models.Server{"GetAllServers": all, "GetWorkingServers": working} {
+		if len(servers) != 1 || servers[0].ID != imported.ID {
+			t.Errorf("%s() = %+v, want only the imported server", name, servers)
+		}
+	}
+}
+
+func TestRecordServerFailure(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+
+	for want := 1; want <= 2; want++ {
+		got, err := db.RecordServerFailure(ctx, &server)
+		if err != nil {
+			t.Fatalf("RecordServerFailure() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("RecordServerFailure() = %d, want %d", got, want)
+		}
+	}
+
+	// A successful run resets the count
+	if err := db.UpdateServerTestResults(ctx, &server); err != nil {
+		t.Fatalf("UpdateServerTestResults() error = %v", err)
+	}
+	got, err := db.RecordServerFailure(ctx, &server)
+	if err != nil {
+		t.Fatalf("RecordServerFailure() error = %v", err)
+	}
+	if got != 1 {
+		t.Errorf("RecordServerFailure() after a successful run = %d, want 1", got)
+	}
+}
+
+func TestMarkServerInactive(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	failed := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	working := models.Server{IP: "192.0.2.2", Port: "443", FullAccessLink: "ss://192.0.2.2:443", Scheme: "ss"}
+	for _, s := range []*models.Server{&failed, &working} {
+		if err := db.UpsertServer(ctx, s); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+
+	if err := db.MarkServerInactive(ctx, &failed); err != nil {
+		t.Fatalf("MarkServerInactive() error = %v", err)
+	}
+
+	all, err := db.GetAllServers(ctx)
+	if err != nil {
+		t.Fatalf("GetAllServers() error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("GetAllServers() returned %d servers, want the inactive server kept", len(all))
+	}
+	for _, s := range all {
+		if wantInactive := s.ID == failed.ID; (s.Status == models.ServerStatusInactive) != wantInactive {
+			t.Errorf("server %s has status %q", s.IP, s.Status)
+		}
+	}
+
+	workingIDs := func() []int64 {
+		t.Helper()
+		servers, err := db.GetWorkingServers(ctx, nil, ServerOrderDefault)
+		if err != nil {
+			t.Fatalf("GetWorkingServers() error = %v", err)
+		}
+		lite, err := db.GetWorkingServersLite(ctx, nil, ServerOrderDefault)
+		if err != nil {
+			t.Fatalf("GetWorkingServersLite() error = %v", err)
+		}
+		var ids []int64
+		for _, s := range servers {
+			ids = append(ids, s.ID)
+		}
+		if len(lite) != len(servers) {
+			t.Errorf("GetWorkingServersLite() returned %d servers, GetWorkingServers() %d", len(lite), len(servers))
+		}
+		return ids
+	}
+	if got := workingIDs(); !reflect.DeepEqual(got, []int64{working.ID}) {
+		t.Errorf("working servers = %v, want only %d", got, working.ID)
+	}
+
+	// A passing test makes the server active again
+	if err := db.UpdateServerTestResults(ctx, &failed); err != nil {
+		t.Fatalf("UpdateServerTestResults() error = %v", err)
+	}
+	if got := workingIDs(); len(got) != 2 {
+		t.Errorf("working servers after a passing test = %v, want both", got)
+	}
+}
+
+func TestUpsertServerTransportJSON(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{
+		IP:             "192.0.2.1",
+		Port:           "8388",
+		FullAccessLink: "ss://key@192.0.2.1:8388/?prefix=%16%03%01",
+		Scheme:         "ss",
+		TransportJSON:  json.RawMessage(`{"scheme":"ss","params":{"prefix":"%16%03%01"}}`),
+	}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+
+	// Upserting without transport info keeps the stored one
+	update := server
+	update.TransportJSON = nil
+	if err := db.UpsertServer(ctx, &update); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+
+	servers, err := db.GetServersByIDs(ctx, []int64{server.ID})
+	if err != nil || len(servers) != 1 {
+		t.Fatalf("GetServersByIDs() = %v, %v", servers, err)
+	}
+	var got struct {
+		Params map[string]string `json:"params"`
+	}
+	if err := json.Unmarshal(servers[0].TransportJSON, &got); err != nil {
+		t.Fatalf("stored TransportJSON %q is not valid: %v", servers[0].TransportJSON, err)
+	}
+	if got.Params["prefix"] != "%16%03%01" {
+		t.Errorf("stored params = %v, want the prefix", got.Params)
+	}
+}
+
+func TestGetWorkingServersByIPType(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	// a.example resolved to an IPv4 and an IPv6 address
+	for _, s := range []models.Server{
+		{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss", IPType: "v4", DomainName: "a.example"},
+		{IP: "2001:db8::1", Port: "443", FullAccessLink: "ss://[2001:db8::1]:443", Scheme: "ss", IPType: "v6", DomainName: "a.example"},
+		{IP: "192.0.2.2", Port: "443", FullAccessLink: "ss://192.0.2.2:443", Scheme: "ss", IPType: "v4"},
+	} {
+		if err := db.UpsertServer(ctx, &s); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+
+	for ipType, want := range map[string][]string{
+		"v4": {"192.0.2.1", "192.0.2.2"},
+		"v6": {"2001:db8::1"},
+		"":   {"192.0.2.1", "192.0.2.2", "2001:db8::1"},
+	} {
+		servers, err := db.GetWorkingServersByIPType(ctx, ipType, nil, ServerOrderDefault)
+		if err != nil {
+			t.Fatalf("GetWorkingServersByIPType(%q) error = %v", ipType, err)
+		}
+		var ips []string
+		for _, s := range servers {
+			ips = append(ips, s.IP)
+			if ipType != "" && s.IPType != ipType {
+				t.Errorf("GetWorkingServersByIPType(%q) returned %s of type %q", ipType, s.IP, s.IPType)
+			}
+		}
+		slices.Sort(ips)
+		if !reflect.DeepEqual(ips, want) {
+			t.Errorf("GetWorkingServersByIPType(%q) = %v, want %v", ipType, ips, want)
+		}
+	}
+}
+
+func TestGetWorkingServersLite(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	server := models.Server{
+		IP:             "192.0.2.1",
+		Port:           "8388",
+		UserInfo:       "key",
+		FullAccessLink: "ss://key@192.0.2.1:8388",
+		Name:           "group",
+		Scheme:         "ss",
+		DomainName:     "example.com",
+		TransportJSON:  json.RawMessage(`{"scheme":"ss"}`),
+		ASNumber:       "AS64496",
+		ASOrg:          "Example",
+		Country:        "US",
+		UDPErrorMsg:    "timeout",
+		UDPErrorOp:     "read",
+		LastTestTime:   time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := db.UpsertServer(ctx, &server); err != nil {
+		t.Fatalf("UpsertServer() error = %v", err)
+	}
+
+	servers, err := db.GetWorkingServersLite(ctx, []string{"8388"}, ServerOrderStalest)
+	if err != nil {
+		t.Fatalf("GetWorkingServersLite() error = %v", err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("GetWorkingServersLite() = %+v, want one server", servers)
+	}
+	got := servers[0].Server()
+	// The stalest first order of the run needs the last test time
+	if !got.LastTestTime.Equal(server.LastTestTime) {
+		t.Errorf("GetWorkingServersLite() last test time = %v, want %v", got.LastTestTime, server.LastTestTime)
+	}
+	want := models.Server{
+		ID:             server.ID,
+		IP:             "192.0.2.1",
+		Port:           "8388",
+		FullAccessLink: "ss://key@192.0.2.1:8388",
+		Scheme:         "ss",
+		UDPErrorMsg:    "timeout",
+		UDPErrorOp:     "read",
+		LastTestTime:   got.LastTestTime,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetWorkingServersLite() server = %+v, want only the essential fields %+v", got, want)
+	}
+
+	// Storing errors of a lite server keeps the columns it didn't load
+	got.TCPErrorMsg, got.TCPErrorOp = "refused", "connect"
+	if err := db.UpdateServerErrors(ctx, &got); err != nil {
+		t.Fatalf("UpdateServerErrors() error = %v", err)
+	}
+	stored, err := db.GetServersByIDs(ctx, []int64{server.ID})
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("GetServersByIDs() = %v, %v", stored, err)
+	}
+	if stored[0].TCPErrorMsg != "refused" || stored[0].ASOrg != "Example" || stored[0].DomainName != "example.com" {
+		t.Errorf("stored server = %+v, want the TCP error and the unloaded columns kept", stored[0])
+	}
+}
+
+func TestGetServersByTag(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	servers := []models.Server{
+		{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss",
+			Tags: map[string]string{"region": "us", "tier": "premium"}},
+		{IP: "192.0.2.2", Port: "443", FullAccessLink: "ss://192.0.2.2:443", Scheme: "ss",
+			Tags: map[string]string{"region": "eu", "tier": "premium"}},
+		{IP: "192.0.2.3", Port: "443", FullAccessLink: "ss://192.0.2.3:443", Scheme: "ss",
+			Tags: map[string]string{"region": "us", "tier": "free"}},
+		{IP: "192.0.2.4", Port: "443", FullAccessLink: "ss://192.0.2.4:443", Scheme: "ss",
+			Tags: map[string]string{`say"hi`: "x"}},
+		{IP: "192.0.2.5", Port: "443", FullAccessLink: "ss://192.0.2.5:443", Scheme: "ss",
+			Tags: map[string]string{"tier": "free"}},
+	}
+	for i := range servers {
+		if err := db.UpsertServer(ctx, &servers[i]); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+
+	// Upserting without tags keeps them, upserting empty tags clears them
+	keep, clear := servers[2], servers[4]
+	keep.Tags = nil
+	clear.Tags = map[string]string{}
+	for _, server := range []models.Server{keep, clear} {
+		if err := db.UpsertServer(ctx, &server); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		tags map[string]string
+		want []int64
+	}{
+		{map[string]string{"tier": "premium"}, []int64{servers[0].ID, servers[1].ID}},
+		{map[string]string{"tier": "premium", "region": "us"}, []int64{servers[0].ID}},
+		{map[string]string{"tier": "free"}, []int64{servers[2].ID}},
+		{map[string]string{`say"hi`: "x"}, []int64{servers[3].ID}},
+		{map[string]string{"tier": "gold"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := db.GetServersByTag(ctx, tt.tags)
+		if err != nil {
+			t.Fatalf("GetServersByTag(%v) error = %v", tt.tags, err)
+		}
+		var ids []int64
+		for _, s := range got {
+			ids = append(ids, s.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("GetServersByTag(%v) = servers %v, want %v", tt.tags, ids, tt.want)
+		}
+	}
+}
+
+func TestMirrorClientsAndServers(t *testing.T) {
+	ctx := context.Background()
+	primary, results := newTestDB(t), newTestDB(t)
+	for _, db := range []*DB{primary, results} {
+		if err := db.InitSchema(ctx); err != nil {
+			t.Fatalf("InitSchema() error = %v", err)
+		}
+	}
+
+	// Offset the primary IDs so the copies must keep them
+	for i := 1; i <= 2; i++ {
+		server := models.Server{IP: fmt.Sprintf("192.0.2.%d", i), Port: "443", FullAccessLink: fmt.Sprintf("ss://192.0.2.%d:443", i), Scheme: "ss"}
+		if err := primary.UpsertServer(ctx, &server); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+	servers, err := primary.GetServersByIDs(ctx, []int64{2})
+	if err != nil {
+		t.Fatalf("GetServersByIDs() error = %v", err)
+	}
+	now := time.Now()
+	clients, err := primary.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.1", ClientType: "mobile", Time: now, ExpirationTime: now, IPVersion: "v4",
+		CountryCode: "ir", CountryName: "Iran", LastSeen: now, ISP: "MCI", Proxy: "soax",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+
+	// Copies are idempotent
+	for i := 0; i < 2; i++ {
+		if err := results.MirrorServers(ctx, servers); err != nil {
+			t.Fatalf("MirrorServers() error = %v", err)
+		}
+		if err := results.MirrorClients(ctx, clients); err != nil {
+			t.Fatalf("MirrorClients() error = %v", err)
+		}
+	}
+
+	m := models.Measurement{ClientID: clients[0].ID, ServerID: servers[0].ID, Time: now, Protocol: "tcp", ErrorOp: "success"}
+	if err := results.InsertMeasurement(ctx, &m); err != nil {
+		t.Fatalf("InsertMeasurement() referencing the copies error = %v", err)
+	}
+	got, err := results.GetServersByIDs(ctx, []int64{servers[0].ID})
+	if err != nil || len(got) != 1 || got[0].IP != "192.0.2.2" {
+		t.Errorf("GetServersByIDs() on the copy = %+v, %v", got, err)
+	}
+
+	// Copies are updated with the rows they mirror
+	servers[0].ASOrg = "updated"
+	if err := results.MirrorServers(ctx, servers); err != nil {
+		t.Fatalf("MirrorServers() error = %v", err)
+	}
+	if got, err := results.GetServersByIDs(ctx, []int64{servers[0].ID}); err != nil || len(got) != 1 || got[0].ASOrg != "updated" {
+		t.Errorf("GetServersByIDs() after a new copy = %+v, %v, want the updated server", got, err)
+	}
+
+	// Rows inserted in the results database don't take the mirrored IDs
+	local, err := results.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.2", ClientType: "mobile", Time: now, ExpirationTime: now, IPVersion: "v4",
+		CountryCode: "ir", CountryName: "Iran", LastSeen: now, ISP: "MCI", Proxy: "soax",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+	if local[0].ID <= clients[0].ID {
+		t.Errorf("client inserted after the copy got ID %d, want more than %d", local[0].ID, clients[0].ID)
+	}
+
+	// A server stored under another ID with the same access link isn't
+	// silently skipped
+	conflicting := servers[0]
+	conflicting.ID = servers[0].ID + 100
+	if err := results.MirrorServers(ctx, []models.Server{conflicting}); err == nil {
+		t.Error("MirrorServers() of a server stored under another ID succeeded")
+	}
+}
@@ -0,0 +1,174 @@
+package export
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"connectivity-tester/pkg/models"
+)
+
+// CompareKey groups the measurements that are compared across runs
+type CompareKey struct {
+	ServerID int64  `json:"server_id"`
+	Protocol string `json:"protocol"`
+	Country  string `json:"country"`
+	ASN      string `json:"asn"`
+}
+
+func (k CompareKey) compare(o CompareKey) int {
+	if c := cmp.Compare(k.ServerID, o.ServerID); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(k.Protocol, o.Protocol); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(k.Country, o.Country); c != 0 {
+		return c
+	}
+	return cmp.Compare(k.ASN, o.ASN)
+}
+
+// RunStats summarizes the measurements of a key in one run
+type RunStats struct {
+	Measurements int     `json:"measurements"`
+	Successes    int     `json:"successes"`
+	SuccessRate  float64 `json:"success_rate"`
+	// MedianMs is the median duration of the successful measurements, 0
+	// if none succeeded
+	MedianMs int64 `json:"median_ms"`
+}
+
+// Delta compares a key measured in both runs, deltas are B minus A
+type Delta struct {
+	Key              CompareKey `json:"key"`
+	A                RunStats   `json:"a"`
+	B                RunStats   `json:"b"`
+	SuccessRateDelta float64    `json:"success_rate_delta"`
+	// MedianDeltaMs is only set if both runs had successes
+	MedianDeltaMs int64 `json:"median_delta_ms"`
+}
+
+// Comparison reports how reachability changed from run A to run B
+type Comparison struct {
+	Deltas []Delta `json:"deltas"`
+	// OnlyA and OnlyB are the keys measured in a single run, e.g. servers
+	// that were added or removed between the runs
+	OnlyA []CompareKey `json:"only_a"`
+	OnlyB []CompareKey `json:"only_b"`
+}
+
+// grouped holds the successful durations of a key next to its counts
+type grouped struct {
+	stats     RunStats
+	durations []int64
+}
+
+// groupRun summarizes the measurements of a run by key, leaving out skipped
+// tests, retries and tests through a prefix, so the runs compare the first
+// attempt of plain tests. Measurements must have their client loaded for its
+// country and ASN.
+func groupRun(measurements []models.Measurement) (map[CompareKey]RunStats, error) {
+	groups := make(map[CompareKey]*grouped)
+	for _, m := range measurements {
+		if m.ErrorOp == "skipped" || m.RetryNumber != 0 || m.PrefixUsed != "" {
+			continue
+		}
+		if m.Client == nil {
+			return nil, fmt.Errorf("measurement %d has no client", m.ID)
+		}
+		key := CompareKey{
+			ServerID: m.ServerID,
+			Protocol: m.Protocol,
+			Country:  m.Client.CountryCode,
+			ASN:      m.Client.ASNumber,
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &grouped{}
+			groups[key] = g
+		}
+		g.stats.Measurements++
+		if m.ErrorOp == "success" {
+			g.stats.Successes++
+			g.durations = append(g.durations, m.Duration)
+		}
+	}
+
+	stats := make(map[CompareKey]RunStats, len(groups))
+	for key, g := range groups {
+		g.stats.SuccessRate = float64(g.stats.Successes) / float64(g.stats.Measurements)
+		g.stats.MedianMs = median(g.durations)
+		stats[key] = g.stats
+	}
+	return stats, nil
+}
+
+// median returns the median of durations, 0 if there are none
+func median(durations []int64) int64 {
+	if len(durations) == 0 {
+		return 0
+	}
+	slices.Sort(durations)
+	mid := len(durations) / 2
+	if len(durations)%2 == 0 {
+		return (durations[mid-1] + durations[mid]) / 2
+	}
+	return durations[mid]
+}
+
+// Compare joins the measurements of two runs by server, protocol, client
+// country and ASN, and reports the change in success rate and median
+// latency of each key. Only the first attempt of tests without a prefix is
+// compared. Measurements must have their client loaded.
+func Compare(a, b []models.Measurement) (Comparison, error) {
+	statsA, err := groupRun(a)
+	if err != nil {
+		return Comparison{}, err
+	}
+	statsB, err := groupRun(b)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	comparison := Comparison{Deltas: []Delta{}, OnlyA: []CompareKey{}, OnlyB: []CompareKey{}}
+	for key, sa := range statsA {
+		sb, ok := statsB[key]
+		if !ok {
+			comparison.OnlyA = append(comparison.OnlyA, key)
+			continue
+		}
+		delta := Delta{
+			Key:              key,
+			A:                sa,
+			B:                sb,
+			SuccessRateDelta: sb.SuccessRate - sa.SuccessRate,
+		}
+		if sa.Successes > 0 && sb.Successes > 0 {
+			delta.MedianDeltaMs = sb.MedianMs - sa.MedianMs
+		}
+		comparison.Deltas = append(comparison.Deltas, delta)
+	}
+	for key := range statsB {
+		if _, ok := statsA[key]; !ok {
+			comparison.OnlyB = append(comparison.OnlyB, key)
+		}
+	}
+
+	slices.SortFunc(comparison.Deltas, func(x, y Delta) int { return x.Key.compare(y.Key) })
+	slices.SortFunc(comparison.OnlyA, CompareKey.compare)
+	slices.SortFunc(comparison.OnlyB, CompareKey.compare)
+	return comparison, nil
+}
+
+// WriteComparison writes the comparison as indented JSON
+func WriteComparison(w io.Writer, comparison Comparison) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(comparison); err != nil {
+		return fmt.Errorf("failed to write comparison: %v", err)
+	}
+	return nil
+}
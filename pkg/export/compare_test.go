@@ -0,0 +1,69 @@
+package export
+
+import (
+	"reflect"
+	"testing"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestCompare(t *testing.T) {
+	mci := &models.Client{CountryCode: "ir", ASNumber: "197207"}
+	mtn := &models.Client{CountryCode: "ir", ASNumber: "44244"}
+	measurement := func(serverID int64, protocol string, client *models.Client, op string, duration int64) models.Measurement {
+		return models.Measurement{ServerID: serverID, Protocol: protocol, Client: client, ErrorOp: op, Duration: duration}
+	}
+
+	runA := []models.Measurement{
+		measurement(1, "tcp", mci, "success", 100),
+		measurement(1, "tcp", mci, "connect", 0),
+		measurement(1, "tcp", mci, "success", 300),
+		// Retries and prefixed tests are left out
+		{ServerID: 1, Protocol: "tcp", Client: mci, ErrorOp: "success", Duration: 10, RetryNumber: 1},
+		{ServerID: 1, Protocol: "tcp", Client: mci, ErrorOp: "connect", PrefixUsed: "HTTP/1.1 "},
+		measurement(1, "udp", mci, "receive", 0),
+		measurement(2, "tcp", mci, "success", 50),
+	}
+	runB := []models.Measurement{
+		measurement(1, "tcp", mci, "success", 80),
+		measurement(1, "tcp", mci, "success", 120),
+		measurement(1, "udp", mci, "success", 40),
+		measurement(1, "tcp", mtn, "success", 90),
+	}
+
+	got, err := Compare(runA, runB)
+	if err != nil {
+		t.Fatalf("Compare() error = %v", err)
+	}
+
+	rateA := 2.0 / 3
+	tcp := CompareKey{ServerID: 1, Protocol: "tcp", Country: "ir", ASN: "197207"}
+	udp := CompareKey{ServerID: 1, Protocol: "udp", Country: "ir", ASN: "197207"}
+	want := Comparison{
+		Deltas: []Delta{
+			{
+				Key:              tcp,
+				A:                RunStats{Measurements: 3, Successes: 2, SuccessRate: rateA, MedianMs: 200},
+				B:                RunStats{Measurements: 2, Successes: 2, SuccessRate: 1, MedianMs: 100},
+				SuccessRateDelta: 1 - rateA,
+				MedianDeltaMs:    -100,
+			},
+			{
+				// No latency delta without successes in run A
+				Key:              udp,
+				A:                RunStats{Measurements: 1},
+				B:                RunStats{Measurements: 1, Successes: 1, SuccessRate: 1, MedianMs: 40},
+				SuccessRateDelta: 1,
+			},
+		},
+		OnlyA: []CompareKey{{ServerID: 2, Protocol: "tcp", Country: "ir", ASN: "197207"}},
+		OnlyB: []CompareKey{{ServerID: 1, Protocol: "tcp", Country: "ir", ASN: "44244"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Compare() = %+v, want %+v", got, want)
+	}
+
+	if _, err := Compare([]models.Measurement{{ID: 1}}, nil); err == nil {
+		t.Errorf("Compare() expected an error for a measurement without client")
+	}
+}
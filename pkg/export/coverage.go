@@ -0,0 +1,45 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"connectivity-tester/pkg/database"
+)
+
+// Coverage output formats
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// WriteCoverageGaps writes the coverage gaps of a run as an aligned table
+// or as indented JSON
+func WriteCoverageGaps(w io.Writer, gaps []database.CoverageGap, format string) error {
+	switch format {
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ISP\tSERVER ID\tSERVER IP\tPROTOCOL\tCLIENTS\tSUCCESSES")
+		for _, g := range gaps {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%d\n", g.ISP, g.ServerID, g.ServerIP, g.Protocol, g.Clients, g.Successes)
+		}
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("failed to write coverage gaps: %v", err)
+		}
+		return nil
+	case FormatJSON:
+		if gaps == nil {
+			gaps = []database.CoverageGap{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(gaps); err != nil {
+			return fmt.Errorf("failed to write coverage gaps: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported coverage format: %s", format)
+	}
+}
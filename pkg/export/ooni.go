@@ -0,0 +1,126 @@
+// Package export converts stored measurements into formats meant for
+// sharing and analysis outside of this tool.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+// FormatOONI is the OONI measurement envelope format
+const FormatOONI = "ooni"
+
+const (
+	ooniDataFormatVersion = "0.2.0"
+	ooniTestName          = "outline_connectivity"
+	ooniTestVersion       = "0.1.0"
+	ooniSoftwareName      = "connectivity-tester"
+	ooniSoftwareVersion   = "0.1.0"
+	ooniTimeLayout        = "2006-01-02 15:04:05"
+)
+
+// OONIMeasurement is a measurement in the OONI data format envelope. The
+// probe IP is left out to avoid publishing the proxy exit addresses.
+type OONIMeasurement struct {
+	Annotations          map[string]string      `json:"annotations"`
+	DataFormatVersion    string                 `json:"data_format_version"`
+	Input                string                 `json:"input"`
+	MeasurementStartTime string                 `json:"measurement_start_time"`
+	ProbeASN             string                 `json:"probe_asn"`
+	ProbeCC              string                 `json:"probe_cc"`
+	ProbeNetworkName     string                 `json:"probe_network_name"`
+	ReportID             string                 `json:"report_id"`
+	SoftwareName         string                 `json:"software_name"`
+	SoftwareVersion      string                 `json:"software_version"`
+	TestName             string                 `json:"test_name"`
+	TestRuntime          float64                `json:"test_runtime"`
+	TestStartTime        string                 `json:"test_start_time"`
+	TestVersion          string                 `json:"test_version"`
+	TestKeys             map[string]interface{} `json:"test_keys"`
+}
+
+// ToOONI maps a measurement, which must have its client and server loaded,
+// into the OONI envelope. The keys of the connectivity report become test keys.
+func ToOONI(m models.Measurement) (OONIMeasurement, error) {
+	if m.Client == nil || m.Server == nil {
+		return OONIMeasurement{}, fmt.Errorf("measurement %d has no client or server", m.ID)
+	}
+
+	testKeys := make(map[string]interface{})
+	if len(m.FullReport) > 0 {
+		if err := json.Unmarshal(m.FullReport, &testKeys); err != nil {
+			return OONIMeasurement{}, fmt.Errorf("failed to decode report of measurement %d: %v", m.ID, err)
+		}
+	}
+	// OONI reports a failure string, or null on success
+	var failure *string
+	if m.ErrorMsg != "" {
+		failure = &m.ErrorMsg
+	}
+	testKeys["failure"] = failure
+	testKeys["failure_op"] = m.ErrorOp
+	testKeys["failure_category"] = m.ErrorCategory
+	testKeys["protocol"] = m.Protocol
+	testKeys["prefix"] = m.PrefixUsed
+
+	// Only the endpoint is used as input so the access key secret isn't shared
+	host := m.Server.DomainName
+	if host == "" {
+		host = m.Server.IP
+	}
+
+	probeASN := "AS0"
+	if m.Client.ASNumber != "" {
+		probeASN = "AS" + strings.TrimPrefix(m.Client.ASNumber, "AS")
+	}
+
+	startTime := m.Time.UTC().Format(ooniTimeLayout)
+	return OONIMeasurement{
+		Annotations: map[string]string{
+			"proxy":        m.Client.Proxy,
+			"client_type":  m.Client.ClientType,
+			"isp":          m.Client.ISP,
+			"scheme":       m.Server.Scheme,
+			"session_id":   m.SessionID,
+			"retry_number": fmt.Sprint(m.RetryNumber),
+		},
+		DataFormatVersion:    ooniDataFormatVersion,
+		Input:                host,
+		MeasurementStartTime: startTime,
+		ProbeASN:             probeASN,
+		ProbeCC:              strings.ToUpper(m.Client.CountryCode),
+		ProbeNetworkName:     m.Client.ASOrg,
+		ReportID:             m.RunID,
+		SoftwareName:         ooniSoftwareName,
+		SoftwareVersion:      ooniSoftwareVersion,
+		TestName:             ooniTestName,
+		TestRuntime:          (time.Duration(m.Duration) * time.Millisecond).Seconds(),
+		TestStartTime:        startTime,
+		TestVersion:          ooniTestVersion,
+		TestKeys:             testKeys,
+	}, nil
+}
+
+// WriteOONI writes the measurements as newline delimited OONI JSON. Skipped
+// tests were never run and are left out.
+func WriteOONI(w io.Writer, measurements []models.Measurement) error {
+	enc := json.NewEncoder(w)
+	for _, m := range measurements {
+		if m.ErrorOp == "skipped" {
+			continue
+		}
+		om, err := ToOONI(m)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(om); err != nil {
+			return fmt.Errorf("failed to write measurement %d: %v", m.ID, err)
+		}
+	}
+	return nil
+}
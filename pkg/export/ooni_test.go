@@ -0,0 +1,128 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+func sampleMeasurement() models.Measurement {
+	return models.Measurement{
+		ID:            42,
+		Time:          time.Date(2026, 10, 16, 12, 30, 5, 0, time.UTC),
+		Protocol:      "tcp",
+		RunID:         "run-1",
+		SessionID:     "session-1",
+		RetryNumber:   1,
+		PrefixUsed:    "%16%03%01",
+		ErrorMsg:      "connection reset by peer",
+		ErrorOp:       "receive",
+		ErrorCategory: "reset",
+		Duration:      1500,
+		FullReport:    json.RawMessage(`{"test":{"proto":"tcp","duration_ms":1500},"tcp_connections":[{"ip":"192.0.2.1","port":"8388"}]}`),
+		Client: &models.Client{
+			ASNumber:    "44244",
+			ASOrg:       "Iran Cell Service and Communication Company",
+			CountryCode: "ir",
+			ClientType:  "mobile",
+			ISP:         "MTN Irancell",
+			Proxy:       "soax",
+		},
+		Server: &models.Server{
+			IP:         "192.0.2.1",
+			DomainName: "ss.example.com",
+			Scheme:     "ss",
+		},
+	}
+}
+
+func TestToOONI(t *testing.T) {
+	got, err := ToOONI(sampleMeasurement())
+	if err != nil {
+		t.Fatalf("ToOONI() error = %v", err)
+	}
+
+	fields := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"input", got.Input, "ss.example.com"},
+		{"probe_asn", got.ProbeASN, "AS44244"},
+		{"probe_cc", got.ProbeCC, "IR"},
+		{"probe_network_name", got.ProbeNetworkName, "Iran Cell Service and Communication Company"},
+		{"report_id", got.ReportID, "run-1"},
+		{"test_name", got.TestName, "outline_connectivity"},
+		{"measurement_start_time", got.MeasurementStartTime, "2026-10-16 12:30:05"},
+		{"test_runtime", got.TestRuntime, 1.5},
+		{"data_format_version", got.DataFormatVersion, "0.2.0"},
+		{"annotations.proxy", got.Annotations["proxy"], "soax"},
+		{"annotations.retry_number", got.Annotations["retry_number"], "1"},
+		{"test_keys.failure", *got.TestKeys["failure"].(*string), "connection reset by peer"},
+		{"test_keys.failure_category", got.TestKeys["failure_category"], "reset"},
+		{"test_keys.prefix", got.TestKeys["prefix"], "%16%03%01"},
+	}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.got, f.want) {
+			t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+		}
+	}
+
+	// The keys of the connectivity report are kept as test keys
+	if _, ok := got.TestKeys["tcp_connections"]; !ok {
+		t.Errorf("test_keys is missing the report's tcp_connections: %v", got.TestKeys)
+	}
+}
+
+func TestToOONISuccessAndFallbacks(t *testing.T) {
+	m := sampleMeasurement()
+	m.ErrorMsg = ""
+	m.FullReport = nil
+	m.Server.DomainName = ""
+	m.Client.ASNumber = ""
+
+	got, err := ToOONI(m)
+	if err != nil {
+		t.Fatalf("ToOONI() error = %v", err)
+	}
+	if got.Input != "192.0.2.1" {
+		t.Errorf("input = %q, want the server IP when there is no domain", got.Input)
+	}
+	if got.ProbeASN != "AS0" {
+		t.Errorf("probe_asn = %q, want AS0 when unknown", got.ProbeASN)
+	}
+	if failure := got.TestKeys["failure"].(*string); failure != nil {
+		t.Errorf("test_keys.failure = %q, want null on success", *failure)
+	}
+
+	m.Client = nil
+	if _, err := ToOONI(m); err == nil {
+		t.Errorf("ToOONI() expected an error without the client")
+	}
+}
+
+func TestWriteOONI(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteOONI(&buf, []models.Measurement{sampleMeasurement(), sampleMeasurement()}); err != nil {
+		t.Fatalf("WriteOONI() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("WriteOONI() wrote %d lines, want 2", len(lines))
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &envelope); err != nil {
+		t.Fatalf("line is not JSON: %v", err)
+	}
+	if envelope["test_keys"].(map[string]interface{})["failure"] != "connection reset by peer" {
+		t.Errorf("test_keys.failure = %v", envelope["test_keys"])
+	}
+	if strings.Contains(buf.String(), "probe_ip") {
+		t.Errorf("export must not contain the probe IP")
+	}
+}
@@ -0,0 +1,23 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"connectivity-tester/pkg/database"
+)
+
+// WritePrefixMatrix writes the winning prefix of each server, country and
+// ASN as indented JSON
+func WritePrefixMatrix(w io.Writer, cells []database.PrefixMatrixCell) error {
+	if cells == nil {
+		cells = []database.PrefixMatrixCell{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cells); err != nil {
+		return fmt.Errorf("failed to write prefix matrix: %v", err)
+	}
+	return nil
+}
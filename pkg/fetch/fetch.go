@@ -12,7 +12,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
+	"connectivity-tester/pkg/connectivity"
 )
 
 // Options contains all the configuration options for making a fetch request
@@ -59,7 +59,7 @@ func Fetch(url string, opts Options) (*Result, error) {
 		}
 	}
 
-	dialer, err := configurl.NewDefaultConfigToDialer().NewStreamDialer(opts.Transport)
+	dialer, err := connectivity.NewConfigToDialer().NewStreamDialer(opts.Transport)
 	if err != nil {
 		return nil, fmt.Errorf("could not create dialer: %w", err)
 	}
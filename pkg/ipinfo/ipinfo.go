@@ -1,11 +1,13 @@
 package ipinfo
 
 import (
+	"bytes"
 	"connectivity-tester/pkg/models"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -24,7 +26,26 @@ type IPInfoResponse struct {
 }
 
 func GetIPInfo(ip string) (IPInfoResponse, error) {
-	url := fmt.Sprintf("https://ipinfo.io/%s?token=%s", ip, viper.GetString("ipinfo.token"))
+	return getIPInfo(fmt.Sprintf("https://ipinfo.io/%s?token=%s", ip, viper.GetString("ipinfo.token")))
+}
+
+// GetLocalIPInfo returns the info of this machine's public IP. ipVersion
+// is "v4" or "v6" to look up the address of that version on dual stack
+// machines, or empty to use the address the lookup connects from.
+func GetLocalIPInfo(ipVersion string) (IPInfoResponse, error) {
+	var host string
+	switch ipVersion {
+	case "":
+		host = "ipinfo.io"
+	case "v4", "v6":
+		host = ipVersion + ".ipinfo.io"
+	default:
+		return IPInfoResponse{}, fmt.Errorf("unsupported IP version: %s", ipVersion)
+	}
+	return getIPInfo(fmt.Sprintf("https://%s/?token=%s", host, viper.GetString("ipinfo.token")))
+}
+
+func getIPInfo(url string) (IPInfoResponse, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		return IPInfoResponse{}, err
@@ -40,6 +61,59 @@ func GetIPInfo(ip string) (IPInfoResponse, error) {
 	return ipInfo, nil
 }
 
+// batchSize is the maximum number of IPs ipinfo.io accepts in a batch request
+const batchSize = 1000
+
+// batchURL is the ipinfo.io batch endpoint, it's replaced in tests
+var batchURL = "https://ipinfo.io/batch"
+
+// GetIPInfoBatch looks up the IPs with as few requests as possible, posting up
+// to batchSize IPs per request. The result is keyed by IP and only contains
+// the IPs ipinfo.io returned information for.
+func GetIPInfoBatch(ips []string) (map[string]IPInfoResponse, error) {
+	results := make(map[string]IPInfoResponse, len(ips))
+	for start := 0; start < len(ips); start += batchSize {
+		end := min(start+batchSize, len(ips))
+		if err := getIPInfoBatch(ips[start:end], results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// getIPInfoBatch posts a single batch request and adds the responses to results
+func getIPInfoBatch(ips []string, results map[string]IPInfoResponse) error {
+	body, err := json.Marshal(ips)
+	if err != nil {
+		return fmt.Errorf("failed to encode batch request: %v", err)
+	}
+
+	url := fmt.Sprintf("%s?token=%s", batchURL, viper.GetString("ipinfo.token"))
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("batch request failed with status %s", resp.Status)
+	}
+
+	var batch map[string]IPInfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return fmt.Errorf("failed to decode batch response: %v", err)
+	}
+
+	for ip, ipInfo := range batch {
+		// IPs ipinfo.io couldn't look up come back as an error object
+		if ipInfo.IP == "" {
+			continue
+		}
+		results[ip] = ipInfo
+	}
+	return nil
+}
+
 func UpdateServerWithIPInfo(server *models.Server, ipInfo IPInfoResponse) {
 	// Parse ASN and AS org name from the "org" field
 	orgParts := strings.SplitN(ipInfo.Org, " ", 2)
@@ -54,4 +128,5 @@ func UpdateServerWithIPInfo(server *models.Server, ipInfo IPInfoResponse) {
 	server.City = ipInfo.City
 	server.Region = ipInfo.Region
 	server.Country = ipInfo.Country
+	server.GeoUpdatedAt = time.Now()
 }
\ No newline at end of file
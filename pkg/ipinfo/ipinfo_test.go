@@ -0,0 +1,92 @@
+package ipinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetIPInfoBatch(t *testing.T) {
+	var requests [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("got %s request, want POST", r.Method)
+		}
+		var ips []string
+		if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+			t.Fatalf("failed to decode request: %v", err)
+		}
+		requests = append(requests, ips)
+
+		resp := make(map[string]any)
+		for _, ip := range ips {
+			if ip == "bogus" {
+				resp[ip] = map[string]any{"error": map[string]string{"title": "Wrong ip"}}
+				continue
+			}
+			resp[ip] = IPInfoResponse{IP: ip, Country: "US", Org: "AS15169 Google LLC"}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	origURL := batchURL
+	t.Cleanup(func() { batchURL = origURL })
+	batchURL = srv.URL
+
+	ips := []string{"bogus"}
+	for i := 0; i < batchSize+1; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+
+	got, err := GetIPInfoBatch(ips)
+	if err != nil {
+		t.Fatalf("GetIPInfoBatch() error = %v", err)
+	}
+
+	if len(requests) != 2 || len(requests[0]) != batchSize || len(requests[1]) != 2 {
+		t.Errorf("got %d requests, want %d IPs in the first and 2 in the second", len(requests), batchSize)
+	}
+	if len(got) != batchSize+1 {
+		t.Errorf("GetIPInfoBatch() returned %d results, want %d", len(got), batchSize+1)
+	}
+	if _, ok := got["bogus"]; ok {
+		t.Errorf("GetIPInfoBatch() returned a result for an IP that failed to look up")
+	}
+	if info := got["10.0.0.1"]; info.Country != "US" || info.Org != "AS15169 Google LLC" {
+		t.Errorf("GetIPInfoBatch()[10.0.0.1] = %+v", info)
+	}
+}
+
+func TestGetIPInfoBatchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	origURL := batchURL
+	t.Cleanup(func() { batchURL = origURL })
+	batchURL = srv.URL
+
+	if _, err := GetIPInfoBatch([]string{"10.0.0.1"}); err == nil {
+		t.Errorf("GetIPInfoBatch() expected an error for a failed request")
+	}
+}
+
+func TestParseOrg(t *testing.T) {
+	tests := []struct {
+		org, asNumber, asOrg string
+	}{
+		{"AS3320 Deutsche Telekom AG", "3320", "Deutsche Telekom AG"},
+		{"Telekom", "", "Telekom"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		asNumber, asOrg := ParseOrg(tt.org)
+		if asNumber != tt.asNumber || asOrg != tt.asOrg {
+			t.Errorf("ParseOrg(%q) = %q, %q, want %q, %q", tt.org, asNumber, asOrg, tt.asNumber, tt.asOrg)
+		}
+	}
+}
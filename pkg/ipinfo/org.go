@@ -0,0 +1,14 @@
+package ipinfo
+
+import "strings"
+
+// ParseOrg splits an org such as "AS3320 Deutsche Telekom AG" into the AS
+// number and the organization name. An org without an AS number is returned
+// whole as the organization name.
+func ParseOrg(org string) (asNumber, asOrg string) {
+	orgParts := strings.SplitN(org, " ", 2)
+	if len(orgParts) == 2 {
+		return strings.TrimPrefix(orgParts[0], "AS"), orgParts[1]
+	}
+	return "", org
+}
@@ -0,0 +1,143 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"connectivity-tester/pkg/models"
+)
+
+// errNoSuccess is returned by measure when none of the first tests of a
+// server succeeded. It's a result, not an error of the job, but counts as a
+// failure of the client, see failureBreaker.
+var errNoSuccess = errors.New("no test succeeded")
+
+// failureBreaker stops the jobs of a client after limit consecutive failed
+// jobs, since a client that fails every server most likely has a bad exit
+// node. A limit that is not positive never trips.
+type failureBreaker struct {
+	mu          sync.Mutex
+	limit       int
+	consecutive int
+	tripped     bool
+	// tripping is set while onTrip of the tripped breaker runs, jobs wait
+	// for it in skip
+	tripping bool
+	// done is signaled when onTrip returns
+	done *sync.Cond
+	// abandoned counts the jobs skipped while the breaker was tripped
+	abandoned int
+}
+
+// newFailureBreaker creates the breaker of a client session from
+// measurement.max_consecutive_failures
+func (s *MeasurementService) newFailureBreaker() *failureBreaker {
+	return &failureBreaker{limit: s.config.GetInt("measurement.max_consecutive_failures")}
+}
+
+// skip reports whether the next job must be abandoned and counts it if so.
+// It waits for the breaker to finish tripping.
+func (b *failureBreaker) skip() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.tripping {
+		b.done.Wait()
+	}
+	if b.tripped {
+		b.abandoned++
+	}
+	return b.tripped
+}
+
+// record counts the outcome of a job. When the breaker trips, onTrip is
+// called before any other job starts, and the breaker is reset if it
+// returns true, e.g. because the client was replaced. The outcomes of jobs
+// that finish while onTrip runs aren't counted.
+func (b *failureBreaker) record(failed bool, onTrip func() bool) {
+	b.mu.Lock()
+	if b.limit <= 0 || b.tripped {
+		b.mu.Unlock()
+		return
+	}
+	if !failed {
+		b.consecutive = 0
+		b.mu.Unlock()
+		return
+	}
+	b.consecutive++
+	if b.consecutive < b.limit {
+		b.mu.Unlock()
+		return
+	}
+	b.tripped = true
+	b.tripping = true
+	if b.done == nil {
+		b.done = sync.NewCond(&b.mu)
+	}
+	b.mu.Unlock()
+
+	// onTrip may take a while to replace the client, it runs unlocked so
+	// it can't deadlock on the breaker
+	reset := onTrip()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if reset {
+		b.tripped = false
+		b.consecutive = 0
+	}
+	b.tripping = false
+	b.done.Broadcast()
+}
+
+// abandonedJobs returns the number of jobs skipped by the breaker
+func (b *failureBreaker) abandonedJobs() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.abandoned
+}
+
+// tripClient stops using a client that failed too many jobs in a row: it's
+// expired and, if the session can replace it, see
+// measurement.replace_failing_clients, replaced so the remaining jobs run on
+// a new client. It returns true if the session has a new client.
+func (s *MeasurementService) tripClient(session *clientSession, client *models.Client, failures int) bool {
+	s.logger.Warn("Client failed too many jobs in a row, abandoning its remaining jobs",
+		"clientID", client.ID,
+		"clientIP", client.IP,
+		"isp", client.ISP,
+		"consecutiveFailures", failures)
+
+	var replaced bool
+	if session.replace != nil {
+		replacement, err := session.swap(client, session.replace, func(old, new *models.Client) {
+			// Keep monitoring the session with the new client
+			if _, monitored := s.activeClients.Load(old.ID); monitored {
+				s.activeClients.Store(new.ID, new)
+			}
+		})
+		if err != nil {
+			s.logger.Error("Failed to replace failing client",
+				"clientID", client.ID,
+				"isp", client.ISP,
+				"error", err)
+		} else {
+			s.logger.Info("Replaced failing client",
+				"oldClientID", client.ID,
+				"clientID", replacement.ID,
+				"clientIP", replacement.IP,
+				"isp", replacement.ISP)
+			replaced = true
+		}
+	}
+
+	s.activeClients.Delete(client.ID)
+	if err := s.db.UpdateClientExpiration(context.Background(), client.ID, timeNow()); err != nil {
+		s.logger.Error("Failed to expire failing client",
+			"clientID", client.ID,
+			"error", err)
+	}
+	return replaced
+}
@@ -0,0 +1,152 @@
+package measurement
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+func TestProcessMeasurementsBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	origNow := timeNow
+	t.Cleanup(func() { timeNow = origNow })
+	timeNow = func() time.Time { return now }
+
+	var servers []models.Server
+	for i := 1; i <= 8; i++ {
+		servers = append(servers, models.Server{ID: int64(i)})
+	}
+
+	for _, replace := range []bool{false, true} {
+		store := &memoryStore{}
+		clients, _ := store.InsertClients(context.Background(), []models.Client{
+			{IP: "198.51.100.1", ISP: "MCI", ExpirationTime: now.Add(time.Hour)},
+			{IP: "198.51.100.2", ISP: "MCI", ExpirationTime: now.Add(time.Hour)},
+		})
+		bad, good := clients[0], clients[1]
+
+		config := viper.New()
+		config.Set("measurement.max_consecutive_failures", 3)
+		config.Set("measurement.replace_failing_clients", replace)
+		s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, &fakeProvider{})
+
+		// Every server fails on the bad client and works on the good one
+		var got []int64
+		s.measure = func(client models.Client, server models.Server, rotate *sessionRotation) error {
+			got = append(got, client.ID)
+			if client.ID == bad.ID {
+				return errNoSuccess
+			}
+			return nil
+		}
+		session := s.newClientSession(&bad, func() (*models.Client, error) {
+			return &good, nil
+		})
+		s.activeClients.Store(bad.ID, &bad)
+
+		s.processMeasurements(session, servers, database.ServerOrderDefault)
+
+		want := []int64{bad.ID, bad.ID, bad.ID}
+		if replace {
+			want = append(want, good.ID, good.ID, good.ID, good.ID, good.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("replace %t: jobs ran on clients %v, want %v", replace, got, want)
+		}
+
+		// The failing client is expired and no longer monitored
+		if expiration := store.clients[0].ExpirationTime; !expiration.Equal(now) {
+			t.Errorf("replace %t: failing client expires at %v, want %v", replace, expiration, now)
+		}
+		if _, monitored := s.activeClients.Load(bad.ID); monitored {
+			t.Errorf("replace %t: failing client is still monitored", replace)
+		}
+		if _, monitored := s.activeClients.Load(good.ID); monitored != replace {
+			t.Errorf("replace %t: replacement client monitored = %t", replace, monitored)
+		}
+	}
+}
+
+func TestFailureBreakerDisabled(t *testing.T) {
+	breaker := &failureBreaker{}
+	for i := 0; i < 10; i++ {
+		breaker.record(true, func() bool {
+			t.Fatal("breaker without a limit tripped")
+			return false
+		})
+	}
+	if breaker.skip() {
+		t.Error("breaker without a limit skips jobs")
+	}
+}
+
+func TestFailureBreakerTripUnlocked(t *testing.T) {
+	breaker := &failureBreaker{limit: 1}
+	tripped := make(chan struct{})
+	go breaker.record(true, func() bool {
+		// The breaker can be used while the client is replaced
+		breaker.abandonedJobs()
+		close(tripped)
+		return true
+	})
+	select {
+	case <-tripped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onTrip deadlocked on the breaker")
+	}
+	if breaker.skip() {
+		t.Error("breaker skips jobs after the client was replaced")
+	}
+}
+
+func TestMeasureOnClientsBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	origNow := timeNow
+	t.Cleanup(func() { timeNow = origNow })
+	timeNow = func() time.Time { return now }
+
+	store := &memoryStore{}
+	clients, _ := store.InsertClients(context.Background(), []models.Client{
+		{IP: "198.51.100.1", ISP: "MCI", ExpirationTime: now.Add(time.Hour)},
+		{IP: "198.51.100.2", ISP: "MTN", ExpirationTime: now.Add(time.Hour)},
+	})
+	bad, good := clients[0], clients[1]
+
+	config := viper.New()
+	config.Set("measurement.max_consecutive_failures", 2)
+	s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, &fakeProvider{})
+	measured := make(map[int64]int)
+	s.measure = func(client models.Client, server models.Server, rotate *sessionRotation) error {
+		measured[client.ID]++
+		if client.ID == bad.ID {
+			return errNoSuccess
+		}
+		return nil
+	}
+	sessions := []clientServers{
+		{session: s.newClientSession(&bad, nil), breaker: s.newFailureBreaker()},
+		{session: s.newClientSession(&good, nil), breaker: s.newFailureBreaker()},
+	}
+
+	// The provider has one worker, so the servers are measured in turn
+	for id := int64(1); id <= 5; id++ {
+		s.measureOnClients(models.Server{ID: id}, sessions)
+	}
+	if measured[bad.ID] != 2 || measured[good.ID] != 5 {
+		t.Errorf("measured %d servers on the failing client and %d on the other, want 2 and 5", measured[bad.ID], measured[good.ID])
+	}
+	if abandoned := sessions[0].breaker.abandonedJobs(); abandoned != 3 {
+		t.Errorf("abandoned %d servers of the failing client, want 3", abandoned)
+	}
+	if expiration := store.clients[0].ExpirationTime; !expiration.Equal(now) {
+		t.Errorf("failing client expires at %v, want %v", expiration, now)
+	}
+}
@@ -0,0 +1,158 @@
+package measurement
+
+import (
+	"net/url"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+)
+
+// defaultAttemptCost is the estimated time a single retry or prefix attempt
+// takes when measurement.attempt_cost is not configured
+const defaultAttemptCost = 15 * time.Second
+
+// timeNow returns the current time, it's replaced in tests
+var timeNow = time.Now
+
+// attemptFunc runs one retry of a protocol test, optionally with a prefix
+// and an access link that overrides the server's. It reports whether the
+// test succeeded.
+type attemptFunc func(retryNumber int, prefix string, accessLinkOverride *string) (bool, error)
+
+// stopOnFirstSuccess reports whether the remaining prefixes of a protocol are
+// skipped once a retry or prefix succeeded, measurement.stop_on_first_success
+func (s *MeasurementService) stopOnFirstSuccess() bool {
+	return s.config.GetBool("measurement.stop_on_first_success")
+}
+
+// attemptCost returns the estimated time a single retry or prefix attempt takes
+func (s *MeasurementService) attemptCost() time.Duration {
+	if seconds := s.config.GetInt("measurement.attempt_cost"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultAttemptCost
+}
+
+// hasSessionBudget reports whether the client session lasts long enough
+// for another attempt of the given cost
+func hasSessionBudget(client models.Client, cost time.Duration) bool {
+	return !timeNow().Add(cost).After(client.ExpirationTime)
+}
+
+// retryProtocol retries a failed protocol test, then tries each prefix for
+// tcp. Remaining attempts are skipped once the client session has no time
+// left for them, or with measurement.stop_on_first_success once one of them
+// succeeded. It returns the last retry number used.
+func (s *MeasurementService) retryProtocol(
+	client models.Client,
+	server models.Server,
+	protocol string,
+	retryCount int,
+	attempt attemptFunc,
+) int {
+	cost := s.attemptCost()
+
+	if !hasSessionBudget(client, cost) {
+		s.logger.Warn("Session budget exhausted, skipping retries",
+			"protocol", protocol,
+			"clientID", client.ID,
+			"serverIP", server.IP,
+			"expiresIn", client.ExpirationTime.Sub(timeNow()).Seconds())
+		return retryCount
+	}
+
+	retryCount = retryCount + 1
+	// Perform retry measurement for this protocol
+	succeeded, err := attempt(retryCount, "", nil)
+	if err != nil {
+		s.logger.Warn("retry measurement failed",
+			"protocol", protocol,
+			"error", err)
+	}
+	if succeeded && s.stopOnFirstSuccess() {
+		s.logger.Debug("Retry succeeded, skipping prefixes",
+			"protocol", protocol,
+			"clientID", client.ID,
+			"serverIP", server.IP)
+		return retryCount
+	}
+
+	return s.tryPrefixes(client, server, protocol, retryCount, attempt)
+}
+
+// tryPrefixes tests each prefix in turn while the client session has time
+// left for it, and with measurement.stop_on_first_success until one of them
+// succeeded. Prefixes only apply to tcp tests through a tunnel protocol. It
+// returns the last retry number used.
+func (s *MeasurementService) tryPrefixes(
+	client models.Client,
+	server models.Server,
+	protocol string,
+	retryCount int,
+	attempt attemptFunc,
+) int {
+	// don't try prefixes on udp as it's not supported, nor on
+	// direct targets which have no tunnel protocol to prefix
+	if protocol != "tcp" || server.Scheme == connectivity.DirectScheme {
+		return retryCount
+	}
+
+	cost := s.attemptCost()
+
+	// Try with different prefixes for this protocol
+	for i, prefix := range s.prefixes {
+		if !hasSessionBudget(client, cost) {
+			s.logger.Warn("Session budget exhausted, skipping prefixes",
+				"protocol", protocol,
+				"clientID", client.ID,
+				"serverIP", server.IP,
+				"skippedPrefixes", len(s.prefixes)-i,
+				"expiresIn", client.ExpirationTime.Sub(timeNow()).Seconds())
+			break
+		}
+
+		newAccessLink := prefixedAccessLink(server, prefix)
+		s.logger.Debug("Testing with prefix",
+			"prefix", prefix,
+			"newAccessLink", connectivity.RedactTransport(newAccessLink),
+		)
+		retryCount = retryCount + 1
+		succeeded, err := attempt(retryCount, prefix, &newAccessLink)
+		if err != nil {
+			s.logger.Warn("prefix measurement failed",
+				"protocol", protocol,
+				"prefix", prefix,
+				"error", err)
+		}
+		if succeeded && s.stopOnFirstSuccess() {
+			s.logger.Info("Prefix succeeded, skipping remaining prefixes",
+				"protocol", protocol,
+				"prefix", prefix,
+				"clientID", client.ID,
+				"serverIP", server.IP,
+				"skippedPrefixes", len(s.prefixes)-i-1)
+			break
+		}
+		// TODO: try split for tcp if at least one retry has succeeded
+	}
+
+	return retryCount
+}
+
+// prefixedAccessLink returns the access link of server with prefix applied.
+// The prefix replaces the one the link may have, and its other query
+// parameters are kept. Prefixes are percent-encoded, as in config.
+func prefixedAccessLink(server models.Server, prefix string) string {
+	u, err := url.Parse(server.FullAccessLink)
+	if err != nil {
+		return server.FullAccessLink + "?prefix=" + prefix
+	}
+	if unescaped, err := url.PathUnescape(prefix); err == nil {
+		prefix = unescaped
+	}
+	q := u.Query()
+	q.Set("prefix", prefix)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
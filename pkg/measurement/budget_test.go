@@ -0,0 +1,173 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+func TestRetryProtocolSessionBudget(t *testing.T) {
+	start := time.Now()
+	now := start
+	origNow := timeNow
+	t.Cleanup(func() { timeNow = origNow })
+	timeNow = func() time.Time { return now }
+
+	config := viper.New()
+	config.Set("measurement.attempt_cost", 10)
+	s := &MeasurementService{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config:   config,
+		prefixes: []string{"a", "b", "c"},
+	}
+	server := models.Server{IP: "192.0.2.1", Scheme: "ss", FullAccessLink: "ss://user:pass@192.0.2.1:8388"}
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		protocol  string
+		want      []string
+	}{
+		{
+			name:      "enough time for all attempts",
+			expiresIn: time.Hour,
+			protocol:  "tcp",
+			want:      []string{"", "a", "b", "c"},
+		},
+		{
+			name:      "near expiry skips later prefixes",
+			expiresIn: 25 * time.Second,
+			protocol:  "tcp",
+			want:      []string{"", "a"},
+		},
+		{
+			name:      "no time left skips the retry",
+			expiresIn: 5 * time.Second,
+			protocol:  "tcp",
+			want:      nil,
+		},
+		{
+			name:      "udp is not retried with prefixes",
+			expiresIn: time.Hour,
+			protocol:  "udp",
+			want:      []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = start
+			client := models.Client{ID: 1, ExpirationTime: start.Add(tt.expiresIn)}
+
+			var attempted []string
+			retryCount := s.retryProtocol(client, server, tt.protocol, 2,
+				func(retryNumber int, prefix string, accessLinkOverride *string) (bool, error) {
+					attempted = append(attempted, prefix)
+					// each attempt takes as long as estimated
+					now = now.Add(10 * time.Second)
+					return false, nil
+				})
+
+			if !reflect.DeepEqual(attempted, tt.want) {
+				t.Errorf("attempted prefixes = %q, want %q", attempted, tt.want)
+			}
+			if want := 2 + len(tt.want); retryCount != want {
+				t.Errorf("retryProtocol() = %d, want %d", retryCount, want)
+			}
+		})
+	}
+}
+
+func TestMeasureServerStopOnFirstSuccess(t *testing.T) {
+	for _, stop := range []bool{false, true} {
+		store := &memoryStore{}
+		ctx := context.Background()
+		server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://user:pass@192.0.2.1:443", Scheme: "ss"}
+		store.UpsertServer(ctx, &server)
+
+		config := viper.New()
+		config.Set("measurement.prefixes", []string{"a", "b", "c"})
+		config.Set("measurement.stop_on_first_success", stop)
+		s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, &fakeProvider{})
+		// Only tcp with prefix b gets through
+		s.testConnectivity = func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+			if proto == "tcp" && strings.HasSuffix(transportConfig, "?prefix=b") {
+				return connectivity.ConnectivityReport{}, nil
+			}
+			return connectivity.ConnectivityReport{}, errors.New("connection reset by peer")
+		}
+
+		client := models.Client{ID: 1, IP: "198.51.100.1", Proxy: "fake", ProxyURL: "socks5://198.51.100.1", ExpirationTime: time.Now().Add(time.Hour)}
+		if err := s.measureServer(client, server, nil); !errors.Is(err, errNoSuccess) {
+			t.Fatalf("stop %t: measureServer() error = %v, want errNoSuccess", stop, err)
+		}
+
+		var tcpPrefixes []string
+		for _, m := range store.measurements {
+			if m.Protocol == "tcp" && m.RetryNumber > 0 {
+				tcpPrefixes = append(tcpPrefixes, m.PrefixUsed)
+			}
+		}
+		want := []string{"", "a", "b", "c"}
+		if stop {
+			want = []string{"", "a", "b"}
+		}
+		if !reflect.DeepEqual(tcpPrefixes, want) {
+			t.Errorf("stop %t: tcp retried with prefixes %q, want %q", stop, tcpPrefixes, want)
+		}
+	}
+}
+
+func TestRetryProtocolStopsAfterSuccessfulRetry(t *testing.T) {
+	config := viper.New()
+	config.Set("measurement.stop_on_first_success", true)
+	s := &MeasurementService{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config:   config,
+		prefixes: []string{"a", "b"},
+	}
+	server := models.Server{IP: "192.0.2.1", Scheme: "ss", FullAccessLink: "ss://user:pass@192.0.2.1:8388"}
+	client := models.Client{ID: 1, ExpirationTime: time.Now().Add(time.Hour)}
+
+	var attempted []string
+	retryCount := s.retryProtocol(client, server, "tcp", 0,
+		func(retryNumber int, prefix string, accessLinkOverride *string) (bool, error) {
+			attempted = append(attempted, prefix)
+			return true, nil
+		})
+	if want := []string{""}; !reflect.DeepEqual(attempted, want) || retryCount != 1 {
+		t.Errorf("attempted prefixes = %q with retry count %d, want %q and 1", attempted, retryCount, want)
+	}
+}
+
+func TestPrefixedAccessLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		link   string
+		prefix string
+		want   string
+	}{
+		{"no query", "ss://key@192.0.2.1:8388", "GET%20", "ss://key@192.0.2.1:8388?prefix=GET+"},
+		{"query", "ss://key@192.0.2.1:8388/?outline=1", "%16%03%01", "ss://key@192.0.2.1:8388/?outline=1&prefix=%16%03%01"},
+		{"replaced prefix", "ss://key@192.0.2.1:8388/?outline=1&prefix=%16%03%01", "POST%20", "ss://key@192.0.2.1:8388/?outline=1&prefix=POST+"},
+		{"fragment", "ss://key@192.0.2.1:8388#name", "%13%03%03", "ss://key@192.0.2.1:8388?prefix=%13%03%03#name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := prefixedAccessLink(models.Server{FullAccessLink: tt.link}, tt.prefix)
+			if got != tt.want {
+				t.Errorf("prefixedAccessLink(%q, %q) = %q, want %q", tt.link, tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package measurement
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defaultWriteAttempts is the number of times an insert is tried when
+	// measurement.write_retry_attempts is not configured
+	defaultWriteAttempts = 5
+	// defaultWriteBackoff is the wait before the first retry of an insert
+	// when measurement.write_retry_backoff_ms is not configured
+	defaultWriteBackoff = 500 * time.Millisecond
+)
+
+// writeBuffer holds back measurements while their store is unavailable so a
+// brief database outage doesn't lose them. Inserts failing to reach the
+// database are retried with backoff, and if the store is still failing
+// they're spilled to a file to be imported later, see ImportSpillFile.
+// Inserts the database rejects, e.g. for a constraint violation, fail as
+// they would without the buffer.
+type writeBuffer struct {
+	logger *slog.Logger
+	// attempts is the number of times an insert is tried before spilling
+	attempts int
+	// backoff is the wait before the first retry, it doubles for each
+	// further retry
+	backoff time.Duration
+	// spillFile receives the measurements that couldn't be inserted, they
+	// are lost if it's empty
+	spillFile string
+	// sleep waits between retries until ctx is done, it's replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu sync.Mutex
+	// outage is set after a measurement was spilled, inserts are tried only
+	// once until one succeeds again, so workers don't wait out the backoff
+	// of each measurement
+	outage bool
+	// spilled counts the measurements written to the spill file
+	spilled int
+}
+
+// newWriteBuffer returns the write buffer of measurement.write_retry_attempts,
+// measurement.write_retry_backoff_ms and measurement.spill_file
+func newWriteBuffer(config *viper.Viper, logger *slog.Logger) *writeBuffer {
+	w := &writeBuffer{
+		logger:    logger,
+		attempts:  defaultWriteAttempts,
+		backoff:   defaultWriteBackoff,
+		spillFile: config.GetString("measurement.spill_file"),
+		sleep:     sleepContext,
+	}
+	if config.IsSet("measurement.write_retry_attempts") {
+		w.attempts = config.GetInt("measurement.write_retry_attempts")
+	}
+	if ms := config.GetInt("measurement.write_retry_backoff_ms"); ms > 0 {
+		w.backoff = time.Duration(ms) * time.Millisecond
+	}
+	return w
+}
+
+// insert stores the measurement in store, retrying while the database is
+// unavailable, see database.IsUnavailable. A measurement that still can't be
+// inserted, or whose insert failed once ctx is done, is spilled right away,
+// only the failure to spill it is returned. Other insert errors are returned
+// as they are. A nil buffer inserts once.
+func (w *writeBuffer) insert(ctx context.Context, store measurementStore, measurement *models.Measurement) error {
+	if w == nil {
+		return store.InsertMeasurement(ctx, measurement)
+	}
+
+	attempts := w.attempts
+	w.mu.Lock()
+	if w.outage {
+		attempts = 1
+	}
+	w.mu.Unlock()
+
+	backoff := w.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = store.InsertMeasurement(ctx, measurement); err == nil {
+			w.recovered()
+			return nil
+		}
+		if !database.IsUnavailable(err) && ctx.Err() == nil {
+			return err
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+		w.logger.Warn("Failed to insert measurement, retrying",
+			"attempt", attempt,
+			"backoff", backoff,
+			"error", err)
+		if w.sleep(ctx, backoff) != nil {
+			break
+		}
+		backoff *= 2
+	}
+
+	if w.spillFile == "" {
+		return err
+	}
+	if spillErr := w.spill(measurement); spillErr != nil {
+		return fmt.Errorf("%v, failed to spill measurement: %v", err, spillErr)
+	}
+	w.logger.Warn("Spilled measurement the database didn't take",
+		"file", w.spillFile,
+		"serverID", measurement.ServerID,
+		"clientID", measurement.ClientID,
+		"error", err)
+	return nil
+}
+
+// sleepContext waits for d, or until ctx is done and returns its error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// recovered ends an outage after a successful insert
+func (w *writeBuffer) recovered() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.outage {
+		w.logger.Info("Database takes measurements again",
+			"spilled", w.spilled,
+			"file", w.spillFile)
+		w.outage = false
+	}
+}
+
+// spill appends the measurement to the spill file as a line of JSON
+func (w *writeBuffer) spill(measurement *models.Measurement) error {
+	data, err := json.Marshal(measurement)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := appendSpillFile(w.spillFile, append(data, '\n')); err != nil {
+		return err
+	}
+	w.outage = true
+	w.spilled++
+	return nil
+}
+
+// appendSpillFile appends data to the file at path, creating it if needed
+func appendSpillFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ImportSpillFile inserts the measurements spilled to path into store and
+// returns how many were inserted. The file is moved aside before it's read,
+// so measurements a running measure spills meanwhile go to a new file at
+// path and are kept for the next import. If an insert fails, the
+// measurements not inserted yet are appended back to path, so the import can
+// be run again.
+func ImportSpillFile(ctx context.Context, store measurementStore, path string) (int, error) {
+	importing := fmt.Sprintf("%s.importing-%d", path, os.Getpid())
+	if err := os.Rename(path, importing); err != nil {
+		return 0, err
+	}
+	measurements, err := readSpillFile(importing)
+	if err != nil {
+		if restoreErr := restoreSpillFile(importing, path); restoreErr != nil {
+			return 0, fmt.Errorf("%v, failed to restore %s from %s: %v", err, path, importing, restoreErr)
+		}
+		return 0, err
+	}
+
+	for i := range measurements {
+		// The database assigns the IDs
+		measurements[i].ID = 0
+		if err := store.InsertMeasurement(ctx, &measurements[i]); err != nil {
+			if writeErr := writeSpillFile(path, measurements[i:]); writeErr != nil {
+				return i, fmt.Errorf("failed to insert measurement: %v, failed to keep the remaining measurements, the first %d of %s are inserted: %v", err, i, importing, writeErr)
+			}
+			return i, errors.Join(fmt.Errorf("failed to insert measurement: %v", err), os.Remove(importing))
+		}
+	}
+	return len(measurements), os.Remove(importing)
+}
+
+// readSpillFile returns the measurements spilled to the file at path
+func readSpillFile(path string) ([]models.Measurement, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var measurements []models.Measurement
+	scanner := bufio.NewScanner(f)
+	// Full reports can be larger than the default line limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var measurement models.Measurement
+		if err := json.Unmarshal(scanner.Bytes(), &measurement); err != nil {
+			return nil, fmt.Errorf("invalid measurement on line %d of %s: %v", line, path, err)
+		}
+		measurements = append(measurements, measurement)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return measurements, nil
+}
+
+// writeSpillFile appends the measurements to the file at path
+func writeSpillFile(path string, measurements []models.Measurement) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range measurements {
+		if err := enc.Encode(&measurements[i]); err != nil {
+			return err
+		}
+	}
+	return appendSpillFile(path, buf.Bytes())
+}
+
+// restoreSpillFile puts the spill file moved to importing back at path,
+// keeping the measurements spilled there meanwhile
+func restoreSpillFile(importing, path string) error {
+	data, err := os.ReadFile(importing)
+	if err != nil {
+		return err
+	}
+	if err := appendSpillFile(path, data); err != nil {
+		return err
+	}
+	return os.Remove(importing)
+}
@@ -0,0 +1,280 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+)
+
+// downStore fails the inserts of a memoryStore while down is set, those of
+// the servers in rejected as the database would reject invalid rows, and
+// those with a done context
+type downStore struct {
+	*memoryStore
+	down     bool
+	failures int
+	rejected map[int64]bool
+	// inserted is called after each insert
+	inserted func()
+}
+
+func (d *downStore) InsertMeasurement(ctx context.Context, measurement *models.Measurement) error {
+	if err := ctx.Err(); err != nil {
+		d.failures++
+		return fmt.Errorf("error inserting measurement: %w", err)
+	}
+	if d.down {
+		d.failures++
+		return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	if d.rejected[measurement.ServerID] {
+		d.failures++
+		return errors.New("violates foreign key constraint")
+	}
+	if err := d.memoryStore.InsertMeasurement(ctx, measurement); err != nil {
+		return err
+	}
+	if d.inserted != nil {
+		d.inserted()
+	}
+	return nil
+}
+
+func TestWriteBufferSurvivesOutage(t *testing.T) {
+	store := &downStore{memoryStore: &memoryStore{}}
+	spillFile := filepath.Join(t.TempDir(), "spill.jsonl")
+	var waits []time.Duration
+	w := &writeBuffer{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		attempts:  3,
+		backoff:   100 * time.Millisecond,
+		spillFile: spillFile,
+	}
+	ctx := context.Background()
+	insert := func(serverID int64) {
+		t.Helper()
+		m := models.Measurement{ClientID: 1, ServerID: serverID, Protocol: "tcp", ErrorOp: "success", FullReport: []byte(`{"test":1}`)}
+		if err := w.insert(ctx, store, &m); err != nil {
+			t.Fatalf("insert(server %d) error = %v", serverID, err)
+		}
+	}
+
+	// A brief outage is waited out
+	store.down = true
+	w.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		store.down = false
+		return nil
+	}
+	insert(1)
+	if len(waits) != 1 || waits[0] != 100*time.Millisecond {
+		t.Errorf("waited %v before retrying, want the 100ms backoff", waits)
+	}
+
+	// A longer one spills the measurements, trying them once after the first
+	store.down = true
+	w.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	insert(2)
+	insert(3)
+	if store.failures != 1+3+1 {
+		t.Errorf("tried %d failed inserts, want 5", store.failures)
+	}
+	if len(waits) != 3 || waits[2] != 200*time.Millisecond {
+		t.Errorf("waited %v before retrying, want the backoff to double", waits)
+	}
+
+	// The database recovers
+	store.down = false
+	insert(4)
+	if len(store.measurements) != 2 {
+		t.Fatalf("stored %d measurements during the outage, want 2", len(store.measurements))
+	}
+
+	imported, err := ImportSpillFile(ctx, store, spillFile)
+	if err != nil {
+		t.Fatalf("ImportSpillFile() error = %v", err)
+	}
+	if imported != 2 {
+		t.Errorf("ImportSpillFile() imported %d measurements, want 2", imported)
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Errorf("spill file wasn't removed after the import: %v", err)
+	}
+
+	// No measurement is lost
+	stored := make(map[int64]models.Measurement)
+	for _, m := range store.measurements {
+		stored[m.ServerID] = m
+	}
+	for serverID := int64(1); serverID <= 4; serverID++ {
+		m, ok := stored[serverID]
+		if !ok {
+			t.Errorf("measurement of server %d was lost", serverID)
+			continue
+		}
+		if m.ErrorOp != "success" || string(m.FullReport) != `{"test":1}` {
+			t.Errorf("measurement of server %d = %+v, want it as it was measured", serverID, m)
+		}
+	}
+}
+
+func TestImportSpillFileKeepsRemaining(t *testing.T) {
+	store := &downStore{memoryStore: &memoryStore{}}
+	spillFile := filepath.Join(t.TempDir(), "spill.jsonl")
+	w := &writeBuffer{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		attempts:  1,
+		spillFile: spillFile,
+	}
+	ctx := context.Background()
+	store.down = true
+	for serverID := int64(1); serverID <= 3; serverID++ {
+		if err := w.insert(ctx, store, &models.Measurement{ServerID: serverID}); err != nil {
+			t.Fatalf("insert() error = %v", err)
+		}
+	}
+
+	// The database is still down, nothing is imported and the file is kept
+	if imported, err := ImportSpillFile(ctx, store, spillFile); err == nil || imported != 0 {
+		t.Fatalf("ImportSpillFile() = %d, %v, want the insert error", imported, err)
+	}
+
+	store.down = false
+	imported, err := ImportSpillFile(ctx, store, spillFile)
+	if err != nil || imported != 3 {
+		t.Fatalf("ImportSpillFile() = %d, %v, want 3 measurements", imported, err)
+	}
+	for i, m := range store.measurements {
+		if m.ServerID != int64(i+1) {
+			t.Errorf("measurement %d is of server %d, want %d", i, m.ServerID, i+1)
+		}
+	}
+}
+
+func TestWriteBufferWithoutSpillFile(t *testing.T) {
+	store := &downStore{memoryStore: &memoryStore{}, down: true}
+	w := &writeBuffer{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		attempts: 2,
+		sleep:    func(context.Context, time.Duration) error { return nil },
+	}
+	if err := w.insert(context.Background(), store, &models.Measurement{ServerID: 1}); err == nil {
+		t.Error("insert() without spill file succeeded while the database is down")
+	}
+	if store.failures != 2 {
+		t.Errorf("tried %d inserts, want 2", store.failures)
+	}
+}
+
+func TestWriteBufferRejectedInsert(t *testing.T) {
+	store := &downStore{memoryStore: &memoryStore{}, rejected: map[int64]bool{1: true}}
+	spillFile := filepath.Join(t.TempDir(), "spill.jsonl")
+	w := &writeBuffer{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		attempts:  3,
+		spillFile: spillFile,
+		sleep: func(context.Context, time.Duration) error {
+			t.Error("a rejected insert was retried")
+			return nil
+		},
+	}
+	if err := w.insert(context.Background(), store, &models.Measurement{ServerID: 1}); err == nil {
+		t.Error("insert() of a rejected measurement succeeded")
+	}
+	if store.failures != 1 {
+		t.Errorf("tried %d inserts, want 1", store.failures)
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Errorf("rejected measurement was spilled: %v", err)
+	}
+}
+
+func TestImportSpillFileWhileSpilling(t *testing.T) {
+	store := &downStore{memoryStore: &memoryStore{}}
+	spillFile := filepath.Join(t.TempDir(), "spill.jsonl")
+	w := &writeBuffer{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		attempts:  1,
+		spillFile: spillFile,
+	}
+	ctx := context.Background()
+	store.down = true
+	for serverID := int64(1); serverID <= 2; serverID++ {
+		if err := w.insert(ctx, store, &models.Measurement{ServerID: serverID}); err != nil {
+			t.Fatalf("insert() error = %v", err)
+		}
+	}
+
+	// A running measure spills a measurement during the import
+	store.down = false
+	store.inserted = func() {
+		store.inserted = nil
+		if err := w.spill(&models.Measurement{ServerID: 3}); err != nil {
+			t.Fatalf("spill() error = %v", err)
+		}
+	}
+	if imported, err := ImportSpillFile(ctx, store, spillFile); err != nil || imported != 2 {
+		t.Fatalf("ImportSpillFile() = %d, %v, want 2 measurements", imported, err)
+	}
+	if imported, err := ImportSpillFile(ctx, store, spillFile); err != nil || imported != 1 {
+		t.Fatalf("second ImportSpillFile() = %d, %v, want the measurement spilled meanwhile", imported, err)
+	}
+	if len(store.measurements) != 3 || store.measurements[2].ServerID != 3 {
+		t.Errorf("stored %+v, want the measurements of servers 1 to 3", store.measurements)
+	}
+	if files, _ := filepath.Glob(spillFile + "*"); len(files) != 0 {
+		t.Errorf("import left %v behind", files)
+	}
+}
+
+func TestWriteBufferCanceledBackoff(t *testing.T) {
+	store := &downStore{memoryStore: &memoryStore{}, down: true}
+	spillFile := filepath.Join(t.TempDir(), "spill.jsonl")
+	w := &writeBuffer{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		attempts:  3,
+		backoff:   time.Hour,
+		spillFile: spillFile,
+		sleep:     sleepContext,
+	}
+
+	// The run is canceled while the insert waits out its backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if err := w.insert(ctx, store, &models.Measurement{ServerID: 1}); err != nil {
+		t.Fatalf("insert() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled insert took %v, want it to stop waiting", elapsed)
+	}
+	if store.failures != 1 {
+		t.Errorf("tried %d inserts, want 1", store.failures)
+	}
+
+	// It's spilled, as are the inserts that fail once the run is canceled
+	store.down = false
+	if err := w.insert(ctx, store, &models.Measurement{ServerID: 2}); err != nil {
+		t.Fatalf("insert() after cancel error = %v", err)
+	}
+	measurements, err := readSpillFile(spillFile)
+	if err != nil {
+		t.Fatalf("readSpillFile() error = %v", err)
+	}
+	if len(measurements) != 2 || measurements[0].ServerID != 1 || measurements[1].ServerID != 2 {
+		t.Errorf("spilled %+v, want the measurements of servers 1 and 2", measurements)
+	}
+}
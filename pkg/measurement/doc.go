@@ -19,8 +19,9 @@ MeasurementService Methods:
 Settings Configuration:
 
 	type Settings struct {
-		Country     string              // Target country for measurements
+		Countries   []string            // Target countries, measured in order
 		ISP         string              // Specific ISP to test (optional)
+		City        string              // City to target clients in (optional)
 		ClientType  models.ClientType   // Type of client (residential/mobile)
 		ServerIDs   []int64            // Specific server IDs to test (optional)
 		ServerNames []string           // Specific server names to test (optional)
@@ -40,14 +41,20 @@ Usage Example:
 
 	// Configure measurement settings
 	settings := measurement.Settings{
-		Country:    "US",
+		Countries:  []string{"us", "ir"},
 		ClientType: models.ResidentialType,
 		MaxRetries: 3,
 		MaxClients: 5,
 	}
 
+	// Check the settings before spending anything, RunMeasurements
+	// checks them again
+	if err := settings.Validate(proxyProvider); err != nil {
+		log.Fatal(err)
+	}
+
 	// Run measurements
-	err := measurementSvc.RunMeasurements(
+	result, err := measurementSvc.RunMeasurements(
 		context.Background(),
 		proxyProvider,
 		settings,
@@ -55,6 +62,7 @@ Usage Example:
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("country mismatches per ISP:", result.CountryMismatches)
 
 	// Cleanup when done
 	defer measurementSvc.Shutdown()
@@ -62,31 +70,76 @@ Usage Example:
 Measurement Process:
 
 1. Client Acquisition:
-  - Obtains proxy clients from the configured provider
-  - Validates client connectivity and characteristics
+  - Obtains proxy clients from the configured provider, optionally falling
+    back to a random ISP when the requested one has no clients
+    (measurement.isp_fallback)
+  - Optionally spreads the clients of a country over its ISPs by subscriber
+    share instead of evenly (measurement.isp_weights)
+  - Optionally gets its own number of clients for an ISP instead of
+    MaxClients (measurement.isp_client_counts)
+  - Optionally reuses the still-valid clients of previous runs for the same
+    target before acquiring new sessions (measurement.session_pool)
+  - Validates client connectivity and characteristics, optionally checking
+    new clients once before measuring (measurement.warmup_clients)
   - Stores client information in the database
 
 2. Server Selection:
   - Retrieves target servers based on configuration
   - Filters servers based on allowed ports and working status
+  - Optionally leaves out servers that recently failed from clients of the
+    provider (measurement.min_server_success_rate)
   - Supports both specific server selection and automatic discovery
+  - Optionally measures a random sample of the servers on each client
+    (Settings.ServersPerClient)
+  - Splits the servers of a client across several sessions when measuring
+    them would take longer than the provider allows (<provider>.max_session_length)
+  - Measures all servers on a client before the next client, or with
+    measurement.iteration_order server_first, a server on every client
+    before the next server
 
 3. Connectivity Testing:
-  - Performs TCP and UDP connectivity tests
+  - Performs TCP and UDP connectivity tests, optionally in parallel
+    (measurement.parallel_protocols), and HTTP requests through the
+    transport (measurement.http_probe)
   - Handles automatic retries for failed connections
-  - Supports custom prefix testing for enhanced connectivity
+  - Supports custom prefix testing for enhanced connectivity, with the
+    inline measurement.prefixes merged with those of
+    measurement.prefixes_source, a file or URL read for every run
+  - Optionally stops trying the prefixes of a protocol once a retry or
+    prefix succeeded (measurement.stop_on_first_success)
 
 4. Result Management:
   - Records detailed measurement results in the database
-  - Captures timing, errors, and full connectivity reports
+  - Retries inserts that fail to reach the database with backoff and
+    spills the measurements of a longer database outage to
+    measurement.spill_file, imported later with ImportSpillFile
+  - Captures timing, including the time to first byte (ttfb_ms), errors,
+    and full connectivity reports
+  - Records protocols skipped for a previous server error, or UDP tests
+    through a provider that can't relay UDP, as rows with error_op
+    "skipped" and a skip_reason, left out of success rates
+  - Raises an alert for each failed first probe, without retry or prefix,
+    of a server expected to be reachable (SetAlerts), counted in
+    RunResult.ExpectedFailures
   - Maintains historical measurement data
+  - Replays a stored measurement from a new client of the same ISP,
+    country, city and type (Replay) to reproduce failures
 
 Monitoring and Management:
 
 The service includes built-in monitoring capabilities:
-  - Active client monitoring
-  - Session expiration handling
+  - Active client monitoring, storing exit IP changes in ip_changes
+  - Optional exit IP verification before each server, flagging the
+    measurements of clients whose IP changed (measurement.verify_exit_ip)
+  - Session expiration handling, optionally replacing clients before
+    they expire (measurement.refresh_clients)
+  - Optionally retrying failed servers on a new proxy session once several
+    servers in a row failed on a client (measurement.rotate_on_failure,
+    measurement.rotate_after_failures)
   - Concurrent measurement management
+  - Run locks that fail a run fast while another run for the same
+    provider and network is measuring one of its countries
+    (Settings.NoLock skips them, they need Postgres)
   - Resource cleanup
 
 Error Handling:
@@ -116,7 +169,8 @@ The service implements several optimizations:
 
 Dependencies:
 
-  - database: For storing measurement results and client information
+  - database: For storing measurement results and client information, through
+    the Store interface so tests can use an in memory store
   - proxy: For managing proxy providers and clients
   - models: For data structures and types
   - connectivity: For network testing functionality
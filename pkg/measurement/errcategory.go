@@ -0,0 +1,52 @@
+package measurement
+
+import "strings"
+
+// Canonical error categories stored with failed measurements
+const (
+	ErrorCategoryReset        = "reset"
+	ErrorCategoryTimeout      = "timeout"
+	ErrorCategoryRefused      = "refused"
+	ErrorCategoryUnreachable  = "unreachable"
+	ErrorCategoryDNSFailure   = "dns_failure"
+	ErrorCategoryTLSHandshake = "tls_handshake"
+	ErrorCategoryEOF          = "eof"
+	ErrorCategoryOther        = "other"
+)
+
+// errorCategoryRule maps error messages containing any of the substrings
+// to a category. Substrings are matched case insensitively.
+type errorCategoryRule struct {
+	category   string
+	substrings []string
+}
+
+// errorCategoryRules are checked in order and the first match wins, so
+// more specific rules go first. Add rules here to recognize new errors.
+var errorCategoryRules = []errorCategoryRule{
+	{ErrorCategoryTLSHandshake, []string{"tls:", "handshake failure", "certificate"}},
+	{ErrorCategoryDNSFailure, []string{"no such host", "server misbehaving", "dns:", "name resolution", "lookup "}},
+	{ErrorCategoryReset, []string{"connection reset", "econnreset"}},
+	{ErrorCategoryRefused, []string{"connection refused", "econnrefused"}},
+	{ErrorCategoryTimeout, []string{"i/o timeout", "deadline exceeded", "timed out", "timeout"}},
+	{ErrorCategoryUnreachable, []string{"network is unreachable", "no route to host", "host is down"}},
+	{ErrorCategoryEOF, []string{"eof"}},
+}
+
+// categorizeError maps a raw error message to its canonical category.
+// Messages no rule matches are categorized as ErrorCategoryOther and an
+// empty message has no category.
+func categorizeError(msg string) string {
+	if msg == "" {
+		return ""
+	}
+	msg = strings.ToLower(msg)
+	for _, rule := range errorCategoryRules {
+		for _, s := range rule.substrings {
+			if strings.Contains(msg, s) {
+				return rule.category
+			}
+		}
+	}
+	return ErrorCategoryOther
+}
@@ -0,0 +1,32 @@
+package measurement
+
+import "testing"
+
+func TestCategorizeError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"", ""},
+		{"read tcp 10.0.0.2:51234->203.0.113.7:443: read: connection reset by peer", ErrorCategoryReset},
+		{"write tcp 10.0.0.2:40112->198.51.100.9:8388: write: connection reset by peer", ErrorCategoryReset},
+		{"read udp 10.0.0.2:53142->203.0.113.7:8388: i/o timeout", ErrorCategoryTimeout},
+		{"context deadline exceeded", ErrorCategoryTimeout},
+		{"dial tcp 203.0.113.7:443: connect: connection refused", ErrorCategoryRefused},
+		{"dial tcp: lookup ss.example.com on 127.0.0.53:53: no such host", ErrorCategoryDNSFailure},
+		{"lookup example.com: server misbehaving", ErrorCategoryDNSFailure},
+		{"tls: handshake failure", ErrorCategoryTLSHandshake},
+		{"remote error: tls: bad certificate", ErrorCategoryTLSHandshake},
+		{"dial tcp 203.0.113.7:443: connect: network is unreachable", ErrorCategoryUnreachable},
+		{"dial tcp 203.0.113.7:443: connect: no route to host", ErrorCategoryUnreachable},
+		{"unexpected EOF", ErrorCategoryEOF},
+		{"EOF", ErrorCategoryEOF},
+		{"socks connect tcp proxy.example:5000->203.0.113.7:443: unknown error general SOCKS server failure", ErrorCategoryOther},
+	}
+
+	for _, tt := range tests {
+		if got := categorizeError(tt.msg); got != tt.want {
+			t.Errorf("categorizeError(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
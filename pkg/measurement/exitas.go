@@ -0,0 +1,44 @@
+package measurement
+
+import (
+	"sync"
+
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+)
+
+// exitAS is the AS an exit IP is located in
+type exitAS struct {
+	number string
+	org    string
+}
+
+// exitASLookup is the cached AS of an exit IP, looked up once
+type exitASLookup struct {
+	once sync.Once
+	as   exitAS
+}
+
+// exitASOf returns the AS of the client's exit IP as located at measurement
+// time if measurement.exit_asn_lookup is set. Each IP is looked up once per
+// service, a failed lookup leaves the AS of its measurements empty.
+func (s *MeasurementService) exitASOf(client models.Client) exitAS {
+	if client.IP == "" || !s.config.GetBool("measurement.exit_asn_lookup") {
+		return exitAS{}
+	}
+
+	entry, _ := s.exitASes.LoadOrStore(client.IP, &exitASLookup{})
+	lookup := entry.(*exitASLookup)
+	lookup.once.Do(func() {
+		info, err := s.lookupIPInfo(client.IP)
+		if err != nil {
+			s.logger.Warn("Failed to look up exit AS",
+				"clientID", client.ID,
+				"clientIP", client.IP,
+				"error", err)
+			return
+		}
+		lookup.as.number, lookup.as.org = ipinfo.ParseOrg(info.Org)
+	})
+	return lookup.as
+}
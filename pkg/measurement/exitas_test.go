@@ -0,0 +1,74 @@
+package measurement
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+func TestPerformMeasurementExitASN(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		db := newTestDB(t)
+		ctx := context.Background()
+		server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+		if err := db.UpsertServer(ctx, &server); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+		now := time.Now()
+		clients, err := db.InsertClients(ctx, []models.Client{{
+			IP: "198.51.100.1", ClientType: "mobile", Time: now, ExpirationTime: now.Add(time.Hour),
+			IPVersion: "v4", CountryCode: "ir", ASNumber: "197207", LastSeen: now, ISP: "MCI", Proxy: "fake",
+		}})
+		if err != nil {
+			t.Fatalf("InsertClients() error = %v", err)
+		}
+
+		config := viper.New()
+		config.Set("measurement.exit_asn_lookup", enabled)
+		s := NewMeasurementService(db, slog.New(slog.NewTextHandler(io.Discard, nil)), config, &fakeProvider{})
+		s.testConnectivity = func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+			return connectivity.ConnectivityReport{}, nil
+		}
+		var lookups atomic.Int64
+		s.lookupIPInfo = func(ip string) (ipinfo.IPInfoResponse, error) {
+			lookups.Add(1)
+			return ipinfo.IPInfoResponse{IP: ip, Org: "AS44244 Iran Cell Service and Communication Company"}, nil
+		}
+
+		if err := s.performMeasurement(clients[0], server, "session", 0, "", nil); err != nil {
+			t.Fatalf("performMeasurement() error = %v", err)
+		}
+
+		measurements, err := db.GetMeasurementsBySession(ctx, "session", 0)
+		if err != nil {
+			t.Fatalf("GetMeasurementsBySession() error = %v", err)
+		}
+		if len(measurements) != 2 {
+			t.Fatalf("stored %d measurements, want 2", len(measurements))
+		}
+		wantASN, wantOrg := "", ""
+		if enabled {
+			// The exit AS differs from the AS the client was acquired in
+			wantASN, wantOrg = "44244", "Iran Cell Service and Communication Company"
+		}
+		for _, m := range measurements {
+			if m.ExitASN != wantASN || m.ExitASOrg != wantOrg {
+				t.Errorf("lookup %t: %s measurement exit AS = %q %q, want %q %q",
+					enabled, m.Protocol, m.ExitASN, m.ExitASOrg, wantASN, wantOrg)
+			}
+		}
+		// The exit IP is looked up once for both protocols
+		if want := map[bool]int64{false: 0, true: 1}[enabled]; lookups.Load() != want {
+			t.Errorf("lookup %t: looked up %d times, want %d", enabled, lookups.Load(), want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package measurement
+
+import (
+	"connectivity-tester/pkg/models"
+)
+
+// verifyExitIP checks with the provider that the exit IP of a remote client
+// is still the IP it was acquired with before a job, if
+// measurement.verify_exit_ip is set. Sessions are meant to keep their exit IP,
+// but a silent rotation is otherwise only noticed by the client monitor. Once
+// the IP changed, the measurements of the client are flagged with
+// ExitIPChanged, they may not come from its network or location. A failed
+// check is only logged.
+func (s *MeasurementService) verifyExitIP(client models.Client) {
+	if client.Proxy == "none" || !s.config.GetBool("measurement.verify_exit_ip") {
+		return
+	}
+	// The IP doesn't change back, a changed client needs no further checks
+	if s.exitIPChanged(client) {
+		return
+	}
+
+	check, err := s.checkClient(&client)
+	if err != nil {
+		s.logger.Warn("Failed to verify exit IP of client",
+			"clientID", client.ID,
+			"clientIP", client.IP,
+			"error", err)
+		return
+	}
+	if check.Valid {
+		return
+	}
+
+	s.changedExitIPs.Store(client.ID, check.IP)
+	s.logger.Warn("Exit IP of client changed, flagging its measurements",
+		"clientID", client.ID,
+		"clientIP", client.IP,
+		"newIP", check.IP,
+		"isp", client.ISP)
+}
+
+// exitIPChanged reports whether the exit IP of the client was found to have
+// changed by verifyExitIP
+func (s *MeasurementService) exitIPChanged(client models.Client) bool {
+	_, changed := s.changedExitIPs.Load(client.ID)
+	return changed
+}
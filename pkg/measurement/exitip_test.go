@@ -0,0 +1,86 @@
+package measurement
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+
+	"github.com/spf13/viper"
+)
+
+// rotatingProvider reports the exit IP of clients unchanged for the first
+// checks and rotated to another IP from then on
+type rotatingProvider struct {
+	*fakeProvider
+	stableChecks int
+	checks       int
+}
+
+func (p *rotatingProvider) CheckClient(client *models.Client) (proxy.ClientCheck, error) {
+	p.checks++
+	if p.checks <= p.stableChecks {
+		return proxy.ClientCheck{Valid: true, IP: client.IP}, nil
+	}
+	return proxy.ClientCheck{IP: "203.0.113.9", Changed: true}, nil
+}
+
+func TestMeasureServerFlagsChangedExitIP(t *testing.T) {
+	store := &memoryStore{}
+	ctx := context.Background()
+	var servers []models.Server
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		server := models.Server{IP: ip, Port: "443", FullAccessLink: "ss://" + ip + ":443", Scheme: "ss"}
+		store.UpsertServer(ctx, &server)
+		servers = append(servers, server)
+	}
+
+	for _, verify := range []bool{false, true} {
+		config := viper.New()
+		config.Set("measurement.verify_exit_ip", verify)
+		p := &rotatingProvider{fakeProvider: &fakeProvider{}, stableChecks: 1}
+		s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, p)
+		s.runID = fmt.Sprintf("run-%t", verify)
+		s.testConnectivity = func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+			return connectivity.ConnectivityReport{}, nil
+		}
+
+		// The exit IP rotates after the first server was measured
+		client := models.Client{ID: 1, IP: "198.51.100.1", Proxy: "fake", ProxyURL: "socks5://198.51.100.1", ExpirationTime: time.Now().Add(time.Hour)}
+		for _, server := range servers {
+			if err := s.measureServer(client, server, nil); err != nil {
+				t.Fatalf("measureServer(%s) error = %v", server.IP, err)
+			}
+		}
+
+		// The IP isn't checked again once it changed
+		wantChecks := 0
+		if verify {
+			wantChecks = 2
+		}
+		if p.checks != wantChecks {
+			t.Errorf("verify %t: checked the exit IP %d times, want %d", verify, p.checks, wantChecks)
+		}
+
+		var measured int
+		for _, m := range store.measurements {
+			if m.RunID != s.runID {
+				continue
+			}
+			measured++
+			want := verify && m.ServerID != servers[0].ID
+			if m.ExitIPChanged != want {
+				t.Errorf("verify %t: %s measurement of server %d ExitIPChanged = %t, want %t", verify, m.Protocol, m.ServerID, m.ExitIPChanged, want)
+			}
+		}
+		if measured == 0 {
+			t.Errorf("verify %t: no measurement stored", verify)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+// runLockKey identifies the runs that must not overlap in a country: runs
+// for the same provider, country and network contend for the same proxy
+// sessions
+func runLockKey(provider, country string, clientType models.ClientType) string {
+	return fmt.Sprintf("measure/%s/%s/%s", provider, country, clientType)
+}
+
+// lockRun takes the lock of each country of the run, failing fast if another
+// run holds one of them. The countries are locked in sorted order so
+// overlapping runs don't take their locks in opposite orders. Locks held from
+// a previous run of the service are released first.
+func (s *MeasurementService) lockRun(ctx context.Context, provider string, settings Settings) error {
+	s.unlockRun()
+
+	var unlocks []func() error
+	release := func() error {
+		var errs []error
+		for _, unlock := range unlocks {
+			errs = append(errs, unlock())
+		}
+		return errors.Join(errs...)
+	}
+
+	countries := slices.Clone(settings.Countries)
+	slices.Sort(countries)
+	for _, country := range slices.Compact(countries) {
+		key := runLockKey(provider, country, settings.ClientType)
+		unlock, err := s.db.TryLock(ctx, key)
+		if err != nil {
+			if releaseErr := release(); releaseErr != nil {
+				s.logger.Warn("Failed to release run lock", "error", releaseErr)
+			}
+		}
+		if errors.Is(err, database.ErrLocked) {
+			return fmt.Errorf("another measurement run for provider %s, country %s and %s network is in progress, run with --no-lock to measure anyway",
+				provider, country, settings.ClientType)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to take run lock: %v", err)
+		}
+		s.logger.Debug("Took run lock", "key", key)
+		unlocks = append(unlocks, unlock)
+	}
+
+	s.unlock = release
+	return nil
+}
+
+// unlockRun releases the run lock if it's held
+func (s *MeasurementService) unlockRun() {
+	if s.unlock == nil {
+		return
+	}
+	if err := s.unlock(); err != nil {
+		s.logger.Warn("Failed to release run lock", "error", err)
+	}
+	s.unlock = nil
+}
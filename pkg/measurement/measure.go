@@ -3,13 +3,21 @@ package measurement
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"connectivity-tester/pkg/alert"
 	"connectivity-tester/pkg/connectivity"
 	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/ipinfo"
 	"connectivity-tester/pkg/models"
 	"connectivity-tester/pkg/proxy"
 
@@ -17,43 +25,102 @@ import (
 	"github.com/spf13/viper"
 )
 
-type Settings struct {
-	Country     string
-	ISP         string
-	ClientType  models.ClientType
-	ServerIDs   []int64
-	ServerNames []string
-	MaxRetries  int
-	MaxClients  int
+// RunResult summarizes a measurement run
+type RunResult struct {
+	// RunID identifies the measurements taken in the run
+	RunID string
+	// CountryMismatches counts per ISP the clients whose exit IP was
+	// located in a different country than requested
+	CountryMismatches map[string]int
+	// BaselineSuccesses counts the successful first tests of the run, and
+	// PrefixSuccesses the successful tests with a prefix. Retries without a
+	// prefix count in neither.
+	BaselineSuccesses int64
+	PrefixSuccesses   int64
+	// ClientAcquisitions and ClientValidations count the client requests
+	// and validity checks made to the provider
+	ClientAcquisitions int64
+	ClientValidations  int64
+	// SessionSeconds is the total session length allocated to the clients
+	SessionSeconds int64
+	// ExpectedFailures counts the failed probes of servers expected to be
+	// reachable
+	ExpectedFailures int64
 }
 
 // MeasurementService struct update to include configuration
 type MeasurementService struct {
-	db       *database.DB
+	db       Store
 	logger   *slog.Logger
 	config   *viper.Viper
 	prefixes []string
 	provider proxy.Provider
 
+	// extraHops are transports inserted between the client proxy and the access link
+	extraHops []string
+	// runID identifies the measurements of the current run
+	runID string
+	// runCtx is the context of the current run, retries of tests that failed
+	// to run and throttled inserts end when it's done
+	runCtx context.Context
+	// baselineSuccesses and prefixSuccesses count the successful first tests
+	// and prefixed tests of the current run, see RunResult
+	baselineSuccesses atomic.Int64
+	prefixSuccesses   atomic.Int64
+	// usage counts the provider resources consumed by the current run
+	usage providerUsage
+	// unlock releases the run lock, nil if it isn't held
+	unlock func() error
+	// rand samples the servers measured on each client
+	rand *rand.Rand
+	// results stores the measurements if set, see SetResultsStore
+	results ResultsStore
+	// pool hands out the valid clients of previous runs, nil if
+	// measurement.session_pool isn't set
+	pool *SessionPool
+	// alerts is notified of failed probes of servers expected to be
+	// reachable if set, see SetAlerts
+	alerts *alert.Dispatcher
+	// expectedFailures counts the alerts raised in the current run
+	expectedFailures atomic.Int64
+	// writes retries and spills the measurements the store fails to insert,
+	// see writeBuffer
+	writes *writeBuffer
+	// serverErrorsMu serializes the updates of server errors by the
+	// protocol measurements of a local client
+	serverErrorsMu sync.Mutex
+
+	// testConnectivity runs connectivity tests, it's replaced in tests
+	testConnectivity connectivityTestFunc
+	// lookupIPInfo locates exit IPs, it's replaced in tests
+	lookupIPInfo func(ip string) (ipinfo.IPInfoResponse, error)
+	// exitASes caches the exit AS lookups by IP, see exitASOf
+	exitASes sync.Map
+	// changedExitIPs holds the exit IP of clients by ID once it was found
+	// to have changed, see verifyExitIP
+	changedExitIPs sync.Map
+	// measure runs the measurements of a job, it's replaced in tests
+	measure func(client models.Client, server models.Server, rotate *sessionRotation) error
+
 	activeClients sync.Map      // stores active clients being monitored
 	stopMonitor   chan struct{} // channel to stop monitoring
 }
 
-// measurementJob represents a single measurement task
+// measurementJob represents a single measurement task. Jobs don't hold a
+// client, they run on the current client of their session.
 type measurementJob struct {
-	client *models.Client
 	server models.Server
 }
 
 // NewMeasurementService constructor
-func NewMeasurementService(db *database.DB, logger *slog.Logger, config *viper.Viper, provider proxy.Provider) *MeasurementService {
+func NewMeasurementService(db Store, logger *slog.Logger, config *viper.Viper, provider proxy.Provider) *MeasurementService {
 	prefixes := config.GetStringSlice("measurement.prefixes")
 	if prefixes == nil {
 		logger.Debug("No prefixes configured")
 		prefixes = []string{}
 	}
 
-	return &MeasurementService{
+	s := &MeasurementService{
 		db:            db,
 		logger:        logger,
 		config:        config,
@@ -61,111 +128,455 @@ func NewMeasurementService(db *database.DB, logger *slog.Logger, config *viper.V
 		provider:      provider,
 		activeClients: sync.Map{},
 		stopMonitor:   make(chan struct{}),
+		runCtx:        context.Background(),
+
+		extraHops:        config.GetStringSlice("measurement.extra_hops"),
+		testConnectivity: connectivity.TestConnectivity,
+		lookupIPInfo:     ipinfo.GetIPInfo,
+		rand:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		writes:           newWriteBuffer(config, logger),
+	}
+	// Tests that fail to run because of a transient error are retried if
+	// connectivity.retry_attempts is set
+	if retry := connectivity.RetryFromConfig(config); retry.Attempts > 1 {
+		s.testConnectivity = func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+			return connectivity.TestConnectivityWithRetry(s.runCtx, retry, transportConfig, proto, resolver, domains)
+		}
+	}
+	// The local client has no session to reuse
+	if config.GetBool("measurement.session_pool") && provider.GetProviderName() != string(proxy.SystemNone) {
+		s.pool = NewSessionPool(db, provider, s.refreshThreshold())
 	}
+	s.measure = s.measureServer
+	return s
+}
+
+// SetAlerts checks the probes of servers expected to be reachable with
+// alerts, which raises an alert for each failed probe
+func (s *MeasurementService) SetAlerts(alerts *alert.Dispatcher) {
+	s.alerts = alerts
+}
+
+// SetResultsStore writes measurements to results instead of the Store, which
+// servers are still read from and clients recorded in
+func (s *MeasurementService) SetResultsStore(results ResultsStore) {
+	s.results = results
+}
+
+// measurements returns the store measurements are written to
+func (s *MeasurementService) measurements() measurementStore {
+	if s.results != nil {
+		return s.results
+	}
+	return s.db
+}
+
+// insertMeasurement writes the measurement to the store of measurements
+// through the write buffer
+func (s *MeasurementService) insertMeasurement(ctx context.Context, measurement *models.Measurement) error {
+	return s.writes.insert(ctx, s.measurements(), measurement)
+}
+
+// mirrorServers copies the servers to the results store, if there is one,
+// so measurements of them can reference them there
+func (s *MeasurementService) mirrorServers(ctx context.Context, servers []models.Server) error {
+	if s.results == nil {
+		return nil
+	}
+	// Working servers are loaded with only some of their columns
+	ids := make([]int64, len(servers))
+	for i, server := range servers {
+		ids[i] = server.ID
+	}
+	full, err := s.db.GetServersByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	return s.results.MirrorServers(ctx, full)
 }
 
 // RunMeasurements performs measurements for all clients
-func (s *MeasurementService) RunMeasurements(ctx context.Context, p proxy.Provider, settings Settings) error {
+func (s *MeasurementService) RunMeasurements(ctx context.Context, p proxy.Provider, settings Settings) (*RunResult, error) {
+	if err := settings.Validate(p); err != nil {
+		return nil, err
+	}
+	order, err := s.iterationOrder()
+	if err != nil {
+		return nil, err
+	}
+	switch fallback := s.config.GetString("measurement.isp_fallback"); fallback {
+	case "", ispFallbackNone, ispFallbackRandom:
+	default:
+		return nil, fmt.Errorf("unsupported ISP fallback: %s", fallback)
+	}
+
+	if !settings.NoLock {
+		if err := s.lockRun(ctx, p.GetProviderName(), settings); err != nil {
+			return nil, err
+		}
+	}
+
+	s.runID = uuid.New().String()
+	s.runCtx = ctx
+	if seeder, ok := p.(proxy.SessionSeeder); ok {
+		seeder.SeedSessions(s.runID)
+	}
+	s.prefixes = s.loadPrefixes(ctx)
+	s.baselineSuccesses.Store(0)
+	s.prefixSuccesses.Store(0)
+	s.usage.reset()
+	s.expectedFailures.Store(0)
+	s.logger.Info("Starting measurement run", "runID", s.runID)
+
+	// Pick up the live sessions of a previous process
+	if resumed, err := s.resumeClientMonitoring(ctx); err != nil {
+		s.logger.Warn("Failed to resume monitoring of active clients", "error", err)
+	} else if resumed > 0 {
+		s.logger.Info("Resumed monitoring of active clients", "count", resumed)
+	}
+
 	var servers []models.Server
-	var err error
 	if len(settings.ServerIDs) != 0 {
 		// Get server by ID
 		srvs, err := s.db.GetServersByIDs(ctx, settings.ServerIDs)
 		if err != nil {
-			return fmt.Errorf("failed to get server by ID: %v", err)
+			return nil, fmt.Errorf("failed to get server by ID: %v", err)
+		}
+		servers = append(servers, srvs...)
+	} else if len(settings.Servers) != 0 {
+		// Store servers that weren't imported so measurements can reference them
+		srvs, err := s.db.InsertEphemeralServers(ctx, settings.Servers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store servers: %v", err)
 		}
 		servers = append(servers, srvs...)
 	} else if len(settings.ServerNames) != 0 {
 		// Get server by name
 		srvs, err := s.db.GetServersByNames(ctx, settings.ServerNames)
 		if err != nil {
-			return fmt.Errorf("failed to get server by name: %v", err)
+			return nil, fmt.Errorf("failed to get server by name: %v", err)
+		}
+		servers = append(servers, srvs...)
+	} else if len(settings.Tags) != 0 {
+		// Get servers by fragment tags
+		srvs, err := s.db.GetServersByTag(ctx, settings.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get servers by tag: %v", err)
 		}
 		servers = append(servers, srvs...)
 	} else {
 		// TODO: get servers by group name, must add flag in CLI
 		// Get working servers for this provider
-		servers, err = s.getWorkingServers(ctx, p.GetProviderName())
+		servers, err = s.getWorkingServers(ctx, p.GetProviderName(), settings.Priority, settings.ServerIPVersion)
 		if err != nil {
-			return fmt.Errorf("failed to get working servers: %v", err)
+			return nil, fmt.Errorf("failed to get working servers: %v", err)
 		}
 	}
+	// Servers selected explicitly are filtered here
+	servers = filterByIPType(servers, settings.ServerIPVersion)
 
 	if len(servers) == 0 {
-		return fmt.Errorf("no working servers found for provider %s", p.GetProviderName())
+		return nil, fmt.Errorf("no working servers found for provider %s", p.GetProviderName())
 	}
-
-	var isps []string
-	if settings.ISP != "" {
-		// ISP list with only one ISP
-		isps = append(isps, settings.ISP)
-	} else {
-		// Get ISP list shuffled
-		isps, err = p.GetISPList(settings.Country, settings.ClientType)
-		if err != nil {
-			return fmt.Errorf("failed to get ISP list: %v", err)
-		}
+	if err := s.mirrorServers(ctx, servers); err != nil {
+		return nil, fmt.Errorf("failed to copy servers to the results database: %v", err)
 	}
 
+	perSession := s.serversPerSession(p)
 	s.logger.Info("Starting measurements",
 		"provider", p.GetProviderName(),
-		"country", settings.Country,
+		"countries", settings.Countries,
+		"city", settings.City,
 		"clientType", settings.ClientType,
-		"ispCount", len(isps),
-		"serverCount", len(servers))
-
-	// Process each ISP
-	for _, isp := range isps {
-		// Try to get up to maximum number of clients for the ISP
-		for i := 0; i < settings.MaxClients; i++ {
-			client, err := p.GetClientForISP(isp, settings.ClientType, settings.Country, settings.MaxRetries)
-			if err != nil {
-				s.logger.Error("Failed to get client for ISP",
-					"isp", isp,
-					"error", err)
-				continue
+		"serverCount", len(servers),
+		"serversPerClient", settings.ServersPerClient,
+		"serversPerSession", perSession,
+		"iterationOrder", order)
+
+	if order == IterationServerFirst {
+		if err := s.runServerFirst(ctx, p, settings, servers); err != nil {
+			return nil, err
+		}
+		return s.runResult(p), nil
+	}
+
+	err = s.acquireClients(p, settings, func(country string, client *models.Client) {
+		// Each client measures its own sample of the servers, split into
+		// batches that fit in a session of the provider
+		clientServers := orderServers(sampleServers(s.rand, servers, settings.ServersPerClient), settings.Priority)
+		batches := splitServers(clientServers, perSession)
+		isp := client.ISP
+
+		for i, batch := range batches {
+			// New clients, for the next batches and replacements of an
+			// expiring client, are acquired for the same ISP, country and city
+			acquire := s.clientAcquirer(ctx, p, settings, country, isp, len(batch))
+
+			var (
+				savedClient *models.Client
+				err         error
+			)
+			if i == 0 {
+				savedClient, err = s.prepareClient(ctx, p, client, len(batch))
+				if errors.Is(err, errShortSession) {
+					s.logger.Debug("Skipping pooled client", "isp", isp, "error", err)
+					// The acquired client is prepared and warmed up
+					savedClient, err = acquire()
+				} else if err == nil && !s.warmUpClient(savedClient) {
+					return
+				}
+				if err != nil {
+					s.logger.Error("Failed to save client",
+						"error", err,
+						"clientIP", client.IP)
+					return
+				}
+			} else {
+				savedClient, err = acquire()
+				if err != nil {
+					s.logger.Error("Failed to get client for the next batch of servers",
+						"isp", isp,
+						"batch", i+1,
+						"batches", len(batches),
+						"error", err)
+					return
+				}
 			}
+			session := s.newClientSession(savedClient, acquire)
+
+			// Start monitoring the client
+			s.startClientMonitoring(session)
+
+			// Process measurements in parallel
+			s.processMeasurements(session, batch, settings.Priority)
+
+			s.stopClientMonitoring(session.current().ID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.runResult(p), nil
+}
+
+// runResult summarizes the current run
+func (s *MeasurementService) runResult(p proxy.Provider) *RunResult {
+	return &RunResult{
+		RunID:             s.runID,
+		CountryMismatches: p.CountryMismatches(),
+		BaselineSuccesses: s.baselineSuccesses.Load(),
+		PrefixSuccesses:   s.prefixSuccesses.Load(),
+
+		ClientAcquisitions: s.usage.acquisitions.Load(),
+		ClientValidations:  s.usage.validations.Load(),
+		SessionSeconds:     s.usage.sessionSeconds.Load(),
 
-			// Save client to database and get the updated client with ID
-			savedClients, err := s.db.InsertClients(ctx, []models.Client{*client})
+		ExpectedFailures: s.expectedFailures.Load(),
+	}
+}
+
+// clientAcquirer returns the function that gets new clients for the ISP,
+// country and city of a session, prepared for measuring serverCount servers
+func (s *MeasurementService) clientAcquirer(ctx context.Context, p proxy.Provider, settings Settings, country, isp string, serverCount int) acquireFunc {
+	return func() (*models.Client, error) {
+		for {
+			client, err := s.getClient(p, isp, settings, country)
 			if err != nil {
-				s.logger.Error("Failed to save client",
-					"error", err,
-					"clientIP", client.IP)
+				return nil, err
+			}
+			if client.CountryCode == "" {
+				client.CountryCode = country
+			}
+			prepared, err := s.prepareClient(ctx, p, client, serverCount)
+			if errors.Is(err, errShortSession) {
+				// The pool hands out each client once, so the next one
+				// is another pooled client or a new session
+				s.logger.Debug("Skipping pooled client", "isp", isp, "error", err)
 				continue
 			}
+			if err != nil {
+				return nil, err
+			}
+			if !s.warmUpClient(prepared) {
+				return nil, fmt.Errorf("client %s failed warm-up", prepared.IP)
+			}
+			return prepared, nil
+		}
+	}
+}
 
-			if len(savedClients) == 0 {
-				s.logger.Error("No clients returned after upsert",
-					"clientIP", client.IP)
-				continue
+// prepareClient saves a new client and sets up its session for measuring
+// serverCount servers. A pooled client is already saved and keeps its
+// session, errShortSession is returned if it expires before the session of
+// a new client would.
+func (s *MeasurementService) prepareClient(ctx context.Context, p proxy.Provider, client *models.Client, serverCount int) (*models.Client, error) {
+	if client.ID != 0 {
+		length := time.Duration(s.sessionLength(p, serverCount)) * time.Second
+		if remaining := client.ExpirationTime.Sub(timeNow()); remaining < length {
+			return nil, fmt.Errorf("%w, client %d expires in %v, measuring %d servers takes %v",
+				errShortSession, client.ID, remaining.Round(time.Second), serverCount, length)
+		}
+		if s.results != nil {
+			if err := s.results.MirrorClients(ctx, []models.Client{*client}); err != nil {
+				return nil, err
 			}
+		}
+		return client, nil
+	}
 
-			savedClient := &savedClients[0]
-			s.logger.Debug("Successfully saved client",
-				"clientID", savedClient.ID,
-				"clientIP", savedClient.IP)
+	// The length is saved with the client, so the URL of its session can be
+	// rebuilt when it's resumed or pooled
+	client.SessionLength = s.sessionLength(p, serverCount)
 
-			// Set client session length based on number of servers to measure
-			// More servers need more time to measure
-			// SessionLength is in seconds
-			// Each server test with retires and prefixes can take up to 150 seconds
-			savedClient.SessionLength = len(servers) * p.GetSessionLength()
+	// Save client to database and get the updated client with ID
+	savedClients, err := s.db.InsertClients(ctx, []models.Client{*client})
+	if err != nil {
+		return nil, err
+	}
+	if len(savedClients) == 0 {
+		return nil, fmt.Errorf("no clients returned after upsert")
+	}
+	if s.results != nil {
+		if err := s.results.MirrorClients(ctx, savedClients); err != nil {
+			return nil, err
+		}
+	}
 
-			// save the proxy socks5 transport URL
-			savedClient.ProxyURL = p.BuildTransportURL(savedClient)
+	savedClient := &savedClients[0]
+	s.logger.Debug("Successfully saved client",
+		"clientID", savedClient.ID,
+		"clientIP", savedClient.IP,
+		"country", savedClient.CountryCode)
 
-			// Start monitoring the client
-			s.startClientMonitoring(savedClient)
+	s.usage.sessionSeconds.Add(int64(savedClient.SessionLength))
 
-			// Process measurements in parallel
-			s.processMeasurements(savedClient, servers)
-		}
+	// save the proxy socks5 transport URL
+	savedClient.ProxyURL = p.BuildTransportURL(savedClient)
+
+	return savedClient, nil
+}
+
+// persistServerErrors reports whether tests from the local client record
+// their result on the server, measurement.persist_server_errors defaults to true
+func (s *MeasurementService) persistServerErrors() bool {
+	return !s.config.IsSet("measurement.persist_server_errors") || s.config.GetBool("measurement.persist_server_errors")
+}
+
+// warmUpClient checks a new client with the provider before it's measured if
+// measurement.warmup_clients is set, since the first test through a session
+// that isn't established at the exit node yet tends to fail. It reports
+// whether the client should be measured.
+func (s *MeasurementService) warmUpClient(client *models.Client) bool {
+	if !s.config.GetBool("measurement.warmup_clients") {
+		return true
 	}
 
+	valid, err := s.isValidClient(client)
+	if err != nil || !valid {
+		s.logger.Warn("Discarding client that failed warm-up",
+			"clientID", client.ID,
+			"clientIP", client.IP,
+			"isp", client.ISP,
+			"error", err)
+		return false
+	}
+	return true
+}
+
+// acquireClients gets up to settings.MaxClients clients for every ISP of every
+// country and passes each to handle with the country it was acquired for.
+// ISPs are always requested in the country whose ISP list they come from.
+// ISPs listed in measurement.isp_client_counts get their own number of
+// clients. With measurement.isp_weights the same number of clients is spread
+// over the ISPs of a country proportionally to their weights instead.
+func (s *MeasurementService) acquireClients(p proxy.Provider, settings Settings, handle func(country string, client *models.Client)) error {
+	for _, country := range settings.Countries {
+		var isps []string
+		// A single requested ISP gets all the clients whatever its weight
+		var weights map[string]float64
+		if settings.ISP != "" {
+			// ISP list with only one ISP
+			isps = append(isps, settings.ISP)
+		} else {
+			// Get ISP list shuffled
+			var err error
+			isps, err = p.GetISPList(country, settings.ClientType)
+			if err != nil {
+				return fmt.Errorf("failed to get ISP list for %s: %v", country, err)
+			}
+			if len(isps) == 0 {
+				return fmt.Errorf("provider %s has no %s ISPs in country %s, check the country code",
+					p.GetProviderName(), settings.ClientType, country)
+			}
+			weights = s.ispWeights()
+		}
+
+		s.logger.Info("Measuring country",
+			"country", country,
+			"ispCount", len(isps))
+
+		// Try to get up to maximum number of clients for each ISP
+		for _, isp := range acquisitionPlan(s.rand, isps, weights, s.ispClientCounts(), settings.MaxClients) {
+			client, err := s.getClient(p, isp, settings, country)
+			if err != nil && settings.ISP != "" && s.config.GetString("measurement.isp_fallback") == ispFallbackRandom {
+				client, err = s.getFallbackClient(p, settings, country, err)
+			}
+			if err != nil {
+				s.logger.Error("Failed to get client for ISP",
+					"country", country,
+					"isp", isp,
+					"error", err)
+				continue
+			}
+
+			// Providers that don't locate the exit IP leave the country empty
+			if client.CountryCode == "" {
+				client.CountryCode = country
+			}
+
+			handle(country, client)
+		}
+	}
 	return nil
 }
 
+// ISP fallback strategies of measurement.isp_fallback when the requested ISP
+// has no clients
+const (
+	ispFallbackNone   = "none"
+	ispFallbackRandom = "random"
+)
+
+// getFallbackClient gets a client for a random other ISP of the country after
+// the ISP of the settings failed with ispErr. The client's ISP is the one it
+// was acquired for.
+func (s *MeasurementService) getFallbackClient(p proxy.Provider, settings Settings, country string, ispErr error) (*models.Client, error) {
+	isps, err := p.GetISPList(country, settings.ClientType)
+	if err != nil {
+		return nil, fmt.Errorf("%v, failed to get ISP list for fallback: %v", ispErr, err)
+	}
+	isps = slices.DeleteFunc(slices.Clone(isps), func(isp string) bool {
+		return strings.EqualFold(isp, settings.ISP)
+	})
+	if len(isps) == 0 {
+		return nil, fmt.Errorf("%v, no other ISP to fall back to", ispErr)
+	}
+
+	fallback := isps[s.rand.Intn(len(isps))]
+	s.logger.Warn("Requested ISP has no clients, falling back to a random ISP",
+		"country", country,
+		"isp", settings.ISP,
+		"fallbackISP", fallback,
+		"error", ispErr)
+	return s.getClient(p, fallback, settings, country)
+}
+
+// defaultSuccessRateWindow is the number of recent measurements of a server
+// its success rate is computed over when measurement.success_rate_window is
+// not configured
+const defaultSuccessRateWindow = 20
+
 // getAllowedPorts returns the allowed ports for a specific proxy service
 func (s *MeasurementService) getAllowedPorts(proxyProvider string) []string {
 	allowedPorts := s.config.GetIntSlice(fmt.Sprintf("%s.allowed_ports", proxyProvider))
@@ -190,18 +601,86 @@ func (s *MeasurementService) getAllowedPorts(proxyProvider string) []string {
 }
 
 // getWorkingServers returns servers with no errors and allowed ports for the specified provider
-func (s *MeasurementService) getWorkingServers(ctx context.Context, proxyProvider string) ([]models.Server, error) {
+func (s *MeasurementService) getWorkingServers(ctx context.Context, proxyProvider string, order database.ServerOrder, ipType string) ([]models.Server, error) {
 	allowedPorts := s.getAllowedPorts(proxyProvider)
 
 	s.logger.Debug("Getting working servers",
 		"provider", proxyProvider,
-		"allowedPorts", allowedPorts)
+		"allowedPorts", allowedPorts,
+		"order", order,
+		"ipType", ipType)
+
+	lite, err := s.db.GetWorkingServersByIPType(ctx, ipType, allowedPorts, order)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]models.Server, len(lite))
+	for i, server := range lite {
+		servers[i] = server.Server()
+	}
+	return s.filterByProxySuccessRate(ctx, proxyProvider, servers)
+}
+
+// filterByIPType returns the servers whose IPType is ipType, all of them if
+// ipType is empty
+func filterByIPType(servers []models.Server, ipType string) []models.Server {
+	if ipType == "" {
+		return servers
+	}
+	var filtered []models.Server
+	for _, server := range servers {
+		if server.IPType == ipType {
+			filtered = append(filtered, server)
+		}
+	}
+	return filtered
+}
+
+// filterByProxySuccessRate leaves out the servers whose recent success rate
+// from clients of the provider is below measurement.min_server_success_rate.
+// The rate is computed over the last measurement.success_rate_window
+// measurements of each server, servers without any are kept.
+func (s *MeasurementService) filterByProxySuccessRate(ctx context.Context, proxyProvider string, servers []models.Server) ([]models.Server, error) {
+	minRate := s.config.GetFloat64("measurement.min_server_success_rate")
+	if minRate <= 0 {
+		return servers, nil
+	}
+	window := s.config.GetInt("measurement.success_rate_window")
+	if window <= 0 {
+		window = defaultSuccessRateWindow
+	}
 
-	return s.db.GetWorkingServers(ctx, allowedPorts)
+	rates, err := s.db.GetServerProxySuccessRates(ctx, proxyProvider, window)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[int64]bool)
+	for _, rate := range rates {
+		if rate.SuccessRate < minRate {
+			excluded[rate.ServerID] = true
+		}
+	}
+
+	kept := make([]models.Server, 0, len(servers))
+	for _, server := range servers {
+		if !excluded[server.ID] {
+			kept = append(kept, server)
+		}
+	}
+	s.logger.Info("Excluded servers with a low success rate from provider clients",
+		"provider", proxyProvider,
+		"minSuccessRate", minRate,
+		"window", window,
+		"excluded", len(servers)-len(kept))
+	return kept, nil
 }
 
-// measureServer performs connectivity tests from a client to a server
-func (s *MeasurementService) measureServer(client models.Client, server models.Server) error {
+// measureServer performs connectivity tests from a client to a server. If
+// rotate is set and the first tests of too many servers in a row failed,
+// failed protocols are retried on a client of a new proxy session, so a bad
+// exit node doesn't fail the retries as well. It returns errNoSuccess if
+// none of the first tests succeeded.
+func (s *MeasurementService) measureServer(client models.Client, server models.Server, rotate *sessionRotation) error {
 	// Check if client session is not expired and
 	// return an error to abort the measurement job
 	if client.ExpirationTime.Before(time.Now()) {
@@ -211,6 +690,7 @@ func (s *MeasurementService) measureServer(client models.Client, server models.S
 			"Expired seconds ago:", time.Since(client.ExpirationTime).Seconds())
 		return fmt.Errorf("client session has expired")
 	}
+	s.verifyExitIP(client)
 
 	// Generate a unique session ID for this measurement series
 	sessionID := uuid.New().String()
@@ -224,14 +704,46 @@ func (s *MeasurementService) measureServer(client models.Client, server models.S
 	}
 
 	// Retrieve the initial measurements
-	measurements, err := s.db.GetMeasurementsBySession(context.Background(), sessionID, 0)
+	measurements, err := s.measurements().GetMeasurementsBySession(context.Background(), sessionID, 0)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve initial measurements: %v", err)
 	}
 
 	// Check which protocols had errors
+	var failed bool
+	allFailed := true
 	for _, m := range measurements {
+		// Skipped tests aren't retried, they would be skipped again
+		if m.ErrorOp == skippedOp {
+			continue
+		}
 		initialResults[m.Protocol] = (m.ErrorMsg != "" || m.ErrorOp != "success")
+		failed = failed || initialResults[m.Protocol]
+		allFailed = allFailed && initialResults[m.Protocol]
+	}
+
+	// Retries run on the rotated client and their measurements reference it
+	retryClient := client
+	if rotate != nil && rotate.due(failed) {
+		rotated, err := rotate.acquire()
+		if err != nil {
+			s.logger.Warn("Failed to rotate client session, retrying on the same client",
+				"clientID", client.ID,
+				"serverIP", server.IP,
+				"error", err)
+		} else {
+			s.logger.Info("Rotated client session for retries",
+				"clientID", client.ID,
+				"sessionID", client.SessionID,
+				"rotatedClientID", rotated.ID,
+				"rotatedSessionID", rotated.SessionID,
+				"rotatedClientIP", rotated.IP,
+				"serverIP", server.IP)
+			retryClient = *rotated
+			// The rotated client is monitored while the retries run on it
+			s.startClientMonitoring(&clientSession{client: rotated})
+			defer s.stopClientMonitoring(rotated.ID)
+		}
 	}
 
 	var retryCount = 0
@@ -240,37 +752,23 @@ func (s *MeasurementService) measureServer(client models.Client, server models.S
 	for protocol, hasError := range initialResults {
 		if hasError {
 			s.logger.Debug("Performing retries for failed protocol",
+				"sessionID", sessionID,
+				"protocol", protocol,
+				"clientIP", retryClient.IP,
+				"serverIP", server.IP)
+
+			retryCount = s.retryProtocol(retryClient, server, protocol, retryCount,
+				s.protocolAttempt(retryClient, &server, sessionID, protocol))
+		} else if s.config.GetBool("measurement.always_try_prefixes") {
+			// Record the prefixed results next to the successful baseline
+			s.logger.Debug("Trying prefixes for successful protocol",
 				"sessionID", sessionID,
 				"protocol", protocol,
 				"clientIP", client.IP,
 				"serverIP", server.IP)
 
-			retryCount = retryCount + 1
-			// Perform retry measurement for this protocol
-			if err := s.performProtocolMeasurement(client, server, sessionID, retryCount, "", nil, protocol); err != nil {
-				s.logger.Warn("retry measurement failed",
-					"protocol", protocol,
-					"error", err)
-			}
-			// don't try prefixes on udp as it's not supported
-			if protocol == "tcp" {
-				// Try with different prefixes for this protocol
-				for _, prefix := range s.prefixes {
-					newAccessLink := server.FullAccessLink + "?prefix=" + prefix
-					s.logger.Debug("Testing with prefix",
-						"prefix", prefix,
-						"newAccessLink", newAccessLink,
-					)
-					retryCount = retryCount + 1
-					if err := s.performProtocolMeasurement(client, server, sessionID, retryCount, prefix, &newAccessLink, protocol); err != nil {
-						s.logger.Warn("prefix measurement failed",
-							"protocol", protocol,
-							"prefix", prefix,
-							"error", err)
-					}
-					// TODO: try split for tcp if at least one retry has succeeded
-				}
-			}
+			retryCount = s.tryPrefixes(client, server, protocol, retryCount,
+				s.protocolAttempt(client, &server, sessionID, protocol))
 		} else {
 			s.logger.Debug("Skipping retries for successful protocol",
 				"sessionID", sessionID,
@@ -280,23 +778,37 @@ func (s *MeasurementService) measureServer(client models.Client, server models.S
 		}
 	}
 
+	// The client is judged by its own tests, retries may run on another one
+	if len(initialResults) > 0 && allFailed {
+		return errNoSuccess
+	}
 	return nil
 }
 
-// performProtocolMeasurement handles a single measurement for a specific protocol
+// protocolAttempt returns the attempts of a protocol's retries and prefixes
+// on client
+func (s *MeasurementService) protocolAttempt(client models.Client, server *models.Server, sessionID, protocol string) attemptFunc {
+	return func(retryNumber int, prefix string, accessLinkOverride *string) (bool, error) {
+		return s.performProtocolMeasurement(client, server, sessionID, retryNumber, prefix, accessLinkOverride, protocol)
+	}
+}
+
+// performProtocolMeasurement handles a single measurement for a specific
+// protocol and reports whether its test succeeded. The errors of a local
+// client are recorded on server, which may be shared by the measurements of
+// both protocols.
 func (s *MeasurementService) performProtocolMeasurement(
 	client models.Client,
-	server models.Server,
+	server *models.Server,
 	sessionID string,
 	retryNumber int,
 	prefix string,
 	accessLinkOverride *string,
 	protocol string,
-) error {
+) (bool, error) {
 	// Construct the transport config
 	s.logger.Debug("Building transport",
-		"Proxy transport URL: ",
-		client.ProxyURL)
+		"proxyURL", connectivity.RedactTransport(client.ProxyURL))
 
 	s.logger.Debug("Testing connectivity",
 		"sessionID", sessionID,
@@ -306,57 +818,95 @@ func (s *MeasurementService) performProtocolMeasurement(
 		"clientIP", client.IP,
 		"serverIP", server.IP)
 
+	exit := s.exitASOf(client)
 	measurement := models.Measurement{
 		ClientID:    client.ID,
 		ServerID:    server.ID,
 		Time:        time.Now(),
 		Protocol:    protocol,
+		RunID:       s.runID,
 		SessionID:   sessionID,
 		RetryNumber: retryNumber,
 		PrefixUsed:  prefix,
+		ExitASN:     exit.number,
+		ExitASOrg:   exit.org,
+
+		ExitIPChanged: s.exitIPChanged(client),
+	}
+
+	accessLink := server.FullAccessLink
+	if accessLinkOverride != nil {
+		accessLink = *accessLinkOverride
 	}
 
-	var transport string
 	// Determine transport URL
-	if client.Proxy == "none" {
-		// Connect directly to the server
-		if accessLinkOverride != nil {
-			transport = *accessLinkOverride
-		} else {
-			transport = server.FullAccessLink
-		}
-	} else {
+	var proxyURL string
+	if client.Proxy != "none" {
 		// Skip test for protocol if there is an error message for it on the server
 		// only applicable to remote measurements
-		if s.shouldSkipProtocol(protocol, server) {
-			return nil
-		}
-		if accessLinkOverride != nil {
-			transport = fmt.Sprintf("%s|%s", client.ProxyURL, *accessLinkOverride)
-		} else {
-			transport = fmt.Sprintf("%s|%s", client.ProxyURL, server.FullAccessLink)
+		if reason := s.skipReason(protocol, *server); reason != "" {
+			// Record the skip so skipped tests can be told from missing ones
+			measurement.ErrorOp = skippedOp
+			measurement.SkipReason = reason
+			if err := s.insertMeasurement(s.runCtx, &measurement); err != nil {
+				return false, fmt.Errorf("failed to save skipped measurement: %v", err)
+			}
+			return false, nil
 		}
+		proxyURL = client.ProxyURL
 	}
-
-	// Perform connectivity test
-	report, err := connectivity.TestConnectivity(
+	// Local clients connect directly, or through the extra hops only
+	transport := composeTransport(proxyURL, s.extraHops, accessLink)
+
+	// Perform connectivity test, sampling it several times if configured
+	samples := s.config.GetInt("measurement.samples")
+	domains := connectivity.SchemeDomains(server.Scheme)
+	if url := connectivity.HTTPURL(); protocol == "http" && url != "" {
+		domains = []string{url}
+	}
+	report, stats, err := sampleConnectivity(
+		s.testConnectivity,
+		samples,
 		transport,
 		protocol,
-		viper.GetString("connectivity.resolver"),
-		viper.GetString("connectivity.domain"),
+		connectivity.SchemeResolver(server.Scheme, protocol),
+		domains,
 	)
 
 	if err := s.handleTestResult(err, report, &measurement); err != nil {
-		return err
+		return false, err
+	}
+	measurement.DialedIP = report.DialedIP(transport)
+
+	// Only store the latency distribution when there is more than one sample
+	if samples > 1 {
+		stats.apply(&measurement)
 	}
 
 	// Save measurement
-	if err := s.db.InsertMeasurement(context.Background(), &measurement); err != nil {
-		return fmt.Errorf("failed to save measurement: %v", err)
+	if err := s.insertMeasurement(s.runCtx, &measurement); err != nil {
+		return false, fmt.Errorf("failed to save measurement: %v", err)
 	}
+	// Only the baseline probe is checked, failed retries and prefixes are
+	// attempts at getting through, not failures of the server
+	if s.alerts != nil && retryNumber == 0 && prefix == "" && s.alerts.Check(*server, client, measurement) {
+		s.expectedFailures.Add(1)
+	}
+	succeeded := measurement.ErrorOp == "success"
+	if succeeded {
+		if prefix != "" {
+			s.prefixSuccesses.Add(1)
+		} else if retryNumber == 0 {
+			s.baselineSuccesses.Add(1)
+		}
+	}
+
+	// Update server errors if this is a local client, servers only keep the
+	// errors of tcp and udp
+	if client.Proxy == "none" && s.persistServerErrors() && protocol != "http" {
+		s.serverErrorsMu.Lock()
+		defer s.serverErrorsMu.Unlock()
 
-	// Update server errors if this is a local client
-	if client.Proxy == "none" {
 		if protocol == "tcp" {
 			server.TCPErrorMsg = measurement.ErrorMsg
 			server.TCPErrorOp = measurement.ErrorOp
@@ -365,14 +915,26 @@ func (s *MeasurementService) performProtocolMeasurement(
 			server.UDPErrorOp = measurement.ErrorOp
 		}
 
-		return s.db.UpsertServer(context.Background(), &server)
+		return succeeded, s.db.UpdateServerErrors(context.Background(), server)
 
 	}
 
-	return nil
+	return succeeded, nil
 }
 
-// Update performMeasurement to use performProtocolMeasurement for both protocols
+// protocols returns the protocols measured on each server: tcp, udp and, if
+// measurement.http_probe is set, http
+func (s *MeasurementService) protocols() []string {
+	protocols := []string{"tcp", "udp"}
+	if s.config.GetBool("measurement.http_probe") {
+		protocols = append(protocols, "http")
+	}
+	return protocols
+}
+
+// performMeasurement measures all protocols, one after the other or, with
+// measurement.parallel_protocols, concurrently. All protocols are measured
+// in parallel even if one fails, the error of the first one is reported.
 func (s *MeasurementService) performMeasurement(
 	client models.Client,
 	server models.Server,
@@ -381,31 +943,85 @@ func (s *MeasurementService) performMeasurement(
 	prefix string,
 	accessLinkOverride *string,
 ) error {
-	for _, protocol := range []string{"tcp", "udp"} {
-		if err := s.performProtocolMeasurement(client, server, sessionID, retryNumber, prefix, accessLinkOverride, protocol); err != nil {
-			return fmt.Errorf("measurement failed for %s: %v", protocol, err)
+	protocols := s.protocols()
+	if !s.config.GetBool("measurement.parallel_protocols") {
+		for _, protocol := range protocols {
+			if _, err := s.performProtocolMeasurement(client, &server, sessionID, retryNumber, prefix, accessLinkOverride, protocol); err != nil {
+				return fmt.Errorf("measurement failed for %s: %v", protocol, err)
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, len(protocols))
+	var wg sync.WaitGroup
+	for i, protocol := range protocols {
+		wg.Add(1)
+		go func(i int, protocol string) {
+			defer wg.Done()
+			_, errs[i] = s.performProtocolMeasurement(client, &server, sessionID, retryNumber, prefix, accessLinkOverride, protocol)
+		}(i, protocol)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("measurement failed for %s: %v", protocols[i], err)
 		}
 	}
 	return nil
 }
 
-// shouldSkipProtocol determines if a protocol test should be skipped
-func (s *MeasurementService) shouldSkipProtocol(protocol string, server models.Server) bool {
-	if protocol == "tcp" && server.TCPErrorMsg != "" {
+// composeTransport chains the client proxy, the extra hops and the access
+// link, in that order. An empty proxy URL connects without a client proxy.
+func composeTransport(proxyURL string, extraHops []string, accessLink string) string {
+	var hops []string
+	if proxyURL != "" {
+		hops = append(hops, proxyURL)
+	}
+	hops = append(hops, extraHops...)
+	hops = append(hops, accessLink)
+	return strings.Join(hops, "|")
+}
+
+// skippedOp is the error op of the measurements recorded for skipped tests
+const skippedOp = "skipped"
+
+// Reasons a test is skipped, recorded as the skip reason of its measurement
+const (
+	skipServerTCPError = "server_tcp_error"
+	skipServerUDPError = "server_udp_error"
+	skipProviderNoUDP  = "provider_no_udp"
+)
+
+// skipReason returns why a protocol test through a proxy should be skipped,
+// empty if it shouldn't. UDP tests are skipped if the provider's clients
+// can't relay UDP. Server errors are recorded by local tests, so
+// reachability through a proxy may differ; measurement.ignore_server_error_state
+// tests servers whatever their errors.
+func (s *MeasurementService) skipReason(protocol string, server models.Server) string {
+	if protocol == "udp" && !s.provider.Capabilities().UDP {
+		return skipProviderNoUDP
+	}
+	if s.config.GetBool("measurement.ignore_server_error_state") {
+		return ""
+	}
+	// HTTP tests run over TCP
+	if (protocol == "tcp" || protocol == "http") && server.TCPErrorMsg != "" {
 		s.logger.Debug("Skipping TCP test",
 			"serverIP", server.IP,
 			"serverPort", server.Port,
 			"error", server.TCPErrorMsg)
-		return true
+		return skipServerTCPError
 	}
 	if protocol == "udp" && server.UDPErrorMsg != "" {
 		s.logger.Debug("Skipping UDP test",
 			"serverIP", server.IP,
 			"serverPort", server.Port,
 			"error", server.UDPErrorMsg)
-		return true
+		return skipServerUDPError
 	}
-	return false
+	return ""
 }
 
 // handleTestResult processes the test result and updates the measurement
@@ -421,6 +1037,7 @@ func (s *MeasurementService) handleTestResult(
 			"sessionID", measurement.SessionID)
 		measurement.ErrorMsg = err.Error()
 		measurement.ErrorOp = "fail"
+		measurement.ErrorCategory = categorizeError(measurement.ErrorMsg)
 		return nil
 	}
 
@@ -431,6 +1048,7 @@ func (s *MeasurementService) handleTestResult(
 		measurement.ErrorMsg = report.Test.Error.Msg
 		measurement.ErrorMsgVerbose = report.Test.Error.MsgVerbose
 		measurement.ErrorOp = report.Test.Error.Op
+		measurement.ErrorCategory = categorizeError(measurement.ErrorMsg)
 		measurement.Duration = report.Test.DurationMs
 	} else {
 		s.logger.Debug("Connectivity Test successful",
@@ -439,6 +1057,7 @@ func (s *MeasurementService) handleTestResult(
 		measurement.Duration = report.Test.DurationMs
 		measurement.ErrorOp = "success"
 	}
+	measurement.TTFBMs = report.Test.TTFBMs
 
 	// Marshal report into JSON
 	reportJson, err := json.Marshal(report)
@@ -451,17 +1070,126 @@ func (s *MeasurementService) handleTestResult(
 	return nil
 }
 
-// worker processes measurement jobs from the jobs channel
-func (s *MeasurementService) worker(wg *sync.WaitGroup, jobs <-chan measurementJob, results chan<- error) {
+// worker processes measurement jobs from the jobs channel on the current
+// client of the session
+func (s *MeasurementService) worker(wg *sync.WaitGroup, session *clientSession, breaker *failureBreaker, jobs <-chan measurementJob, results chan<- error) {
 	defer wg.Done()
 	for job := range jobs {
-		err := s.measureServer(*job.client, job.server)
+		if breaker.skip() {
+			continue
+		}
+		client := s.sessionClient(session)
+		err := s.measure(*client, job.server, session.rotate)
+		breaker.record(err != nil, func() bool {
+			return s.tripClient(session, client, breaker.limit)
+		})
+		if errors.Is(err, errNoSuccess) {
+			err = nil
+		}
 		results <- err
 	}
 }
 
-// processMeasurements handles parallel processing of measurements for a client
-func (s *MeasurementService) processMeasurements(client *models.Client, servers []models.Server) {
+// orderServers returns the servers in priority order. Servers selected by
+// ID or name don't come sorted from the database so the order is always
+// applied here.
+func orderServers(servers []models.Server, priority database.ServerOrder) []models.Server {
+	ordered := make([]models.Server, len(servers))
+	copy(ordered, servers)
+
+	switch priority {
+	case database.ServerOrderStalest:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].LastTestTime.Before(ordered[j].LastTestTime)
+		})
+	}
+	return ordered
+}
+
+// queueJobs builds the measurement jobs with servers in priority order
+func queueJobs(servers []models.Server, priority database.ServerOrder) []measurementJob {
+	ordered := orderServers(servers, priority)
+
+	jobs := make([]measurementJob, len(ordered))
+	for i, server := range ordered {
+		jobs[i] = measurementJob{
+			server: server,
+		}
+	}
+	return jobs
+}
+
+// sampleServers returns n servers picked at random, in their original order.
+// All servers are returned if n is 0 or not smaller than their count.
+func sampleServers(r *rand.Rand, servers []models.Server, n int) []models.Server {
+	if n <= 0 || n >= len(servers) {
+		return servers
+	}
+	picked := r.Perm(len(servers))[:n]
+	sort.Ints(picked)
+
+	sample := make([]models.Server, n)
+	for i, idx := range picked {
+		sample[i] = servers[idx]
+	}
+	return sample
+}
+
+// splitServers splits servers into batches of at most n, 0 keeps them in a
+// single batch
+func splitServers(servers []models.Server, n int) [][]models.Server {
+	if n <= 0 || len(servers) <= n {
+		return [][]models.Server{servers}
+	}
+	var batches [][]models.Server
+	for len(servers) > n {
+		batches = append(batches, servers[:n])
+		servers = servers[n:]
+	}
+	return append(batches, servers)
+}
+
+// sessionLength returns the session length in seconds of a client measuring
+// serverCount servers
+func (s *MeasurementService) sessionLength(p proxy.Provider, serverCount int) int {
+	// Set client session length based on number of servers to measure
+	// More servers need more time to measure
+	// Each server test with retires and prefixes can take up to 150 seconds
+	length := serverCount * p.GetSessionLength()
+	// Longer sessions would be cut short by the provider
+	if maxLength := s.maxSessionLength(p); maxLength > 0 && length > maxLength {
+		length = maxLength
+	}
+	return length
+}
+
+// maxSessionLength returns the longest session in seconds the provider
+// allows, <provider>.max_session_length if set, otherwise the bound of its
+// capabilities. 0 means unbounded.
+func (s *MeasurementService) maxSessionLength(p proxy.Provider) int {
+	if seconds := s.config.GetInt(p.GetProviderName() + ".max_session_length"); seconds > 0 {
+		return seconds
+	}
+	return p.Capabilities().MaxSessionLength
+}
+
+// serversPerSession returns how many servers fit in the longest session of
+// the provider, at least one, 0 if sessions are unbounded
+func (s *MeasurementService) serversPerSession(p proxy.Provider) int {
+	// The local client has no proxy session that expires
+	if p.GetProviderName() == string(proxy.SystemNone) {
+		return 0
+	}
+	maxLength := s.maxSessionLength(p)
+	if maxLength <= 0 || p.GetSessionLength() <= 0 {
+		return 0
+	}
+	return max(1, maxLength/p.GetSessionLength())
+}
+
+// processMeasurements handles parallel processing of measurements on the
+// clients of a session
+func (s *MeasurementService) processMeasurements(session *clientSession, servers []models.Server, priority database.ServerOrder) {
 	// Determine number of workers
 	maxWorkers := s.provider.GetMaxWorkers()
 
@@ -473,19 +1201,18 @@ func (s *MeasurementService) processMeasurements(client *models.Client, servers
 	jobs := make(chan measurementJob, len(servers))
 	results := make(chan error, len(servers))
 
-	// Start worker pool
+	// Start worker pool, the workers stop running jobs once the breaker
+	// trips on a failing client
+	breaker := s.newFailureBreaker()
 	var wg sync.WaitGroup
 	for i := 0; i < maxWorkers; i++ {
 		wg.Add(1)
-		go s.worker(&wg, jobs, results)
+		go s.worker(&wg, session, breaker, jobs, results)
 	}
 
-	// Send jobs to workers
-	for _, server := range servers {
-		jobs <- measurementJob{
-			client: client,
-			server: server,
-		}
+	// Send jobs to workers in priority order
+	for _, job := range queueJobs(servers, priority) {
+		jobs <- job
 	}
 	close(jobs)
 
@@ -500,6 +1227,7 @@ func (s *MeasurementService) processMeasurements(client *models.Client, servers
 	for err := range results {
 		if err != nil {
 			errorCount++
+			client := session.current()
 			s.logger.Error("Measurement failed",
 				"error", err,
 				"clientID", client.ID,
@@ -507,29 +1235,57 @@ func (s *MeasurementService) processMeasurements(client *models.Client, servers
 				"errorCount", errorCount)
 		}
 	}
+	if abandoned := breaker.abandonedJobs(); abandoned > 0 {
+		client := session.current()
+		s.logger.Warn("Abandoned jobs of a failing client",
+			"clientID", client.ID,
+			"isp", client.ISP,
+			"jobs", abandoned)
+	}
 }
 
-// startClientMonitoring starts monitoring a client's validity (IP hasn't changed)
-func (s *MeasurementService) startClientMonitoring(client *models.Client) {
+// startClientMonitoring starts monitoring the validity of a session's client
+// (IP hasn't changed). With client refresh enabled, a client about to expire
+// is replaced and the new client is monitored instead.
+func (s *MeasurementService) startClientMonitoring(session *clientSession) {
 	// Store client in active clients map
+	client := session.current()
 	s.activeClients.Store(client.ID, client)
 
+	ticker := time.NewTicker(monitorInterval)
 	go func() {
-		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				// Check if client is still in active clients map
-				if _, exists := s.activeClients.Load(client.ID); !exists {
+				client := session.current()
+
+				// Check if client is still in active clients map, and
+				// wasn't taken over by another session, e.g. a resumed
+				// client reused from the session pool
+				if monitored, exists := s.activeClients.Load(client.ID); !exists || monitored != client {
 					s.logger.Debug("Client no longer being monitored, stopping goroutine",
 						"clientID", client.ID,
 						"clientIP", client.IP)
 					return
 				}
 
-				valid, err := s.provider.IsValidClient(client)
+				// Replace the client before it expires
+				if session.expiring(client) {
+					s.sessionClient(session)
+					continue
+				}
+
+				if !timeNow().Before(client.ExpirationTime) {
+					s.logger.Debug("Client session expired, stopping monitoring",
+						"clientID", client.ID,
+						"clientIP", client.IP)
+					s.activeClients.Delete(client.ID)
+					return
+				}
+
+				check, err := s.checkClient(client)
 				if err != nil {
 					s.logger.Error("Failed to validate client",
 						"clientID", client.ID,
@@ -537,8 +1293,11 @@ func (s *MeasurementService) startClientMonitoring(client *models.Client) {
 						"error", err)
 					continue
 				}
+				if check.Changed {
+					s.recordIPChange(client, check)
+				}
 
-				if !valid {
+				if !check.Valid {
 					s.logger.Warn("Client is no longer valid",
 						"clientID", client.ID,
 						"clientIP", client.IP)
@@ -560,6 +1319,7 @@ func (s *MeasurementService) startClientMonitoring(client *models.Client) {
 					"clientIP", client.IP)
 
 			case <-s.stopMonitor:
+				client := session.current()
 				s.logger.Debug("Stopping client monitoring",
 					"clientID", client.ID,
 					"clientIP", client.IP)
@@ -569,6 +1329,64 @@ func (s *MeasurementService) startClientMonitoring(client *models.Client) {
 	}()
 }
 
+// recordIPChange stores the exit IP change of a monitored client
+func (s *MeasurementService) recordIPChange(client *models.Client, check proxy.ClientCheck) {
+	change := &models.IPChange{
+		ClientID:    client.ID,
+		Time:        timeNow(),
+		OldIP:       client.IP,
+		NewIP:       check.IP,
+		CountryCode: check.CountryCode,
+		ASNumber:    check.ASNumber,
+		SameCountry: check.SameCountry,
+		SameASN:     check.SameASN,
+	}
+	if err := s.db.InsertIPChange(context.Background(), change); err != nil {
+		s.logger.Error("Failed to store client IP change",
+			"clientID", client.ID,
+			"error", err)
+	}
+}
+
+// resumeClientMonitoring reconciles the monitored clients with the clients
+// of the provider that are still active in the database, so a restarted
+// process keeps monitoring the live sessions of the previous one. It returns
+// the number of clients whose monitoring was resumed.
+func (s *MeasurementService) resumeClientMonitoring(ctx context.Context) (int, error) {
+	clients, err := s.db.GetActiveClients(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var resumed int
+	for i := range clients {
+		client := &clients[i]
+		if client.Proxy != s.provider.GetProviderName() {
+			continue
+		}
+		if _, monitored := s.activeClients.Load(client.ID); monitored {
+			continue
+		}
+
+		client.ProxyURL = s.provider.BuildTransportURL(client)
+		// Nothing measures on a resumed client, so it isn't refreshed
+		s.startClientMonitoring(&clientSession{client: client})
+		resumed++
+	}
+	return resumed, nil
+}
+
+// monitoredClients returns the clients whose validity is being monitored
+func (s *MeasurementService) monitoredClients() []models.Client {
+	var clients []models.Client
+	s.activeClients.Range(func(key, value interface{}) bool {
+		clients = append(clients, *value.(*models.Client))
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
 // stopClientMonitoring stops monitoring a specific client
 func (s *MeasurementService) stopClientMonitoring(clientID int64) {
 	s.activeClients.Delete(clientID)
@@ -576,6 +1394,7 @@ func (s *MeasurementService) stopClientMonitoring(clientID int64) {
 
 // Shutdown cleans up the MeasurementService
 func (s *MeasurementService) Shutdown() {
+	s.unlockRun()
 	close(s.stopMonitor)
 	// Wait a moment for goroutines to clean up
 	time.Sleep(100 * time.Millisecond)
@@ -0,0 +1,146 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+)
+
+// IterationOrder is the order in which the clients and servers of a run are
+// measured, set by measurement.iteration_order
+type IterationOrder string
+
+const (
+	// IterationClientFirst measures all servers on a client before moving
+	// on to the next client
+	IterationClientFirst IterationOrder = "client_first"
+	// IterationServerFirst measures a server on every client before moving
+	// on to the next server, for even temporal coverage of each server
+	IterationServerFirst IterationOrder = "server_first"
+)
+
+// iterationOrder returns the configured iteration order, client first by
+// default
+func (s *MeasurementService) iterationOrder() (IterationOrder, error) {
+	switch order := IterationOrder(s.config.GetString("measurement.iteration_order")); order {
+	case "", IterationClientFirst:
+		return IterationClientFirst, nil
+	case IterationServerFirst:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unsupported iteration order: %s", order)
+	}
+}
+
+// clientServers is a session with the servers its client measures
+type clientServers struct {
+	session *clientSession
+	servers map[int64]bool
+	// breaker stops measuring on the client of the session once it failed
+	// too many servers in a row
+	breaker *failureBreaker
+}
+
+// runServerFirst acquires all clients of the run up front and then measures
+// the servers one after the other, each on every client that sampled it.
+// Sessions aren't split into batches, a client holds its session for the
+// whole run and is only replaced before it expires if
+// measurement.refresh_clients is set.
+func (s *MeasurementService) runServerFirst(ctx context.Context, p proxy.Provider, settings Settings, servers []models.Server) error {
+	var clients []clientServers
+	defer func() {
+		for _, c := range clients {
+			s.stopClientMonitoring(c.session.current().ID)
+		}
+	}()
+
+	err := s.acquireClients(p, settings, func(country string, client *models.Client) {
+		sample := sampleServers(s.rand, servers, settings.ServersPerClient)
+		acquire := s.clientAcquirer(ctx, p, settings, country, client.ISP, len(sample))
+		savedClient, err := s.prepareClient(ctx, p, client, len(sample))
+		if errors.Is(err, errShortSession) {
+			s.logger.Debug("Skipping pooled client", "isp", client.ISP, "error", err)
+			// The acquired client is prepared and warmed up
+			savedClient, err = acquire()
+		} else if err == nil && !s.warmUpClient(savedClient) {
+			return
+		}
+		if err != nil {
+			s.logger.Error("Failed to save client",
+				"error", err,
+				"clientIP", client.IP)
+			return
+		}
+
+		session := s.newClientSession(savedClient, acquire)
+		s.startClientMonitoring(session)
+
+		ids := make(map[int64]bool, len(sample))
+		for _, server := range sample {
+			ids[server.ID] = true
+		}
+		clients = append(clients, clientServers{session: session, servers: ids, breaker: s.newFailureBreaker()})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, server := range orderServers(servers, settings.Priority) {
+		var measuring []clientServers
+		for _, c := range clients {
+			if c.servers[server.ID] {
+				measuring = append(measuring, c)
+			}
+		}
+		s.measureOnClients(server, measuring)
+	}
+
+	for _, c := range clients {
+		if abandoned := c.breaker.abandonedJobs(); abandoned > 0 {
+			client := c.session.current()
+			s.logger.Warn("Abandoned jobs of a failing client",
+				"clientID", client.ID,
+				"isp", client.ISP,
+				"jobs", abandoned)
+		}
+	}
+	return nil
+}
+
+// measureOnClients measures server on the current client of each session,
+// with at most the provider's number of workers in parallel. Sessions whose
+// breaker tripped skip the server.
+func (s *MeasurementService) measureOnClients(server models.Server, clients []clientServers) {
+	workers := make(chan struct{}, max(s.provider.GetMaxWorkers(), 1))
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(c clientServers) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			if c.breaker.skip() {
+				return
+			}
+			client := s.sessionClient(c.session)
+			err := s.measure(*client, server, c.session.rotate)
+			c.breaker.record(err != nil, func() bool {
+				return s.tripClient(c.session, client, c.breaker.limit)
+			})
+			if err != nil && !errors.Is(err, errNoSuccess) {
+				s.logger.Error("Measurement failed",
+					"error", err,
+					"clientID", client.ID,
+					"clientIP", client.IP,
+					"serverIP", server.IP)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,120 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+)
+
+// errShortSession is returned when a pooled client expires before it could
+// measure its servers
+var errShortSession = errors.New("pooled session is too short")
+
+// SessionPool hands out the still-valid clients that previous runs stored,
+// so new sessions are only acquired from the provider when there is no
+// client to reuse. It works with any provider that can rebuild the transport
+// URL of a stored client. Each client is handed out once per pool.
+type SessionPool struct {
+	store    Store
+	provider proxy.Provider
+	// minRemaining is how long a client must still be valid to be reused
+	minRemaining time.Duration
+
+	mu sync.Mutex
+	// taken holds the IDs of the clients handed out
+	taken map[int64]bool
+}
+
+// NewSessionPool creates a pool of the clients of provider stored in store
+// that are valid for at least minRemaining
+func NewSessionPool(store Store, provider proxy.Provider, minRemaining time.Duration) *SessionPool {
+	return &SessionPool{
+		store:        store,
+		provider:     provider,
+		minRemaining: minRemaining,
+		taken:        make(map[int64]bool),
+	}
+}
+
+// Get returns a client of the ISP, country and city in settings with its
+// ProxyURL rebuilt, or nil if the pool has none left
+func (p *SessionPool) Get(ctx context.Context, settings Settings, country, isp string) (*models.Client, error) {
+	target := database.ClientTarget{
+		Proxy:      p.provider.GetProviderName(),
+		ClientType: string(settings.ClientType),
+		Country:    country,
+		ISP:        isp,
+		City:       settings.City,
+	}
+	clients, err := p.store.GetActiveClientsFor(ctx, target, timeNow().Add(p.minRemaining))
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range clients {
+		client := &clients[i]
+		if p.taken[client.ID] {
+			continue
+		}
+		client.ProxyURL = p.provider.BuildTransportURL(client)
+		if client.ProxyURL == "" {
+			continue
+		}
+		p.taken[client.ID] = true
+		return client, nil
+	}
+	return nil, nil
+}
+
+// pooledClient returns a pooled client for isp that the provider still
+// considers valid, nil if the pool is disabled or has none. Clients the
+// provider reports invalid are marked expired so later runs skip them.
+func (s *MeasurementService) pooledClient(isp string, settings Settings, country string) *models.Client {
+	if s.pool == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	for {
+		client, err := s.pool.Get(ctx, settings, country, isp)
+		if err != nil {
+			s.logger.Warn("Failed to get pooled client", "isp", isp, "error", err)
+			return nil
+		}
+		if client == nil {
+			return nil
+		}
+
+		valid, err := s.isValidClient(client)
+		if err == nil && valid {
+			s.logger.Info("Reusing pooled client",
+				"clientID", client.ID,
+				"clientIP", client.IP,
+				"isp", isp,
+				"expiresIn", client.ExpirationTime.Sub(timeNow()).Round(time.Second))
+			return client
+		}
+
+		s.logger.Debug("Discarding pooled client",
+			"clientID", client.ID,
+			"clientIP", client.IP,
+			"valid", valid,
+			"error", err)
+		if err != nil {
+			// The check may fail for reasons unrelated to the client
+			continue
+		}
+		if err := s.db.UpdateClientExpiration(ctx, client.ID, timeNow()); err != nil {
+			s.logger.Error("Failed to update client expiration in database",
+				"clientID", client.ID,
+				"error", err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package measurement
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+// poolProvider is a fakeProvider that reports the clients of invalidIPs invalid
+type poolProvider struct {
+	fakeProvider
+	invalidIPs map[string]bool
+}
+
+func (p *poolProvider) IsValidClient(client *models.Client) (bool, error) {
+	return !p.invalidIPs[client.IP], nil
+}
+
+func TestSessionPool(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	stored := func(ip, isp string, expiresIn time.Duration) models.Client {
+		return models.Client{
+			IP: ip, ISP: isp, CountryCode: "ir", ClientType: string(models.MobileType),
+			Proxy: "fake", SessionID: 42, ExpirationTime: now.Add(expiresIn),
+		}
+	}
+	store := &memoryStore{}
+	store.InsertClients(ctx, []models.Client{
+		stored("198.51.100.1", "MCI", -time.Minute),
+		stored("198.51.100.2", "MCI", time.Hour),
+		stored("198.51.100.3", "MTN", time.Hour),
+		stored("198.51.100.4", "Rightel", 30*time.Second),
+	})
+
+	config := viper.New()
+	config.Set("measurement.session_pool", true)
+	p := &poolProvider{invalidIPs: map[string]bool{"198.51.100.3": true}}
+	s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, p)
+	settings := Settings{Countries: []string{"ir"}, ClientType: models.MobileType, MaxRetries: 1}
+
+	// The valid client is reused without a new acquisition
+	client, err := s.getClient(p, "MCI", settings, "ir")
+	if err != nil {
+		t.Fatalf("getClient() error = %v", err)
+	}
+	if client.ID != 2 || client.ProxyURL != "socks5://198.51.100.2" {
+		t.Errorf("getClient() = client %d with proxy URL %q, want pooled client 2", client.ID, client.ProxyURL)
+	}
+	if got := s.usage.acquisitions.Load(); got != 0 {
+		t.Errorf("acquisitions = %d after reusing a pooled client, want 0", got)
+	}
+	prepared, err := s.prepareClient(ctx, p, client, 5)
+	if err != nil || prepared.ID != 2 || len(store.clients) != 4 {
+		t.Errorf("prepareClient() stored the pooled client again, ID %d, error %v", prepared.ID, err)
+	}
+
+	// Once it's taken, and for ISPs whose clients are expired, expiring or
+	// invalid, new sessions are acquired
+	for _, isp := range []string{"MCI", "MTN", "Rightel"} {
+		client, err := s.getClient(p, isp, settings, "ir")
+		if err != nil {
+			t.Fatalf("getClient(%s) error = %v", isp, err)
+		}
+		if client.ID != 0 {
+			t.Errorf("getClient(%s) reused client %d, want a new acquisition", isp, client.ID)
+		}
+	}
+	if got := s.usage.acquisitions.Load(); got != 3 {
+		t.Errorf("acquisitions = %d, want 3", got)
+	}
+
+	// The invalid client is expired so it isn't pooled again
+	active, _ := store.GetActiveClients(ctx)
+	for _, c := range active {
+		if c.ID == 3 {
+			t.Error("invalid pooled client is still active")
+		}
+	}
+}
+
+func TestPooledClientSessionLength(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{}
+	store.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.2", ISP: "MCI", CountryCode: "ir", ClientType: string(models.MobileType),
+		Proxy: "fake", SessionID: 42, ExpirationTime: time.Now().Add(10 * time.Minute),
+	}})
+
+	config := viper.New()
+	config.Set("measurement.session_pool", true)
+	p := &poolProvider{}
+	s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, p)
+	settings := Settings{Countries: []string{"ir"}, ClientType: models.MobileType, MaxRetries: 1}
+
+	// Measuring 5 servers takes 25 minutes, the pooled client expires before
+	client, err := s.getClient(p, "MCI", settings, "ir")
+	if err != nil || client.ID != 1 {
+		t.Fatalf("getClient() = %+v, %v, want pooled client 1", client, err)
+	}
+	if _, err := s.prepareClient(ctx, p, client, 5); !errors.Is(err, errShortSession) {
+		t.Errorf("prepareClient(5 servers) error = %v, want errShortSession", err)
+	}
+	if _, err := s.prepareClient(ctx, p, client, 1); err != nil {
+		t.Errorf("prepareClient(1 server) error = %v", err)
+	}
+
+	// The acquirer skips it for a new session, the pool is recreated so
+	// it's handed out again
+	s.pool = NewSessionPool(store, p, s.refreshThreshold())
+	prepared, err := s.clientAcquirer(ctx, p, settings, "ir", "MCI", 5)()
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if prepared.ID == 1 || prepared.SessionLength != 5*300 {
+		t.Errorf("acquire() = client %d with session length %d, want a new client of 1500s", prepared.ID, prepared.SessionLength)
+	}
+	if got := s.usage.acquisitions.Load(); got != 1 {
+		t.Errorf("acquisitions = %d, want 1", got)
+	}
+}
@@ -0,0 +1,96 @@
+package measurement
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// prefixesSourceTimeout bounds fetching the prefixes of a URL source
+const prefixesSourceTimeout = 30 * time.Second
+
+// loadPrefixes returns the prefixes of a run: the inline measurement.prefixes
+// followed by those of measurement.prefixes_source that aren't inline. The
+// source is read again for every run so updates are picked up. If it can't
+// be read, the run uses the inline prefixes only.
+func (s *MeasurementService) loadPrefixes(ctx context.Context) []string {
+	prefixes := slices.Clone(s.config.GetStringSlice("measurement.prefixes"))
+	if prefixes == nil {
+		prefixes = []string{}
+	}
+	source := s.config.GetString("measurement.prefixes_source")
+	if source == "" {
+		return prefixes
+	}
+
+	loaded, err := readPrefixesSource(ctx, source)
+	if err != nil {
+		s.logger.Warn("Failed to load prefixes, using the inline prefixes only",
+			"source", source,
+			"inlinePrefixes", len(prefixes),
+			"error", err)
+		return prefixes
+	}
+	for _, prefix := range loaded {
+		if !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	s.logger.Info("Loaded prefixes", "source", source, "loaded", len(loaded), "prefixes", len(prefixes))
+	return prefixes
+}
+
+// readPrefixesSource reads the prefixes of an http(s) URL or a file path
+func readPrefixesSource(ctx context.Context, source string) ([]string, error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open prefixes file: %v", err)
+		}
+		defer file.Close()
+		return readPrefixes(file)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, prefixesSourceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prefixes request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch prefixes: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch prefixes: %s", resp.Status)
+	}
+	return readPrefixes(resp.Body)
+}
+
+// readPrefixes reads URL-escaped prefixes, one per line, like the inline
+// ones. Blank lines and lines starting with # are skipped.
+func readPrefixes(r io.Reader) ([]string, error) {
+	var prefixes []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefixes = append(prefixes, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read prefixes: %v", err)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no prefixes")
+	}
+	return prefixes, nil
+}
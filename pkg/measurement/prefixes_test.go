@@ -0,0 +1,98 @@
+package measurement
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+func TestRunMeasurementsPrefixesSource(t *testing.T) {
+	list := "# DPI evasion prefixes\nPOST%20\n\n%16%03%01\nGET%20\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, list)
+	}))
+	defer srv.Close()
+
+	store := &memoryStore{}
+	ctx := context.Background()
+	server := models.Server{IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://192.0.2.1:443", Scheme: "ss"}
+	store.UpsertServer(ctx, &server)
+
+	config := viper.New()
+	config.Set("measurement.prefixes", []string{"GET%20"})
+	config.Set("measurement.prefixes_source", srv.URL)
+	p := &fakeProvider{isps: map[string][]string{"ir": {"MCI"}}}
+	s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), config, p)
+	defer s.Shutdown()
+	// tcp only works with a prefix
+	s.testConnectivity = func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+		if proto == "tcp" && !strings.Contains(transportConfig, "prefix=") {
+			return connectivity.ConnectivityReport{}, fmt.Errorf("connection reset by peer")
+		}
+		return connectivity.ConnectivityReport{}, nil
+	}
+
+	settings := Settings{Countries: []string{"ir"}, ClientType: models.MobileType, MaxClients: 1, MaxRetries: 1, NoLock: true}
+	result, err := s.RunMeasurements(ctx, p, settings)
+	if err != nil {
+		t.Fatalf("RunMeasurements() error = %v", err)
+	}
+
+	// The inline prefix comes first, the loaded ones follow without duplicates
+	var tried []string
+	for _, m := range store.measurements {
+		if m.Protocol == "tcp" && m.PrefixUsed != "" {
+			tried = append(tried, m.PrefixUsed)
+		}
+	}
+	if want := []string{"GET%20", "POST%20", "%16%03%01"}; !reflect.DeepEqual(tried, want) {
+		t.Errorf("tried prefixes %v, want %v", tried, want)
+	}
+	if result.PrefixSuccesses != 3 {
+		t.Errorf("prefix successes = %d, want 3", result.PrefixSuccesses)
+	}
+
+	// The source is read again by the next run
+	list = "%13%03%03\n"
+	if _, err := s.RunMeasurements(ctx, p, settings); err != nil {
+		t.Fatalf("RunMeasurements() error = %v", err)
+	}
+	if want := []string{"GET%20", "%13%03%03"}; !reflect.DeepEqual(s.prefixes, want) {
+		t.Errorf("second run prefixes = %v, want %v", s.prefixes, want)
+	}
+}
+
+func TestLoadPrefixesFallback(t *testing.T) {
+	config := viper.New()
+	config.Set("measurement.prefixes", []string{"GET%20"})
+	s := &MeasurementService{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), config: config}
+
+	// A file source is merged with the inline prefixes
+	filename := filepath.Join(t.TempDir(), "prefixes.txt")
+	if err := os.WriteFile(filename, []byte("POST%20\n"), 0o600); err != nil {
+		t.Fatalf("failed to write prefixes file: %v", err)
+	}
+	config.Set("measurement.prefixes_source", filename)
+	if got, want := s.loadPrefixes(context.Background()), []string{"GET%20", "POST%20"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loadPrefixes() = %v, want %v", got, want)
+	}
+
+	// An unreadable source falls back to the inline prefixes
+	config.Set("measurement.prefixes_source", filepath.Join(t.TempDir(), "missing.txt"))
+	if got, want := s.loadPrefixes(context.Background()), []string{"GET%20"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loadPrefixes() = %v, want %v", got, want)
+	}
+}
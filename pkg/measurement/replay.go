@@ -0,0 +1,99 @@
+package measurement
+
+import (
+	"context"
+	"fmt"
+
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+
+	"github.com/google/uuid"
+)
+
+// ReplayResult pairs a stored measurement with the measurement replaying it
+type ReplayResult struct {
+	Original models.Measurement
+	Replay   models.Measurement
+	// ASNMismatch is set if the new client exits from another AS than the
+	// original client, which may explain a different outcome
+	ASNMismatch bool
+}
+
+// Replay re-runs the probe of a stored measurement to reproduce its
+// conditions: the same server, protocol, prefix and retry number from a new
+// client of p with the ISP, country, city and type of the original client.
+// Providers implementing proxy.SessionSeeder are asked for the session of
+// the original client first.
+// The replay is recorded as a measurement of a new run. maxRetries bounds
+// the attempts to get the client.
+func (s *MeasurementService) Replay(ctx context.Context, p proxy.Provider, measurementID int64, maxRetries int) (*ReplayResult, error) {
+	original, err := s.db.GetMeasurement(ctx, measurementID)
+	if err != nil {
+		return nil, err
+	}
+	if original.Client == nil || original.Server == nil {
+		return nil, fmt.Errorf("measurement %d has no client or server", measurementID)
+	}
+	if original.ErrorOp == skippedOp {
+		return nil, fmt.Errorf("measurement %d is a skipped test, there is no probe to replay", measurementID)
+	}
+	if original.Client.Proxy != p.GetProviderName() {
+		return nil, fmt.Errorf("measurement %d was taken through proxy %s, not %s",
+			measurementID, original.Client.Proxy, p.GetProviderName())
+	}
+
+	origClient := original.Client
+	settings := Settings{
+		ClientType: models.ClientType(origClient.ClientType),
+		City:       origClient.TargetCity,
+		MaxRetries: maxRetries,
+	}
+	s.runID = uuid.New().String()
+	s.runCtx = ctx
+	if seeder, ok := p.(proxy.SessionSeeder); ok {
+		seeder.SeedSessions(s.runID)
+		seeder.PinSession(origClient.ISP, origClient.SessionID)
+	}
+	client, err := s.clientAcquirer(ctx, p, settings, origClient.CountryCode, origClient.ISP, 1)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a client for ISP %s in %s: %v", origClient.ISP, origClient.CountryCode, err)
+	}
+	s.logger.Info("Replaying measurement",
+		"measurementID", measurementID,
+		"serverIP", original.Server.IP,
+		"protocol", original.Protocol,
+		"prefix", original.PrefixUsed,
+		"clientIP", client.IP,
+		"isp", client.ISP)
+
+	server := *original.Server
+	var accessLinkOverride *string
+	if original.PrefixUsed != "" {
+		link := prefixedAccessLink(server, original.PrefixUsed)
+		accessLinkOverride = &link
+	}
+	sessionID := uuid.New().String()
+	if _, err := s.performProtocolMeasurement(*client, &server, sessionID, original.RetryNumber,
+		original.PrefixUsed, accessLinkOverride, original.Protocol); err != nil {
+		return nil, fmt.Errorf("replay failed: %v", err)
+	}
+
+	replays, err := s.measurements().GetMeasurementsBySession(ctx, sessionID, original.RetryNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve replay: %v", err)
+	}
+	if len(replays) == 0 {
+		return nil, fmt.Errorf("replay of measurement %d recorded no measurement", measurementID)
+	}
+
+	result := &ReplayResult{Original: *original, Replay: replays[0]}
+	result.Replay.Client = client
+	result.Replay.Server = &server
+	if origClient.ASNumber != "" && client.ASNumber != "" && origClient.ASNumber != client.ASNumber {
+		result.ASNMismatch = true
+		s.logger.Warn("Replay client exits from a different AS",
+			"originalASN", origClient.ASNumber,
+			"replayASN", client.ASNumber)
+	}
+	return result, nil
+}
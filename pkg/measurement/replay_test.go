@@ -0,0 +1,81 @@
+package measurement
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+// targetRecorder records the clients requested from a fakeProvider
+type targetRecorder struct {
+	*fakeProvider
+	requests []string
+}
+
+func (p *targetRecorder) GetClientForISP(isp string, clientType models.ClientType, country, city string, maxRetries int) (*models.Client, error) {
+	p.requests = append(p.requests, isp+"/"+string(clientType)+"/"+country+"/"+city)
+	return p.fakeProvider.GetClientForISP(isp, clientType, country, city, maxRetries)
+}
+
+func TestReplay(t *testing.T) {
+	store := &memoryStore{}
+	ctx := context.Background()
+	server := models.Server{IP: "203.0.113.5", Port: "443", FullAccessLink: "ss://203.0.113.5:443", Scheme: "ss"}
+	store.UpsertServer(ctx, &server)
+	clients, _ := store.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.7", ISP: "MCI", CountryCode: "ir", TargetCity: "tehran",
+		ClientType: string(models.MobileType), Proxy: "fake", ExpirationTime: time.Now().Add(-time.Hour),
+	}})
+	original := models.Measurement{
+		ClientID: clients[0].ID, ServerID: server.ID, Protocol: "tcp", RunID: "old-run",
+		SessionID: "old", RetryNumber: 2, PrefixUsed: "GET ", ErrorOp: "connect",
+	}
+	store.InsertMeasurement(ctx, &original)
+
+	p := &targetRecorder{fakeProvider: &fakeProvider{}}
+	s := NewMeasurementService(store, slog.New(slog.NewTextHandler(io.Discard, nil)), viper.New(), p)
+	var transport, proto string
+	s.testConnectivity = func(transportConfig, protocol, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+		transport, proto = transportConfig, protocol
+		return connectivity.ConnectivityReport{}, nil
+	}
+
+	result, err := s.Replay(ctx, p, original.ID, 1)
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+
+	// The new client targets the ISP, type, country and city of the original
+	if want := []string{"MCI/mobile/ir/tehran"}; len(p.requests) != 1 || p.requests[0] != want[0] {
+		t.Errorf("client requests = %v, want %v", p.requests, want)
+	}
+	// The probe reuses the protocol and prefix through the new client
+	if want := "socks5://192.0.2.1|ss://203.0.113.5:443?prefix=GET+"; transport != want || proto != "tcp" {
+		t.Errorf("tested %s over %q, want tcp over %q", proto, transport, want)
+	}
+
+	r := result.Replay
+	if r.ServerID != server.ID || r.Protocol != "tcp" || r.PrefixUsed != "GET " || r.RetryNumber != 2 {
+		t.Errorf("replay = %+v, want the parameters of the original", r)
+	}
+	if r.ClientID == original.ClientID || r.RunID == "old-run" || r.ErrorOp != "success" {
+		t.Errorf("replay client %d run %q result %q, want a new client and run", r.ClientID, r.RunID, r.ErrorOp)
+	}
+	if result.Original.ErrorOp != "connect" {
+		t.Errorf("original result = %q, want connect", result.Original.ErrorOp)
+	}
+
+	// Skipped tests have no probe to replay
+	skipped := models.Measurement{ClientID: clients[0].ID, ServerID: server.ID, Protocol: "udp", ErrorOp: skippedOp}
+	store.InsertMeasurement(ctx, &skipped)
+	if _, err := s.Replay(ctx, p, skipped.ID, 1); err == nil {
+		t.Error("Replay() of a skipped test succeeded, want error")
+	}
+}
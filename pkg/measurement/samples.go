@@ -0,0 +1,91 @@
+package measurement
+
+import (
+	"math"
+	"sort"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+)
+
+// connectivityTestFunc runs a single connectivity test, see connectivity.TestConnectivity
+type connectivityTestFunc func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error)
+
+// latencyStats is the duration distribution of the successful samples of a test
+type latencyStats struct {
+	samples    int
+	successful int
+	min        int64
+	median     int64
+	p95        int64
+	max        int64
+}
+
+// apply stores the distribution on the measurement
+func (l latencyStats) apply(m *models.Measurement) {
+	m.Samples = l.samples
+	m.SuccessfulSamples = l.successful
+	m.DurationMin = l.min
+	m.DurationMedian = l.median
+	m.DurationP95 = l.p95
+	m.DurationMax = l.max
+}
+
+// newLatencyStats computes the distribution of durations using nearest-rank percentiles
+func newLatencyStats(samples int, durations []int64) latencyStats {
+	stats := latencyStats{samples: samples, successful: len(durations)}
+	if len(durations) == 0 {
+		return stats
+	}
+
+	sorted := make([]int64, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p float64) int64 {
+		rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+		if rank < 1 {
+			rank = 1
+		}
+		return sorted[rank-1]
+	}
+
+	stats.min = sorted[0]
+	stats.median = percentile(50)
+	stats.p95 = percentile(95)
+	stats.max = sorted[len(sorted)-1]
+	return stats
+}
+
+// sampleConnectivity runs the connectivity test n times. If any sample fails,
+// the first failure is returned as the result so the error gets recorded,
+// otherwise the last report is returned. The latency stats only cover the
+// successful samples.
+func sampleConnectivity(test connectivityTestFunc, n int, transport, proto, resolver string, domains []string) (connectivity.ConnectivityReport, latencyStats, error) {
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		result    connectivity.ConnectivityReport
+		resultErr error
+		failed    bool
+		durations []int64
+	)
+	for i := 0; i < n; i++ {
+		report, err := test(transport, proto, resolver, domains)
+		if err != nil || report.Test.Error != nil {
+			if !failed {
+				result, resultErr, failed = report, err, true
+			}
+			continue
+		}
+
+		durations = append(durations, report.Test.DurationMs)
+		if !failed {
+			result = report
+		}
+	}
+
+	return result, newLatencyStats(n, durations), resultErr
+}
@@ -0,0 +1,79 @@
+package measurement
+
+import (
+	"errors"
+	"testing"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+)
+
+// scriptedTester returns a connectivity test that replays the given
+// durations in order. A negative duration produces a failed test.
+func scriptedTester(durations ...int64) connectivityTestFunc {
+	var i int
+	return func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+		d := durations[i%len(durations)]
+		i++
+
+		var report connectivity.ConnectivityReport
+		report.Test.Proto = proto
+		report.Test.DurationMs = d
+		if d < 0 {
+			return report, errors.New("connect: connection reset by peer")
+		}
+		return report, nil
+	}
+}
+
+func TestSampleConnectivity(t *testing.T) {
+	t.Run("all samples succeed", func(t *testing.T) {
+		test := scriptedTester(40, 10, 30, 20, 50, 60, 70, 80, 90, 100)
+		report, stats, err := sampleConnectivity(test, 10, "", "tcp", "1.1.1.1", []string{"example.com"})
+		if err != nil {
+			t.Fatalf("sampleConnectivity() error = %v", err)
+		}
+		if report.Test.DurationMs != 100 {
+			t.Errorf("got report of sample with duration %d, want the last sample (100)", report.Test.DurationMs)
+		}
+
+		want := latencyStats{samples: 10, successful: 10, min: 10, median: 50, p95: 100, max: 100}
+		if stats != want {
+			t.Errorf("sampleConnectivity() stats = %+v, want %+v", stats, want)
+		}
+	})
+
+	t.Run("failed samples are recorded but excluded from stats", func(t *testing.T) {
+		test := scriptedTester(30, -1, 10, 50, 20)
+		_, stats, err := sampleConnectivity(test, 5, "", "tcp", "1.1.1.1", []string{"example.com"})
+		if err == nil {
+			t.Errorf("sampleConnectivity() expected the sample error to be returned")
+		}
+
+		want := latencyStats{samples: 5, successful: 4, min: 10, median: 20, p95: 50, max: 50}
+		if stats != want {
+			t.Errorf("sampleConnectivity() stats = %+v, want %+v", stats, want)
+		}
+	})
+
+	t.Run("single sample", func(t *testing.T) {
+		_, stats, err := sampleConnectivity(scriptedTester(25), 0, "", "udp", "1.1.1.1", []string{"example.com"})
+		if err != nil {
+			t.Fatalf("sampleConnectivity() error = %v", err)
+		}
+		want := latencyStats{samples: 1, successful: 1, min: 25, median: 25, p95: 25, max: 25}
+		if stats != want {
+			t.Errorf("sampleConnectivity() stats = %+v, want %+v", stats, want)
+		}
+	})
+}
+
+func TestLatencyStatsApply(t *testing.T) {
+	var m models.Measurement
+	latencyStats{samples: 3, successful: 2, min: 1, median: 2, p95: 3, max: 3}.apply(&m)
+
+	if m.Samples != 3 || m.SuccessfulSamples != 2 || m.DurationMin != 1 ||
+		m.DurationMedian != 2 || m.DurationP95 != 3 || m.DurationMax != 3 {
+		t.Errorf("apply() set %+v", m)
+	}
+}
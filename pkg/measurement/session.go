@@ -0,0 +1,201 @@
+package measurement
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+)
+
+// defaultRefreshThreshold is how long before it expires a client is replaced
+// when measurement.refresh_threshold is not configured
+const defaultRefreshThreshold = 60 * time.Second
+
+// defaultRotateAfterFailures is the number of servers in a row whose first
+// tests must fail on a client before the retries run on a rotated session
+// when measurement.rotate_after_failures is not configured
+const defaultRotateAfterFailures = 3
+
+// acquireFunc gets a new client to continue measurements on
+type acquireFunc func() (*models.Client, error)
+
+// sessionRotation gets clients of a new proxy session to retry failed servers
+// on, once the first tests of threshold servers in a row failed on the
+// client of a session. The count restarts after each rotation, so a list of
+// blocked servers rotates the session once per threshold servers.
+type sessionRotation struct {
+	mu      sync.Mutex
+	acquire acquireFunc
+	// threshold is the number of failed servers in a row that rotates
+	threshold int
+	// consecutive counts the servers in a row whose first tests failed
+	consecutive int
+}
+
+// due records whether the first tests of a server failed and reports whether
+// its retries should run on a rotated session
+func (r *sessionRotation) due(failed bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !failed {
+		r.consecutive = 0
+		return false
+	}
+	r.consecutive++
+	if r.consecutive < r.threshold {
+		return false
+	}
+	r.consecutive = 0
+	return true
+}
+
+// clientSession holds the client the measurement jobs of an ISP run on. When
+// refresh is enabled, a client about to expire is replaced by a new session
+// for the same ISP and the remaining jobs continue on the new client.
+type clientSession struct {
+	mu     sync.Mutex
+	client *models.Client
+	// acquire gets the replacement client, nil disables refresh
+	acquire acquireFunc
+	// rotate gets a client on a new proxy session to retry failed servers
+	// on, nil disables rotation
+	rotate *sessionRotation
+	// replace gets a client to run the remaining jobs on when the client
+	// failed too many in a row, nil abandons them, see failureBreaker
+	replace acquireFunc
+	// threshold is how long before expiry the client is replaced
+	threshold time.Duration
+	// onRefresh is called with the replaced and the new client before
+	// the new client is visible to jobs
+	onRefresh func(old, new *models.Client)
+}
+
+// current returns the client jobs should run on
+func (c *clientSession) current() *models.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// expiring reports whether client expires within the refresh threshold and
+// should be replaced
+func (c *clientSession) expiring(client *models.Client) bool {
+	return c.acquire != nil && !timeNow().Add(c.threshold).Before(client.ExpirationTime)
+}
+
+// refresh replaces old with a new client. If old was already replaced, by a
+// worker or the monitor, the current client is returned without acquiring
+// another one.
+func (c *clientSession) refresh(old *models.Client) (*models.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == old && c.acquire == nil {
+		return nil, fmt.Errorf("client refresh is disabled")
+	}
+	return c.swapLocked(old, c.acquire, c.onRefresh)
+}
+
+// swap replaces old with a client from acquire, see refresh. onSwap, if
+// set, is called with old and the new client before jobs can see it.
+func (c *clientSession) swap(old *models.Client, acquire acquireFunc, onSwap func(old, new *models.Client)) (*models.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.swapLocked(old, acquire, onSwap)
+}
+
+func (c *clientSession) swapLocked(old *models.Client, acquire acquireFunc, onSwap func(old, new *models.Client)) (*models.Client, error) {
+	if c.client != old {
+		return c.client, nil
+	}
+
+	client, err := acquire()
+	if err != nil {
+		return nil, err
+	}
+	if onSwap != nil {
+		onSwap(old, client)
+	}
+	c.client = client
+	return client, nil
+}
+
+// refreshThreshold returns how long before it expires a client is replaced
+func (s *MeasurementService) refreshThreshold() time.Duration {
+	if seconds := s.config.GetInt("measurement.refresh_threshold"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultRefreshThreshold
+}
+
+// rotateAfterFailures returns the number of servers in a row whose first
+// tests must fail on a client before their retries run on a rotated session
+func (s *MeasurementService) rotateAfterFailures() int {
+	if failures := s.config.GetInt("measurement.rotate_after_failures"); failures > 0 {
+		return failures
+	}
+	return defaultRotateAfterFailures
+}
+
+// sessionClient returns the client for the next job of a session, replacing
+// it first if it's about to expire. If no replacement can be acquired the
+// expiring client is kept and its jobs fail once it has expired.
+func (s *MeasurementService) sessionClient(session *clientSession) *models.Client {
+	client := session.current()
+	if !session.expiring(client) {
+		return client
+	}
+
+	refreshed, err := session.refresh(client)
+	if err != nil {
+		s.logger.Error("Failed to refresh client",
+			"clientID", client.ID,
+			"clientIP", client.IP,
+			"isp", client.ISP,
+			"error", err)
+		return client
+	}
+	return refreshed
+}
+
+// newClientSession creates the session of a client. acquire gets a new client
+// for the same target, which replaces an expiring client if
+// measurement.refresh_clients is set, retries failed servers if
+// measurement.rotate_on_failure is set, see sessionRotation, and replaces a client that failed too
+// many jobs in a row if measurement.replace_failing_clients is set.
+func (s *MeasurementService) newClientSession(client *models.Client, acquire acquireFunc) *clientSession {
+	var rotate *sessionRotation
+	// The local client has no proxy session to rotate
+	if s.config.GetBool("measurement.rotate_on_failure") && s.provider.GetProviderName() != string(proxy.SystemNone) {
+		rotate = &sessionRotation{acquire: acquire, threshold: s.rotateAfterFailures()}
+	}
+	var replace acquireFunc
+	if s.config.GetBool("measurement.replace_failing_clients") && s.provider.GetProviderName() != string(proxy.SystemNone) {
+		replace = acquire
+	}
+	if !s.config.GetBool("measurement.refresh_clients") {
+		acquire = nil
+	}
+	return &clientSession{
+		client:    client,
+		acquire:   acquire,
+		rotate:    rotate,
+		replace:   replace,
+		threshold: s.refreshThreshold(),
+		onRefresh: func(old, new *models.Client) {
+			s.logger.Info("Client refreshed before expiry",
+				"oldClientID", old.ID,
+				"oldClientIP", old.IP,
+				"clientID", new.ID,
+				"clientIP", new.IP,
+				"isp", new.ISP)
+			// Keep monitoring the session with the new client
+			if _, monitored := s.activeClients.LoadAndDelete(old.ID); monitored {
+				s.activeClients.Store(new.ID, new)
+			}
+		},
+	}
+}
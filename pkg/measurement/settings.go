@@ -0,0 +1,119 @@
+package measurement
+
+import (
+	"fmt"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+)
+
+// Settings selects the clients and servers of a measurement run
+type Settings struct {
+	// Countries are measured one after the other, each with its own ISP list
+	Countries []string
+	ISP       string
+	// City targets clients in a city of the country, empty targets any city
+	City        string
+	ClientType  models.ClientType
+	ServerIDs   []int64
+	ServerNames []string
+	// Tags selects the servers that have all of these fragment tags
+	Tags       map[string]string
+	MaxRetries int
+	MaxClients int
+	// Priority is the order in which servers are queued for each client
+	Priority database.ServerOrder
+	// Servers are measured instead of stored servers. They don't need to be
+	// imported, see database.InsertEphemeralServers.
+	Servers []models.Server
+	// NoLock runs without taking the run lock, which keeps overlapping
+	// runs for the same provider, countries and network out
+	NoLock bool
+	// ServersPerClient measures a random sample of this many servers on
+	// each client instead of all of them, 0 measures all servers
+	ServersPerClient int
+	// ServerIPVersion measures only the servers with this IPType, v4 or v6,
+	// empty measures servers of both
+	ServerIPVersion string
+}
+
+// Validate checks that the settings can be measured with provider p. It's
+// called by RunMeasurements, settings filled from user input can be checked
+// with it before.
+func (settings Settings) Validate(p proxy.Provider) error {
+	capabilities := p.Capabilities()
+	if !capabilities.SupportsClientType(settings.ClientType) {
+		return fmt.Errorf("provider %s does not support %s clients, it supports %v",
+			p.GetProviderName(), settings.ClientType, capabilities.ClientTypes)
+	}
+	if settings.ISP != "" && !capabilities.ISPTargeting {
+		return fmt.Errorf("provider %s does not support ISP targeting", p.GetProviderName())
+	}
+	if settings.City != "" && !capabilities.CityTargeting {
+		return fmt.Errorf("provider %s does not support city targeting", p.GetProviderName())
+	}
+
+	if len(settings.Countries) == 0 {
+		return fmt.Errorf("no country to measure")
+	}
+	for _, country := range settings.Countries {
+		if !isCountryCode(country) {
+			return fmt.Errorf("invalid country code %q, must be a two-letter ISO code like ir", country)
+		}
+	}
+	// An ISP or a city belongs to a single country
+	if settings.ISP != "" && len(settings.Countries) > 1 {
+		return fmt.Errorf("an ISP can only be targeted in a single country")
+	}
+	if settings.City != "" && len(settings.Countries) > 1 {
+		return fmt.Errorf("a city can only be targeted in a single country")
+	}
+
+	if settings.MaxClients <= 0 {
+		return fmt.Errorf("max clients must be positive, got %d", settings.MaxClients)
+	}
+	if settings.MaxRetries < 1 {
+		return fmt.Errorf("max retries must be at least 1, got %d", settings.MaxRetries)
+	}
+
+	// Servers are selected in a single way
+	selections := 0
+	for _, selected := range []bool{len(settings.ServerIDs) > 0, len(settings.ServerNames) > 0, len(settings.Servers) > 0, len(settings.Tags) > 0} {
+		if selected {
+			selections++
+		}
+	}
+	if selections > 1 {
+		return fmt.Errorf("only one of server IDs, server names, servers or tags can be set")
+	}
+
+	switch settings.Priority {
+	case database.ServerOrderDefault, database.ServerOrderStalest:
+	default:
+		return fmt.Errorf("unsupported server priority: %s", settings.Priority)
+	}
+	if settings.ServersPerClient < 0 {
+		return fmt.Errorf("servers per client must not be negative")
+	}
+	switch settings.ServerIPVersion {
+	case "", "v4", "v6":
+	default:
+		return fmt.Errorf("invalid server IP version %q, must be v4 or v6", settings.ServerIPVersion)
+	}
+	return nil
+}
+
+// isCountryCode reports whether country looks like a two-letter ISO 3166
+// country code, in either case
+func isCountryCode(country string) bool {
+	if len(country) != 2 {
+		return false
+	}
+	for _, c := range country {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package measurement
+
+import (
+	"strings"
+	"testing"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestSettingsValidate(t *testing.T) {
+	valid := func() Settings {
+		return Settings{Countries: []string{"ir"}, ClientType: models.MobileType, MaxClients: 1, MaxRetries: 1}
+	}
+	p := &fakeProvider{}
+	if err := valid().Validate(p); err != nil {
+		t.Fatalf("Validate() of valid settings error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(s *Settings)
+		wantErr string
+	}{
+		{"no country", func(s *Settings) { s.Countries = nil }, "no country"},
+		{"invalid country", func(s *Settings) { s.Countries = []string{"iran"} }, "invalid country code"},
+		{"unsupported client type", func(s *Settings) { s.ClientType = models.ResidentialType }, "does not support residential clients"},
+		{"no clients", func(s *Settings) { s.MaxClients = 0 }, "max clients"},
+		{"no retries", func(s *Settings) { s.MaxRetries = 0 }, "max retries"},
+		{"server IDs and names", func(s *Settings) {
+			s.ServerIDs = []int64{1}
+			s.ServerNames = []string{"group"}
+		}, "only one of"},
+		{"servers and tags", func(s *Settings) {
+			s.Servers = []models.Server{{IP: "192.0.2.1"}}
+			s.Tags = map[string]string{"tier": "premium"}
+		}, "only one of"},
+		{"ISP in several countries", func(s *Settings) {
+			s.Countries = []string{"ir", "ru"}
+			s.ISP = "MCI"
+		}, "single country"},
+		{"city without city targeting", func(s *Settings) { s.City = "Tehran" }, "city targeting"},
+		{"unsupported priority", func(s *Settings) { s.Priority = "random" }, "priority"},
+		{"negative servers per client", func(s *Settings) { s.ServersPerClient = -1 }, "servers per client"},
+		{"invalid server IP version", func(s *Settings) { s.ServerIPVersion = "ipv4" }, "server IP version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := valid()
+			tt.modify(&settings)
+			err := settings.Validate(p)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package measurement
+
+import (
+	"context"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+// Store is the database the measurement service reads servers from and
+// records clients and measurements in, it's implemented by database.DB
+type Store interface {
+	InsertMeasurement(ctx context.Context, measurement *models.Measurement) error
+	GetMeasurementsBySession(ctx context.Context, sessionID string, retryNumber int) ([]models.Measurement, error)
+	GetServerProxySuccessRates(ctx context.Context, proxy string, window int) ([]database.ServerProxySuccessRate, error)
+	GetMeasurement(ctx context.Context, id int64) (*models.Measurement, error)
+
+	InsertClients(ctx context.Context, clients []models.Client) ([]models.Client, error)
+	UpdateClientExpiration(ctx context.Context, clientID int64, expirationTime time.Time) error
+	GetActiveClients(ctx context.Context) ([]models.Client, error)
+	GetActiveClientsFor(ctx context.Context, target database.ClientTarget, validUntil time.Time) ([]models.Client, error)
+	InsertIPChange(ctx context.Context, change *models.IPChange) error
+
+	UpdateServerErrors(ctx context.Context, server *models.Server) error
+	InsertEphemeralServers(ctx context.Context, servers []models.Server) ([]models.Server, error)
+	GetServersByIDs(ctx context.Context, ids []int64) ([]models.Server, error)
+	GetServersByNames(ctx context.Context, names []string) ([]models.Server, error)
+	GetServersByTag(ctx context.Context, tags map[string]string) ([]models.Server, error)
+	GetWorkingServersByIPType(ctx context.Context, ipType string, allowedPorts []string, order database.ServerOrder) ([]database.ServerLite, error)
+
+	TryLock(ctx context.Context, key string) (unlock func() error, err error)
+}
+
+// measurementStore is where measurements are written and read back from
+type measurementStore interface {
+	InsertMeasurement(ctx context.Context, measurement *models.Measurement) error
+	GetMeasurementsBySession(ctx context.Context, sessionID string, retryNumber int) ([]models.Measurement, error)
+}
+
+// ResultsStore is a separate database measurements are written to instead
+// of the Store, e.g. a shared analysis database. The clients and servers of
+// the measurements are copied to it with their IDs. It's implemented by
+// database.DB.
+type ResultsStore interface {
+	measurementStore
+	MirrorClients(ctx context.Context, clients []models.Client) error
+	MirrorServers(ctx context.Context, servers []models.Server) error
+}
+
+var (
+	_ Store        = (*database.DB)(nil)
+	_ ResultsStore = (*database.DB)(nil)
+)
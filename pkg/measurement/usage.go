@@ -0,0 +1,57 @@
+package measurement
+
+import (
+	"sync/atomic"
+	"time"
+
+	"connectivity-tester/pkg/models"
+	"connectivity-tester/pkg/proxy"
+)
+
+// monitorInterval is how often monitored clients are validated, it's
+// replaced in tests
+var monitorInterval = 10 * time.Second
+
+// providerUsage counts the provider resources a run consumes, so it can be
+// reconciled against the provider's billing
+type providerUsage struct {
+	// acquisitions counts the requests for a client
+	acquisitions atomic.Int64
+	// validations counts the checks that a client is still valid
+	validations atomic.Int64
+	// sessionSeconds is the total session length allocated to clients
+	sessionSeconds atomic.Int64
+}
+
+func (u *providerUsage) reset() {
+	u.acquisitions.Store(0)
+	u.validations.Store(0)
+	u.sessionSeconds.Store(0)
+}
+
+// getClient reuses a pooled client if there is one, and otherwise requests a
+// client from the provider, counting the request
+func (s *MeasurementService) getClient(p proxy.Provider, isp string, settings Settings, country string) (*models.Client, error) {
+	if client := s.pooledClient(isp, settings, country); client != nil {
+		return client, nil
+	}
+	s.usage.acquisitions.Add(1)
+	return p.GetClientForISP(isp, settings.ClientType, country, settings.City, settings.MaxRetries)
+}
+
+// isValidClient checks a client with the provider, counting the check
+func (s *MeasurementService) isValidClient(client *models.Client) (bool, error) {
+	check, err := s.checkClient(client)
+	return check.Valid, err
+}
+
+// checkClient checks a client with the provider, counting the check. The
+// exit IP is only reported by providers implementing proxy.ClientChecker.
+func (s *MeasurementService) checkClient(client *models.Client) (proxy.ClientCheck, error) {
+	s.usage.validations.Add(1)
+	if checker, ok := s.provider.(proxy.ClientChecker); ok {
+		return checker.CheckClient(client)
+	}
+	valid, err := s.provider.IsValidClient(client)
+	return proxy.ClientCheck{Valid: valid, IP: client.IP}, err
+}
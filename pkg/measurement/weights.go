@@ -0,0 +1,90 @@
+package measurement
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// ispWeights returns measurement.isp_weights, the relative subscriber share of
+// ISPs, by lowercased ISP name. It's nil if no positive weight is configured.
+func (s *MeasurementService) ispWeights() map[string]float64 {
+	var configured map[string]float64
+	if err := s.config.UnmarshalKey("measurement.isp_weights", &configured); err != nil {
+		s.logger.Warn("Ignoring invalid ISP weights", "error", err)
+		return nil
+	}
+
+	weights := make(map[string]float64, len(configured))
+	for isp, weight := range configured {
+		if weight > 0 {
+			weights[strings.ToLower(isp)] = weight
+		}
+	}
+	if len(weights) == 0 {
+		return nil
+	}
+	return weights
+}
+
+// ispClientCounts returns measurement.isp_client_counts, the number of
+// clients of ISPs overriding Settings.MaxClients, by lowercased ISP name.
+// Negative counts are ignored.
+func (s *MeasurementService) ispClientCounts() map[string]int {
+	var configured map[string]int
+	if err := s.config.UnmarshalKey("measurement.isp_client_counts", &configured); err != nil {
+		s.logger.Warn("Ignoring invalid ISP client counts", "error", err)
+		return nil
+	}
+
+	counts := make(map[string]int, len(configured))
+	for isp, count := range configured {
+		if count >= 0 {
+			counts[strings.ToLower(isp)] = count
+		}
+	}
+	return counts
+}
+
+// acquisitionPlan returns the ISP of each client acquisition of a country.
+// Every ISP gets its count of counts, or perISP if it has none, and without
+// weights its acquisitions follow each other. With weights the same total
+// number of acquisitions is drawn proportionally to them, so ISPs without a
+// weight are left out, unless none of the ISPs has one.
+func acquisitionPlan(r *rand.Rand, isps []string, weights map[string]float64, counts map[string]int, perISP int) []string {
+	clients := func(isp string) int {
+		if count, ok := counts[strings.ToLower(isp)]; ok {
+			return count
+		}
+		return perISP
+	}
+	var n int
+	for _, isp := range isps {
+		n += clients(isp)
+	}
+	plan := make([]string, 0, n)
+
+	var total float64
+	cumulative := make([]float64, len(isps))
+	for i, isp := range isps {
+		total += weights[strings.ToLower(isp)]
+		cumulative[i] = total
+	}
+	if total == 0 {
+		for _, isp := range isps {
+			for i := 0; i < clients(isp); i++ {
+				plan = append(plan, isp)
+			}
+		}
+		return plan
+	}
+
+	for len(plan) < cap(plan) {
+		draw := r.Float64() * total
+		i := 0
+		for i < len(cumulative)-1 && draw >= cumulative[i] {
+			i++
+		}
+		plan = append(plan, isps[i])
+	}
+	return plan
+}
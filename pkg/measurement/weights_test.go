@@ -0,0 +1,103 @@
+package measurement
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"connectivity-tester/pkg/models"
+
+	"github.com/spf13/viper"
+)
+
+func TestAcquisitionPlan(t *testing.T) {
+	isps := []string{"Irancell", "MCI", "Rightel", "Shatel"}
+
+	config := viper.New()
+	config.Set("measurement.isp_weights", map[string]interface{}{"irancell": 45, "MCI": "40", "Rightel": 15, "Pars": 10})
+	s := &MeasurementService{config: config, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	weights := s.ispWeights()
+
+	const perISP = 5000
+	plan := acquisitionPlan(rand.New(rand.NewSource(1)), isps, weights, nil, perISP)
+	if len(plan) != len(isps)*perISP {
+		t.Fatalf("got %d acquisitions, want %d", len(plan), len(isps)*perISP)
+	}
+
+	counts := make(map[string]int)
+	for _, isp := range plan {
+		counts[isp]++
+	}
+	// Pars isn't offered by the provider, Shatel has no weight
+	want := map[string]float64{"Irancell": 0.45, "MCI": 0.40, "Rightel": 0.15, "Shatel": 0}
+	for isp, share := range want {
+		got := float64(counts[isp]) / float64(len(plan))
+		if math.Abs(got-share) > 0.01 {
+			t.Errorf("%s got %.3f of the acquisitions, want %.2f", isp, got, share)
+		}
+	}
+}
+
+func TestAcquisitionPlanUniform(t *testing.T) {
+	isps := []string{"Irancell", "MCI"}
+	want := []string{"Irancell", "Irancell", "MCI", "MCI"}
+
+	s := &MeasurementService{config: viper.New(), logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if weights := s.ispWeights(); weights != nil {
+		t.Fatalf("got weights %v without configuration", weights)
+	}
+	for _, weights := range []map[string]float64{nil, {"pars": 10}} {
+		plan := acquisitionPlan(rand.New(rand.NewSource(1)), isps, weights, nil, 2)
+		if !reflect.DeepEqual(plan, want) {
+			t.Errorf("weights %v: got plan %v, want %v", weights, plan, want)
+		}
+	}
+}
+
+func TestAcquireClientsISPClientCounts(t *testing.T) {
+	p := &fakeProvider{isps: map[string][]string{"ir": {"MTN Irancell", "MCI", "Rightel", "Shatel"}}}
+	config := viper.New()
+	config.Set("measurement.isp_client_counts", map[string]interface{}{"mtn irancell": 5, "MCI": 4, "Shatel": 0, "Pars": 3})
+	s := &MeasurementService{config: config, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	settings := Settings{
+		Countries:  []string{"ir"},
+		ClientType: models.MobileType,
+		MaxClients: 2,
+	}
+	clientsPerISP := make(map[string]int)
+	err := s.acquireClients(p, settings, func(country string, client *models.Client) {
+		clientsPerISP[client.ISP]++
+	})
+	if err != nil {
+		t.Fatalf("acquireClients() error = %v", err)
+	}
+
+	// Rightel isn't listed and gets MaxClients, Shatel none
+	want := map[string]int{"MTN Irancell": 5, "MCI": 4, "Rightel": 2}
+	if !reflect.DeepEqual(clientsPerISP, want) {
+		t.Errorf("clients per ISP = %v, want %v", clientsPerISP, want)
+	}
+
+	// A requested ISP gets its own count too
+	settings.ISP = "MCI"
+	clientsPerISP = make(map[string]int)
+	if err := s.acquireClients(p, settings, func(country string, client *models.Client) {
+		clientsPerISP[client.ISP]++
+	}); err != nil {
+		t.Fatalf("acquireClients() error = %v", err)
+	}
+	if want := map[string]int{"MCI": 4}; !reflect.DeepEqual(clientsPerISP, want) {
+		t.Errorf("clients per ISP with --isp = %v, want %v", clientsPerISP, want)
+	}
+
+	// With weights the counts make up the total number of clients
+	weights := map[string]float64{"mci": 1}
+	plan := acquisitionPlan(rand.New(rand.NewSource(1)), p.isps["ir"], weights, s.ispClientCounts(), 2)
+	if len(plan) != 11 {
+		t.Errorf("got %d weighted acquisitions, want 11", len(plan))
+	}
+}
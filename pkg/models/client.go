@@ -16,25 +16,29 @@ const (
 type Client struct {
 	bun.BaseModel `bun:"table:clients,alias:sc"`
 
-	ID             int64     `bun:",pk,autoincrement"`
-	IP             string    `bun:",notnull"`
-	ClientType     string    `bun:",notnull"`
-	SessionID      int       `bun:",notnull"`
-	SessionLength  int       `bun:",notnull"`
-	Time           time.Time `bun:",notnull"`
-	ExpirationTime time.Time `bun:",notnull"`
-	IPVersion      string    `bun:",notnull"`
-	Carrier        string
-	City           string
-	CountryCode    string `bun:",notnull"`
-	CountryName    string `bun:",notnull"`
-	ASNumber       string
-	ASOrg          string
-	LastSeen       time.Time `bun:",notnull"`
-	UpdateCount    int       `bun:",notnull,default:0"`
-	ISP            string    `bun:",notnull"`
-	Proxy          string    `bun:",notnull"` // can be soax or proxyrack
-	ProxyURL       string    `bun:"-"`        // Do not store in database
+	ID              int64     `bun:",pk,autoincrement"`
+	IP              string    `bun:",notnull"`
+	ClientType      string    `bun:",notnull"`
+	SessionID       int       `bun:",notnull"`
+	SessionLength   int       `bun:",notnull"`
+	Time            time.Time `bun:",notnull"`
+	ExpirationTime  time.Time `bun:",notnull"`
+	IPVersion       string    `bun:",notnull"`
+	Carrier         string
+	City            string
+	TargetCity      string // city requested from the provider, empty if any city
+	Region          string
+	CountryCode     string `bun:",notnull"`
+	CountryName     string `bun:",notnull"`
+	ASNumber        string
+	ASOrg           string
+	LastSeen        time.Time `bun:",notnull"`
+	UpdateCount     int       `bun:",notnull,default:0"`
+	ISP             string    `bun:",notnull"`
+	DetectedISP     string    // ISP the exit IP checker reported, ISP is the requested one
+	Proxy           string    `bun:",notnull"`               // can be soax or proxyrack
+	CountryMismatch bool      `bun:",notnull,default:false"` // exit IP is in a different country than requested
+	ProxyURL        string    `bun:"-"`                      // Do not store in database
 }
 
 type SoaxIPInfo struct {
@@ -26,12 +26,15 @@ Client represents a proxy client with its properties:
 		IPVersion      string    // IP version (v4/v6)
 		Carrier        string    // Mobile carrier if applicable
 		City           string    // Geographic city location
+		TargetCity     string    // City requested from the provider, empty if any
+		Region         string    // Geographic region reported for the exit IP
 		CountryCode    string    // ISO country code
 		CountryName    string    // Full country name
 		ASNumber       string    // Autonomous System number
 		ASOrg          string    // AS organization name
 		LastSeen       time.Time // Last activity timestamp
-		ISP            string    // Internet Service Provider
+		ISP            string    // Internet Service Provider requested from the provider
+		DetectedISP    string    // ISP reported by the exit IP checker
 		Proxy          string    // Proxy provider name
 		ProxyURL       string    // Full proxy URL for connections
 	}
@@ -50,6 +53,7 @@ Server represents a target server for testing:
 		UDPErrorMsg   string    // Last UDP error message
 		UDPErrorOp    string    // Last UDP error operation
 		IPType        string    // IP version
+		TransportJSON json.RawMessage // Redacted access link parts and params parsed on import
 		ASNumber      string    // AS number
 		ASOrg         string    // AS organization
 		City          string    // Server city location
@@ -58,6 +62,8 @@ Server represents a target server for testing:
 		CreatedAt     time.Time // Creation timestamp
 		UpdatedAt     time.Time // Last update timestamp
 		FullAccessLink string   // Complete server access URL
+		Expected      string    // Expected outcome of probes, ExpectReachable or empty
+		Status        string    // ServerStatusInactive or empty for active servers
 	}
 
 Measurement represents a connectivity test result:
@@ -69,15 +75,37 @@ Measurement represents a connectivity test result:
 		Time            time.Time // Measurement timestamp
 		Protocol        string    // Test protocol (TCP/UDP)
 		Duration        float64   // Test duration in milliseconds
+		TTFBMs          int64     // Time from first hop connect to first response byte
+		DialedIP        string    // IP the test connected to
+		ExitIPChanged   bool      // Client's exit IP had changed before the test
 		ErrorMsg        string    // Error message if any
 		ErrorMsgVerbose string    // Detailed error information
-		ErrorOp         string    // Error operation type
+		ErrorOp         string    // Error operation type, "skipped" if not tested
+		ErrorCategory   string    // Canonical error category, e.g. reset or timeout
+		ExitASN         string    // AS number of the exit IP at measurement time
+		ExitASOrg       string    // AS organization of the exit IP
+		SkipReason      string    // Why a skipped test was not run
+		RunID           string    // Measurement run identifier
 		SessionID       string    // Test session identifier
 		RetryNumber     int       // Retry attempt number
 		PrefixUsed      string    // Network prefix used
 		FullReport      []byte    // Complete test report
 	}
 
+IPChange records a monitored client whose exit IP changed:
+
+	type IPChange struct {
+		ID          int64     // Unique identifier
+		ClientID    int64     // Reference to client
+		Time        time.Time // When the change was observed
+		OldIP       string    // Exit IP of the client
+		NewIP       string    // Exit IP observed by the checker
+		CountryCode string    // Country of the new IP
+		ASNumber    string    // AS number of the new IP
+		SameCountry bool      // New IP is in the client's country
+		SameASN     bool      // New IP is in the client's AS
+	}
+
 SoaxIPInfo represents IP information from SOAX API:
 
 	type SoaxIPInfo struct {
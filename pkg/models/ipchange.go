@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// IPChange records a monitored client whose exit IP changed during its
+// session, with where the new IP is compared to the client
+type IPChange struct {
+	bun.BaseModel `bun:"table:ip_changes,alias:ic"`
+
+	ID          int64     `bun:",pk,autoincrement"`
+	ClientID    int64     `bun:",notnull"`
+	Client      *Client   `bun:"rel:belongs-to,join:client_id=id"`
+	Time        time.Time `bun:",notnull"`
+	OldIP       string    `bun:",notnull"`
+	NewIP       string    `bun:",notnull"`
+	CountryCode string    // country of the new IP
+	ASNumber    string    // AS number of the new IP, empty if the lookup failed
+	SameCountry bool      `bun:",notnull,default:false"` // new IP is in the client's country
+	SameASN     bool      `bun:",notnull,default:false"` // new IP is in the client's AS
+}
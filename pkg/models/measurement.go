@@ -16,23 +16,61 @@ type Measurement struct {
 	ServerID        int64     `bun:",notnull"`
 	Time            time.Time `bun:",notnull"`
 	Protocol        string    `bun:",notnull"`
+	RunID           string
 	SessionID       string
 	RetryNumber     int
 	PrefixUsed      string
 	ErrorMsg        string
 	ErrorMsgVerbose string
 	ErrorOp         string
+	ErrorCategory   string // canonical category of ErrorMsg, e.g. reset or timeout
 	Duration        int64
-	FullReport      json.RawMessage `bun:",type:jsonb"`
+	FullReport      json.RawMessage `bun:",type:jsonb,nullzero"`
+	// ReportHash references the report in the reports table when reports
+	// are deduplicated, FullReport is not stored then
+	ReportHash string `bun:",nullzero"`
+
+	// SkipReason says why a test wasn't run when ErrorOp is "skipped", e.g.
+	// server_tcp_error if a local test recorded a TCP error for the server
+	SkipReason string `bun:",nullzero"`
+
+	// ExitASN and ExitASOrg locate the client's exit IP at measurement
+	// time, which may differ from the AS the client was acquired in
+	ExitASN   string `bun:"exit_asn,nullzero"`
+	ExitASOrg string `bun:"exit_as_org,nullzero"`
+
+	// TTFBMs is the time in ms from the connection to the first hop to the
+	// first response byte, Duration also includes resolving and the rest
+	// of the exchange
+	TTFBMs int64 `bun:"ttfb_ms,nullzero"`
+
+	// DialedIP is the IP the test connected to, see
+	// connectivity.ConnectivityReport.DialedIP
+	DialedIP string `bun:",nullzero"`
+
+	// ExitIPChanged is set when the client's exit IP was found to differ
+	// from the IP it was acquired with before the test, so the result may
+	// not come from the client's network, see measurement.verify_exit_ip
+	ExitIPChanged bool `bun:",notnull,default:false"`
+
+	// Latency distribution in ms when a test is sampled several times
+	Samples           int   `bun:",nullzero"`
+	SuccessfulSamples int   `bun:",nullzero"`
+	DurationMin       int64 `bun:",nullzero"`
+	DurationMedian    int64 `bun:",nullzero"`
+	DurationP95       int64 `bun:",nullzero"`
+	DurationMax       int64 `bun:",nullzero"`
 
 	Client *Client `bun:"rel:belongs-to,join:client_id=id"`
 	Server *Server `bun:"rel:belongs-to,join:server_id=id"`
+	Report *Report `bun:"rel:belongs-to,join:report_hash=hash"`
 }
 
 // Define indexes and foreign keys
 type _ struct {
 	_ struct{} `bun:"index:measurements_client_id_idx,column:client_id"`
 	_ struct{} `bun:"index:measurements_server_id_idx,column:server_id"`
+	_ struct{} `bun:"index:measurements_run_id_idx,column:run_id"`
 	_ struct{} `bun:"fk:client_id,references:clients(id) on delete cascade on update cascade"`
 	_ struct{} `bun:"fk:server_id,references:servers(id) on delete cascade on update cascade"`
 }
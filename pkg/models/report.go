@@ -0,0 +1,18 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Report is a connectivity report stored once and referenced by the
+// measurements that produced it, see Measurement.ReportHash
+type Report struct {
+	bun.BaseModel `bun:"table:reports,alias:r"`
+
+	Hash      string          `bun:",pk"` // hex SHA-256 of Report
+	Report    json.RawMessage `bun:",type:jsonb,notnull"`
+	CreatedAt time.Time       `bun:",nullzero,notnull,default:current_timestamp"`
+}
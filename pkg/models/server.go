@@ -1,11 +1,20 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/uptrace/bun"
 )
 
+// ExpectReachable is the Expected outcome of servers that must pass every
+// probe, a failed probe of such a server raises an alert
+const ExpectReachable = "reachable"
+
+// ServerStatusInactive is the Status of servers kept after repeated test
+// failures, they are left out of the working servers until a test passes
+const ServerStatusInactive = "inactive"
+
 type Server struct {
 	bun.BaseModel `bun:"table:servers,alias:s"`
 
@@ -16,19 +25,29 @@ type Server struct {
 	FullAccessLink string `bun:",unique:servers_ip_full_access_link_key,notnull"`
 	Name           string
 	Fragment       string
-	Scheme         string `bun:",notnull"`
-	DomainName     string `bun:",notnull"`
-	IPType         string
-	ASNumber       string
-	ASOrg          string
-	City           string
-	Region         string
-	Country        string
-	LastTestTime   time.Time `bun:",notnull"`
-	TCPErrorMsg    string
-	TCPErrorOp     string
-	UDPErrorMsg    string
-	UDPErrorOp     string
-	CreatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp"`
-	UpdatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	// Tags are the key=value tags parsed from the fragment. Upserting a
+	// server with nil tags keeps the stored ones, an empty map clears them.
+	Tags          map[string]string `bun:",type:jsonb,nullzero"`
+	Scheme        string            `bun:",notnull"`
+	DomainName    string            `bun:",notnull"`
+	IPType        string
+	TransportJSON json.RawMessage `bun:",type:jsonb,nullzero"` // access link parts and params parsed on import, redacted
+	ASNumber      string
+	ASOrg         string
+	City          string
+	Region        string
+	Country       string
+	GeoUpdatedAt  time.Time `bun:",nullzero"`
+	LastTestTime  time.Time `bun:",notnull"`
+	TCPErrorMsg   string
+	TCPErrorOp    string
+	UDPErrorMsg   string
+	UDPErrorOp    string
+	FailureCount  int       `bun:",notnull"` // consecutive test runs that failed
+	LastFailure   time.Time `bun:",nullzero"`
+	Ephemeral     bool      `bun:",notnull,default:false"` // measured from a servers file without being imported
+	Expected      string    `bun:",nullzero"`              // expected outcome of probes, ExpectReachable or empty
+	Status        string    `bun:",nullzero"`              // ServerStatusInactive or empty for active servers
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 }
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/fetch"
+)
+
+// auditTime returns the time audit records are stamped with, it's replaced
+// in tests
+var auditTime = time.Now
+
+// auditRecord is a raw response of a provider API or the IP checker, kept
+// to report unexpected answers to the vendor
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	// Request is the method and URL of the request, with the transport it
+	// went through if any, without credentials
+	Request string `json:"request"`
+	Status  int    `json:"status,omitempty"`
+	// Body is the response body as received
+	Body string `json:"body"`
+}
+
+// auditResponse writes the response to request to a new file in the
+// Config.AuditDir of config, if it's set. Failing to write it is only
+// logged, the response is still used.
+func auditResponse(logger *slog.Logger, config Config, request string, status int, body []byte) {
+	if config.AuditDir == "" {
+		return
+	}
+
+	record := auditRecord{
+		Time:     auditTime().UTC(),
+		Provider: string(config.System),
+		Request:  request,
+		Status:   status,
+		Body:     string(body),
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		logger.Warn("Failed to encode provider response for audit", "error", err)
+		return
+	}
+
+	// The random suffix keeps concurrent responses of the same second apart
+	pattern := fmt.Sprintf("%s-%s-*.json", record.Provider, record.Time.Format("20060102T150405Z"))
+	f, err := os.CreateTemp(config.AuditDir, pattern)
+	if err != nil {
+		logger.Warn("Failed to create provider audit file", "dir", config.AuditDir, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		logger.Warn("Failed to write provider audit file", "file", f.Name(), "error", err)
+	}
+}
+
+// auditedFetch is fetchURL writing the response to the audit dir of config
+func auditedFetch(logger *slog.Logger, config Config, rawURL string, opts fetch.Options) (*fetch.Result, error) {
+	result, err := fetchURL(rawURL, opts)
+	if err != nil || config.AuditDir == "" {
+		return result, err
+	}
+
+	request := opts.Method + " " + redactURL(rawURL)
+	if opts.Transport != "" {
+		request += " via " + connectivity.RedactTransport(opts.Transport)
+	}
+	var status int
+	if result.Response != nil {
+		status = result.Response.StatusCode
+	}
+	auditResponse(logger, config, request, status, result.Body)
+	return result, nil
+}
+
+// redactURL masks the API credentials in the query of a request URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "REDACTED"
+	}
+	query := u.Query()
+	for _, key := range []string{"api_key", "package_key"} {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
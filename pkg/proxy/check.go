@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+)
+
+// ClientCheck is the outcome of checking the exit IP of a client
+type ClientCheck struct {
+	// Valid is false once the exit IP changed, the client is expired then
+	Valid bool
+	// IP is the exit IP the checker observed, Changed reports whether it
+	// differs from the IP of the client
+	IP      string
+	Changed bool
+	// CountryCode and ASNumber locate a changed IP, SameCountry and SameASN
+	// report whether it's still in the country and network of the client
+	CountryCode string
+	ASNumber    string
+	SameCountry bool
+	SameASN     bool
+}
+
+// ClientChecker is implemented by providers that report the exit IP they
+// observe when checking a client, not only whether it's still valid
+type ClientChecker interface {
+	CheckClient(client *models.Client) (ClientCheck, error)
+}
+
+// checkExitIP asks the checker for the exit IP of the client through
+// transport. If the IP changed the client is marked expired and the new IP
+// is located to tell whether it drifted out of the client's country or
+// network.
+func checkExitIP(logger *slog.Logger, config Config, transport string, client *models.Client) (ClientCheck, error) {
+	opts := checkerOptions(transport, config.CheckerIP)
+
+	result, err := auditedFetch(logger, config, checkerURL, opts)
+	if err != nil {
+		return ClientCheck{}, fmt.Errorf("failed to fetch IP info: %w", err)
+	}
+
+	var ipInfo models.SoaxIPInfo
+	if err := json.Unmarshal(result.Body, &ipInfo); err != nil {
+		return ClientCheck{}, fmt.Errorf("failed to decode IP info: %w", err)
+	}
+
+	check := ClientCheck{
+		Valid:       true,
+		IP:          ipInfo.Data.IP,
+		CountryCode: ipInfo.Data.CountryCode,
+		ASNumber:    client.ASNumber,
+		SameCountry: true,
+		SameASN:     true,
+	}
+	if ipInfo.Data.IP == client.IP {
+		return check, nil
+	}
+
+	check.Valid, check.Changed = false, true
+	check.SameCountry = strings.EqualFold(ipInfo.Data.CountryCode, client.CountryCode)
+	// The checker has no AS numbers, the new IP is looked up. The network is
+	// unknown if the lookup fails.
+	check.ASNumber = ""
+	check.SameASN = false
+	if asnInfo, err := lookupIPInfo(ipInfo.Data.IP); err == nil {
+		check.ASNumber, _ = ipinfo.ParseOrg(asnInfo.Org)
+		check.SameASN = check.ASNumber != "" && check.ASNumber == client.ASNumber
+	} else {
+		logger.Debug("Failed to look up ASN of changed IP", "ip", ipInfo.Data.IP, "error", err)
+	}
+
+	logger.Info("client IP has changed",
+		"old_ip", client.IP,
+		"new_ip", ipInfo.Data.IP,
+		"session_id", client.SessionID,
+		"same_country", check.SameCountry,
+		"same_asn", check.SameASN)
+
+	// Mark the client as expired by setting expiration time to now
+	client.ExpirationTime = time.Now()
+	return check, nil
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+)
+
+func TestCheckClient(t *testing.T) {
+	providers := map[string]ClientChecker{
+		"soax":      newSoaxProvider(testSoaxConfig(), testLogger),
+		"proxyrack": newProxyRackProvider(testProxyRackConfig(), testLogger),
+	}
+	newClient := func() *models.Client {
+		return &models.Client{IP: "198.51.100.4", CountryCode: "de", ASNumber: "3320", ExpirationTime: time.Now().Add(time.Hour)}
+	}
+
+	t.Run("unchanged IP", func(t *testing.T) {
+		stubLookups(t,
+			`{"status":true,"data":{"ip":"198.51.100.4","country_code":"de"}}`,
+			ipinfo.IPInfoResponse{IP: "198.51.100.4", Country: "DE", Org: "AS3320 Deutsche Telekom AG"},
+		)
+		for name, p := range providers {
+			client := newClient()
+			check, err := p.CheckClient(client)
+			if err != nil {
+				t.Fatalf("%s: CheckClient() error = %v", name, err)
+			}
+			if !check.Valid || check.Changed || check.IP != client.IP {
+				t.Errorf("%s: CheckClient() = %+v, want a valid unchanged client", name, check)
+			}
+			if !client.ExpirationTime.After(time.Now()) {
+				t.Errorf("%s: unchanged client was expired", name)
+			}
+		}
+	})
+
+	t.Run("IP moved to another country", func(t *testing.T) {
+		stubLookups(t,
+			`{"status":true,"data":{"ip":"203.0.113.9","country_code":"tr"}}`,
+			ipinfo.IPInfoResponse{IP: "203.0.113.9", Country: "TR", Org: "AS9121 Turk Telekom"},
+		)
+		for name, p := range providers {
+			client := newClient()
+			check, err := p.CheckClient(client)
+			if err != nil {
+				t.Fatalf("%s: CheckClient() error = %v", name, err)
+			}
+			want := ClientCheck{IP: "203.0.113.9", Changed: true, CountryCode: "tr", ASNumber: "9121"}
+			if check != want {
+				t.Errorf("%s: CheckClient() = %+v, want %+v", name, check, want)
+			}
+			if client.ExpirationTime.After(time.Now()) {
+				t.Errorf("%s: changed client was not expired", name)
+			}
+			// IsValidClient reports the same check
+			if valid, err := p.(Provider).IsValidClient(newClient()); err != nil || valid {
+				t.Errorf("%s: IsValidClient() = %v, %v, want an invalid client", name, valid, err)
+			}
+		}
+	})
+}
@@ -20,6 +20,13 @@ Provider Interface Methods:
 	GetProviderName: Returns the provider's name
 	IsValidClient: Verifies if a client is still valid
 	GetSessionLength: Returns the session length in seconds
+	GetMaxWorkers: Returns the maximum number of concurrent measurement workers
+	CountryMismatches: Returns per ISP counts of clients located in the wrong country
+	Capabilities: Describes the supported client types, ISP and city targeting, UDP and session length bounds
+
+SOAX and ProxyRack also implement ClientChecker, whose CheckClient reports
+the exit IP observed for a client and, if it changed, whether the new IP is
+still in the client's country and AS.
 
 Supported Providers:
 
@@ -27,6 +34,7 @@ Supported Providers:
     - Supports both residential and mobile proxies
     - Manages proxy sessions with automatic IP rotation
     - Provides ISP targeting capabilities
+    - Lists the regions and cities of a country (GetRegionList, GetCityList)
 
  2. ProxyRack Provider:
     - Supports country and ISP-based proxy selection
@@ -57,7 +65,7 @@ Usage Example:
 	}
 
 	// Get a client for a specific ISP
-	client, err := provider.GetClientForISP("Comcast", models.ResidentialType, "US", 3)
+	client, err := provider.GetClientForISP("Comcast", models.ResidentialType, "US", "", 3)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -81,6 +89,11 @@ ProxyRack Configuration:
   - Endpoint: ProxyRack proxy endpoint
   - MaxWorkers: Maximum number of concurrent workers
 
+Client transports are socks5:// URLs unless ProxyScheme selects an http:// or
+https:// HTTP CONNECT proxy at the endpoint, which only relays TCP. The
+capabilities of a SOAX provider reporting such a scheme have no UDP, and its
+UDP tests are skipped.
+
 Error Handling:
 
 The package implements comprehensive error handling for various scenarios:
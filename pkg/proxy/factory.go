@@ -7,10 +7,20 @@ import (
 
 // NewProvider creates a new proxy provider based on the config
 func NewProvider(config Config, logger *slog.Logger) (Provider, error) {
+	if err := validateProxyScheme(config.ProxyScheme); err != nil {
+		return nil, err
+	}
+
 	switch config.System {
 	case SystemSOAX:
+		if err := validateSoaxOptions(config.SoaxOptions); err != nil {
+			return nil, err
+		}
 		return newSoaxProvider(config, logger), nil
 	case SystemProxyRack:
+		if err := validateAutoReplace(config.AutoReplace); err != nil {
+			return nil, err
+		}
 		return newProxyRackProvider(config, logger), nil
 	case SystemNone:
 		return newNoneProvider(config, logger), nil
@@ -18,3 +28,18 @@ func NewProvider(config Config, logger *slog.Logger) (Provider, error) {
 		return nil, fmt.Errorf("unsupported proxy system: %s", config.System)
 	}
 }
+
+// CapabilitiesOf returns the features a proxy system supports without
+// creating a provider, which requires credentials
+func CapabilitiesOf(system System) (Capabilities, error) {
+	switch system {
+	case SystemSOAX:
+		return soaxCapabilities(), nil
+	case SystemProxyRack:
+		return proxyRackCapabilities(), nil
+	case SystemNone:
+		return noneCapabilities(), nil
+	default:
+		return Capabilities{}, fmt.Errorf("unsupported proxy system: %s", system)
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"connectivity-tester/pkg/fetch"
+	"connectivity-tester/pkg/ipinfo"
+)
+
+// Network lookups used by the providers. They are package variables so
+// tests can replace them with stubs.
+var (
+	fetchURL          = fetch.Fetch
+	lookupIPInfo      = ipinfo.GetIPInfo
+	lookupLocalIPInfo = ipinfo.GetLocalIPInfo
+)
+
+// checkerURL returns the exit IP and its location of the client making the request
+const checkerURL = "https://checker.soax.com/api/ipinfo"
+
+// checkerOptions builds the options of a checker request through transport.
+// A non-empty checkerIP is dialed instead of resolving the checker hostname,
+// which fails through some exit nodes.
+func checkerOptions(transport, checkerIP string) fetch.Options {
+	return fetch.Options{
+		Transport:  transport,
+		Address:    checkerIP,
+		Method:     "GET",
+		Headers:    []string{"User-Agent: MyApp/1.0"},
+		TimeoutSec: 10,
+	}
+}
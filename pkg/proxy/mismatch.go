@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+)
+
+// countryMismatches counts, per ISP, the clients whose exit IP was reported
+// in a different country than the one requested (e.g. the client has a VPN on)
+type countryMismatches struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *countryMismatches) recordCountryMismatch(isp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[isp]++
+}
+
+// CountryMismatches returns a snapshot of the country mismatch counts per ISP
+func (c *countryMismatches) CountryMismatches() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]int, len(c.counts))
+	for isp, count := range c.counts {
+		counts[isp] = count
+	}
+	return counts
+}
+
+// sameCity compares city names ignoring case and the separators providers
+// use in place of spaces, e.g. "new-york" and "New York"
+func sameCity(a, b string) bool {
+	normalize := strings.NewReplacer("-", " ", "_", " ", "+", " ")
+	return strings.EqualFold(normalize.Replace(a), normalize.Replace(b))
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"connectivity-tester/pkg/fetch"
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+)
+
+// stubLookups replaces the provider network lookups with canned responses
+// for the SOAX checker and ipinfo.io, and restores them when the test ends
+func stubLookups(t *testing.T, checkerBody string, ipInfo ipinfo.IPInfoResponse) {
+	t.Helper()
+	origFetch, origLookup := fetchURL, lookupIPInfo
+	t.Cleanup(func() {
+		fetchURL, lookupIPInfo = origFetch, origLookup
+	})
+
+	fetchURL = func(url string, opts fetch.Options) (*fetch.Result, error) {
+		return &fetch.Result{Body: []byte(checkerBody)}, nil
+	}
+	lookupIPInfo = func(ip string) (ipinfo.IPInfoResponse, error) {
+		return ipInfo, nil
+	}
+}
+
+func TestGetClientForISPCountryMismatch(t *testing.T) {
+	stubLookups(t,
+		`{"status":true,"data":{"ip":"203.0.113.7","country_code":"de","country_name":"Germany","isp":"Telekom"}}`,
+		ipinfo.IPInfoResponse{IP: "203.0.113.7", Country: "DE", Org: "AS3320 Deutsche Telekom AG"},
+	)
+
+	newProviders := func(allow bool) map[string]Provider {
+		soaxConfig, proxyRackConfig := testSoaxConfig(), testProxyRackConfig()
+		soaxConfig.AllowCountryMismatch = allow
+		proxyRackConfig.AllowCountryMismatch = allow
+		return map[string]Provider{
+			"soax":      newSoaxProvider(soaxConfig, testLogger),
+			"proxyrack": newProxyRackProvider(proxyRackConfig, testLogger),
+		}
+	}
+
+	t.Run("discard mismatched clients", func(t *testing.T) {
+		for name, p := range newProviders(false) {
+			client, err := p.GetClientForISP("Verizon", models.ResidentialType, "us", "", 3)
+			if err == nil {
+				t.Errorf("%s: expected error, got client %+v", name, client)
+			}
+			if got := p.CountryMismatches()["Verizon"]; got != 3 {
+				t.Errorf("%s: CountryMismatches()[Verizon] = %d, want 3", name, got)
+			}
+		}
+	})
+
+	t.Run("keep mismatched clients", func(t *testing.T) {
+		for name, p := range newProviders(true) {
+			client, err := p.GetClientForISP("Verizon", models.ResidentialType, "us", "", 3)
+			if err != nil {
+				t.Fatalf("%s: GetClientForISP() error = %v", name, err)
+			}
+			if !client.CountryMismatch {
+				t.Errorf("%s: expected client to be tagged with CountryMismatch", name)
+			}
+			if client.CountryCode != "de" {
+				t.Errorf("%s: CountryCode = %q, want %q", name, client.CountryCode, "de")
+			}
+			if got := p.CountryMismatches()["Verizon"]; got != 1 {
+				t.Errorf("%s: CountryMismatches()[Verizon] = %d, want 1", name, got)
+			}
+		}
+	})
+}
+
+func TestGetClientForISPCity(t *testing.T) {
+	stubLookups(t, "", ipinfo.IPInfoResponse{IP: "203.0.113.7", Country: "IR", Org: "AS44244 Iran Cell Service and Communication Company"})
+
+	// The first node is in another city, the second in the requested one
+	cities := []string{"Mashhad", "Tehran"}
+	var transports []string
+	fetchURL = func(url string, opts fetch.Options) (*fetch.Result, error) {
+		city := cities[len(transports)%len(cities)]
+		transports = append(transports, opts.Transport)
+		return &fetch.Result{Body: []byte(`{"status":true,"data":{"ip":"203.0.113.7","country_code":"ir","city":"` + city + `"}}`)}, nil
+	}
+
+	p := newSoaxProvider(testSoaxConfig(), testLogger)
+
+	if _, err := p.GetClientForISP("MTN Irancell", models.MobileType, "ir", "tehran", 1); err == nil {
+		t.Errorf("GetClientForISP() expected an error when no node is in the city")
+	}
+
+	transports = nil
+	client, err := p.GetClientForISP("MTN Irancell", models.MobileType, "ir", "tehran", 2)
+	if err != nil {
+		t.Fatalf("GetClientForISP() error = %v", err)
+	}
+	if len(transports) != 2 {
+		t.Errorf("GetClientForISP() checked %d nodes, want 2", len(transports))
+	}
+	if client.City != "Tehran" || client.TargetCity != "tehran" {
+		t.Errorf("client City = %q, TargetCity = %q", client.City, client.TargetCity)
+	}
+	for _, transport := range transports {
+		if !strings.Contains(transport, "-country-ir-city-tehran-") {
+			t.Errorf("transport %q doesn't target the city", transport)
+		}
+	}
+	if url := p.BuildTransportURL(client); !strings.Contains(url, "-city-tehran-") {
+		t.Errorf("BuildTransportURL() = %q, want the target city", url)
+	}
+}
+
+func TestGetClientForISPDetectedISP(t *testing.T) {
+	stubLookups(t,
+		`{"status":true,"data":{"ip":"203.0.113.7","country_code":"de","isp":"Telekom","region":"Hesse"}}`,
+		ipinfo.IPInfoResponse{IP: "203.0.113.7", Country: "DE", Region: "Bavaria", Org: "AS3320 Deutsche Telekom AG"},
+	)
+
+	providers := map[string]Provider{
+		"soax":      newSoaxProvider(testSoaxConfig(), testLogger),
+		"proxyrack": newProxyRackProvider(testProxyRackConfig(), testLogger),
+	}
+	for name, p := range providers {
+		client, err := p.GetClientForISP("Deutsche Telekom", models.ResidentialType, "de", "", 1)
+		if err != nil {
+			t.Fatalf("%s: GetClientForISP() error = %v", name, err)
+		}
+		if client.ISP != "Deutsche Telekom" {
+			t.Errorf("%s: ISP = %q, want the requested ISP", name, client.ISP)
+		}
+		if client.DetectedISP != "Telekom" {
+			t.Errorf("%s: DetectedISP = %q, want %q", name, client.DetectedISP, "Telekom")
+		}
+		if client.Region != "Hesse" {
+			t.Errorf("%s: Region = %q, want %q", name, client.Region, "Hesse")
+		}
+	}
+}
@@ -3,14 +3,16 @@ package proxy
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"strings"
 	"time"
 
-	"connectivity-tester/pkg/ipinfo"
 	"connectivity-tester/pkg/models"
 )
 
 type NoneProvider struct {
+	countryMismatches
+
 	config Config
 	logger *slog.Logger
 }
@@ -32,15 +34,29 @@ func (p *NoneProvider) GetISPList(countryISO string, clientType models.ClientTyp
 	return []string{"Default"}, nil
 }
 
-// GetClientForISP creates a local client representation. clientType, country, maxRetries are ignored.
-func (p *NoneProvider) GetClientForISP(isp string, clientType models.ClientType, country string, maxRetries int) (*models.Client, error) {
+// GetClientForISP creates a local client representation. clientType, country, city, maxRetries are ignored.
+func (p *NoneProvider) GetClientForISP(isp string, clientType models.ClientType, country, city string, maxRetries int) (*models.Client, error) {
 
 	// Get local IP information
-	ipInfoIO, err := ipinfo.GetIPInfo("")
+	ipInfoIO, err := lookupLocalIPInfo(p.config.IPVersion)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get local IP info: %w", err)
 	}
 
+	// Determine IP version
+	ip := net.ParseIP(ipInfoIO.IP)
+	var ipVersion string
+	if ip.To4() != nil {
+		ipVersion = "v4"
+	} else if ip.To16() != nil {
+		ipVersion = "v6"
+	} else {
+		return nil, fmt.Errorf("invalid local IP: %q", ipInfoIO.IP)
+	}
+	if p.config.IPVersion != "" && ipVersion != p.config.IPVersion {
+		return nil, fmt.Errorf("local IP %s is not %s", ipInfoIO.IP, p.config.IPVersion)
+	}
+
 	// Parse ASN and org name
 	orgParts := strings.SplitN(ipInfoIO.Org, " ", 2)
 	var asNumber, asOrg string
@@ -58,7 +74,7 @@ func (p *NoneProvider) GetClientForISP(isp string, clientType models.ClientType,
 		SessionLength:  p.GetSessionLength(), // 24 hours - local client doesn't expire
 		Time:           time.Now(),
 		ExpirationTime: time.Now().Add(24 * time.Hour),
-		IPVersion:      "v4", // You might want to detect this
+		IPVersion:      ipVersion,
 		City:           ipInfoIO.City,
 		CountryCode:    ipInfoIO.Country,
 		ASNumber:       asNumber,
@@ -76,9 +92,12 @@ func (p *NoneProvider) BuildTransportURL(client *models.Client) string {
 	return ""
 }
 
+// noneSessionLength is 24 hours in seconds as local client doesn't expire
+const noneSessionLength = 86400
+
 // GetSessionLength returns 24 hours in seconds as local client doesn't expire
 func (p *NoneProvider) GetSessionLength() int {
-	return 86400
+	return noneSessionLength
 }
 
 // IsValidClient always returns true for local client
@@ -89,3 +108,20 @@ func (p *NoneProvider) IsValidClient(client *models.Client) (bool, error) {
 func (p *NoneProvider) GetMaxWorkers() int {
 	return p.config.MaxWorkers
 }
+
+// noneCapabilities are the features of the local client. The local machine is
+// always recorded as a residential client of its own ISP and doesn't expire.
+func noneCapabilities() Capabilities {
+	return Capabilities{
+		ClientTypes:      []models.ClientType{models.ResidentialType},
+		ISPTargeting:     false,
+		UDP:              true,
+		MinSessionLength: noneSessionLength,
+		MaxSessionLength: noneSessionLength,
+	}
+}
+
+// Capabilities returns the features of the local client, see noneCapabilities
+func (p *NoneProvider) Capabilities() Capabilities {
+	return noneCapabilities()
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/fetch"
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func testSoaxConfig() Config {
+	return Config{
+		System:     SystemSOAX,
+		APIKey:     "key",
+		PackageID:  "1",
+		PackageKey: "pkg",
+		Endpoint:   "proxy.example:5000",
+	}
+}
+
+func testProxyRackConfig() Config {
+	return Config{
+		System:   SystemProxyRack,
+		Username: "user",
+		APIKey:   "key",
+		Endpoint: "proxy.example:10000",
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    Provider
+		want        Capabilities
+		residential bool
+		mobile      bool
+	}{
+		{
+			name:     "soax",
+			provider: newSoaxProvider(testSoaxConfig(), testLogger),
+			want: Capabilities{
+				ClientTypes:      []models.ClientType{models.ResidentialType, models.MobileType},
+				ISPTargeting:     true,
+				CityTargeting:    true,
+				UDP:              true,
+				MinSessionLength: 90,
+				MaxSessionLength: 3600,
+			},
+			residential: true,
+			mobile:      true,
+		},
+		{
+			name:     "proxyrack",
+			provider: newProxyRackProvider(testProxyRackConfig(), testLogger),
+			want: Capabilities{
+				ClientTypes:      []models.ClientType{models.ResidentialType},
+				ISPTargeting:     true,
+				UDP:              false,
+				MinSessionLength: 60,
+				MaxSessionLength: 3600,
+			},
+			residential: true,
+			mobile:      false,
+		},
+		{
+			name:     "none",
+			provider: newNoneProvider(Config{System: SystemNone}, testLogger),
+			want: Capabilities{
+				ClientTypes:      []models.ClientType{models.ResidentialType},
+				ISPTargeting:     false,
+				UDP:              true,
+				MinSessionLength: 86400,
+				MaxSessionLength: 86400,
+			},
+			residential: true,
+			mobile:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps := tt.provider.Capabilities()
+			if !reflect.DeepEqual(caps, tt.want) {
+				t.Errorf("Capabilities() = %+v, want %+v", caps, tt.want)
+			}
+			if got := caps.SupportsClientType(models.ResidentialType); got != tt.residential {
+				t.Errorf("SupportsClientType(residential) = %v, want %v", got, tt.residential)
+			}
+			if got := caps.SupportsClientType(models.MobileType); got != tt.mobile {
+				t.Errorf("SupportsClientType(mobile) = %v, want %v", got, tt.mobile)
+			}
+			if caps.SupportsClientType("satellite") {
+				t.Errorf("SupportsClientType(satellite) = true, want false")
+			}
+
+			bySystem, err := CapabilitiesOf(System(tt.name))
+			if err != nil {
+				t.Fatalf("CapabilitiesOf() error = %v", err)
+			}
+			if !reflect.DeepEqual(bySystem, tt.want) {
+				t.Errorf("CapabilitiesOf() = %+v, want %+v", bySystem, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesConnectProxy(t *testing.T) {
+	// CONNECT proxies don't relay UDP
+	for _, scheme := range []string{"http", "https"} {
+		config := testSoaxConfig()
+		config.ProxyScheme = scheme
+		if newSoaxProvider(config, testLogger).Capabilities().UDP {
+			t.Errorf("Capabilities() of soax over %s has UDP", scheme)
+		}
+	}
+}
+
+func TestNewProviderNone(t *testing.T) {
+	p, err := NewProvider(Config{System: SystemNone}, testLogger)
+	if err != nil {
+		t.Fatalf("NewProvider() error = %v", err)
+	}
+	if _, ok := p.(*NoneProvider); !ok {
+		t.Fatalf("NewProvider() = %T, want *NoneProvider", p)
+	}
+	if name := p.GetProviderName(); name != "none" {
+		t.Errorf("GetProviderName() = %q, want %q", name, "none")
+	}
+	if url := p.BuildTransportURL(&models.Client{IP: "192.0.2.1"}); url != "" {
+		t.Errorf("BuildTransportURL() = %q, want empty to connect directly", url)
+	}
+
+	if _, err := NewProvider(Config{System: "satellite"}, testLogger); err == nil {
+		t.Errorf("NewProvider() expected an error for an unsupported system")
+	}
+}
+
+func TestNoneProviderIPVersion(t *testing.T) {
+	origLookup := lookupLocalIPInfo
+	t.Cleanup(func() { lookupLocalIPInfo = origLookup })
+
+	addrs := map[string]string{"": "2001:db8::7", "v4": "192.0.2.7", "v6": "2001:db8::7"}
+	lookupLocalIPInfo = func(ipVersion string) (ipinfo.IPInfoResponse, error) {
+		return ipinfo.IPInfoResponse{IP: addrs[ipVersion], Country: "US", Org: "AS64500 Example"}, nil
+	}
+
+	tests := []struct {
+		requested string
+		want      string
+	}{
+		{requested: "", want: "v6"},
+		{requested: "v4", want: "v4"},
+		{requested: "v6", want: "v6"},
+	}
+
+	for _, tt := range tests {
+		p := newNoneProvider(Config{System: SystemNone, IPVersion: tt.requested}, testLogger)
+		client, err := p.GetClientForISP("", models.ResidentialType, "", "", 1)
+		if err != nil {
+			t.Fatalf("GetClientForISP() with IP version %q error = %v", tt.requested, err)
+		}
+		if client.IPVersion != tt.want || client.IP != addrs[tt.requested] {
+			t.Errorf("GetClientForISP() with IP version %q = %s (%s), want %s", tt.requested, client.IP, client.IPVersion, tt.want)
+		}
+	}
+
+	// A lookup that doesn't return an address of the requested version fails
+	addrs["v6"] = "192.0.2.7"
+	p := newNoneProvider(Config{System: SystemNone, IPVersion: "v6"}, testLogger)
+	if _, err := p.GetClientForISP("", models.ResidentialType, "", "", 1); err == nil {
+		t.Errorf("GetClientForISP() expected an error when the local IP is not v6")
+	}
+}
+
+func TestCheckerIPOverride(t *testing.T) {
+	stubLookups(t,
+		`{"status":true,"data":{"ip":"203.0.113.7","country_code":"us","country_name":"United States","isp":"Verizon"}}`,
+		ipinfo.IPInfoResponse{IP: "203.0.113.7", Country: "US", Org: "AS701 Verizon Business"},
+	)
+	checkerBody := []byte(`{"status":true,"data":{"ip":"203.0.113.7","country_code":"us","country_name":"United States","isp":"Verizon"}}`)
+
+	var gotAddresses []string
+	fetchURL = func(url string, opts fetch.Options) (*fetch.Result, error) {
+		if url != checkerURL {
+			t.Errorf("fetched %s, want the checker", url)
+		}
+		gotAddresses = append(gotAddresses, opts.Address)
+		return &fetch.Result{Body: checkerBody}, nil
+	}
+
+	for _, checkerIP := range []string{"", "192.0.2.10"} {
+		soaxConfig, proxyRackConfig := testSoaxConfig(), testProxyRackConfig()
+		soaxConfig.CheckerIP = checkerIP
+		proxyRackConfig.CheckerIP = checkerIP
+		providers := map[string]Provider{
+			"soax":      newSoaxProvider(soaxConfig, testLogger),
+			"proxyrack": newProxyRackProvider(proxyRackConfig, testLogger),
+		}
+
+		for name, p := range providers {
+			gotAddresses = nil
+			client, err := p.GetClientForISP("Verizon", models.ResidentialType, "us", "", 1)
+			if err != nil {
+				t.Fatalf("%s: GetClientForISP() error = %v", name, err)
+			}
+			client.ProxyURL = p.BuildTransportURL(client)
+			if _, err := p.IsValidClient(client); err != nil {
+				t.Fatalf("%s: IsValidClient() error = %v", name, err)
+			}
+
+			want := []string{checkerIP, checkerIP}
+			if !reflect.DeepEqual(gotAddresses, want) {
+				t.Errorf("%s: checker addresses = %q, want %q", name, gotAddresses, want)
+			}
+		}
+	}
+}
+
+func TestSoaxOptions(t *testing.T) {
+	client := &models.Client{
+		ClientType:    string(models.MobileType),
+		CountryCode:   "ir",
+		SessionID:     42,
+		SessionLength: 600,
+		ISP:           "MTN Irancell",
+	}
+
+	config := testSoaxConfig()
+	config.SoaxOptions = []string{"opt-keepalive", "region-tehran", "opt-session-ttl-600"}
+	if err := validateSoaxOptions(config.SoaxOptions); err != nil {
+		t.Fatalf("validateSoaxOptions() error = %v", err)
+	}
+	got := newSoaxProvider(config, testLogger).BuildTransportURL(client)
+	want := "socks5://package-1-country-ir-region-tehran-sessionid-42-sessionlength-600-isp-MTN%20Irancell-opt-uniqip-opt-keepalive-opt-session-ttl-600:pkg@proxy.example:5000"
+	if got != want {
+		t.Errorf("BuildTransportURL() = %q, want %q", got, want)
+	}
+
+	// Without options the URL is unchanged
+	got = newSoaxProvider(testSoaxConfig(), testLogger).BuildTransportURL(client)
+	want = "socks5://package-1-country-ir-sessionid-42-sessionlength-600-isp-MTN%20Irancell-opt-uniqip:pkg@proxy.example:5000"
+	if got != want {
+		t.Errorf("BuildTransportURL() = %q, want %q", got, want)
+	}
+
+	// The city is set by the city targeting of each client
+	for _, option := range []string{"sessionid-7", "isp-MCI", "country-us", "city-tehran", "opt-uniqip", "city:x", "opt keepalive", ""} {
+		config.SoaxOptions = []string{option}
+		if _, err := NewProvider(config, testLogger); err == nil {
+			t.Errorf("NewProvider() expected an error for option %q", option)
+		}
+	}
+}
+
+func TestProxyRackLogsRedactedTransport(t *testing.T) {
+	stubLookups(t,
+		`{"status":true,"data":{"ip":"203.0.113.7","country_code":"us","country_name":"United States","isp":"Verizon"}}`,
+		ipinfo.IPInfoResponse{IP: "203.0.113.7", Country: "US", Org: "AS701 Verizon Business"},
+	)
+	fetchURL = func(url string, opts fetch.Options) (*fetch.Result, error) {
+		return &fetch.Result{Body: []byte(`{"status":true,"data":{"ip":"203.0.113.7","country_code":"us","country_name":"United States","isp":"Verizon"}}`)}, nil
+	}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	config := testProxyRackConfig()
+	config.APIKey = "s3cr3t-api-key"
+	p := newProxyRackProvider(config, logger)
+
+	if _, err := p.GetClientForISP("Verizon", models.ResidentialType, "us", "", 1); err != nil {
+		t.Fatalf("GetClientForISP() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "transport=") {
+		t.Fatalf("no transport was logged:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), config.APIKey) {
+		t.Errorf("logs contain the API key:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), ":REDACTED@proxy.example:10000") {
+		t.Errorf("logged transport is not redacted:\n%s", logs.String())
+	}
+}
+
+func TestProxyRackAutoReplace(t *testing.T) {
+	client := &models.Client{CountryCode: "us", SessionID: 7, SessionLength: 300, ISP: "Verizon"}
+
+	for mode, want := range map[string]string{"": "-autoReplace-strict:", "true": "-autoReplace-true:"} {
+		config := testProxyRackConfig()
+		config.AutoReplace = mode
+		p, err := NewProvider(config, testLogger)
+		if err != nil {
+			t.Fatalf("NewProvider(%q) error = %v", mode, err)
+		}
+		if url := p.BuildTransportURL(client); !strings.Contains(url, want) {
+			t.Errorf("auto replace %q: BuildTransportURL() = %q, want %s", mode, url, want)
+		}
+	}
+
+	config := testProxyRackConfig()
+	config.AutoReplace = "sometimes"
+	if _, err := NewProvider(config, testLogger); err == nil {
+		t.Error("NewProvider() accepted an invalid auto replace mode")
+	}
+}
+
+func TestProxyScheme(t *testing.T) {
+	client := &models.Client{CountryCode: "us", ClientType: string(models.MobileType), SessionID: 7, SessionLength: 300, ISP: "Verizon"}
+
+	for _, config := range []Config{testSoaxConfig(), testProxyRackConfig()} {
+		for scheme, want := range map[string]string{"": "socks5://", "http": "http://", "https": "https://"} {
+			config.ProxyScheme = scheme
+			p, err := NewProvider(config, testLogger)
+			if err != nil {
+				t.Fatalf("%s: NewProvider(%q) error = %v", config.System, scheme, err)
+			}
+			transport := p.BuildTransportURL(client)
+			if !strings.HasPrefix(transport, want) {
+				t.Errorf("%s scheme %q: BuildTransportURL() = %q, want %s", config.System, scheme, transport, want)
+			}
+			if err := connectivity.ValidateTransport(transport); err != nil {
+				t.Errorf("%s scheme %q: transport %q is invalid: %v", config.System, scheme, transport, err)
+			}
+		}
+
+		config.ProxyScheme = "ftp"
+		if _, err := NewProvider(config, testLogger); err == nil {
+			t.Errorf("%s: NewProvider() accepted an invalid proxy scheme", config.System)
+		}
+	}
+}
@@ -4,18 +4,38 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
+	"connectivity-tester/pkg/connectivity"
 	"connectivity-tester/pkg/fetch"
 	"connectivity-tester/pkg/ipinfo"
 	"connectivity-tester/pkg/models"
 )
 
+// defaultAutoReplace keeps replacement exit nodes on the requested ISP
+const defaultAutoReplace = "strict"
+
+// proxyRackAutoReplaceModes are the autoReplace values ProxyRack accepts:
+// strict replaces a lost exit node with one of the same ISP, true with any
+// node of the country, and false ends the session instead
+var proxyRackAutoReplaceModes = []string{"strict", "true", "false"}
+
+// validateAutoReplace checks that mode is a ProxyRack autoReplace value
+func validateAutoReplace(mode string) error {
+	if mode == "" || slices.Contains(proxyRackAutoReplaceModes, mode) {
+		return nil
+	}
+	return fmt.Errorf("invalid ProxyRack auto replace mode %q, must be one of %v", mode, proxyRackAutoReplaceModes)
+}
+
 type ProxyRackProvider struct {
+	countryMismatches
+	sessionIDs
+
 	config Config
 	logger *slog.Logger
 }
@@ -40,10 +60,14 @@ func newProxyRackProvider(config Config, logger *slog.Logger) *ProxyRackProvider
 	if config.MaxWorkers == 0 {
 		config.MaxWorkers = 1 // default to 1 worker if not specified
 	}
+	if config.AutoReplace == "" {
+		config.AutoReplace = defaultAutoReplace
+	}
 
 	return &ProxyRackProvider{
-		config: config,
-		logger: logger,
+		sessionIDs: sessionIDs{deterministic: config.DeterministicSessions},
+		config:     config,
+		logger:     logger,
 	}
 }
 
@@ -58,7 +82,8 @@ func (p *ProxyRackProvider) GetProviderName() string {
 
 func (p *ProxyRackProvider) GetISPList(countryISO string, clientType models.ClientType) ([]string, error) {
 	// Build a basic transport URL to access the API
-	transport := fmt.Sprintf("socks5://%s-country-%s:%s@%s",
+	transport := fmt.Sprintf("%s://%s-country-%s:%s@%s",
+		p.config.proxyScheme(),
 		p.config.Username,
 		strings.ToUpper(countryISO),
 		p.config.APIKey,
@@ -71,7 +96,7 @@ func (p *ProxyRackProvider) GetISPList(countryISO string, clientType models.Clie
 	}
 
 	apiURL := fmt.Sprintf("http://api.proxyrack.net/countries/%s/isps", countryISO)
-	result, err := fetch.Fetch(apiURL, opts)
+	result, err := auditedFetch(p.logger, p.config, apiURL, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch ISP list: %w", err)
 	}
@@ -87,11 +112,13 @@ func (p *ProxyRackProvider) GetISPList(countryISO string, clientType models.Clie
 	return isps, nil
 }
 
-func (p *ProxyRackProvider) GetClientForISP(isp string, clientType models.ClientType, country string, maxRetries int) (*models.Client, error) {
+// GetClientForISP gets a client of the ISP in country. city is ignored, ProxyRack
+// clients can't be targeted by city.
+func (p *ProxyRackProvider) GetClientForISP(isp string, clientType models.ClientType, country, city string, maxRetries int) (*models.Client, error) {
 	sessionLength := p.config.SessionLength
 
 	for retry := 0; retry < maxRetries; retry++ {
-		sessionID := rand.Intn(1000000)
+		sessionID := p.nextSessionID(isp)
 
 		// Build initial client to get transport URL
 		tempClient := &models.Client{
@@ -106,17 +133,12 @@ func (p *ProxyRackProvider) GetClientForISP(isp string, clientType models.Client
 		transport := p.BuildTransportURL(tempClient)
 
 		p.logger.Debug("fetching IP info",
-			"transport", transport,
+			"transport", connectivity.RedactTransport(transport),
 		)
 
-		opts := fetch.Options{
-			Transport:  transport,
-			Method:     "GET",
-			Headers:    []string{"User-Agent: MyApp/1.0"},
-			TimeoutSec: 10,
-		}
+		opts := checkerOptions(transport, p.config.CheckerIP)
 
-		result, err := fetch.Fetch("https://checker.soax.com/api/ipinfo", opts)
+		result, err := auditedFetch(p.logger, p.config, checkerURL, opts)
 		if err != nil {
 			if strings.Contains(err.Error(), "general SOCKS server failure") {
 				return nil, fmt.Errorf("no available nodes for ISP %s", isp)
@@ -130,26 +152,23 @@ func (p *ProxyRackProvider) GetClientForISP(isp string, clientType models.Client
 		}
 
 		// Get ASN information
-		ipInfoIO, err := ipinfo.GetIPInfo(ipInfo.Data.IP)
+		ipInfoIO, err := lookupIPInfo(ipInfo.Data.IP)
 		if err != nil {
 			continue
 		}
 
 		// Parse ASN and org name
-		orgParts := strings.SplitN(ipInfoIO.Org, " ", 2)
-		var asNumber, asOrg string
-		if len(orgParts) == 2 {
-			asNumber = strings.TrimPrefix(orgParts[0], "AS")
-			asOrg = orgParts[1]
-		} else {
-			asOrg = ipInfoIO.Org
-		}
+		asNumber, asOrg := ipinfo.ParseOrg(ipInfoIO.Org)
 
 		// Use ipinfo.io city as fallback if SOAX city is empty
 		city := ipInfo.Data.City
 		if city == "" {
 			city = ipInfoIO.City
 		}
+		region := ipInfo.Data.Region
+		if region == "" {
+			region = ipInfoIO.Region
+		}
 
 		// Determine IP version
 		ip := net.ParseIP(ipInfo.Data.IP)
@@ -165,32 +184,40 @@ func (p *ProxyRackProvider) GetClientForISP(isp string, clientType models.Client
 		// ensure that the IP is from the correct country
 		// sometimes clients have their VPN on which can cause the IP
 		// to be from a different country
-		if !strings.EqualFold(country, ipInfo.Data.CountryCode) {
+		countryMismatch := !strings.EqualFold(country, ipInfo.Data.CountryCode)
+		if countryMismatch {
+			p.recordCountryMismatch(isp)
 			p.logger.Debug("IP is from a different country",
 				"ip", ipInfo.Data.IP,
 				"expected", country,
-				"actual", ipInfo.Data.CountryCode)
-			continue
+				"actual", ipInfo.Data.CountryCode,
+				"kept", p.config.AllowCountryMismatch)
+			if !p.config.AllowCountryMismatch {
+				continue
+			}
 		}
 
 		now := time.Now()
 		client := &models.Client{
-			IP:             ipInfo.Data.IP,
-			ClientType:     string(clientType),
-			SessionID:      sessionID,
-			SessionLength:  sessionLength,
-			Time:           now,
-			ExpirationTime: now.Add(time.Duration(sessionLength) * time.Second),
-			IPVersion:      ipVersion,
-			Carrier:        ipInfo.Data.Carrier,
-			City:           city,
-			CountryCode:    ipInfo.Data.CountryCode,
-			CountryName:    ipInfo.Data.CountryName,
-			ASNumber:       asNumber,
-			ASOrg:          asOrg,
-			LastSeen:       now,
-			ISP:            isp,
-			Proxy:          string(SystemProxyRack),
+			IP:              ipInfo.Data.IP,
+			ClientType:      string(clientType),
+			SessionID:       sessionID,
+			SessionLength:   sessionLength,
+			Time:            now,
+			ExpirationTime:  now.Add(time.Duration(sessionLength) * time.Second),
+			IPVersion:       ipVersion,
+			Carrier:         ipInfo.Data.Carrier,
+			City:            city,
+			Region:          region,
+			CountryCode:     ipInfo.Data.CountryCode,
+			CountryName:     ipInfo.Data.CountryName,
+			ASNumber:        asNumber,
+			ASOrg:           asOrg,
+			LastSeen:        now,
+			ISP:             isp,
+			DetectedISP:     ipInfo.Data.ISP,
+			Proxy:           string(SystemProxyRack),
+			CountryMismatch: countryMismatch,
 		}
 
 		return client, nil
@@ -203,52 +230,46 @@ func (p *ProxyRackProvider) GetClientForISP(isp string, clientType models.Client
 func (p *ProxyRackProvider) BuildTransportURL(client *models.Client) string {
 	encodedISP := strings.ReplaceAll(url.QueryEscape(client.ISP), "+", "%20")
 
-	return fmt.Sprintf("socks5://%s-country-%s-session-%d-refreshMinutes-%d-isp-%s-autoReplace-strict:%s@%s",
+	return fmt.Sprintf("%s://%s-country-%s-session-%d-refreshMinutes-%d-isp-%s-autoReplace-%s:%s@%s",
+		p.config.proxyScheme(),
 		p.config.Username,
 		strings.ToUpper(client.CountryCode),
 		client.SessionID,
 		client.SessionLength/60,
 		encodedISP,
+		p.config.AutoReplace,
 		p.config.APIKey,
 		p.config.Endpoint)
 }
 
 // IsValid checks if the client's IP hasn't changed and is still valid
 func (p *ProxyRackProvider) IsValidClient(client *models.Client) (bool, error) {
-	//transport := p.BuildTransportURL(client)
-
-	opts := fetch.Options{
-		Transport:  client.ProxyURL,
-		Method:     "GET",
-		Headers:    []string{"User-Agent: MyApp/1.0"},
-		TimeoutSec: 10,
-	}
-
-	result, err := fetch.Fetch("https://checker.soax.com/api/ipinfo", opts)
-	if err != nil {
-		return false, fmt.Errorf("failed to fetch IP info: %w", err)
-	}
+	check, err := p.CheckClient(client)
+	return check.Valid, err
+}
 
-	var ipInfo models.SoaxIPInfo
-	if err := json.Unmarshal(result.Body, &ipInfo); err != nil {
-		return false, fmt.Errorf("failed to decode IP info: %w", err)
-	}
+// CheckClient checks the exit IP of the client, see ClientChecker
+func (p *ProxyRackProvider) CheckClient(client *models.Client) (ClientCheck, error) {
+	return checkExitIP(p.logger, p.config, client.ProxyURL, client)
+}
 
-	// Check if the IP has changed
-	if ipInfo.Data.IP != client.IP {
-		p.logger.Info("client IP has changed",
-			"old_ip", client.IP,
-			"new_ip", ipInfo.Data.IP,
-			"session_id", client.SessionID)
+func (p *ProxyRackProvider) GetMaxWorkers() int {
+	return p.config.MaxWorkers
+}
 
-		// Mark the client as expired by setting expiration time to now
-		client.ExpirationTime = time.Now()
-		return false, nil
+// proxyRackCapabilities are the features of ProxyRack. ProxyRack only offers
+// residential clients and sessions are refreshed in whole minutes, up to an hour.
+func proxyRackCapabilities() Capabilities {
+	return Capabilities{
+		ClientTypes:      []models.ClientType{models.ResidentialType},
+		ISPTargeting:     true,
+		UDP:              false,
+		MinSessionLength: 60,
+		MaxSessionLength: 3600,
 	}
-
-	return true, nil
 }
 
-func (p *ProxyRackProvider) GetMaxWorkers() int {
-	return p.config.MaxWorkers
+// Capabilities returns the features of ProxyRack, see proxyRackCapabilities
+func (p *ProxyRackProvider) Capabilities() Capabilities {
+	return proxyRackCapabilities()
 }
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// maxSessionID bounds the session IDs requested from providers
+const maxSessionID = 1000000
+
+// SessionSeeder is implemented by providers whose session IDs can be
+// reproduced, see Config.DeterministicSessions
+type SessionSeeder interface {
+	// SeedSessions starts the session IDs of a run over from runID
+	SeedSessions(runID string)
+	// PinSession makes the next client of isp use sessionID, e.g. to
+	// request the exit session of a stored client again
+	PinSession(isp string, sessionID int)
+}
+
+// sessionIDs hands out the session IDs of new clients. They are random
+// unless deterministic is set, in which case the n-th session of an ISP in a
+// run is DeterministicSessionID(runID, isp, n).
+type sessionIDs struct {
+	mu            sync.Mutex
+	deterministic bool
+	runID         string
+	counts        map[string]int
+	pinned        map[string]int
+}
+
+func (s *sessionIDs) SeedSessions(runID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runID = runID
+	s.counts = nil
+}
+
+func (s *sessionIDs) PinSession(isp string, sessionID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pinned == nil {
+		s.pinned = make(map[string]int)
+	}
+	s.pinned[isp] = sessionID
+}
+
+// nextSessionID returns the session ID of the next client of isp
+func (s *sessionIDs) nextSessionID(isp string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sessionID, ok := s.pinned[isp]; ok {
+		delete(s.pinned, isp)
+		return sessionID
+	}
+	if !s.deterministic {
+		return rand.Intn(maxSessionID)
+	}
+
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+	index := s.counts[isp]
+	s.counts[isp]++
+	return DeterministicSessionID(s.runID, isp, index)
+}
+
+// DeterministicSessionID derives the session ID of the client with index
+// index of an ISP in a run, retries included
+func DeterministicSessionID(runID, isp string, index int) int {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", runID, isp, index)
+	return int(h.Sum64() % maxSessionID)
+}
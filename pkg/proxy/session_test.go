@@ -0,0 +1,50 @@
+package proxy
+
+import "testing"
+
+func TestDeterministicSessionID(t *testing.T) {
+	id := DeterministicSessionID("run-1", "MCI", 0)
+	if got := DeterministicSessionID("run-1", "MCI", 0); got != id {
+		t.Errorf("DeterministicSessionID() = %d, then %d for the same inputs", id, got)
+	}
+	if id < 0 || id >= maxSessionID {
+		t.Errorf("DeterministicSessionID() = %d, want it in [0, %d)", id, maxSessionID)
+	}
+	for _, other := range []int{
+		DeterministicSessionID("run-2", "MCI", 0),
+		DeterministicSessionID("run-1", "Irancell", 0),
+		DeterministicSessionID("run-1", "MCI", 1),
+	} {
+		if other == id {
+			t.Errorf("different inputs yield the same session ID %d", id)
+		}
+	}
+}
+
+func TestNextSessionID(t *testing.T) {
+	sequence := func() []int {
+		s := &sessionIDs{deterministic: true}
+		s.SeedSessions("run-1")
+		return []int{s.nextSessionID("MCI"), s.nextSessionID("Irancell"), s.nextSessionID("MCI")}
+	}
+	first, second := sequence(), sequence()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("session %d = %d, then %d for the same run", i, first[i], second[i])
+		}
+	}
+	if want := DeterministicSessionID("run-1", "MCI", 1); first[2] != want {
+		t.Errorf("second MCI session = %d, want %d", first[2], want)
+	}
+
+	// A pinned session is used once
+	s := &sessionIDs{deterministic: true}
+	s.SeedSessions("run-1")
+	s.PinSession("MCI", 42)
+	if got := s.nextSessionID("MCI"); got != 42 {
+		t.Errorf("pinned session = %d, want 42", got)
+	}
+	if got, want := s.nextSessionID("MCI"), DeterministicSessionID("run-1", "MCI", 0); got != want {
+		t.Errorf("session after the pinned one = %d, want %d", got, want)
+	}
+}
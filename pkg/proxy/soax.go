@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,15 +10,18 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
-	"connectivity-tester/pkg/fetch"
 	"connectivity-tester/pkg/ipinfo"
 	"connectivity-tester/pkg/models"
 )
 
 type SoaxProvider struct {
+	countryMismatches
+	sessionIDs
+
 	config Config
 	logger *slog.Logger
 }
@@ -47,8 +51,9 @@ func newSoaxProvider(config Config, logger *slog.Logger) *SoaxProvider {
 	}
 
 	return &SoaxProvider{
-		config: config,
-		logger: logger,
+		sessionIDs: sessionIDs{deterministic: config.DeterministicSessions},
+		config:     config,
+		logger:     logger,
 	}
 }
 
@@ -76,12 +81,12 @@ func (p *SoaxProvider) GetISPList(countryISO string, clientType models.ClientTyp
 
 	if clientType == models.ResidentialType {
 		packageKey = p.config.PackageKey
-		endpoint = "https://api.soax.com/api/get-country-isp"
+		endpoint = soaxAPIURL + "/get-country-isp"
 		url = fmt.Sprintf("%s?api_key=%s&package_key=%s&country_iso=%s&conn_type=wifi",
 			endpoint, p.config.APIKey, packageKey, countryISO)
 	} else {
 		packageKey = p.config.PackageKey
-		endpoint = "https://api.soax.com/api/get-country-operators"
+		endpoint = soaxAPIURL + "/get-country-operators"
 		url = fmt.Sprintf("%s?api_key=%s&package_key=%s&country_iso=%s",
 			endpoint, p.config.APIKey, packageKey, countryISO)
 	}
@@ -92,11 +97,15 @@ func (p *SoaxProvider) GetISPList(countryISO string, clientType models.ClientTyp
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ISP list: %w", err)
+	}
+	auditResponse(p.logger, p.config, "GET "+redactURL(url), resp.StatusCode, body)
+
 	var isps []string
-	if err := json.NewDecoder(resp.Body).Decode(&isps); err != nil {
+	if err := json.Unmarshal(body, &isps); err != nil {
 		// log body of the response
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Println("body:", string(body))
 		p.logger.Error("failed to decode ISP list", "body", string(body))
 		return nil, fmt.Errorf("failed to decode ISP list: %w", err)
 	}
@@ -107,11 +116,76 @@ func (p *SoaxProvider) GetISPList(countryISO string, clientType models.ClientTyp
 	return isps, nil
 }
 
-func (p *SoaxProvider) GetClientForISP(isp string, clientType models.ClientType, country string, maxRetries int) (*models.Client, error) {
+// soaxAPIURL is the base URL of the SOAX API, a variable so tests can
+// replace it
+var soaxAPIURL = "https://api.soax.com/api"
+
+// GetRegionList returns the regions SOAX has clients in for a country
+func (p *SoaxProvider) GetRegionList(countryISO string) ([]string, error) {
+	params := url.Values{"country_iso": {countryISO}}
+	regions, err := p.getSoaxList("get-country-regions", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get region list: %v", err)
+	}
+	return regions, nil
+}
+
+// GetCityList returns the cities SOAX has clients in for a country, only
+// those of isp if it's not empty
+func (p *SoaxProvider) GetCityList(countryISO, isp string) ([]string, error) {
+	params := url.Values{"country_iso": {countryISO}}
+	if isp != "" {
+		params.Set("provider", isp)
+	}
+	cities, err := p.getSoaxList("get-country-cities", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get city list: %v", err)
+	}
+	return cities, nil
+}
+
+// getSoaxList calls a SOAX API endpoint returning a list of names and
+// returns them sorted and de-duplicated. Errors leave out the URL, which
+// holds the API key.
+func (p *SoaxProvider) getSoaxList(endpoint string, params url.Values) ([]string, error) {
+	params.Set("api_key", p.config.APIKey)
+	params.Set("package_key", p.config.PackageKey)
+
+	requestURL := soaxAPIURL + "/" + endpoint + "?" + params.Encode()
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %v", endpoint, errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %v", endpoint, err)
+	}
+	auditResponse(p.logger, p.config, "GET "+redactURL(requestURL), resp.StatusCode, body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+
+	var names []string
+	if err := json.Unmarshal(body, &names); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %v", endpoint, err)
+	}
+
+	// The API may repeat names or return them padded
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+	}
+	names = slices.DeleteFunc(names, func(name string) bool { return name == "" })
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// GetClientForISP gets a client of the ISP in country, and in city if it's not empty
+func (p *SoaxProvider) GetClientForISP(isp string, clientType models.ClientType, country, city string, maxRetries int) (*models.Client, error) {
 	sessionLength := p.config.SessionLength
 
 	for retry := 0; retry < maxRetries; retry++ {
-		sessionID := rand.Intn(1000000)
+		sessionID := p.nextSessionID(isp)
 
 		// Build initial client to get transport URL
 		tempClient := &models.Client{
@@ -119,20 +193,16 @@ func (p *SoaxProvider) GetClientForISP(isp string, clientType models.ClientType,
 			SessionLength: sessionLength,
 			CountryCode:   country,
 			ISP:           isp,
+			TargetCity:    city,
 			ClientType:    string(clientType),
 			Proxy:         string(SystemSOAX),
 		}
 
 		transport := p.BuildTransportURL(tempClient)
 
-		opts := fetch.Options{
-			Transport:  transport,
-			Method:     "GET",
-			Headers:    []string{"User-Agent: MyApp/1.0"},
-			TimeoutSec: 10,
-		}
+		opts := checkerOptions(transport, p.config.CheckerIP)
 
-		result, err := fetch.Fetch("https://checker.soax.com/api/ipinfo", opts)
+		result, err := auditedFetch(p.logger, p.config, checkerURL, opts)
 		if err != nil {
 			if strings.Contains(err.Error(), "general SOCKS server failure") {
 				return nil, fmt.Errorf("no available nodes for ISP %s", isp)
@@ -146,25 +216,22 @@ func (p *SoaxProvider) GetClientForISP(isp string, clientType models.ClientType,
 		}
 
 		// Get ASN information
-		asnInfo, err := ipinfo.GetIPInfo(ipInfo.Data.IP)
+		asnInfo, err := lookupIPInfo(ipInfo.Data.IP)
 		if err != nil {
 			continue
 		}
 
 		// Parse ASN and org name
-		orgParts := strings.SplitN(asnInfo.Org, " ", 2)
-		var asNumber, asOrg string
-		if len(orgParts) == 2 {
-			asNumber = strings.TrimPrefix(orgParts[0], "AS")
-			asOrg = orgParts[1]
-		} else {
-			asOrg = asnInfo.Org
-		}
+		asNumber, asOrg := ipinfo.ParseOrg(asnInfo.Org)
 
 		// Use ipinfo.io city as fallback if SOAX city is empty
-		city := ipInfo.Data.City
-		if city == "" {
-			city = asnInfo.City
+		exitCity := ipInfo.Data.City
+		if exitCity == "" {
+			exitCity = asnInfo.City
+		}
+		region := ipInfo.Data.Region
+		if region == "" {
+			region = asnInfo.Region
 		}
 
 		// Determine IP version
@@ -181,32 +248,50 @@ func (p *SoaxProvider) GetClientForISP(isp string, clientType models.ClientType,
 		// ensure that the IP is from the correct country
 		// sometimes clients have their VPN on which can cause the IP
 		// to be from a different country
-		if !strings.EqualFold(country, ipInfo.Data.CountryCode) {
+		countryMismatch := !strings.EqualFold(country, ipInfo.Data.CountryCode)
+		if countryMismatch {
+			p.recordCountryMismatch(isp)
 			p.logger.Debug("IP is from a different country",
 				"ip", ipInfo.Data.IP,
 				"expected", country,
-				"actual", ipInfo.Data.CountryCode)
+				"actual", ipInfo.Data.CountryCode,
+				"kept", p.config.AllowCountryMismatch)
+			if !p.config.AllowCountryMismatch {
+				continue
+			}
+		}
+
+		// Nodes outside the requested city are retried
+		if city != "" && !sameCity(city, exitCity) {
+			p.logger.Debug("IP is from a different city",
+				"ip", ipInfo.Data.IP,
+				"expected", city,
+				"actual", exitCity)
 			continue
 		}
 
 		now := time.Now()
 		client := &models.Client{
-			IP:             ipInfo.Data.IP,
-			ClientType:     string(clientType),
-			SessionID:      sessionID,
-			SessionLength:  sessionLength,
-			Time:           now,
-			ExpirationTime: now.Add(time.Duration(sessionLength) * time.Second),
-			IPVersion:      ipVersion,
-			Carrier:        ipInfo.Data.Carrier,
-			City:           city,
-			CountryCode:    ipInfo.Data.CountryCode,
-			CountryName:    ipInfo.Data.CountryName,
-			ASNumber:       asNumber,
-			ASOrg:          asOrg,
-			LastSeen:       now,
-			ISP:            isp,
-			Proxy:          string(SystemSOAX),
+			IP:              ipInfo.Data.IP,
+			ClientType:      string(clientType),
+			SessionID:       sessionID,
+			SessionLength:   sessionLength,
+			Time:            now,
+			ExpirationTime:  now.Add(time.Duration(sessionLength) * time.Second),
+			IPVersion:       ipVersion,
+			Carrier:         ipInfo.Data.Carrier,
+			City:            exitCity,
+			Region:          region,
+			CountryCode:     ipInfo.Data.CountryCode,
+			CountryName:     ipInfo.Data.CountryName,
+			ASNumber:        asNumber,
+			ASOrg:           asOrg,
+			LastSeen:        now,
+			ISP:             isp,
+			DetectedISP:     ipInfo.Data.ISP,
+			TargetCity:      city,
+			Proxy:           string(SystemSOAX),
+			CountryMismatch: countryMismatch,
 		}
 
 		return client, nil
@@ -231,53 +316,94 @@ func (p *SoaxProvider) BuildTransportURL(client *models.Client) string {
 	// Encode ISP name properly
 	encodedISP := strings.ReplaceAll(url.QueryEscape(client.ISP), "+", "%20")
 
+	// Targeting options narrow the country, flags trail the session fields
+	targeting, flags := splitSoaxOptions(p.config.SoaxOptions)
+	if client.TargetCity != "" {
+		targeting = "-city-" + strings.ReplaceAll(url.QueryEscape(client.TargetCity), "+", "%20") + targeting
+	}
+
 	// Generate transport URL
-	return fmt.Sprintf("socks5://package-%s-country-%s-sessionid-%d-sessionlength-%d-isp-%s-opt-uniqip:%s@%s",
+	return fmt.Sprintf("%s://package-%s-country-%s%s-sessionid-%d-sessionlength-%d-isp-%s-opt-uniqip%s:%s@%s",
+		p.config.proxyScheme(),
 		packageID,
 		client.CountryCode,
+		targeting,
 		client.SessionID,
 		client.SessionLength,
 		encodedISP,
+		flags,
 		packageKey,
 		p.config.Endpoint)
 }
 
-// IsValid checks if the client's IP hasn't changed and is still valid
-func (p *SoaxProvider) IsValidClient(client *models.Client) (bool, error) {
-	transport := p.BuildTransportURL(client)
-
-	opts := fetch.Options{
-		Transport:  transport,
-		Method:     "GET",
-		Headers:    []string{"User-Agent: MyApp/1.0"},
-		TimeoutSec: 10,
-	}
-
-	result, err := fetch.Fetch("https://checker.soax.com/api/ipinfo", opts)
-	if err != nil {
-		return false, fmt.Errorf("failed to fetch IP info: %w", err)
+// soaxBuiltinOptions are the userinfo fields BuildTransportURL sets itself,
+// the city comes from the city targeting of the run
+var soaxBuiltinOptions = []string{"package", "country", "city", "sessionid", "sessionlength", "isp", "opt-uniqip"}
+
+// validateSoaxOptions checks that extra SOAX options are single userinfo
+// segments like opt-keepalive or region-tehran and don't override the fields
+// BuildTransportURL sets
+func validateSoaxOptions(options []string) error {
+	for _, option := range options {
+		if option == "" || strings.ContainsAny(option, ":@/ ") {
+			return fmt.Errorf("invalid SOAX option %q", option)
+		}
+		for _, builtin := range soaxBuiltinOptions {
+			if option == builtin || strings.HasPrefix(option, builtin+"-") {
+				return fmt.Errorf("SOAX option %q conflicts with the %s field set for each client", option, builtin)
+			}
+		}
 	}
+	return nil
+}
 
-	var ipInfo models.SoaxIPInfo
-	if err := json.Unmarshal(result.Body, &ipInfo); err != nil {
-		return false, fmt.Errorf("failed to decode IP info: %w", err)
+// splitSoaxOptions joins the configured options into the targeting segments
+// that follow the country and the opt- flags that end the userinfo. Each
+// segment starts with a dash.
+func splitSoaxOptions(options []string) (targeting, flags string) {
+	for _, option := range options {
+		if strings.HasPrefix(option, "opt-") {
+			flags += "-" + option
+		} else {
+			targeting += "-" + option
+		}
 	}
+	return targeting, flags
+}
 
-	// Check if the IP has changed
-	if ipInfo.Data.IP != client.IP {
-		p.logger.Info("client IP has changed",
-			"old_ip", client.IP,
-			"new_ip", ipInfo.Data.IP,
-			"session_id", client.SessionID)
-
-		// Mark the client as expired by setting expiration time to now
-		client.ExpirationTime = time.Now()
-		return false, nil
-	}
+// IsValid checks if the client's IP hasn't changed and is still valid
+func (p *SoaxProvider) IsValidClient(client *models.Client) (bool, error) {
+	check, err := p.CheckClient(client)
+	return check.Valid, err
+}
 
-	return true, nil
+// CheckClient checks the exit IP of the client, see ClientChecker
+func (p *SoaxProvider) CheckClient(client *models.Client) (ClientCheck, error) {
+	return checkExitIP(p.logger, p.config, p.BuildTransportURL(client), client)
 }
 
 func (p *SoaxProvider) GetMaxWorkers() int {
 	return p.config.MaxWorkers
 }
+
+// soaxCapabilities are the features of SOAX. SOAX has both residential and
+// mobile packages, relays UDP and accepts sessions of 90 seconds to an hour.
+func soaxCapabilities() Capabilities {
+	return Capabilities{
+		ClientTypes:      []models.ClientType{models.ResidentialType, models.MobileType},
+		ISPTargeting:     true,
+		CityTargeting:    true,
+		UDP:              true,
+		MinSessionLength: 90,
+		MaxSessionLength: 3600,
+	}
+}
+
+// Capabilities returns the features of SOAX, see soaxCapabilities. UDP is
+// only supported through SOCKS5 proxies, not HTTP CONNECT.
+func (p *SoaxProvider) Capabilities() Capabilities {
+	caps := soaxCapabilities()
+	// HTTP CONNECT clients can't carry the UDP SOAX relays
+	caps.UDP = p.config.relaysUDP()
+	return caps
+}
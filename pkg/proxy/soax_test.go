@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stubSoaxAPI serves responses by endpoint in place of the SOAX API and
+// records the query of each request
+func stubSoaxAPI(t *testing.T, responses map[string]any) map[string]url.Values {
+	t.Helper()
+	queries := make(map[string]url.Values)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := strings.TrimPrefix(r.URL.Path, "/")
+		queries[endpoint] = r.URL.Query()
+		resp, ok := responses[endpoint]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	origURL := soaxAPIURL
+	t.Cleanup(func() { soaxAPIURL = origURL })
+	soaxAPIURL = srv.URL
+	return queries
+}
+
+func TestSoaxRegionAndCityList(t *testing.T) {
+	queries := stubSoaxAPI(t, map[string]any{
+		"get-country-regions": []string{"tehran", "isfahan", "tehran", " fars ", ""},
+		"get-country-cities":  []string{"tehran", "karaj", "karaj"},
+	})
+	p := newSoaxProvider(testSoaxConfig(), testLogger)
+
+	regions, err := p.GetRegionList("ir")
+	if err != nil {
+		t.Fatalf("GetRegionList() error = %v", err)
+	}
+	if want := []string{"fars", "isfahan", "tehran"}; !reflect.DeepEqual(regions, want) {
+		t.Errorf("GetRegionList() = %v, want %v", regions, want)
+	}
+	if q := queries["get-country-regions"]; q.Get("country_iso") != "ir" || q.Get("api_key") != "key" || q.Get("package_key") != "pkg" {
+		t.Errorf("region request query = %v", q)
+	}
+
+	cities, err := p.GetCityList("ir", "MCI")
+	if err != nil {
+		t.Fatalf("GetCityList() error = %v", err)
+	}
+	if want := []string{"karaj", "tehran"}; !reflect.DeepEqual(cities, want) {
+		t.Errorf("GetCityList() = %v, want %v", cities, want)
+	}
+	if q := queries["get-country-cities"]; q.Get("country_iso") != "ir" || q.Get("provider") != "MCI" {
+		t.Errorf("city request query = %v", q)
+	}
+
+	// Without an ISP the cities of all ISPs are listed
+	if _, err := p.GetCityList("ir", ""); err != nil {
+		t.Fatalf("GetCityList() error = %v", err)
+	}
+	if q := queries["get-country-cities"]; q.Has("provider") {
+		t.Errorf("city request without ISP has provider %q", q.Get("provider"))
+	}
+}
+
+func TestSoaxListErrors(t *testing.T) {
+	stubSoaxAPI(t, map[string]any{
+		"get-country-regions": map[string]string{"message": "invalid package"},
+	})
+	config := testSoaxConfig()
+	config.APIKey = "s3cr3t-api-key"
+	p := newSoaxProvider(config, testLogger)
+
+	if _, err := p.GetRegionList("ir"); err == nil {
+		t.Error("GetRegionList() with an object response succeeded, want error")
+	}
+	_, err := p.GetCityList("ir", "")
+	if err == nil {
+		t.Fatal("GetCityList() with a missing endpoint succeeded, want error")
+	}
+	// The API key is part of the request URL and must not leak into errors
+	if strings.Contains(err.Error(), config.APIKey) {
+		t.Errorf("GetCityList() error %q contains the API key", err)
+	}
+}
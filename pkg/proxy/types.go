@@ -1,6 +1,11 @@
 package proxy
 
-import "connectivity-tester/pkg/models"
+import (
+	"fmt"
+	"slices"
+
+	"connectivity-tester/pkg/models"
+)
 
 // System represents the type of proxy system
 type System string
@@ -20,15 +25,88 @@ type Config struct {
 	SessionLength int
 	Endpoint      string
 	MaxWorkers    int
+	// AllowCountryMismatch keeps clients whose exit IP is in a different
+	// country than requested instead of discarding them
+	AllowCountryMismatch bool
+	// SoaxOptions are extra SOAX userinfo segments such as opt-keepalive or
+	// region-tehran, see validateSoaxOptions
+	SoaxOptions []string
+	// CheckerIP is dialed for requests to the IP checker instead of
+	// resolving its hostname, empty resolves it through the proxy
+	CheckerIP string
+	// IPVersion is the IP version ("v4" or "v6") the local client of the
+	// none provider measures from, empty uses the default route
+	IPVersion string
+	// AutoReplace is the ProxyRack autoReplace mode of a session whose exit
+	// node goes away, see proxyRackAutoReplaceModes; empty uses strict
+	AutoReplace string
+	// ProxyScheme is the scheme of the client transports, see proxySchemes;
+	// empty uses socks5
+	ProxyScheme string
+	// DeterministicSessions derives session IDs from the run ID, ISP and
+	// client index instead of picking them at random, see SessionSeeder
+	DeterministicSessions bool
+	// AuditDir is the directory the raw responses of the provider API and
+	// the IP checker are written to, empty doesn't keep them
+	AuditDir string
+}
+
+// proxySchemes are the transports a client proxy can be reached with: a
+// SOCKS5 proxy, or an HTTP CONNECT proxy over plain HTTP or TLS. CONNECT
+// proxies don't relay UDP.
+var proxySchemes = []string{"socks5", "http", "https"}
+
+// validateProxyScheme checks that scheme is one of proxySchemes
+func validateProxyScheme(scheme string) error {
+	if scheme == "" || slices.Contains(proxySchemes, scheme) {
+		return nil
+	}
+	return fmt.Errorf("invalid proxy scheme %q, must be one of %v", scheme, proxySchemes)
+}
+
+// proxyScheme returns the scheme of the client transports
+func (c Config) proxyScheme() string {
+	if c.ProxyScheme == "" {
+		return "socks5"
+	}
+	return c.ProxyScheme
+}
+
+// relaysUDP reports whether the client transports relay UDP, only SOCKS5
+// proxies do
+func (c Config) relaysUDP() bool {
+	return c.proxyScheme() == "socks5"
+}
+
+// Capabilities describes the features a provider supports
+type Capabilities struct {
+	// ClientTypes are the client types the provider can supply
+	ClientTypes []models.ClientType
+	// ISPTargeting is true if clients can be requested for a specific ISP
+	ISPTargeting bool
+	// CityTargeting is true if clients can be requested for a specific city
+	CityTargeting bool
+	// UDP is true if UDP traffic can be relayed through clients
+	UDP bool
+	// MinSessionLength and MaxSessionLength bound the session length in seconds
+	MinSessionLength int
+	MaxSessionLength int
+}
+
+// SupportsClientType reports whether the provider can supply clients of the given type
+func (c Capabilities) SupportsClientType(clientType models.ClientType) bool {
+	return slices.Contains(c.ClientTypes, clientType)
 }
 
 // Provider defines the interface for different proxy providers
 type Provider interface {
 	GetISPList(countryISO string, clientType models.ClientType) ([]string, error)
-	GetClientForISP(isp string, clientType models.ClientType, country string, maxRetries int) (*models.Client, error)
+	GetClientForISP(isp string, clientType models.ClientType, country, city string, maxRetries int) (*models.Client, error)
 	BuildTransportURL(client *models.Client) string
 	GetProviderName() string
 	IsValidClient(client *models.Client) (bool, error)
 	GetSessionLength() int
 	GetMaxWorkers() int
+	CountryMismatches() map[string]int
+	Capabilities() Capabilities
 }
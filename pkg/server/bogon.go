@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/netip"
+)
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which like
+// private ranges isn't reachable from the internet
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// bogonReason returns why a server IP isn't a public unicast address that
+// measurements could reach through a proxy, empty if it is
+func bogonReason(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	switch {
+	case addr.IsUnspecified():
+		return "unspecified"
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsPrivate():
+		return "private"
+	case sharedAddressSpace.Contains(addr):
+		return "shared address space"
+	case addr.IsLinkLocalUnicast():
+		return "link-local"
+	case addr.IsMulticast():
+		return "multicast"
+	}
+	return ""
+}
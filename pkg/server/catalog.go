@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+// catalogTimeout bounds the request for the catalog
+const catalogTimeout = 30 * time.Second
+
+// catalogStore is the part of the database a catalog sync reads and writes
+type catalogStore interface {
+	UpsertServer(ctx context.Context, server *models.Server) error
+	GetServersByNames(ctx context.Context, names []string) ([]models.Server, error)
+	RemoveGroupServer(ctx context.Context, id int64, name string) error
+}
+
+// SyncResult counts the servers a catalog sync stored and removed
+type SyncResult struct {
+	Upserted int
+	Removed  int
+}
+
+// SyncServersFromCatalog makes the servers of the group opts.Name match the
+// catalog at catalogURL, a JSON array of access links. Catalog servers are
+// imported like add-servers does and servers of the group that are no
+// longer in the catalog are removed.
+func SyncServersFromCatalog(db *database.DB, catalogURL string, opts ImportOptions) (SyncResult, error) {
+	return syncServers(context.Background(), db, catalogURL, opts)
+}
+
+func syncServers(ctx context.Context, store catalogStore, catalogURL string, opts ImportOptions) (SyncResult, error) {
+	var result SyncResult
+
+	// Removals are limited to a group so other servers are left alone
+	if opts.Name == "" {
+		return result, fmt.Errorf("a server group name is required to sync servers")
+	}
+	if err := opts.validate(); err != nil {
+		return result, err
+	}
+
+	accessKeys, err := fetchCatalog(ctx, catalogURL)
+	if err != nil {
+		return result, err
+	}
+
+	servers := parseServers(accessKeys, opts)
+	// Don't empty the group because the catalog is empty or unparsable
+	if len(servers) == 0 {
+		return result, fmt.Errorf("no valid access links in catalog %s", catalogURL)
+	}
+	annotateServers(servers, opts.LookupConcurrency)
+
+	existing, err := store.GetServersByNames(ctx, []string{opts.Name})
+	if err != nil {
+		return result, err
+	}
+
+	var failed int
+	inCatalog := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		inCatalog[catalogKey(server)] = true
+		if err := store.UpsertServer(ctx, &server); err != nil {
+			slog.Error("Error upserting server", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", err)
+			failed++
+			continue
+		}
+		result.Upserted++
+	}
+
+	for _, server := range existing {
+		if inCatalog[catalogKey(server)] {
+			continue
+		}
+		slog.Info("Removing server no longer in catalog", "id", server.ID, "ip", server.IP, "group", opts.Name)
+		if err := store.RemoveGroupServer(ctx, server.ID, opts.Name); err != nil {
+			slog.Error("Error removing server", "id", server.ID, "error", err)
+			failed++
+			continue
+		}
+		result.Removed++
+	}
+
+	if failed > 0 {
+		return result, fmt.Errorf("failed to sync %d servers", failed)
+	}
+	return result, nil
+}
+
+// catalogKey identifies a server the way the servers table does
+func catalogKey(server models.Server) string {
+	return server.IP + "|" + server.FullAccessLink
+}
+
+// fetchCatalog gets the access links of a catalog
+func fetchCatalog(ctx context.Context, catalogURL string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, catalogTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, catalogURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid catalog URL: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch catalog: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch catalog: %s", resp.Status)
+	}
+
+	var accessKeys []string
+	if err := json.NewDecoder(resp.Body).Decode(&accessKeys); err != nil {
+		return nil, fmt.Errorf("failed to decode catalog: %v", err)
+	}
+
+	return accessKeys, nil
+}
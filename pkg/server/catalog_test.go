@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
+)
+
+// memoryStore keeps servers by their IP and access link like the servers table
+type memoryStore struct {
+	servers map[string]models.Server
+	lastID  int64
+}
+
+func (m *memoryStore) UpsertServer(ctx context.Context, server *models.Server) error {
+	key := catalogKey(*server)
+	if existing, ok := m.servers[key]; ok {
+		server.ID = existing.ID
+		server.Name = existing.Name
+	} else {
+		m.lastID++
+		server.ID = m.lastID
+	}
+	m.servers[key] = *server
+	return nil
+}
+
+func (m *memoryStore) GetServersByNames(ctx context.Context, names []string) ([]models.Server, error) {
+	var servers []models.Server
+	for _, server := range m.servers {
+		for _, name := range names {
+			if server.Name == name {
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers, nil
+}
+
+func (m *memoryStore) RemoveGroupServer(ctx context.Context, id int64, name string) error {
+	for key, server := range m.servers {
+		if server.ID == id && server.Name == name {
+			delete(m.servers, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) links() []string {
+	var links []string
+	for _, server := range m.servers {
+		links = append(links, server.Name+" "+server.FullAccessLink)
+	}
+	sort.Strings(links)
+	return links
+}
+
+func stubCatalog(t *testing.T, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestSyncServers(t *testing.T) {
+	origLookup, origBatch := getIPInfo, getIPInfoBatch
+	t.Cleanup(func() { getIPInfo, getIPInfoBatch = origLookup, origBatch })
+	getIPInfoBatch = func(ips []string) (map[string]ipinfo.IPInfoResponse, error) {
+		return map[string]ipinfo.IPInfoResponse{}, nil
+	}
+	getIPInfo = func(ip string) (ipinfo.IPInfoResponse, error) {
+		return ipinfo.IPInfoResponse{IP: ip, Org: "AS64500 Networks", Country: "DE"}, nil
+	}
+
+	store := &memoryStore{servers: map[string]models.Server{}}
+	for _, server := range []models.Server{
+		{Name: "catalog", IP: "192.0.2.1", FullAccessLink: "ss://key@192.0.2.1:443"},
+		{Name: "catalog", IP: "192.0.2.2", FullAccessLink: "ss://key@192.0.2.2:443"},
+		{Name: "other", IP: "192.0.2.9", FullAccessLink: "ss://key@192.0.2.9:443"},
+	} {
+		store.UpsertServer(context.Background(), &server)
+	}
+
+	// 192.0.2.2 was dropped from the catalog and 192.0.2.3 was added
+	catalogURL := stubCatalog(t, `["ss://key@192.0.2.1:443", "ss://key@192.0.2.3:443", "not a link"]`)
+	result, err := syncServers(context.Background(), store, catalogURL, ImportOptions{Name: "catalog", Preresolve: true})
+	if err != nil {
+		t.Fatalf("syncServers() error = %v", err)
+	}
+
+	if result != (SyncResult{Upserted: 2, Removed: 1}) {
+		t.Errorf("syncServers() = %+v, want 2 upserted and 1 removed", result)
+	}
+	want := []string{
+		"catalog ss://key@192.0.2.1:443",
+		"catalog ss://key@192.0.2.3:443",
+		"other ss://key@192.0.2.9:443",
+	}
+	if got := store.links(); !reflect.DeepEqual(got, want) {
+		t.Errorf("servers after sync = %v, want %v", got, want)
+	}
+	if added := store.servers["192.0.2.3|ss://key@192.0.2.3:443"]; added.Country != "DE" {
+		t.Errorf("added server wasn't annotated: %+v", added)
+	}
+}
+
+func TestSyncServersSharedEndpoint(t *testing.T) {
+	origLookup, origBatch := getIPInfo, getIPInfoBatch
+	t.Cleanup(func() { getIPInfo, getIPInfoBatch = origLookup, origBatch })
+	getIPInfoBatch = func(ips []string) (map[string]ipinfo.IPInfoResponse, error) {
+		return map[string]ipinfo.IPInfoResponse{}, nil
+	}
+	getIPInfo = func(ip string) (ipinfo.IPInfoResponse, error) {
+		return ipinfo.IPInfoResponse{IP: ip}, nil
+	}
+
+	store := &memoryStore{servers: map[string]models.Server{}}
+	for _, server := range []models.Server{
+		{Name: "catalog", IP: "192.0.2.1", Port: "443", UserInfo: "key", FullAccessLink: "ss://key@192.0.2.1:443"},
+		{Name: "catalog", IP: "192.0.2.2", Port: "443", UserInfo: "key", FullAccessLink: "ss://key@192.0.2.2:443"},
+		// Another group has a server of the same endpoint
+		{Name: "other", IP: "192.0.2.2", Port: "443", UserInfo: "key", FullAccessLink: "ss://key@192.0.2.2:443/?outline=1"},
+	} {
+		store.UpsertServer(context.Background(), &server)
+	}
+
+	// The catalog dropped 192.0.2.2 and changed the link of 192.0.2.1
+	catalogURL := stubCatalog(t, `["ss://key@192.0.2.1:443/?outline=1"]`)
+	result, err := syncServers(context.Background(), store, catalogURL, ImportOptions{Name: "catalog", Preresolve: true})
+	if err != nil {
+		t.Fatalf("syncServers() error = %v", err)
+	}
+	if result != (SyncResult{Upserted: 1, Removed: 2}) {
+		t.Errorf("syncServers() = %+v, want 1 upserted and 2 removed", result)
+	}
+	want := []string{
+		"catalog ss://key@192.0.2.1:443/?outline=1",
+		"other ss://key@192.0.2.2:443/?outline=1",
+	}
+	if got := store.links(); !reflect.DeepEqual(got, want) {
+		t.Errorf("servers after sync = %v, want %v", got, want)
+	}
+}
+
+func TestSyncServersErrors(t *testing.T) {
+	store := &memoryStore{servers: map[string]models.Server{
+		"192.0.2.1|ss://key@192.0.2.1:443": {Name: "catalog", IP: "192.0.2.1", FullAccessLink: "ss://key@192.0.2.1:443"},
+	}}
+
+	tests := []struct {
+		name string
+		body string
+		opts ImportOptions
+	}{
+		{name: "no group", body: `["ss://key@192.0.2.3:443"]`},
+		{name: "empty catalog", body: `[]`, opts: ImportOptions{Name: "catalog"}},
+		{name: "not a list of links", body: `{"servers": []}`, opts: ImportOptions{Name: "catalog"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := syncServers(context.Background(), store, stubCatalog(t, tt.body), tt.opts); err == nil {
+				t.Errorf("syncServers() expected an error")
+			}
+			if len(store.servers) != 1 {
+				t.Errorf("failed sync changed the servers: %v", store.links())
+			}
+		})
+	}
+}
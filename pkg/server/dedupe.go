@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+// DuplicateCluster is a group of stored servers that are the same endpoint
+// in the same server group, with the same scheme, domain, port and user info
+// but different IPs or access links
+type DuplicateCluster struct {
+	// Canonical is the server the duplicates are merged into
+	Canonical  models.Server
+	Duplicates []models.Server
+}
+
+// FindDuplicates groups the domain based servers that are the same endpoint,
+// see domainKey. Servers without a domain are never duplicates. The canonical
+// server of a cluster is the most recently tested one, the oldest one if
+// they were tested at the same time. Clusters are ordered by domain, port
+// and group.
+func FindDuplicates(servers []models.Server) []DuplicateCluster {
+	groups := make(map[string][]models.Server)
+	for _, server := range servers {
+		if server.DomainName == "" {
+			continue
+		}
+		key := domainKey(server)
+		groups[key] = append(groups[key], server)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var clusters []DuplicateCluster
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool {
+			if !group[i].LastTestTime.Equal(group[j].LastTestTime) {
+				return group[i].LastTestTime.After(group[j].LastTestTime)
+			}
+			return group[i].ID < group[j].ID
+		})
+		clusters = append(clusters, DuplicateCluster{
+			Canonical:  group[0],
+			Duplicates: group[1:],
+		})
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		a, b := clusters[i].Canonical, clusters[j].Canonical
+		if a.DomainName != b.DomainName {
+			return a.DomainName < b.DomainName
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Name < b.Name
+	})
+	return clusters
+}
+
+// DedupeServers finds the duplicate clusters of the imported servers and,
+// unless dryRun is set, merges each cluster into its canonical server. The
+// measurements of the duplicates are reassigned to the canonical server
+// before the duplicates are deleted.
+func DedupeServers(db *database.DB, dryRun bool) ([]DuplicateCluster, error) {
+	ctx := context.Background()
+	servers, err := db.GetAllServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := FindDuplicates(servers)
+	slog.Info("Found duplicate servers", "clusters", len(clusters), "dryRun", dryRun)
+	if dryRun {
+		return clusters, nil
+	}
+
+	for _, cluster := range clusters {
+		ids := make([]int64, len(cluster.Duplicates))
+		for i, duplicate := range cluster.Duplicates {
+			ids[i] = duplicate.ID
+		}
+		moved, err := db.MergeServers(ctx, cluster.Canonical.ID, ids)
+		if err != nil {
+			return nil, err
+		}
+		// The key holds the user info, the domain identifies the cluster in logs
+		slog.Info("Merged duplicate servers",
+			"domain", cluster.Canonical.DomainName,
+			"port", cluster.Canonical.Port,
+			"name", cluster.Canonical.Name,
+			"canonicalID", cluster.Canonical.ID,
+			"duplicates", len(ids),
+			"measurements", moved)
+	}
+	return clusters, nil
+}
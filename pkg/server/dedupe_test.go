@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	now := time.Now()
+	servers := []models.Server{
+		{ID: 1, IP: "192.0.2.1", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "a.example", LastTestTime: now.Add(-time.Hour)},
+		{ID: 2, IP: "192.0.2.2", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "a.example", LastTestTime: now},
+		{ID: 3, IP: "192.0.2.3", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "a.example", LastTestTime: now.Add(-time.Hour)},
+		// Another port, user info or no domain is another endpoint
+		{ID: 4, IP: "192.0.2.1", Port: "8443", Scheme: "ss", UserInfo: "u", DomainName: "a.example"},
+		{ID: 5, IP: "192.0.2.1", Port: "443", Scheme: "ss", UserInfo: "v", DomainName: "a.example"},
+		{ID: 6, IP: "192.0.2.9", Port: "443", Scheme: "ss", UserInfo: "u"},
+		{ID: 7, IP: "192.0.2.9", Port: "443", Scheme: "ss", UserInfo: "u"},
+		// Untested duplicates keep the oldest server
+		{ID: 9, IP: "198.51.100.2", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "b.example"},
+		{ID: 8, IP: "198.51.100.1", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "b.example"},
+		// The same endpoint in two groups is two servers
+		{ID: 10, IP: "203.0.113.1", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "c.example", Name: "group-a"},
+		{ID: 11, IP: "203.0.113.2", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "c.example", Name: "group-b"},
+	}
+
+	clusters := FindDuplicates(servers)
+	if len(clusters) != 2 {
+		t.Fatalf("FindDuplicates() = %d clusters, want 2: %+v", len(clusters), clusters)
+	}
+	ids := func(servers []models.Server) []int64 {
+		var ids []int64
+		for _, s := range servers {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+	if c := clusters[0]; c.Canonical.ID != 2 || len(c.Duplicates) != 2 || c.Duplicates[0].ID != 1 || c.Duplicates[1].ID != 3 {
+		t.Errorf("cluster of a.example = canonical %d, duplicates %v, want 2 and [1 3]", c.Canonical.ID, ids(c.Duplicates))
+	}
+	if c := clusters[1]; c.Canonical.ID != 8 || len(c.Duplicates) != 1 || c.Duplicates[0].ID != 9 {
+		t.Errorf("cluster of b.example = canonical %d, duplicates %v, want 8 and [9]", c.Canonical.ID, ids(c.Duplicates))
+	}
+}
+
+func TestDedupeServers(t *testing.T) {
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	now := time.Now()
+	servers := []models.Server{
+		{IP: "192.0.2.1", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "a.example",
+			FullAccessLink: "ss://u@192.0.2.1:443", LastTestTime: now},
+		{IP: "192.0.2.2", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "a.example",
+			FullAccessLink: "ss://u@192.0.2.2:443", LastTestTime: now.Add(-time.Hour)},
+		{IP: "192.0.2.3", Port: "443", Scheme: "ss", UserInfo: "u", DomainName: "c.example",
+			FullAccessLink: "ss://u@192.0.2.3:443", LastTestTime: now},
+	}
+	for i := range servers {
+		if err := db.UpsertServer(ctx, &servers[i]); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+	clients, err := db.InsertClients(ctx, []models.Client{{
+		IP: "198.51.100.1", ClientType: "residential", Time: now, ExpirationTime: now,
+		IPVersion: "v4", CountryCode: "ir", LastSeen: now, ISP: "MCI", Proxy: "none",
+	}})
+	if err != nil {
+		t.Fatalf("InsertClients() error = %v", err)
+	}
+	for _, server := range []models.Server{servers[0], servers[1], servers[1], servers[2]} {
+		m := &models.Measurement{ClientID: clients[0].ID, ServerID: server.ID, Time: now, Protocol: "tcp", SessionID: "s"}
+		if err := db.InsertMeasurement(ctx, m); err != nil {
+			t.Fatalf("InsertMeasurement() error = %v", err)
+		}
+	}
+
+	countMeasurements := func(serverID int64) int {
+		n, err := db.NewSelect().Model((*models.Measurement)(nil)).Where("server_id = ?", serverID).Count(ctx)
+		if err != nil {
+			t.Fatalf("failed to count measurements: %v", err)
+		}
+		return n
+	}
+
+	// A dry run only reports the clusters
+	clusters, err := DedupeServers(db, true)
+	if err != nil {
+		t.Fatalf("DedupeServers(dry run) error = %v", err)
+	}
+	if len(clusters) != 1 || clusters[0].Canonical.ID != servers[0].ID {
+		t.Fatalf("DedupeServers(dry run) = %+v, want one cluster merged into server %d", clusters, servers[0].ID)
+	}
+	if stored, _ := db.GetAllServers(ctx); len(stored) != 3 || countMeasurements(servers[1].ID) != 2 {
+		t.Errorf("dry run changed the database: %d servers, %d measurements of the duplicate", len(stored), countMeasurements(servers[1].ID))
+	}
+
+	if _, err := DedupeServers(db, false); err != nil {
+		t.Fatalf("DedupeServers() error = %v", err)
+	}
+	stored, err := db.GetAllServers(ctx)
+	if err != nil {
+		t.Fatalf("GetAllServers() error = %v", err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("%d servers left, want the duplicate deleted", len(stored))
+	}
+	if got := countMeasurements(servers[0].ID); got != 3 {
+		t.Errorf("canonical server has %d measurements, want 3 with the reassigned ones", got)
+	}
+	if got := countMeasurements(servers[1].ID); got != 0 {
+		t.Errorf("deleted duplicate still has %d measurements", got)
+	}
+	if got := countMeasurements(servers[2].ID); got != 1 {
+		t.Errorf("other server has %d measurements, want 1", got)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+// checkLinkHost returns an error if the host of a server's access link is
+// neither its IP nor its domain. Measurements of such a server would be
+// attributed to an address its link doesn't connect to.
+func checkLinkHost(server models.Server) error {
+	u, err := url.Parse(server.FullAccessLink)
+	if err != nil {
+		return fmt.Errorf("failed to parse access link of %s: %v", server.IP, err)
+	}
+	host := u.Hostname()
+	if server.DomainName != "" && host == server.DomainName {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.Equal(net.ParseIP(server.IP)) {
+		return nil
+	}
+	return fmt.Errorf("access link host %s matches neither IP %s nor domain %q", host, server.IP, server.DomainName)
+}
+
+// LinkRepair is a stored server whose access link host doesn't match its IP
+// or domain, and the link pointed at its IP that replaces it
+type LinkRepair struct {
+	Server models.Server
+	Link   string
+}
+
+// repairLink returns the access link of server with its host replaced by the
+// server IP. The port, user info, path and params are kept.
+func repairLink(server models.Server) (string, error) {
+	u, err := url.Parse(server.FullAccessLink)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse access link of %s: %v", server.IP, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = server.Port
+	}
+	u.Host = net.JoinHostPort(server.IP, port)
+	return u.String(), nil
+}
+
+// FindInconsistentLinks returns the repairs of the servers whose access link
+// host matches neither their IP nor their domain. Servers whose link can't
+// be parsed are logged and left out.
+func FindInconsistentLinks(servers []models.Server) []LinkRepair {
+	var repairs []LinkRepair
+	for _, server := range servers {
+		if checkLinkHost(server) == nil {
+			continue
+		}
+		link, err := repairLink(server)
+		if err != nil {
+			slog.Warn("Cannot repair access link", "id", server.ID, "error", err)
+			continue
+		}
+		repairs = append(repairs, LinkRepair{Server: server, Link: link})
+	}
+	return repairs
+}
+
+// RepairLinks finds the imported servers whose access link host matches
+// neither their IP nor their domain and, unless dryRun is set, points their
+// links at their IPs. A repaired link that is already stored for the IP
+// fails to update and is logged, the servers can be merged with servers
+// dedupe then.
+func RepairLinks(db *database.DB, dryRun bool) ([]LinkRepair, error) {
+	ctx := context.Background()
+	servers, err := db.GetAllServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := FindInconsistentLinks(servers)
+	slog.Info("Found inconsistent access links", "servers", len(repairs), "dryRun", dryRun)
+	if dryRun {
+		return repairs, nil
+	}
+
+	var repaired int
+	for _, repair := range repairs {
+		if err := db.UpdateServerAccessLink(ctx, repair.Server.ID, repair.Link); err != nil {
+			slog.Error("Failed to repair access link", "id", repair.Server.ID, "ip", repair.Server.IP, "error", err)
+			continue
+		}
+		repaired++
+	}
+	slog.Info("Repaired access links", "servers", repaired)
+	return repairs, nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"connectivity-tester/pkg/database"
+	"connectivity-tester/pkg/models"
+)
+
+func TestParseAccessKeyLinkConsistency(t *testing.T) {
+	origLookup := lookupIP
+	t.Cleanup(func() { lookupIP = origLookup })
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+
+	for _, preresolve := range []bool{true, false} {
+		servers, err := parseAccessKey("ss://user:pass@example.com:8388/?outline=1", preresolve)
+		if err != nil {
+			t.Fatalf("parseAccessKey(preresolve %t) error = %v", preresolve, err)
+		}
+		if len(servers) != 2 {
+			t.Fatalf("parseAccessKey(preresolve %t) returned %d servers, want 2", preresolve, len(servers))
+		}
+		for _, server := range servers {
+			if err := checkLinkHost(server); err != nil {
+				t.Errorf("preresolve %t: server %s is inconsistent: %v", preresolve, server.IP, err)
+			}
+			host := mustParseURL(server.FullAccessLink).Hostname()
+			if preresolve && host != server.IP {
+				t.Errorf("preresolved link host = %s, want IP %s", host, server.IP)
+			}
+			if !preresolve && host != "example.com" {
+				t.Errorf("link host = %s, want the domain", host)
+			}
+		}
+	}
+}
+
+func TestFindInconsistentLinks(t *testing.T) {
+	servers := []models.Server{
+		{ID: 1, IP: "192.0.2.1", Port: "443", FullAccessLink: "ss://u@192.0.2.1:443"},
+		{ID: 2, IP: "192.0.2.2", Port: "443", DomainName: "a.example", FullAccessLink: "ss://u@a.example:443/?outline=1"},
+		{ID: 3, IP: "2001:db8::1", Port: "443", FullAccessLink: "ss://u@[2001:db8::1]:443"},
+		// The link points to another IP or domain than stored
+		{ID: 4, IP: "192.0.2.4", Port: "443", FullAccessLink: "ss://u:p@192.0.2.99:443/?outline=1"},
+		{ID: 5, IP: "2001:db8::5", Port: "8443", DomainName: "b.example", FullAccessLink: "ss://u@c.example:8443"},
+	}
+
+	repairs := FindInconsistentLinks(servers)
+	if len(repairs) != 2 {
+		t.Fatalf("FindInconsistentLinks() = %+v, want servers 4 and 5", repairs)
+	}
+	want := map[int64]string{
+		4: "ss://u:p@192.0.2.4:443/?outline=1",
+		5: "ss://u@[2001:db8::5]:8443",
+	}
+	for _, repair := range repairs {
+		if repair.Link != want[repair.Server.ID] {
+			t.Errorf("repaired link of server %d = %s, want %s", repair.Server.ID, repair.Link, want[repair.Server.ID])
+		}
+	}
+}
+
+func TestRepairLinks(t *testing.T) {
+	db, err := database.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.InitSchema(ctx); err != nil {
+		t.Fatalf("InitSchema() error = %v", err)
+	}
+
+	for _, server := range []models.Server{
+		{IP: "192.0.2.1", Port: "443", Scheme: "ss", UserInfo: "u", FullAccessLink: "ss://u@192.0.2.1:443"},
+		{IP: "192.0.2.2", Port: "443", Scheme: "ss", UserInfo: "u", FullAccessLink: "ss://u@192.0.2.99:443"},
+	} {
+		if err := db.UpsertServer(ctx, &server); err != nil {
+			t.Fatalf("UpsertServer() error = %v", err)
+		}
+	}
+
+	// A dry run only lists the repairs
+	repairs, err := RepairLinks(db, true)
+	if err != nil || len(repairs) != 1 {
+		t.Fatalf("RepairLinks(dry run) = %+v, %v, want one repair", repairs, err)
+	}
+	if _, err := RepairLinks(db, false); err != nil {
+		t.Fatalf("RepairLinks() error = %v", err)
+	}
+
+	servers, _ := db.GetAllServers(ctx)
+	for _, server := range servers {
+		if err := checkLinkHost(server); err != nil {
+			t.Errorf("server %d is still inconsistent: %v", server.ID, err)
+		}
+	}
+	if repairs, _ := RepairLinks(db, true); len(repairs) != 0 {
+		t.Errorf("RepairLinks() after repairing found %+v", repairs)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+
+	"connectivity-tester/pkg/models"
+)
+
+// FormatLinks is the export format of servers as access links, one per line,
+// as read by ReadServersFile
+const FormatLinks = "links"
+
+// AccessLink returns the access link of a server as it was imported, with
+// its fragment
+func AccessLink(server models.Server) string {
+	if server.Fragment == "" {
+		return server.FullAccessLink
+	}
+	return server.FullAccessLink + "#" + (&url.URL{Fragment: server.Fragment}).EscapedFragment()
+}
+
+// WriteLinks writes the access link of each server, one per line. Servers
+// imported from the same link, one per IP its domain resolved to, share
+// their access link, it's written once.
+func WriteLinks(w io.Writer, servers []models.Server) error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		link := AccessLink(server)
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		if _, err := fmt.Fprintln(bw, link); err != nil {
+			return fmt.Errorf("failed to write access links: %v", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write access links: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"connectivity-tester/pkg/models"
+)
+
+func TestWriteLinksRoundTrip(t *testing.T) {
+	origLookup := lookupIP
+	t.Cleanup(func() { lookupIP = origLookup })
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")}, nil
+	}
+
+	links := []string{
+		"ss://user:p%40ss@example.com:8388/?outline=1#name=foo;tier=premium",
+		"ss://user:pass@198.51.100.1:8388#My%20Server",
+		"direct://198.51.100.2:443",
+	}
+	filename := filepath.Join(t.TempDir(), "servers.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join(links, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := ReadServersFile(filename, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ReadServersFile() error = %v", err)
+	}
+	// The domain is stored once per IP it resolved to
+	if len(servers) != 4 {
+		t.Fatalf("imported %d servers, want 4", len(servers))
+	}
+
+	var out strings.Builder
+	if err := WriteLinks(&out, servers); err != nil {
+		t.Fatalf("WriteLinks() error = %v", err)
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); !reflect.DeepEqual(got, links) {
+		t.Errorf("exported links = %q, want %q", got, links)
+	}
+
+	// The exported links import as the same servers
+	if err := os.WriteFile(filename, []byte(out.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reimported, err := ReadServersFile(filename, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ReadServersFile() of the export error = %v", err)
+	}
+	if !reflect.DeepEqual(reimported, servers) {
+		t.Errorf("reimported servers = %+v, want %+v", reimported, servers)
+	}
+}
+
+func TestAccessLink(t *testing.T) {
+	server := models.Server{FullAccessLink: "ss://user:pass@198.51.100.1:8388", Fragment: "a b#c"}
+	if got, want := AccessLink(server), "ss://user:pass@198.51.100.1:8388#a%20b%23c"; got != want {
+		t.Errorf("AccessLink() = %q, want %q", got, want)
+	}
+	server.Fragment = ""
+	if got := AccessLink(server); got != server.FullAccessLink {
+		t.Errorf("AccessLink() without fragment = %q, want %q", got, server.FullAccessLink)
+	}
+}
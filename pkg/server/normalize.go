@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strings"
+
+	"connectivity-tester/pkg/connectivity"
+)
+
+// NormalizedLink describes an access link as it's parsed on import
+type NormalizedLink struct {
+	// Link is the canonical access link, without its fragment
+	Link       string
+	Scheme     string
+	DomainName string
+	Port       string
+	Fragment   string
+	Params     map[string]string
+	// IPs are the addresses the host resolved to
+	IPs []string
+	// ResolvedLinks are the access links with the host replaced by each IP,
+	// as stored by a preresolved import
+	ResolvedLinks []string
+}
+
+// NormalizeLink parses and resolves an access link like on import, and checks
+// that a dialer can be built from it. It doesn't connect to the server.
+func NormalizeLink(accessKey string) (*NormalizedLink, error) {
+	link, fragment, urls, err := parseLink(strings.TrimSpace(accessKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := connectivity.ValidateTransport(link); err != nil {
+		return nil, err
+	}
+
+	normalized := &NormalizedLink{
+		Link:     link,
+		Fragment: fragment,
+	}
+	for _, t := range urls.TransportJSON {
+		normalized.Scheme = t.Scheme
+		normalized.DomainName = t.Host
+		normalized.Port = t.Port
+		normalized.Params = t.Params
+		normalized.IPs = append(normalized.IPs, t.IP)
+		normalized.ResolvedLinks = append(normalized.ResolvedLinks, t.ResolvedAccessLink)
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLink(t *testing.T) {
+	origLookup := lookupIP
+	t.Cleanup(func() { lookupIP = origLookup })
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "ss.example.com" {
+			t.Errorf("resolved %s, want ss.example.com", host)
+		}
+		return []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+
+	tests := []struct {
+		name string
+		link string
+		want NormalizedLink
+	}{
+		{
+			name: "domain link",
+			link: "  ss://chacha20-ietf-poly1305:secret@ss.example.com:8388/?prefix=%16%03%01#My%20Server\n",
+			want: NormalizedLink{
+				Link:       "ss://chacha20-ietf-poly1305:secret@ss.example.com:8388/?prefix=%16%03%01",
+				Scheme:     "ss",
+				DomainName: "ss.example.com",
+				Port:       "8388",
+				Fragment:   "My Server",
+				Params:     map[string]string{"prefix": "%16%03%01"},
+				IPs:        []string{"203.0.113.1", "2001:db8::1"},
+				ResolvedLinks: []string{
+					"ss://chacha20-ietf-poly1305:secret@203.0.113.1:8388/?prefix=%16%03%01",
+					"ss://chacha20-ietf-poly1305:secret@[2001:db8::1]:8388/?prefix=%16%03%01",
+				},
+			},
+		},
+		{
+			name: "IP link",
+			link: "ss://chacha20-ietf-poly1305:secret@192.0.2.1:443",
+			want: NormalizedLink{
+				Link:          "ss://chacha20-ietf-poly1305:secret@192.0.2.1:443",
+				Scheme:        "ss",
+				Port:          "443",
+				Params:        map[string]string{},
+				IPs:           []string{"192.0.2.1"},
+				ResolvedLinks: []string{"ss://chacha20-ietf-poly1305:secret@192.0.2.1:443"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeLink(tt.link)
+			if err != nil {
+				t.Fatalf("NormalizeLink() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("NormalizeLink() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	// A link no dialer can be built from is rejected
+	if _, err := NormalizeLink("carrier-pigeon://192.0.2.1:443"); err == nil {
+		t.Errorf("NormalizeLink() expected an error for an unsupported scheme")
+	}
+}
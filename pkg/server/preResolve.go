@@ -6,8 +6,13 @@ import (
 	"net/netip"
 	"net/url"
 	"strings"
+
+	"connectivity-tester/pkg/connectivity"
 )
 
+// lookupIP resolves hostnames, it's replaced in tests
+var lookupIP = net.LookupIP
+
 // resolvedURLPart represents a resolved URL part.
 // each part can have multiple resolved URLs resulting from resolution
 // of the hostname to different IP addresses.
@@ -28,6 +33,18 @@ type transportJSON struct {
 	ResolvedAccessLink string            `json:"resolved_access_link,omitempty"`
 }
 
+// redacted returns t without the credentials of its access link, as it's
+// stored, see connectivity.RedactTransport. The user info is the one left in
+// the redacted link, it's dropped if the link has none.
+func (t transportJSON) redacted() transportJSON {
+	t.ResolvedAccessLink = connectivity.RedactTransport(t.ResolvedAccessLink)
+	t.UserInfo = ""
+	if u, err := url.Parse(t.ResolvedAccessLink); err == nil && u.User != nil {
+		t.UserInfo = u.User.String()
+	}
+	return t
+}
+
 // resolveParts resolves the hostname in each part of the transport config
 // to IP addresses and returns a list of resolved URL parts.
 func resolveURL(transport string) (*resolvedURLs, error) {
@@ -37,7 +54,7 @@ func resolveURL(transport string) (*resolvedURLs, error) {
 		return nil, err
 	}
 
-	slog.Debug("Parsing transport config", "url", transport)
+	slog.Debug("Parsing transport config", "url", connectivity.RedactTransport(transport))
 	ip := net.ParseIP(u.Hostname())
 	if ip != nil {
 		// hostname is an IP address
@@ -45,7 +62,7 @@ func resolveURL(transport string) (*resolvedURLs, error) {
 	} else {
 		// hostname is a domain name, try to resolve it
 		var accessLinks []*url.URL
-		ips, err := net.LookupIP(u.Hostname())
+		ips, err := lookupIP(u.Hostname())
 		if err != nil {
 			slog.Error("Failed to resolve hostname", "hostname", u.Hostname(), "error", err)
 			return nil, err
@@ -3,87 +3,313 @@ package server
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"connectivity-tester/pkg/config"
+	"connectivity-tester/pkg/connectivity"
 	"connectivity-tester/pkg/database"
 	"connectivity-tester/pkg/ipinfo"
 	"connectivity-tester/pkg/models"
 )
 
-func AddServersFromFile(db *database.DB, filename string, serversName string, preresolve bool) error {
-	file, err := os.Open(filename)
+// DedupeByDomain collapses servers sharing a domain, port and user info into one server
+const DedupeByDomain = "domain"
+
+// defaultLookupConcurrency bounds the concurrent IP info lookups if no
+// limit is set
+const defaultLookupConcurrency = 8
+
+// IP info lookups and dynamic key fetches, they're replaced in tests
+var (
+	getIPInfo      = ipinfo.GetIPInfo
+	getIPInfoBatch = ipinfo.GetIPInfoBatch
+	fetchSSConfig  = config.FetchSSConfig
+)
+
+// ImportOptions controls how access keys are turned into servers on import
+type ImportOptions struct {
+	// Name is set as the name of all imported servers if not empty
+	Name string
+	// Preresolve replaces the domain in access links with the resolved IPs
+	Preresolve bool
+	// DedupeBy collapses servers that are the same endpoint. The only
+	// supported value is DedupeByDomain, empty disables deduplication.
+	DedupeBy string
+	// AllowPrivate imports servers with private, loopback, link-local or
+	// multicast IPs, which are skipped otherwise
+	AllowPrivate bool
+	// LookupConcurrency bounds the concurrent IP info lookups of the
+	// servers, defaultLookupConcurrency if not positive
+	LookupConcurrency int
+}
+
+func (opts ImportOptions) validate() error {
+	if opts.DedupeBy != "" && opts.DedupeBy != DedupeByDomain {
+		return fmt.Errorf("unsupported dedupe mode: %s", opts.DedupeBy)
+	}
+	return nil
+}
+
+func AddServersFromFile(db *database.DB, filename string, opts ImportOptions) error {
+	servers, err := ReadServersFile(filename, opts)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		accessKey := scanner.Text()
-		servers, err := parseAccessKey(accessKey, preresolve)
+	annotateServers(servers, opts.LookupConcurrency)
+
+	for _, server := range servers {
+		slog.Debug("Adding server", "server", server)
+
+		err = db.UpsertServer(context.Background(), &server)
+		if err != nil {
+			slog.Error("Error upserting server", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", err)
+		} else {
+			slog.Debug("Server upserted successfully", "accessLink", connectivity.RedactTransport(server.FullAccessLink))
+		}
+	}
+
+	return nil
+}
+
+// RefreshServersGeo looks up the geo and AS info of imported servers again
+// and stores it. Only servers in the named groups are refreshed if names is
+// not empty, and only servers not refreshed within olderThan if it's not zero.
+// At most concurrency IPs are looked up at a time.
+func RefreshServersGeo(db *database.DB, names []string, olderThan time.Duration, concurrency int) error {
+	var since time.Time
+	if olderThan > 0 {
+		since = time.Now().Add(-olderThan)
+	}
+
+	servers, err := db.GetServersForGeoRefresh(context.Background(), names, since)
+	if err != nil {
+		return err
+	}
+	slog.Info("Refreshing server geo info", "servers", len(servers))
+
+	annotateServers(servers, concurrency)
+
+	var failed int
+	for _, server := range servers {
+		if err := db.UpdateServerGeo(context.Background(), &server); err != nil {
+			slog.Error("Error updating server geo info", "id", server.ID, "ip", server.IP, "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to update %d of %d servers", failed, len(servers))
+	}
+
+	return nil
+}
+
+// annotateServers adds the location and AS info of each server's IP.
+// IPs are looked up in batches, falling back to single lookups, at most
+// concurrency at a time, for IPs the batch lookup failed for.
+func annotateServers(servers []models.Server, concurrency int) {
+	var ips []string
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		if server.IP != "" && !seen[server.IP] {
+			seen[server.IP] = true
+			ips = append(ips, server.IP)
+		}
+	}
+
+	batch, err := getIPInfoBatch(ips)
+	if err != nil || batch == nil {
 		if err != nil {
-			slog.Error("Error parsing access key", "accessKey", accessKey, "error", err)
+			slog.Warn("Batch IP info lookup failed, falling back to single lookups", "error", err)
+		}
+		batch = map[string]ipinfo.IPInfoResponse{}
+	}
+
+	var missing []string
+	for _, ip := range ips {
+		if _, ok := batch[ip]; !ok {
+			missing = append(missing, ip)
+		}
+	}
+	lookupIPInfos(batch, missing, concurrency)
+
+	for i := range servers {
+		server := &servers[i]
+		ipInfo, ok := batch[server.IP]
+		if !ok {
+			// The lookup failed and was logged
 			continue
 		}
 
-		for _, server := range servers {
-			slog.Debug("Adding server", "server", server)
+		slog.Debug("IP info retrieved", "ip", server.IP, "ipInfo", ipInfo)
+		ipinfo.UpdateServerWithIPInfo(server, ipInfo)
+		slog.Debug("Server updated with IP info", "server", server)
+	}
+}
 
-			// set server name field
-			if serversName != "" {
-				server.Name = serversName
-			}
+// lookupIPInfos looks up ips one at a time with up to concurrency lookups
+// in flight and adds the results to infos. Failed lookups are logged and
+// left out.
+func lookupIPInfos(infos map[string]ipinfo.IPInfoResponse, ips []string, concurrency int) {
+	if concurrency <= 0 {
+		concurrency = defaultLookupConcurrency
+	}
 
-			// Get IP info
-			ipInfo, err := ipinfo.GetIPInfo(server.IP)
-			if err != nil {
-				slog.Warn("Error getting IP info", "ip", server.IP, "error", err)
-			} else {
-				slog.Debug("IP info retrieved", "ip", server.IP, "ipInfo", ipInfo)
-				ipinfo.UpdateServerWithIPInfo(&server, ipInfo)
-				slog.Debug("Server updated with IP info", "server", server)
-			}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-			err = db.UpsertServer(context.Background(), &server)
+			ipInfo, err := getIPInfo(ip)
 			if err != nil {
-				slog.Error("Error upserting server", "accessKey", accessKey, "error", err)
-			} else {
-				slog.Debug("Server upserted successfully", "accessKey", accessKey)
+				slog.Warn("Error getting IP info", "ip", ip, "error", err)
+				return
 			}
+			mu.Lock()
+			infos[ip] = ipInfo
+			mu.Unlock()
+		}(ip)
+	}
+	wg.Wait()
+}
+
+// ReadServersFile parses the access keys in a file, one per line, into
+// servers without storing them
+func ReadServersFile(filename string, opts ImportOptions) ([]models.Server, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	return readServers(file, opts)
+}
+
+// readServers parses the access keys in r, one per line, into servers.
+// Blank lines and lines starting with # are skipped. Access keys that fail
+// to parse are logged and skipped.
+func readServers(r io.Reader, opts ImportOptions) ([]models.Server, error) {
+	var accessKeys []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		accessKeys = append(accessKeys, line)
 	}
 
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading file: %v", err)
+		return nil, fmt.Errorf("error reading file: %v", err)
 	}
 
-	return nil
+	return parseServers(accessKeys, opts), nil
 }
 
-func parseAccessKey(accessKey string, preresolve bool) ([]models.Server, error) {
+// parseServers parses access keys into servers. Access keys that fail to
+// parse are logged and skipped, as are servers with a non-public IP unless
+// opts.AllowPrivate is set.
+func parseServers(accessKeys []string, opts ImportOptions) []models.Server {
 	var servers []models.Server
-	parsedURL, err := url.Parse(accessKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse access key: %v", err)
-	}
+	seen := make(map[string]bool)
 
-	fragment := parsedURL.Fragment
-	parsedURL.Fragment = ""
-	fullURLWithoutFragment := parsedURL.String()
+	for _, accessKey := range accessKeys {
+		if config.IsDynamicKey(accessKey) {
+			link, err := resolveDynamicKey(accessKey)
+			if err != nil {
+				slog.Error("Error fetching dynamic access key", "accessKey", connectivity.RedactTransport(accessKey), "error", err)
+				continue
+			}
+			accessKey = link
+		}
 
-	fmt.Printf("Fragment:%s\n", fragment)
-	fmt.Printf("FullAccessLink:%s\n", fullURLWithoutFragment)
+		// When deduplicating by domain the canonical server keeps the
+		// domain in its access link, so don't preresolve it
+		preresolve := opts.Preresolve && opts.DedupeBy != DedupeByDomain
 
-	// Always resolve URL to get IP addresses
-	urls, err := resolveURL(fullURLWithoutFragment)
+		parsed, err := parseAccessKey(accessKey, preresolve)
+		if err != nil {
+			slog.Error("Error parsing access key", "accessKey", connectivity.RedactTransport(accessKey), "error", err)
+			continue
+		}
+
+		for _, server := range parsed {
+			if reason := bogonReason(server.IP); reason != "" && !opts.AllowPrivate {
+				slog.Warn("Skipping server with a non-public IP",
+					"ip", server.IP,
+					"reason", reason,
+					"accessKey", connectivity.RedactTransport(accessKey))
+				continue
+			}
+			// set server name field
+			if opts.Name != "" {
+				server.Name = opts.Name
+			}
+
+			if opts.DedupeBy == DedupeByDomain && server.DomainName != "" {
+				key := domainKey(server)
+				if seen[key] {
+					slog.Debug("Skipping duplicate server", "key", key, "ip", server.IP)
+					continue
+				}
+				seen[key] = true
+			}
+
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+// resolveDynamicKey returns the server key of a dynamic access key such as
+// an Outline ssconf:// key. The fragment naming the dynamic key is kept if
+// the server key has none.
+func resolveDynamicKey(accessKey string) (string, error) {
+	link, err := fetchSSConfig(accessKey)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	_, fragment, _ := strings.Cut(accessKey, "#")
+	if fragment != "" && !strings.Contains(link, "#") {
+		link += "#" + fragment
+	}
+	slog.Debug("Fetched dynamic access key",
+		"accessKey", connectivity.RedactTransport(accessKey),
+		"link", connectivity.RedactTransport(link))
+	return link, nil
+}
 
-	err = addTransportInfo(urls)
+// domainKey identifies the logical endpoint of a domain based server in its
+// group regardless of the IP its domain resolved to. The same endpoint in
+// another group is another server.
+func domainKey(server models.Server) string {
+	return strings.Join([]string{server.Name, server.Scheme, server.UserInfo, server.DomainName, server.Port}, "|")
+}
+
+func parseAccessKey(accessKey string, preresolve bool) ([]models.Server, error) {
+	var servers []models.Server
+
+	link, fragment, urls, err := parseLink(accessKey)
 	if err != nil {
 		return nil, err
 	}
@@ -96,20 +322,71 @@ func parseAccessKey(accessKey string, preresolve bool) ([]models.Server, error)
 		server.DomainName = t.Host
 		server.UserInfo = t.UserInfo
 		server.Scheme = t.Scheme
-		// If preresolve is false, use the original domain name in the access link
+		// Keep the parsed parts and params for later analysis, without the
+		// credentials
+		server.TransportJSON, err = json.Marshal(t.redacted())
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode transport info: %v", err)
+		}
+		// If preresolve is false, keep the original access link with its
+		// domain, credentials, path and params
 		if !preresolve && server.DomainName != "" {
-			// Reconstruct the URL with the original domain
-			u := &url.URL{
-				Scheme: server.Scheme,
-				User:   url.UserPassword(server.UserInfo, ""), // Note: password is empty as it's not stored
-				Host:   server.DomainName + ":" + server.Port,
-			}
-			server.FullAccessLink = u.String()
+			server.FullAccessLink = link
 		} else {
 			server.FullAccessLink = t.ResolvedAccessLink
 		}
+		if err := checkLinkHost(server); err != nil {
+			return nil, err
+		}
 		server.Fragment = fragment
+		server.Tags = ParseTags(fragment)
+		// An empty map clears the tags of a server imported again without
+		// them, nil would keep the stored ones
+		if server.Tags == nil {
+			server.Tags = map[string]string{}
+		}
+		if server.Tags["expected"] == models.ExpectReachable {
+			server.Expected = models.ExpectReachable
+		}
 		servers = append(servers, server)
 	}
 	return servers, nil
 }
+
+// parseLink parses an access key, resolves its host and adds the transport
+// info of each resolved access link. It returns the access link without its
+// fragment, and the fragment.
+func parseLink(accessKey string) (link, fragment string, urls *resolvedURLs, err error) {
+	// A bare host:port is a plain target that is dialed without a tunnel protocol
+	if !strings.Contains(accessKey, "://") {
+		if _, _, err := net.SplitHostPort(accessKey); err == nil {
+			accessKey = connectivity.DirectScheme + "://" + accessKey
+		}
+	}
+
+	parsedURL, err := url.Parse(accessKey)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to parse access key: %v", err)
+	}
+
+	fragment = parsedURL.Fragment
+	parsedURL.Fragment = ""
+	link = parsedURL.String()
+
+	slog.Debug("Parsed access key",
+		"fragment", fragment,
+		"fullAccessLink", connectivity.RedactTransport(link))
+
+	// Always resolve URL to get IP addresses
+	urls, err = resolveURL(link)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	err = addTransportInfo(urls)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return link, fragment, urls, nil
+}
@@ -1,10 +1,21 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/ipinfo"
+	"connectivity-tester/pkg/models"
 )
 
 func TestResolveURL(t *testing.T) {
@@ -126,6 +137,10 @@ func TestAddTransportInfo(t *testing.T) {
 				t.Errorf("addTransportInfo() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			// The resolved links are checked by TestAddTransportInfoResolvedLinks
+			for i := range tt.input.TransportJSON {
+				tt.input.TransportJSON[i].ResolvedAccessLink = ""
+			}
 			if !reflect.DeepEqual(tt.input.TransportJSON, tt.want) {
 				t.Errorf("addTransportInfo() got = %v, want %v", tt.input.TransportJSON, tt.want)
 			}
@@ -133,8 +148,376 @@ func TestAddTransportInfo(t *testing.T) {
 	}
 }
 
+func TestAddTransportInfoResolvedLinks(t *testing.T) {
+	// Each resolved URL keeps its own link, so the server of each IP can be
+	// measured with its IP as the host
+	input := &resolvedURLs{
+		Host: "example.com",
+		URLs: []*url.URL{
+			mustParseURL("ss://user:pass@93.184.216.34:8388?key1=value1"),
+			mustParseURL("ss://user:pass@[2001:db8::1]:8388"),
+		},
+	}
+	if err := addTransportInfo(input); err != nil {
+		t.Fatalf("addTransportInfo() error = %v", err)
+	}
+	var got []string
+	for _, transport := range input.TransportJSON {
+		got = append(got, transport.ResolvedAccessLink)
+	}
+	want := []string{"ss://user:pass@93.184.216.34:8388?key1=value1", "ss://user:pass@[2001:db8::1]:8388"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("addTransportInfo() resolved links = %v, want %v", got, want)
+	}
+}
+
+func TestParseAccessKeyDirectTarget(t *testing.T) {
+	servers, err := parseAccessKey("1.2.3.4:443", true)
+	if err != nil {
+		t.Fatalf("parseAccessKey() error = %v", err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("parseAccessKey() returned %d servers, want 1", len(servers))
+	}
+
+	want := models.Server{
+		IP:             "1.2.3.4",
+		Port:           "443",
+		IPType:         "v4",
+		Scheme:         connectivity.DirectScheme,
+		FullAccessLink: "direct://1.2.3.4:443",
+		Tags:           map[string]string{},
+		TransportJSON:  json.RawMessage(`{"scheme":"direct","ip":"1.2.3.4","ip_version":"v4","port":"443","resolved_access_link":"direct://1.2.3.4:443"}`),
+	}
+	if !reflect.DeepEqual(servers[0], want) {
+		t.Errorf("parseAccessKey() got = %+v, want %+v", servers[0], want)
+	}
+}
+
+func TestParseAccessKeyTransportJSON(t *testing.T) {
+	servers, err := parseAccessKey("ss://user:pass@1.2.3.4:8388/?outline=1&prefix=%16%03%01#My%20Server", true)
+	if err != nil {
+		t.Fatalf("parseAccessKey() error = %v", err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("parseAccessKey() returned %d servers, want 1", len(servers))
+	}
+
+	var got transportJSON
+	if err := json.Unmarshal(servers[0].TransportJSON, &got); err != nil {
+		t.Fatalf("TransportJSON is not valid: %v", err)
+	}
+	want := map[string]string{"outline": "1", "prefix": "%16%03%01"}
+	if !reflect.DeepEqual(got.Params, want) {
+		t.Errorf("TransportJSON params = %v, want %v", got.Params, want)
+	}
+	if got.IP != "1.2.3.4" || got.Port != "8388" || got.Scheme != "ss" {
+		t.Errorf("TransportJSON = %+v", got)
+	}
+	if got.UserInfo != "user:REDACTED" || strings.Contains(string(servers[0].TransportJSON), "pass") {
+		t.Errorf("TransportJSON = %s, want the password redacted", servers[0].TransportJSON)
+	}
+}
+
+func TestParseAccessKeyKeepsLink(t *testing.T) {
+	origLookup := lookupIP
+	t.Cleanup(func() { lookupIP = origLookup })
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("203.0.113.1")}, nil
+	}
+
+	link := "ss://user:p%40ss@example.com:8388/?outline=1&prefix=%16%03%01"
+	servers, err := parseAccessKey(link+"#My%20Server", false)
+	if err != nil {
+		t.Fatalf("parseAccessKey() error = %v", err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("parseAccessKey() returned %d servers, want 1", len(servers))
+	}
+
+	// The link keeps its credentials and params, only the fragment is split off
+	if servers[0].FullAccessLink != link {
+		t.Errorf("FullAccessLink = %q, want %q", servers[0].FullAccessLink, link)
+	}
+	if servers[0].UserInfo != "user:p%40ss" || servers[0].Fragment != "My Server" {
+		t.Errorf("UserInfo = %q, Fragment = %q", servers[0].UserInfo, servers[0].Fragment)
+	}
+	if servers[0].IP != "203.0.113.1" {
+		t.Errorf("IP = %q, want the resolved address", servers[0].IP)
+	}
+}
+
+func TestReadServersDedupeByDomain(t *testing.T) {
+	origLookup := lookupIP
+	t.Cleanup(func() { lookupIP = origLookup })
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")}, nil
+	}
+
+	input := strings.Join([]string{
+		"ss://user:pass@example.com:8388",
+		"ss://user:pass@example.com:8388#duplicate",
+		"ss://user:pass@198.51.100.1:8388",
+	}, "\n")
+
+	tests := []struct {
+		name     string
+		opts     ImportOptions
+		wantIPs  []string
+		wantHost string
+	}{
+		{
+			name:     "no dedupe preresolves every address",
+			opts:     ImportOptions{Name: "test", Preresolve: true},
+			wantIPs:  []string{"203.0.113.1", "203.0.113.2", "203.0.113.1", "203.0.113.2", "198.51.100.1"},
+			wantHost: "203.0.113.1:8388",
+		},
+		{
+			name:     "dedupe by domain keeps one canonical server",
+			opts:     ImportOptions{Name: "test", Preresolve: true, DedupeBy: DedupeByDomain},
+			wantIPs:  []string{"203.0.113.1", "198.51.100.1"},
+			wantHost: "example.com:8388",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers, err := readServers(strings.NewReader(input), tt.opts)
+			if err != nil {
+				t.Fatalf("readServers() error = %v", err)
+			}
+
+			var gotIPs []string
+			for _, server := range servers {
+				gotIPs = append(gotIPs, server.IP)
+				if server.Name != tt.opts.Name {
+					t.Errorf("server %s has name %q, want %q", server.IP, server.Name, tt.opts.Name)
+				}
+			}
+			if !reflect.DeepEqual(gotIPs, tt.wantIPs) {
+				t.Errorf("readServers() IPs = %v, want %v", gotIPs, tt.wantIPs)
+			}
+			link := mustParseURL(servers[0].FullAccessLink)
+			if link.Host != tt.wantHost {
+				t.Errorf("readServers() link host = %q, want %q", link.Host, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestReadServersFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links.txt")
+	links := "ss://user:pass@192.0.2.1:8388\nnot a link\n192.0.2.2:443\n"
+	if err := os.WriteFile(filename, []byte(links), 0o600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+
+	servers, err := ReadServersFile(filename, ImportOptions{Preresolve: true})
+	if err != nil {
+		t.Fatalf("ReadServersFile() error = %v", err)
+	}
+
+	var got []string
+	for _, server := range servers {
+		got = append(got, server.FullAccessLink)
+	}
+	want := []string{"ss://user:pass@192.0.2.1:8388", "direct://192.0.2.2:443"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadServersFile() links = %v, want %v", got, want)
+	}
+
+	if _, err := ReadServersFile(filename, ImportOptions{DedupeBy: "ip"}); err == nil {
+		t.Errorf("ReadServersFile() expected an error for an unsupported dedupe mode")
+	}
+}
+
+func TestReadServersFileComments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links.txt")
+	links := strings.Join([]string{
+		"# curated servers",
+		"",
+		"  ss://user:pass@192.0.2.1:8388  ",
+		"   ",
+		"  # ss://user:pass@192.0.2.9:8388",
+		"192.0.2.2:443",
+	}, "\n")
+	if err := os.WriteFile(filename, []byte(links), 0o600); err != nil {
+		t.Fatalf("failed to write servers file: %v", err)
+	}
+
+	servers, err := ReadServersFile(filename, ImportOptions{Preresolve: true})
+	if err != nil {
+		t.Fatalf("ReadServersFile() error = %v", err)
+	}
+
+	var got []string
+	for _, server := range servers {
+		got = append(got, server.FullAccessLink)
+	}
+	want := []string{"ss://user:pass@192.0.2.1:8388", "direct://192.0.2.2:443"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadServersFile() links = %v, want %v", got, want)
+	}
+}
+
+func TestAnnotateServers(t *testing.T) {
+	origLookup, origBatch := getIPInfo, getIPInfoBatch
+	t.Cleanup(func() { getIPInfo, getIPInfoBatch = origLookup, origBatch })
+
+	var batchIPs, singleIPs []string
+	getIPInfoBatch = func(ips []string) (map[string]ipinfo.IPInfoResponse, error) {
+		batchIPs = ips
+		// 192.0.2.2 is missing from the batch result
+		return map[string]ipinfo.IPInfoResponse{
+			"192.0.2.1": {IP: "192.0.2.1", Org: "AS64500 New Networks", City: "Berlin", Region: "Berlin", Country: "DE"},
+		}, nil
+	}
+	getIPInfo = func(ip string) (ipinfo.IPInfoResponse, error) {
+		singleIPs = append(singleIPs, ip)
+		return ipinfo.IPInfoResponse{IP: ip, Org: "AS64501 Other Networks", City: "Paris", Region: "Ile-de-France", Country: "FR"}, nil
+	}
+
+	servers := []models.Server{
+		{ID: 1, IP: "192.0.2.1", ASNumber: "64499", ASOrg: "Old Networks", City: "Austin", Country: "US"},
+		{ID: 2, IP: "192.0.2.2", ASNumber: "64499", ASOrg: "Old Networks", City: "Austin", Country: "US"},
+		{ID: 3, IP: "192.0.2.1", Port: "8388"},
+	}
+	annotateServers(servers, 1)
+
+	if !reflect.DeepEqual(batchIPs, []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Errorf("batch lookup got IPs %v, want each IP once", batchIPs)
+	}
+	if !reflect.DeepEqual(singleIPs, []string{"192.0.2.2"}) {
+		t.Errorf("single lookups got IPs %v, want only the IP missing from the batch", singleIPs)
+	}
+
+	want := []struct{ asn, org, city, country string }{
+		{"64500", "New Networks", "Berlin", "DE"},
+		{"64501", "Other Networks", "Paris", "FR"},
+		{"64500", "New Networks", "Berlin", "DE"},
+	}
+	for i, w := range want {
+		s := servers[i]
+		if s.ASNumber != w.asn || s.ASOrg != w.org || s.City != w.city || s.Country != w.country {
+			t.Errorf("server %d = {%s %s %s %s}, want %v", s.ID, s.ASNumber, s.ASOrg, s.City, s.Country, w)
+		}
+		if s.GeoUpdatedAt.IsZero() {
+			t.Errorf("server %d GeoUpdatedAt was not set", s.ID)
+		}
+	}
+}
+
+func TestAnnotateServersConcurrency(t *testing.T) {
+	origLookup, origBatch := getIPInfo, getIPInfoBatch
+	t.Cleanup(func() { getIPInfo, getIPInfoBatch = origLookup, origBatch })
+
+	getIPInfoBatch = func(ips []string) (map[string]ipinfo.IPInfoResponse, error) {
+		return nil, fmt.Errorf("batch lookup unavailable")
+	}
+	var inFlight, maxInFlight atomic.Int32
+	getIPInfo = func(ip string) (ipinfo.IPInfoResponse, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		if ip == "192.0.2.13" {
+			return ipinfo.IPInfoResponse{}, fmt.Errorf("rate limited")
+		}
+		return ipinfo.IPInfoResponse{IP: ip, Org: "AS64500 Networks", Country: "DE"}, nil
+	}
+
+	var servers []models.Server
+	for i := 0; i < 20; i++ {
+		servers = append(servers, models.Server{ID: int64(i), IP: fmt.Sprintf("192.0.2.%d", i)})
+	}
+	const limit = 3
+	annotateServers(servers, limit)
+
+	if max := maxInFlight.Load(); max > limit {
+		t.Errorf("%d lookups ran concurrently, want at most %d", max, limit)
+	}
+	for _, s := range servers {
+		// A failed lookup leaves only its server unannotated
+		if annotated := s.ASNumber == "64500"; annotated == (s.IP == "192.0.2.13") {
+			t.Errorf("server %s annotated = %t", s.IP, annotated)
+		}
+	}
+}
+
 // Helper function to parse URL without error checking
 func mustParseURL(s string) *url.URL {
 	u, _ := url.Parse(s)
 	return u
 }
+
+func TestReadServersSkipsPrivateIPs(t *testing.T) {
+	input := strings.Join([]string{
+		"ss://user:pass@10.1.2.3:8388",
+		"127.0.0.1:443",
+		"ss://user:pass@[fe80::1]:8388",
+		"ss://user:pass@100.64.0.1:8388",
+		"ss://user:pass@198.51.100.1:8388",
+	}, "\n")
+
+	servers, err := readServers(strings.NewReader(input), ImportOptions{Preresolve: true})
+	if err != nil {
+		t.Fatalf("readServers() error = %v", err)
+	}
+	if len(servers) != 1 || servers[0].IP != "198.51.100.1" {
+		t.Errorf("readServers() = %+v, want only the public server", servers)
+	}
+
+	servers, err = readServers(strings.NewReader(input), ImportOptions{Preresolve: true, AllowPrivate: true})
+	if err != nil {
+		t.Fatalf("readServers() error = %v", err)
+	}
+	if len(servers) != 5 {
+		t.Errorf("readServers() with AllowPrivate = %d servers, want 5", len(servers))
+	}
+}
+
+func TestReadServersDynamicKey(t *testing.T) {
+	origFetch := fetchSSConfig
+	t.Cleanup(func() { fetchSSConfig = origFetch })
+	var fetched []string
+	fetchSSConfig = func(accessKey string) (string, error) {
+		fetched = append(fetched, accessKey)
+		if strings.Contains(accessKey, "expired") {
+			return "", fmt.Errorf("dynamic key error: This key has expired")
+		}
+		return "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpzZWNyZXQ@192.0.2.10:443", nil
+	}
+
+	keys := []string{
+		"ssconf://keys.example.com/abc.json#My%20Server",
+		"ssconf://keys.example.com/expired.json",
+	}
+	filename := filepath.Join(t.TempDir(), "servers.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join(keys, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := ReadServersFile(filename, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ReadServersFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(fetched, keys) {
+		t.Errorf("fetched %q, want %q", fetched, keys)
+	}
+	// The expired key is skipped
+	if len(servers) != 1 {
+		t.Fatalf("imported %d servers, want 1", len(servers))
+	}
+	server := servers[0]
+	if server.IP != "192.0.2.10" || server.Port != "443" || server.Scheme != "ss" {
+		t.Errorf("imported server %s:%s (%s), want the fetched ss:// key", server.IP, server.Port, server.Scheme)
+	}
+	if server.Fragment != "My Server" {
+		t.Errorf("Fragment = %q, want the fragment of the dynamic key", server.Fragment)
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"strings"
+)
+
+// ParseTags parses the key=value tags of an access link fragment, separated
+// by semicolons, e.g. name=foo;region=us;tier=premium. Parts without a key
+// are skipped, so fragments that are only a name like MyServer-US have no
+// tags and nil is returned.
+func ParseTags(fragment string) map[string]string {
+	var tags map[string]string
+	for _, part := range strings.Split(fragment, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = strings.TrimSpace(value)
+	}
+	return tags
+}
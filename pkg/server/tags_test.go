@@ -0,0 +1,37 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		fragment string
+		want     map[string]string
+	}{
+		{"name=foo;region=us;tier=premium", map[string]string{"name": "foo", "region": "us", "tier": "premium"}},
+		{" tier = premium ;MyServer;=x", map[string]string{"tier": "premium"}},
+		{"MyServer-US", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseTags(tt.fragment); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTags(%q) = %v, want %v", tt.fragment, got, tt.want)
+		}
+	}
+}
+
+func TestParseAccessKeyTags(t *testing.T) {
+	servers, err := parseAccessKey("ss://chacha20-ietf-poly1305:secret@192.0.2.1:443#name=foo;tier=premium", false)
+	if err != nil {
+		t.Fatalf("parseAccessKey() error = %v", err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("parseAccessKey() = %+v, want one server", servers)
+	}
+	want := map[string]string{"name": "foo", "tier": "premium"}
+	if !reflect.DeepEqual(servers[0].Tags, want) {
+		t.Errorf("Tags = %v, want %v", servers[0].Tags, want)
+	}
+}
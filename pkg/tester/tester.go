@@ -13,12 +13,46 @@ import (
 	"github.com/spf13/viper"
 )
 
-const maxWorkers = 100 // Adjust this based on your needs and system capabilities
+// defaultWorkers is the number of servers tested concurrently when
+// connectivity.test_workers is not configured
+const defaultWorkers = 10
+
+// defaultMaxFailures is the number of consecutive failed test runs after
+// which a server is removed when connectivity.max_failures is not configured
+const defaultMaxFailures = 3
+
+// Actions on a server whose tests failed max failures runs in a row, set with
+// tester.on_failure
+const (
+	// OnFailureDelete removes the server
+	OnFailureDelete = "delete"
+	// OnFailureMark keeps the server but marks it inactive
+	OnFailureMark = "mark"
+)
+
+// testConnectivity runs connectivity tests, it's replaced in tests
+var testConnectivity = connectivity.TestConnectivity
+
+// serverStore is the part of the database the tester writes results to
+type serverStore interface {
+	UpdateServerTestResults(ctx context.Context, server *models.Server) error
+	RecordServerFailure(ctx context.Context, server *models.Server) (int, error)
+	RemoveServer(ctx context.Context, server *models.Server) error
+	MarkServerInactive(ctx context.Context, server *models.Server) error
+}
 
 func TestServers(db *database.DB, retestTCP, retestUDP bool) error {
 	var servers []models.Server
 	var err error
 
+	onFailure := OnFailureDelete
+	if viper.IsSet("tester.on_failure") {
+		onFailure = viper.GetString("tester.on_failure")
+	}
+	if onFailure != OnFailureDelete && onFailure != OnFailureMark {
+		return fmt.Errorf("unsupported tester.on_failure %q, expected %s or %s", onFailure, OnFailureDelete, OnFailureMark)
+	}
+
 	if retestTCP || retestUDP {
 		servers, err = db.GetServersForRetest(context.Background(), retestTCP, retestUDP)
 	} else {
@@ -29,14 +63,34 @@ func TestServers(db *database.DB, retestTCP, retestUDP bool) error {
 		return fmt.Errorf("failed to get servers: %v", err)
 	}
 
+	workers := viper.GetInt("connectivity.test_workers")
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	// Servers are never removed if it is not positive
+	maxFailures := defaultMaxFailures
+	if viper.IsSet("connectivity.max_failures") {
+		maxFailures = viper.GetInt("connectivity.max_failures")
+	}
+
+	runTests(servers, workers, func(server *models.Server) error {
+		return testServer(db, server, retestTCP, retestUDP, maxFailures, onFailure)
+	})
+
+	return nil
+}
+
+// runTests tests the servers with up to workers tests running concurrently
+func runTests(servers []models.Server, workers int, test func(server *models.Server) error) {
 	jobs := make(chan models.Server, len(servers))
 	results := make(chan models.Server, len(servers))
 
 	// Start worker pool
 	var wg sync.WaitGroup
-	for i := 0; i < maxWorkers; i++ {
+	for i := 0; i < min(workers, len(servers)); i++ {
 		wg.Add(1)
-		go worker(db, &wg, jobs, results, retestTCP, retestUDP)
+		go worker(&wg, jobs, results, test)
 	}
 
 	// Send jobs to workers
@@ -53,58 +107,77 @@ func TestServers(db *database.DB, retestTCP, retestUDP bool) error {
 
 	// Collect results
 	for server := range results {
-		slog.Debug("Server tested", "accessLink", server.FullAccessLink)
+		slog.Debug("Server tested", "accessLink", connectivity.RedactTransport(server.FullAccessLink))
 	}
-
-	return nil
 }
 
-func worker(db *database.DB, wg *sync.WaitGroup, jobs <-chan models.Server, results chan<- models.Server, testTCP, testUDP bool) {
+func worker(wg *sync.WaitGroup, jobs <-chan models.Server, results chan<- models.Server, test func(server *models.Server) error) {
 	defer wg.Done()
 	for server := range jobs {
-		err := testServer(db, &server, testTCP, testUDP)
+		err := test(&server)
 		if err != nil {
-			slog.Error("Error testing server", "accessLink", server.FullAccessLink, "error", err)
+			slog.Error("Error testing server", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", err)
 		}
 		results <- server
 	}
 }
 
-func testServer(db *database.DB, server *models.Server, testTCP, testUDP bool) error {
+// testServer tests a server and stores the results. A server whose tests
+// fail to run, e.g. because of an invalid URL or incompatible scheme, is
+// removed, or marked inactive if onFailure is OnFailureMark, once it failed
+// maxFailures consecutive runs, or never if maxFailures is not positive.
+func testServer(db serverStore, server *models.Server, testTCP, testUDP bool, maxFailures int, onFailure string) error {
 	var testFailed bool
 
 	if testTCP || (!testTCP && !testUDP) {
 		// Test TCP
-		tcpReport, err := connectivity.TestConnectivity(server.FullAccessLink, "tcp", viper.GetString("connectivity.resolver"), viper.GetString("connectivity.domain"))
+		tcpReport, err := testConnectivity(server.FullAccessLink, "tcp", connectivity.SchemeResolver(server.Scheme, "tcp"), connectivity.SchemeDomains(server.Scheme))
 		if err != nil {
-			slog.Error("TCP test error", "accessLink", server.FullAccessLink, "error", err)
+			slog.Error("TCP test error", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", err)
 			testFailed = true
 		} else {
 			connectivity.UpdateResultFromReport(server, tcpReport, "tcp")
-			slog.Debug("TCP test completed", "accessLink", server.FullAccessLink, "error", server.TCPErrorMsg)
+			slog.Debug("TCP test completed", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", server.TCPErrorMsg)
 		}
 	}
 
 	if testUDP || (!testTCP && !testUDP) {
 		// Test UDP
-		udpReport, err := connectivity.TestConnectivity(server.FullAccessLink, "udp", viper.GetString("connectivity.resolver"), viper.GetString("connectivity.domain"))
+		udpReport, err := testConnectivity(server.FullAccessLink, "udp", connectivity.SchemeResolver(server.Scheme, "udp"), connectivity.SchemeDomains(server.Scheme))
 		if err != nil {
-			slog.Error("UDP test error", "accessLink", server.FullAccessLink, "error", err)
+			slog.Error("UDP test error", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", err)
 			testFailed = true
 		} else {
 			connectivity.UpdateResultFromReport(server, udpReport, "udp")
-			slog.Debug("UDP test completed", "accessLink", server.FullAccessLink, "error", server.UDPErrorMsg)
+			slog.Debug("UDP test completed", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "error", server.UDPErrorMsg)
 		}
 	}
 
 	if testFailed {
-		// Remove server from database if any test failed
-		// This could be caused by invalid URL or incompatible scheme
-		err := db.RemoveServer(context.Background(), server)
+		// Record the failure so a transient error doesn't lose the server
+		failures, err := db.RecordServerFailure(context.Background(), server)
+		if err != nil {
+			return fmt.Errorf("failed to record server test failure: %v", err)
+		}
+		if maxFailures <= 0 || failures < maxFailures {
+			slog.Warn("Server test failed", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "failures", failures)
+			return nil
+		}
+
+		if onFailure == OnFailureMark {
+			err = db.MarkServerInactive(context.Background(), server)
+			if err != nil {
+				return fmt.Errorf("failed to mark server inactive after test failure: %v", err)
+			}
+			slog.Info("Server marked inactive due to repeated test failures", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "failures", failures)
+			return nil
+		}
+
+		err = db.RemoveServer(context.Background(), server)
 		if err != nil {
 			return fmt.Errorf("failed to remove server after test failure: %v", err)
 		}
-		slog.Info("Server removed due to test failure", "accessLink", server.FullAccessLink)
+		slog.Info("Server removed due to repeated test failures", "accessLink", connectivity.RedactTransport(server.FullAccessLink), "failures", failures)
 	} else {
 		// Update server in database if tests passed
 		err := db.UpdateServerTestResults(context.Background(), server)
@@ -0,0 +1,157 @@
+package tester
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"connectivity-tester/pkg/connectivity"
+	"connectivity-tester/pkg/models"
+)
+
+func TestRunTestsConcurrently(t *testing.T) {
+	const workers = 3
+	servers := make([]models.Server, 7)
+	for i := range servers {
+		servers[i].ID = int64(i + 1)
+	}
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	tested := make(map[int64]bool)
+	// allBusy is closed once every worker is running a test at the same time
+	allBusy := make(chan struct{})
+
+	runTests(servers, workers, func(server *models.Server) error {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+			if maxInFlight == workers {
+				close(allBusy)
+			}
+		}
+		tested[server.ID] = true
+		mu.Unlock()
+
+		select {
+		case <-allBusy:
+		case <-time.After(time.Second):
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	})
+
+	if maxInFlight != workers {
+		t.Errorf("at most %d servers were tested concurrently, want %d", maxInFlight, workers)
+	}
+	if len(tested) != len(servers) {
+		t.Errorf("tested %d servers, want %d", len(tested), len(servers))
+	}
+}
+
+// fakeStore keeps the failure count of a single server
+type fakeStore struct {
+	failures int
+	removed  bool
+	marked   bool
+	updated  int
+}
+
+func (s *fakeStore) UpdateServerTestResults(ctx context.Context, server *models.Server) error {
+	s.failures = 0
+	s.updated++
+	return nil
+}
+
+func (s *fakeStore) RecordServerFailure(ctx context.Context, server *models.Server) (int, error) {
+	s.failures++
+	return s.failures, nil
+}
+
+func (s *fakeStore) RemoveServer(ctx context.Context, server *models.Server) error {
+	s.removed = true
+	return nil
+}
+
+func (s *fakeStore) MarkServerInactive(ctx context.Context, server *models.Server) error {
+	s.marked = true
+	return nil
+}
+
+func TestTestServerFailures(t *testing.T) {
+	var fail bool
+	origTest := testConnectivity
+	t.Cleanup(func() { testConnectivity = origTest })
+	testConnectivity = func(transportConfig, proto, resolver string, domains []string) (connectivity.ConnectivityReport, error) {
+		if fail {
+			return connectivity.ConnectivityReport{}, errors.New("network is unreachable")
+		}
+		return connectivity.ConnectivityReport{}, nil
+	}
+
+	server := &models.Server{IP: "192.0.2.1", FullAccessLink: "ss://user:pass@192.0.2.1:8388"}
+
+	t.Run("removed after max consecutive failures", func(t *testing.T) {
+		store := &fakeStore{}
+		fail = true
+		for run := 1; run <= 3; run++ {
+			if err := testServer(store, server, false, false, 3, OnFailureDelete); err != nil {
+				t.Fatalf("testServer() error = %v", err)
+			}
+			if wantRemoved := run == 3; store.removed != wantRemoved {
+				t.Errorf("after %d failed runs removed = %v, want %v", run, store.removed, wantRemoved)
+			}
+		}
+	})
+
+	t.Run("marked inactive instead of removed", func(t *testing.T) {
+		store := &fakeStore{}
+		fail = true
+		for run := 1; run <= 3; run++ {
+			if err := testServer(store, server, false, false, 3, OnFailureMark); err != nil {
+				t.Fatalf("testServer() error = %v", err)
+			}
+			if wantMarked := run == 3; store.marked != wantMarked {
+				t.Errorf("after %d failed runs marked = %v, want %v", run, store.marked, wantMarked)
+			}
+		}
+		if store.removed {
+			t.Error("server was removed in mark mode")
+		}
+	})
+
+	t.Run("success resets the failure streak", func(t *testing.T) {
+		store := &fakeStore{}
+		for _, f := range []bool{true, true, false, true, true} {
+			fail = f
+			if err := testServer(store, server, false, false, 3, OnFailureDelete); err != nil {
+				t.Fatalf("testServer() error = %v", err)
+			}
+		}
+		if store.removed {
+			t.Errorf("server was removed without %d consecutive failures", 3)
+		}
+		if store.updated != 1 {
+			t.Errorf("test results were stored %d times, want 1", store.updated)
+		}
+	})
+
+	t.Run("never removed when max failures is zero", func(t *testing.T) {
+		store := &fakeStore{}
+		fail = true
+		for run := 0; run < 5; run++ {
+			if err := testServer(store, server, false, false, 0, OnFailureDelete); err != nil {
+				t.Fatalf("testServer() error = %v", err)
+			}
+		}
+		if store.removed || store.failures != 5 {
+			t.Errorf("removed = %v with %d failures, want kept with 5 failures", store.removed, store.failures)
+		}
+	})
+}